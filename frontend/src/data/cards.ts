@@ -14,6 +14,41 @@ export type AutomationCard = {
   supportedModels?: Record<string, boolean>;
   // 模型映射：external model -> internal model
   modelMapping?: Record<string, string>;
+  // 能力声明：vision/tools/thinking/pdf/context_1m/prompt_caching，未声明视为支持
+  capabilities?: Record<string, boolean>;
+  // 兼容性配置：预设（full/no_beta/no_cache/basic）+ 单项覆盖
+  compat?: ProviderCompat;
+  // 影子流量：按百分比（0-100）把成功请求镜像到该 provider 做对比，不影响客户端响应
+  shadowPercent?: number;
+  // 价格倍率：相对官方价格的倍数（如 0.3），未设置视为 1
+  priceMultiplier?: number;
+  // 模型单价：实际模型名（支持通配符）-> 每百万 token 价格（美元），优先于价格倍率
+  modelPrices?: Record<string, ModelPrice>;
+  // 套餐用量窗口：如 5 小时 / 每周的请求数或 token 上限，接近上限时降低优先级
+  usageWindows?: UsageWindow[];
+};
+
+export type UsageWindow = {
+  name: string;
+  hours: number;
+  maxRequests?: number;
+  maxTokens?: number;
+};
+
+export type ModelPrice = {
+  input: number;
+  output: number;
+  cacheCreate?: number;
+  cacheRead?: number;
+};
+
+export type ProviderCompat = {
+  preset?: 'full' | 'no_beta' | 'no_cache' | 'basic';
+  stripCacheControl?: boolean;
+  disableThinking?: boolean;
+  stripContextManagement?: boolean;
+  stripBetas?: boolean;
+  unknownBlocks?: 'keep' | 'drop' | 'text';
 };
 
 export const automationCardGroups: Record<
@@ -4,6 +4,7 @@ import './style.css'
 import { i18n, setupI18n } from './utils/i18n'
 import { initTheme } from './utils/ThemeManager'
 import router from './router/index'
+import { fetchAppSettings } from './services/appSettings'
 
 initTheme()
 const isMac = navigator.userAgent.includes('Mac')
@@ -12,7 +13,14 @@ if (isMac) {
 }
 
 async function bootstrap(){
-    await setupI18n('zh')//默认语言或从后端读取
+    let locale: 'zh' | 'en' = 'zh'
+    try {
+        const settings = await fetchAppSettings()
+        locale = settings?.language === 'en' ? 'en' : 'zh'
+    } catch (error) {
+        console.error('failed to load language setting', error)
+    }
+    await setupI18n(locale)
     createApp(App).use(router).use(i18n).mount('#app')
 }
 bootstrap()
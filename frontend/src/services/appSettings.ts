@@ -5,6 +5,7 @@ export type AppSettings = {
   show_home_title: boolean
   auto_start: boolean
   auto_update: boolean
+  language: 'zh' | 'en'
 }
 
 const DEFAULT_SETTINGS: AppSettings = {
@@ -12,6 +13,7 @@ const DEFAULT_SETTINGS: AppSettings = {
   show_home_title: true,
   auto_start: false,
   auto_update: true,
+  language: 'zh',
 }
 
 export const fetchAppSettings = async (): Promise<AppSettings> => {
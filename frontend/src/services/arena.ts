@@ -0,0 +1,54 @@
+import { Call } from '@wailsio/runtime'
+
+const ARENA_SERVICE = 'codeswitch/services.ArenaService'
+
+export type ArenaPlatform = 'claude' | 'codex'
+
+export type ArenaRequest = {
+  platform: ArenaPlatform
+  providers: string[]
+  prompt?: string
+  request?: string // 抓取的请求体 JSON，优先于 prompt
+  model?: string
+  stream?: boolean
+  maxTokens?: number
+}
+
+export type ArenaResult = {
+  provider: string
+  model: string
+  httpCode: number
+  durationSec: number
+  ttftSec: number
+  inputTokens: number
+  outputTokens: number
+  cacheCreateTokens: number
+  cacheReadTokens: number
+  cost: number
+  response: string
+  errorClass?: string
+  errorMessage?: string
+}
+
+export type ArenaRun = {
+  runId: string
+  platform: ArenaPlatform
+  model: string
+  request: string
+  results: ArenaResult[]
+  createdAt: string
+}
+
+/**
+ * 并发向多个 provider 发送同一请求并对比结果（不计入请求日志和黑名单）
+ */
+export const runArena = async (request: ArenaRequest): Promise<ArenaRun> => {
+  return Call.ByName(`${ARENA_SERVICE}.Run`, request)
+}
+
+/**
+ * 获取最近的对比测试记录
+ */
+export const fetchArenaRuns = async (platform: ArenaPlatform | '' = '', limit = 20): Promise<ArenaRun[]> => {
+  return Call.ByName(`${ARENA_SERVICE}.ListArenaRuns`, platform, limit)
+}
@@ -15,6 +15,19 @@ export type RequestLog = {
   reasoning_tokens: number
   is_stream?: boolean | number
   duration_sec?: number
+  affinity_hit?: boolean
+  ttfb_sec?: number
+  ttft_sec?: number
+  stream_duration_sec?: number
+  tokens_per_sec?: number
+  request_id?: string
+  attempt?: number
+  level?: number
+  error_class?: string
+  error_message?: string
+  blacklist_counted?: boolean
+  resume_count?: number
+  fallback_from?: string
   created_at: string
   total_cost?: number
   input_cost?: number
@@ -39,6 +52,20 @@ export const fetchRequestLogs = async (query: RequestLogQuery = {}): Promise<Req
   return Call.ByName('codeswitch/services.LogService.ListRequestLogs', platform, provider, limit)
 }
 
+export type RequestTrace = {
+  request_id: string
+  platform: LogPlatform | ''
+  succeeded: boolean
+  final_provider: string
+  total_duration_sec: number
+  total_cost: number
+  attempts: RequestLog[]
+}
+
+export const fetchRequestTrace = async (requestId: string): Promise<RequestTrace> => {
+  return Call.ByName('codeswitch/services.LogService.GetRequestTrace', requestId)
+}
+
 export const fetchLogProviders = async (platform: LogPlatform | '' = ''): Promise<string[]> => {
   return Call.ByName('codeswitch/services.LogService.ListProviders', platform)
 }
@@ -93,6 +120,84 @@ export const fetchProviderDailyStats = async (
   return Call.ByName('codeswitch/services.LogService.ProviderDailyStats', platform)
 }
 
+export type ProviderLatencyStat = {
+  provider: string
+  samples: number
+  ttfb_p50: number
+  ttft_p50: number
+  ttft_p95: number
+  tokens_per_sec_p50: number
+  tokens_per_sec_p95: number
+}
+
+export const fetchProviderLatencyStats = async (
+  platform: LogPlatform | '' = '',
+  days = 7,
+): Promise<ProviderLatencyStat[]> => {
+  return Call.ByName('codeswitch/services.LogService.ProviderLatencyStats', platform, days)
+}
+
+export type ShadowLog = {
+  id: number
+  request_id: string
+  platform: string
+  model: string
+  primary_provider: string
+  shadow_provider: string
+  shadow_model: string
+  primary_http_code: number
+  shadow_http_code: number
+  primary_duration_sec: number
+  shadow_duration_sec: number
+  primary_ttft_sec: number
+  shadow_ttft_sec: number
+  primary_output_tokens: number
+  shadow_input_tokens: number
+  shadow_output_tokens: number
+  shadow_cache_create_tokens: number
+  shadow_cache_read_tokens: number
+  error_class: string
+  error_message: string
+  similarity: number
+  diff: string
+  created_at: string
+}
+
+export const fetchShadowLogs = async (
+  platform: LogPlatform | '' = '',
+  shadowProvider = '',
+  limit = 100,
+): Promise<ShadowLog[]> => {
+  return Call.ByName('codeswitch/services.LogService.ListShadowLogs', platform, shadowProvider, limit)
+}
+
+export type ShadowComparisonStat = {
+  shadow_provider: string
+  primary_providers: string[]
+  samples: number
+  shadow_errors: number
+  shadow_error_rate: number
+  primary_error_rate: number
+  primary_duration_p50: number
+  shadow_duration_p50: number
+  duration_ratio: number
+  primary_ttft_p50: number
+  shadow_ttft_p50: number
+  primary_ttft_p95: number
+  shadow_ttft_p95: number
+  ttft_ratio: number
+  output_tokens_ratio: number
+  avg_similarity: number
+  shadow_cost: number
+}
+
+export const fetchShadowComparison = async (
+  platform: LogPlatform | '' = '',
+  days = 7,
+): Promise<ShadowComparisonStat[]> => {
+  return Call.ByName('codeswitch/services.LogService.ShadowComparison', platform, days)
+}
+
 export type HeatmapStat = {
   day: string
   total_requests: number
@@ -0,0 +1,48 @@
+import { Call } from '@wailsio/runtime'
+
+const MODEL_DISCOVERY_SERVICE = 'codeswitch/services.ModelDiscoveryService'
+
+export type DiscoveryPlatform = 'claude' | 'codex' | 'gemini'
+
+export type ModelDiscoveryResult = {
+  platform: DiscoveryPlatform
+  providerId: string
+  provider: string
+  models: string[] // 上游返回的全部模型
+  added: string[] // 上游有、白名单未覆盖的模型
+  removed: string[] // 白名单中有、上游已不存在的模型
+  missingTargets: string[] // 映射目标在上游已不存在
+  error?: string
+  checkedAt: string
+  scheduled?: boolean
+}
+
+/**
+ * 查询 provider 的模型列表并与白名单对比
+ */
+export const discoverModels = async (
+  platform: DiscoveryPlatform,
+  providerId: string | number
+): Promise<ModelDiscoveryResult> => {
+  return Call.ByName(`${MODEL_DISCOVERY_SERVICE}.DiscoverModels`, platform, String(providerId))
+}
+
+/**
+ * 接受选中的新增 / 移除模型，写回白名单
+ */
+export const applyDiscoveredModels = async (
+  platform: DiscoveryPlatform,
+  providerId: string | number,
+  add: string[],
+  remove: string[]
+): Promise<void> => {
+  await Call.ByName(`${MODEL_DISCOVERY_SERVICE}.ApplyDiscoveredModels`, platform, String(providerId), add, remove)
+}
+
+/**
+ * 获取定时刷新发现的问题（映射目标已下线或查询失败）
+ */
+export const fetchModelDiscoveryAlerts = async (): Promise<ModelDiscoveryResult[]> => {
+  const result = await Call.ByName(`${MODEL_DISCOVERY_SERVICE}.GetModelDiscoveryAlerts`)
+  return (result ?? []) as ModelDiscoveryResult[]
+}
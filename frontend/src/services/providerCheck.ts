@@ -0,0 +1,57 @@
+import { Call } from '@wailsio/runtime'
+
+const SPEED_TEST_SERVICE = 'codeswitch/services.SpeedTestService'
+
+export type ProviderCheckPlatform = 'claude' | 'codex' | 'gemini'
+
+export type ProviderCheckStatus =
+  | 'ok'
+  | 'auth_failed'
+  | 'model_unavailable'
+  | 'endpoint_not_found'
+  | 'stream_unsupported'
+  | 'rate_limited'
+  | 'upstream_error'
+  | 'connection_error'
+
+export type ProviderCheckResult = {
+  id: number
+  platform: ProviderCheckPlatform
+  provider: string
+  requestedModel: string
+  model: string // 映射后实际发送的模型
+  status: ProviderCheckStatus
+  keyValid: boolean
+  modelAvailable: boolean
+  streamSupported: boolean
+  httpCode: number
+  ttftMs: number
+  latencyMs: number
+  inputTokens: number
+  outputTokens: number
+  error?: string
+  createdAt: string
+}
+
+/**
+ * 向 provider 发送一次最小的真实补全请求，检查密钥、模型与流式（model 为空时使用默认检查模型）
+ */
+export const checkProvider = async (
+  platform: ProviderCheckPlatform,
+  provider: string,
+  model = ''
+): Promise<ProviderCheckResult> => {
+  return Call.ByName(`${SPEED_TEST_SERVICE}.CheckProvider`, platform, provider, model)
+}
+
+/**
+ * 获取检查记录（platform、provider 为空时不过滤）
+ */
+export const fetchProviderCheckHistory = async (
+  platform = '',
+  provider = '',
+  limit = 100
+): Promise<ProviderCheckResult[]> => {
+  const result = await Call.ByName(`${SPEED_TEST_SERVICE}.GetProviderCheckHistory`, platform, provider, limit)
+  return (result ?? []) as ProviderCheckResult[]
+}
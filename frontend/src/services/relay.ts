@@ -0,0 +1,82 @@
+import { Call } from '@wailsio/runtime'
+
+const RELAY_SERVICE = 'codeswitch/services.ProviderRelayService'
+
+export type RateLimitStatus = {
+  dimension: string // requests / tokens / input-tokens / output-tokens
+  limit: number
+  remaining: number
+  resetAt?: string
+}
+
+export type UsageWindowStatus = {
+  name: string
+  hours: number
+  maxRequests?: number
+  maxTokens?: number
+  requests: number
+  tokens: number
+  resetAt?: string
+}
+
+export type ProviderQuota = {
+  platform: string
+  provider: string
+  headers: RateLimitStatus[]
+  headersAt?: string
+  windows: UsageWindowStatus[]
+  nearLimit: boolean
+  exhausted: boolean
+  exhaustedUntil?: string
+}
+
+/**
+ * 获取各 provider 的剩余额度（上游限流头与本地用量窗口）
+ * Gemini 不统计额度，只支持 claude / codex
+ */
+export const fetchProviderQuotas = async (platform: 'claude' | 'codex'): Promise<ProviderQuota[]> => {
+  return Call.ByName(`${RELAY_SERVICE}.GetProviderQuotas`, platform)
+}
+
+export type RouteSkip = {
+  provider: string
+  reason: string // not_pinned / disabled / missing_credentials / invalid_config / model_unsupported / capability_missing / endpoint_unsupported / blacklisted / previous_response
+  detail?: string
+}
+
+export type RouteCandidate = {
+  provider: string
+  level: number
+  group: number
+  effectiveModel: string
+  affinity?: boolean
+  quota?: 'near_limit' | 'exhausted'
+  quotaReason?: string
+  estimatedCost?: number
+  willTry: boolean
+}
+
+export type RouteExplanation = {
+  platform: string
+  model: string
+  routingMode: string
+  blacklistMode: boolean
+  requiredCapabilities: string[]
+  candidates: RouteCandidate[]
+  skipped: RouteSkip[]
+  fallbackModels: string[]
+  notes: string[]
+}
+
+/**
+ * 路由演练：返回请求会依次尝试的 provider 及被跳过的原因，不发送上游请求
+ * headers 为客户端请求头（如 anthropic-beta、X-Code-Switch-Provider）
+ */
+export const explainRoute = async (
+  platform: 'claude' | 'codex' | 'gemini',
+  model: string,
+  sampleBody = '',
+  headers: Record<string, string> = {},
+): Promise<RouteExplanation> => {
+  return Call.ByName(`${RELAY_SERVICE}.ExplainRoute`, platform, model, sampleBody, headers)
+}
@@ -0,0 +1,46 @@
+import { Call } from '@wailsio/runtime'
+
+const SECRET_SERVICE = 'codeswitch/services.SecretService'
+
+export type SecretStoreStatus = {
+  mode: 'keyfile' | 'passphrase'
+  locked: boolean
+  secretCount: number
+  vaultPath: string
+  keyPath?: string
+}
+
+/**
+ * 获取加密密钥库状态
+ */
+export const fetchSecretStoreStatus = async (): Promise<SecretStoreStatus> => {
+  return Call.ByName(`${SECRET_SERVICE}.GetSecretStoreStatus`)
+}
+
+/**
+ * 使用口令解锁密钥库
+ */
+export const unlockSecrets = async (passphrase: string): Promise<void> => {
+  return Call.ByName(`${SECRET_SERVICE}.UnlockSecrets`, passphrase)
+}
+
+/**
+ * 设置密钥库口令（为空则改回本地密钥文件），会重新加密全部密钥
+ */
+export const setSecretPassphrase = async (passphrase: string): Promise<void> => {
+  return Call.ByName(`${SECRET_SERVICE}.SetSecretPassphrase`, passphrase)
+}
+
+/**
+ * 轮换加密密钥
+ */
+export const rotateSecretKey = async (): Promise<void> => {
+  return Call.ByName(`${SECRET_SERVICE}.RotateSecretKey`)
+}
+
+/**
+ * 导出 provider 与 MCP 配置（JSON）；includeSecrets 为 true 时才包含解密后的密钥
+ */
+export const exportConfig = async (includeSecrets = false): Promise<string> => {
+  return Call.ByName(`${SECRET_SERVICE}.ExportConfig`, includeSecrets)
+}
@@ -63,3 +63,118 @@ export const getBlacklistEnabled = async (): Promise<boolean> => {
 export const setBlacklistEnabled = async (enabled: boolean): Promise<void> => {
   await Call.ByName(`${SETTINGS_SERVICE}.UpdateBlacklistEnabled`, enabled)
 }
+
+/**
+ * 跨 provider 思考块的处理方式
+ * drop: 删除其他 provider 生成的思考块；text: thinking 转为文本；off: 不处理
+ */
+export type ThinkingSignatureMode = 'drop' | 'text' | 'off'
+
+/**
+ * 获取跨 provider 思考块的处理方式
+ */
+export const getThinkingSignatureMode = async (): Promise<ThinkingSignatureMode> => {
+  const result = await Call.ByName(`${SETTINGS_SERVICE}.GetThinkingSignatureMode`)
+  return result as ThinkingSignatureMode
+}
+
+/**
+ * 设置跨 provider 思考块的处理方式
+ */
+export const setThinkingSignatureMode = async (mode: ThinkingSignatureMode): Promise<void> => {
+  await Call.ByName(`${SETTINGS_SERVICE}.SetThinkingSignatureMode`, mode)
+}
+
+/**
+ * 获取流式中断续传开关状态
+ * @returns 上游中途断开时是否用已输出内容续写
+ */
+export const getStreamResumeEnabled = async (): Promise<boolean> => {
+  const result = await Call.ByName(`${SETTINGS_SERVICE}.GetStreamResumeEnabled`)
+  return result as boolean
+}
+
+/**
+ * 设置流式中断续传开关状态
+ * @param enabled 是否启用流式中断续传
+ */
+export const setStreamResumeEnabled = async (enabled: boolean): Promise<void> => {
+  await Call.ByName(`${SETTINGS_SERVICE}.SetStreamResumeEnabled`, enabled)
+}
+
+/**
+ * 获取是否允许客户端通过请求头（X-Code-Switch-Provider / X-Code-Switch-Level）指定 provider
+ */
+export const getProviderPinningEnabled = async (): Promise<boolean> => {
+  const result = await Call.ByName(`${SETTINGS_SERVICE}.GetProviderPinningEnabled`)
+  return result as boolean
+}
+
+/**
+ * 设置是否允许客户端通过请求头指定 provider
+ * @param enabled 是否允许
+ */
+export const setProviderPinningEnabled = async (enabled: boolean): Promise<void> => {
+  await Call.ByName(`${SETTINGS_SERVICE}.SetProviderPinningEnabled`, enabled)
+}
+
+/**
+ * 路由模式
+ * priority: 按配置顺序和 Level；cost_level: Level 内按预估费用排序；cost: 忽略 Level 全部按预估费用排序
+ */
+export type RoutingMode = 'priority' | 'cost_level' | 'cost'
+
+/**
+ * 获取路由模式
+ */
+export const getRoutingMode = async (): Promise<RoutingMode> => {
+  const result = await Call.ByName(`${SETTINGS_SERVICE}.GetRoutingMode`)
+  return result as RoutingMode
+}
+
+/**
+ * 设置路由模式
+ */
+export const setRoutingMode = async (mode: RoutingMode): Promise<void> => {
+  await Call.ByName(`${SETTINGS_SERVICE}.SetRoutingMode`, mode)
+}
+
+/**
+ * 模型降级链：请求模型的 provider 全部不可用或失败后，依次改用 fallbacks 中的模型
+ * 降级时响应头 X-Code-Switch-Fallback-Model 为实际使用的模型
+ */
+export interface ModelFallbackChain {
+  platform: 'claude' | 'codex'
+  model: string // 支持通配符，如 claude-opus-*
+  fallbacks: string[]
+}
+
+/**
+ * 获取模型降级链
+ */
+export const getModelFallbackChains = async (): Promise<ModelFallbackChain[]> => {
+  const result = await Call.ByName(`${SETTINGS_SERVICE}.GetModelFallbackChains`)
+  return (result ?? []) as ModelFallbackChain[]
+}
+
+/**
+ * 设置模型降级链
+ */
+export const setModelFallbackChains = async (chains: ModelFallbackChain[]): Promise<void> => {
+  await Call.ByName(`${SETTINGS_SERVICE}.SetModelFallbackChains`, chains)
+}
+
+/**
+ * 获取模型列表定时刷新间隔（小时，0 表示关闭）
+ */
+export const getModelDiscoveryIntervalHours = async (): Promise<number> => {
+  const result = await Call.ByName(`${SETTINGS_SERVICE}.GetModelDiscoveryIntervalHours`)
+  return (result ?? 0) as number
+}
+
+/**
+ * 设置模型列表定时刷新间隔（0 关闭，1-168 小时）
+ */
+export const setModelDiscoveryIntervalHours = async (hours: number): Promise<void> => {
+  await Call.ByName(`${SETTINGS_SERVICE}.SetModelDiscoveryIntervalHours`, hours)
+}
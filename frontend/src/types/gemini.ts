@@ -2,6 +2,8 @@
 
 export type GeminiAuthType = 'oauth-personal' | 'gemini-api-key' | 'packycode' | 'generic'
 
+export type GeminiAPIFormat = 'gemini' | 'anthropic' | 'openai'
+
 export interface GeminiProvider {
   id: string
   name: string
@@ -14,6 +16,10 @@ export interface GeminiProvider {
   category?: string // official, third_party, custom
   partnerPromotionKey?: string
   enabled: boolean
+  level?: number
+  supportedModels?: Record<string, boolean>
+  modelMapping?: Record<string, string>
+  apiFormat?: GeminiAPIFormat // 上游协议，默认 gemini
   envConfig?: Record<string, string>
   settingsConfig?: Record<string, any>
 }
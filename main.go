@@ -96,7 +96,7 @@ func main() {
 	settingsService := services.NewSettingsService()
 	blacklistService := services.NewBlacklistService(settingsService)
 	geminiService := services.NewGeminiService("127.0.0.1:18100")
-	providerRelay := services.NewProviderRelayService(providerService, geminiService, blacklistService, ":18100")
+	providerRelay := services.NewProviderRelayService(providerService, geminiService, blacklistService, settingsService, ":18100")
 	claudeSettings := services.NewClaudeSettingsService(providerRelay.Addr())
 	codexSettings := services.NewCodexSettingsService(providerRelay.Addr())
 	logService := services.NewLogService()
@@ -109,10 +109,17 @@ func main() {
 	envCheckService := services.NewEnvCheckService()
 	importService := services.NewImportService(providerService, mcpService)
 	deeplinkService := services.NewDeepLinkService(providerService)
-	speedTestService := services.NewSpeedTestService()
+	speedTestService := services.NewSpeedTestService(providerService, geminiService)
 	dockService := dock.New()
 	versionService := NewVersionService()
 	consoleService := services.NewConsoleService()
+	healthProbeService := services.NewHealthProbeService(providerService, geminiService, blacklistService)
+	arenaService := services.NewArenaService(providerService, providerRelay)
+	modelDiscoveryService := services.NewModelDiscoveryService(providerService, geminiService, settingsService)
+	secretService := services.NewSecretService(providerService, geminiService, mcpService)
+	blacklistService.SetRecoveryProbe(healthProbeService.VerifyRecovery)
+	healthProbeService.SetProviderRelayService(providerRelay)
+	providerRelay.SetAppSettingsService(appSettings)
 
 	// 应用待处理的更新
 	go func() {
@@ -149,6 +156,26 @@ func main() {
 		}
 	}()
 
+	// 启动健康探测定时器（配置关闭时不会发送任何请求）
+	go func() {
+		ticker := time.NewTicker(15 * time.Second)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			healthProbeService.RunDueProbes()
+		}
+	}()
+
+	// 启动模型列表定时刷新（刷新间隔为 0 时不会发送任何请求）
+	go func() {
+		ticker := time.NewTicker(5 * time.Minute)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			modelDiscoveryService.RunDueRefresh()
+		}
+	}()
+
 	//fmt.Println(clipboardService)
 	// Create a new Wails application by providing the necessary options.
 	// Variables 'Name' and 'Description' are for application metadata.
@@ -180,6 +207,11 @@ func main() {
 			application.NewService(versionService),
 			application.NewService(geminiService),
 			application.NewService(consoleService),
+			application.NewService(providerRelay),
+			application.NewService(healthProbeService),
+			application.NewService(arenaService),
+			application.NewService(modelDiscoveryService),
+			application.NewService(secretService),
 		},
 		Assets: application.AssetOptions{
 			Handler: application.AssetFileServerFS(assets),
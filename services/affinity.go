@@ -0,0 +1,132 @@
+package services
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+// affinityTTL 会话亲和记录的有效期（覆盖 Anthropic 1 小时的 prompt cache）
+const affinityTTL = time.Hour
+
+// affinitySweepInterval 过期记录的清理间隔
+const affinitySweepInterval = 5 * time.Minute
+
+type affinityEntry struct {
+	provider  string
+	expiresAt time.Time
+}
+
+// providerAffinity 会话 -> provider 的亲和表
+// 同一会话的连续请求优先发往上一次成功的 provider，保证上游 prompt cache 命中
+type providerAffinity struct {
+	mu        sync.Mutex
+	ttl       time.Duration
+	entries   map[string]affinityEntry
+	lastSweep time.Time
+}
+
+func newProviderAffinity(ttl time.Duration) *providerAffinity {
+	return &providerAffinity{
+		ttl:     ttl,
+		entries: make(map[string]affinityEntry),
+	}
+}
+
+// Get 返回会话绑定的 provider（过期视为不存在）
+func (a *providerAffinity) Get(key string) (string, bool) {
+	if key == "" {
+		return "", false
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	entry, ok := a.entries[key]
+	if !ok {
+		return "", false
+	}
+	if time.Now().After(entry.expiresAt) {
+		delete(a.entries, key)
+		return "", false
+	}
+	return entry.provider, true
+}
+
+// Set 绑定会话与 provider，并刷新有效期
+func (a *providerAffinity) Set(key string, provider string) {
+	if key == "" {
+		return
+	}
+	now := time.Now()
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.entries[key] = affinityEntry{provider: provider, expiresAt: now.Add(a.ttl)}
+
+	if now.Sub(a.lastSweep) < affinitySweepInterval {
+		return
+	}
+	a.lastSweep = now
+	for k, entry := range a.entries {
+		if now.After(entry.expiresAt) {
+			delete(a.entries, k)
+		}
+	}
+}
+
+// conversationKey 从请求体推导会话标识，无法识别时返回空字符串
+// Claude 优先使用 metadata.user_id（Claude Code 会带上 session ID），Codex 优先使用 prompt_cache_key；
+// 都没有时使用系统提示词 + 第一条用户消息的哈希。模型也参与计算，避免辅助模型的请求覆盖主模型的亲和记录。
+func conversationKey(kind string, model string, body []byte) string {
+	var seed string
+	switch kind {
+	case "codex":
+		if v := gjson.GetBytes(body, "prompt_cache_key").String(); v != "" {
+			seed = "cache:" + v
+		} else if first := gjson.GetBytes(body, "input.0"); first.Exists() {
+			seed = "prompt:" + gjson.GetBytes(body, "instructions").String() + "\x00" + first.Raw
+		} else if input := gjson.GetBytes(body, "input"); input.Type == gjson.String {
+			seed = "prompt:" + gjson.GetBytes(body, "instructions").String() + "\x00" + input.String()
+		}
+	default:
+		if v := gjson.GetBytes(body, "metadata.user_id").String(); v != "" {
+			seed = "user:" + v
+		} else if first := gjson.GetBytes(body, "messages.0.content"); first.Exists() {
+			seed = "prompt:" + gjson.GetBytes(body, "system").Raw + "\x00" + first.Raw
+		}
+	}
+	if seed == "" {
+		return ""
+	}
+
+	sum := sha256.Sum256([]byte(kind + "\x00" + model + "\x00" + seed))
+	return hex.EncodeToString(sum[:16])
+}
+
+// responseAffinityTTL Codex response ID 与 provider 绑定记录的有效期
+const responseAffinityTTL = 24 * time.Hour
+
+// codexResponseID 从 Responses API 的 JSON 响应或 SSE 事件（response.created 等）中提取 response ID
+func codexResponseID(payload string) string {
+	if strings.HasPrefix(payload, "{") {
+		if gjson.Get(payload, "object").String() == "response" {
+			return gjson.Get(payload, "id").String()
+		}
+		return ""
+	}
+	for _, line := range strings.Split(payload, "\n") {
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, "data:") {
+			continue
+		}
+		if id := gjson.Get(strings.TrimSpace(strings.TrimPrefix(line, "data:")), "response.id").String(); id != "" {
+			return id
+		}
+	}
+	return ""
+}
@@ -0,0 +1,68 @@
+package services
+
+import (
+	"testing"
+	"time"
+)
+
+func TestProviderAffinity(t *testing.T) {
+	body := []byte(`{"model":"claude-sonnet-4","metadata":{"user_id":"user_abc_session_1"},"messages":[{"role":"user","content":"hi"}]}`)
+	otherTurn := []byte(`{"model":"claude-sonnet-4","metadata":{"user_id":"user_abc_session_1"},"messages":[{"role":"user","content":"hi"},{"role":"assistant","content":"hello"},{"role":"user","content":"next"}]}`)
+	otherSession := []byte(`{"model":"claude-sonnet-4","metadata":{"user_id":"user_abc_session_2"},"messages":[{"role":"user","content":"hi"}]}`)
+
+	key := conversationKey("claude", "claude-sonnet-4", body)
+	if key == "" || key != conversationKey("claude", "claude-sonnet-4", otherTurn) {
+		t.Fatal("同一会话的不同轮次应得到相同的会话标识")
+	}
+	if key == conversationKey("claude", "claude-sonnet-4", otherSession) {
+		t.Error("不同会话不应得到相同的会话标识")
+	}
+	if key == conversationKey("claude", "claude-haiku-4", body) {
+		t.Error("不同模型不应共享会话标识")
+	}
+
+	affinity := newProviderAffinity(50 * time.Millisecond)
+	affinity.Set(key, "ProviderB")
+	if name, ok := affinity.Get(key); !ok || name != "ProviderB" {
+		t.Fatalf("应返回绑定的 provider，实际 %q", name)
+	}
+	time.Sleep(60 * time.Millisecond)
+	if _, ok := affinity.Get(key); ok {
+		t.Error("过期的亲和记录不应再返回")
+	}
+
+	levelGroups := map[int][]Provider{
+		1: {{Name: "ProviderA"}, {Name: "ProviderB"}},
+		2: {{Name: "ProviderC"}},
+	}
+	if !preferAffinityProvider(levelGroups, []int{1, 2}, "ProviderB") {
+		t.Fatal("可用的亲和 provider 应命中")
+	}
+	if len(levelGroups[1]) != 2 || levelGroups[1][0].Name != "ProviderB" || levelGroups[1][1].Name != "ProviderA" {
+		t.Errorf("亲和 provider 应移到所在 Level 的最前面: %v", levelGroups[1])
+	}
+	// 低优先级 Level 中的亲和 provider 不能越过高优先级 Level
+	if !preferAffinityProvider(levelGroups, []int{1, 2}, "ProviderC") {
+		t.Fatal("可用的亲和 provider 应命中")
+	}
+	if levelGroups[1][0].Name != "ProviderB" || len(levelGroups[2]) != 1 || levelGroups[2][0].Name != "ProviderC" {
+		t.Errorf("亲和 provider 只能在所在 Level 内调整: %v", levelGroups)
+	}
+	if preferAffinityProvider(levelGroups, []int{1, 2}, "ProviderX") {
+		t.Error("不可用的 provider 不应命中亲和")
+	}
+}
+
+func TestCodexResponseID(t *testing.T) {
+	cases := map[string]string{
+		`data: {"type":"response.created","response":{"id":"resp_stream","status":"in_progress"}}`: "resp_stream",
+		`{"id":"resp_json","object":"response","status":"completed"}`:                              "resp_json",
+		`{"error":{"message":"bad request"}}`:                                                      "",
+		`event: response.created`:                                                                  "",
+	}
+	for payload, want := range cases {
+		if got := codexResponseID(payload); got != want {
+			t.Errorf("codexResponseID(%s) = %q，期望 %q", payload, got, want)
+		}
+	}
+}
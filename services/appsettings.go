@@ -18,10 +18,11 @@ const (
 )
 
 type AppSettings struct {
-	ShowHeatmap   bool `json:"show_heatmap"`
-	ShowHomeTitle bool `json:"show_home_title"`
-	AutoStart     bool `json:"auto_start"`
-	AutoUpdate    bool `json:"auto_update"`
+	ShowHeatmap   bool   `json:"show_heatmap"`
+	ShowHomeTitle bool   `json:"show_home_title"`
+	AutoStart     bool   `json:"auto_start"`
+	AutoUpdate    bool   `json:"auto_update"`
+	Language      string `json:"language"` // 界面与中转错误说明的语言：zh 或 en
 }
 
 type AppSettingsService struct {
@@ -138,9 +139,19 @@ func (as *AppSettingsService) defaultSettings() AppSettings {
 		ShowHomeTitle: true,
 		AutoStart:     autoStartEnabled,
 		AutoUpdate:    true, // 默认开启自动更新
+		Language:      "zh",
 	}
 }
 
+// Language 返回当前语言设置（zh 或 en），读取失败时回退为 zh
+func (as *AppSettingsService) Language() string {
+	settings, err := as.GetAppSettings()
+	if err != nil || settings.Language != "en" {
+		return "zh"
+	}
+	return "en"
+}
+
 // GetAppSettings returns the persisted app settings or defaults if the file does not exist.
 func (as *AppSettingsService) GetAppSettings() (AppSettings, error) {
 	as.mu.Lock()
@@ -0,0 +1,396 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/daodao97/xgo/xdb"
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+
+	modelpricing "codeswitch/resources/model-pricing"
+)
+
+// arenaTimeout 一次对比测试的总超时
+const arenaTimeout = 5 * time.Minute
+
+// arenaDefaultMaxTokens 按提示词构造请求时的默认输出上限
+const arenaDefaultMaxTokens = 1024
+
+// arenaEndpoints 各平台对比测试使用的接口（与中转路由一致）
+var arenaEndpoints = map[string]string{
+	"claude": "/v1/messages",
+	"codex":  "/responses",
+}
+
+// ArenaRequest 对比测试请求：提示词或抓取的完整请求体（二选一，Request 优先）
+type ArenaRequest struct {
+	Platform  string   `json:"platform"`  // claude / codex
+	Providers []string `json:"providers"` // 参与对比的 provider 名称（不要求已启用）
+	Prompt    string   `json:"prompt"`    // 用户提示词
+	Request   string   `json:"request"`   // 抓取的请求体 JSON（如从日志中复制）
+	Model     string   `json:"model"`     // 请求的模型，非空时覆盖请求体中的 model
+	Stream    bool     `json:"stream"`    // 按提示词构造请求时是否使用流式
+	MaxTokens int      `json:"maxTokens"` // 按提示词构造请求时的输出上限
+}
+
+// ArenaResult 单个 provider 的对比结果
+type ArenaResult struct {
+	Provider          string  `json:"provider"`
+	Model             string  `json:"model"` // 应用模型映射后的模型
+	HttpCode          int     `json:"httpCode"`
+	DurationSec       float64 `json:"durationSec"`
+	TTFTSec           float64 `json:"ttftSec"`
+	InputTokens       int     `json:"inputTokens"`
+	OutputTokens      int     `json:"outputTokens"`
+	CacheCreateTokens int     `json:"cacheCreateTokens"`
+	CacheReadTokens   int     `json:"cacheReadTokens"`
+	Cost              float64 `json:"cost"`
+	Response          string  `json:"response"` // 响应文本
+	ErrorClass        string  `json:"errorClass,omitempty"`
+	ErrorMessage      string  `json:"errorMessage,omitempty"`
+}
+
+// ArenaRun 一次对比测试
+type ArenaRun struct {
+	RunID     string        `json:"runId"`
+	Platform  string        `json:"platform"`
+	Model     string        `json:"model"`
+	Request   string        `json:"request"` // 实际发送的请求体（映射前）
+	Results   []ArenaResult `json:"results"`
+	CreatedAt string        `json:"createdAt"`
+}
+
+// ArenaService 多 provider 对比测试
+// 同一请求并发发给选定的 provider（复用中转的模型映射、兼容性配置和连接池），并排返回响应、耗时、用量和费用。
+// 结果写入独立的 arena_run / arena_result 表，不计入 request_log，也不参与黑名单和会话亲和。
+type ArenaService struct {
+	providerService *ProviderService
+	relay           *ProviderRelayService
+	pricing         *modelpricing.Service
+}
+
+// NewArenaService 创建对比测试服务
+func NewArenaService(providerService *ProviderService, relay *ProviderRelayService) *ArenaService {
+	svc, err := modelpricing.DefaultService()
+	if err != nil {
+		log.Printf("pricing service init failed: %v", err)
+	}
+	return &ArenaService{
+		providerService: providerService,
+		relay:           relay,
+		pricing:         svc,
+	}
+}
+
+// Start Wails生命周期方法
+func (as *ArenaService) Start() error {
+	return nil
+}
+
+// Stop Wails生命周期方法
+func (as *ArenaService) Stop() error {
+	return nil
+}
+
+// Run 执行一次对比测试，全部 provider 返回后保存并返回结果（结果顺序与 Providers 一致）
+func (as *ArenaService) Run(request ArenaRequest) (*ArenaRun, error) {
+	endpoint, ok := arenaEndpoints[request.Platform]
+	if !ok {
+		return nil, fmt.Errorf("不支持的平台: %s", request.Platform)
+	}
+	if len(request.Providers) == 0 {
+		return nil, errors.New("请选择至少一个 provider")
+	}
+	body, err := buildArenaBody(request)
+	if err != nil {
+		return nil, err
+	}
+	requestedModel := gjson.GetBytes(body, "model").String()
+	isStream := gjson.GetBytes(body, "stream").Bool()
+
+	all, err := as.providerService.LoadProviders(request.Platform)
+	if err != nil {
+		return nil, fmt.Errorf("加载 provider 失败: %w", err)
+	}
+	byName := make(map[string]Provider, len(all))
+	for _, p := range all {
+		byName[p.Name] = p
+	}
+	selected := make([]Provider, 0, len(request.Providers))
+	for _, name := range request.Providers {
+		p, ok := byName[name]
+		if !ok {
+			return nil, fmt.Errorf("未找到 provider: %s", name)
+		}
+		selected = append(selected, p)
+	}
+
+	headers := map[string]string{"Content-Type": "application/json"}
+	if request.Platform == "claude" {
+		headers["anthropic-version"] = "2023-06-01"
+	}
+	if isStream {
+		headers["Accept"] = "text/event-stream"
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), arenaTimeout)
+	defer cancel()
+	run := &ArenaRun{
+		RunID:     newRequestID(),
+		Platform:  request.Platform,
+		Model:     requestedModel,
+		Request:   string(body),
+		Results:   make([]ArenaResult, len(selected)),
+		CreatedAt: time.Now().Format(timeLayout),
+	}
+	var wg sync.WaitGroup
+	for i, provider := range selected {
+		wg.Add(1)
+		go func(i int, provider Provider) {
+			defer wg.Done()
+			run.Results[i] = as.runOne(ctx, request.Platform, provider, endpoint, headers, body, requestedModel, isStream)
+		}(i, provider)
+	}
+	wg.Wait()
+
+	saveArenaRun(run)
+	return run, nil
+}
+
+// runOne 向单个 provider 发送请求并计算费用
+func (as *ArenaService) runOne(ctx context.Context, kind string, provider Provider, endpoint string, headers map[string]string,
+	body []byte, requestedModel string, isStream bool) ArenaResult {
+	result := ArenaResult{Provider: provider.Name, Model: provider.GetEffectiveModel(requestedModel)}
+	if provider.APIURL == "" || provider.APIKey == "" {
+		result.ErrorClass = relayErrorRequest
+		result.ErrorMessage = "provider 未配置 API 地址或密钥"
+		return result
+	}
+	if problems := blockingConfigErrors(provider.configIssues()); len(problems) > 0 {
+		result.ErrorClass = relayErrorRequest
+		result.ErrorMessage = strings.Join(problems, "; ")
+		return result
+	}
+
+	requestLog := as.relay.sendDetached(ctx, kind, provider, endpoint, nil, headers, body, requestedModel, isStream)
+	result.Model = requestLog.Model
+	result.HttpCode = requestLog.HttpCode
+	result.DurationSec = requestLog.DurationSec
+	result.TTFTSec = requestLog.TTFTSec
+	result.InputTokens = requestLog.InputTokens
+	result.OutputTokens = requestLog.OutputTokens
+	result.CacheCreateTokens = requestLog.CacheCreateTokens
+	result.CacheReadTokens = requestLog.CacheReadTokens
+	result.Response = requestLog.shadowText.String()
+	result.ErrorClass = requestLog.ErrorClass
+	result.ErrorMessage = requestLog.ErrorMessage
+	if as.pricing != nil {
+		usage := modelpricing.UsageSnapshot{
+			InputTokens:       result.InputTokens,
+			OutputTokens:      result.OutputTokens,
+			CacheCreateTokens: result.CacheCreateTokens,
+			CacheReadTokens:   result.CacheReadTokens,
+		}
+		result.Cost = as.pricing.CalculateCost(result.Model, usage).TotalCost
+	}
+	return result
+}
+
+// buildArenaBody 使用抓取的请求体，或按提示词构造最小请求
+func buildArenaBody(request ArenaRequest) ([]byte, error) {
+	var body []byte
+	if strings.TrimSpace(request.Request) != "" {
+		body = []byte(strings.TrimSpace(request.Request))
+		if !gjson.ValidBytes(body) || !gjson.ParseBytes(body).IsObject() {
+			return nil, errors.New("请求体不是有效的 JSON 对象")
+		}
+	} else {
+		if strings.TrimSpace(request.Prompt) == "" {
+			return nil, errors.New("提示词和请求体不能同时为空")
+		}
+		maxTokens := request.MaxTokens
+		if maxTokens <= 0 {
+			maxTokens = arenaDefaultMaxTokens
+		}
+		var err error
+		if request.Platform == "codex" {
+			body, err = sjson.SetBytes([]byte(`{}`), "input", request.Prompt)
+			if err == nil {
+				body, err = sjson.SetBytes(body, "max_output_tokens", maxTokens)
+			}
+		} else {
+			body, err = sjson.SetBytes([]byte(`{}`), "messages", []map[string]string{{"role": "user", "content": request.Prompt}})
+			if err == nil {
+				body, err = sjson.SetBytes(body, "max_tokens", maxTokens)
+			}
+		}
+		if err == nil && request.Stream {
+			body, err = sjson.SetBytes(body, "stream", true)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if request.Model != "" {
+		return sjson.SetBytes(body, "model", request.Model)
+	}
+	if gjson.GetBytes(body, "model").String() == "" {
+		return nil, errors.New("请指定模型")
+	}
+	return body, nil
+}
+
+// ListArenaRuns 获取最近的对比测试（含结果）
+func (as *ArenaService) ListArenaRuns(platform string, limit int) ([]ArenaRun, error) {
+	if limit <= 0 || limit > 200 {
+		limit = 20
+	}
+	options := []xdb.Option{
+		xdb.OrderByDesc("created_at"),
+		xdb.Limit(limit),
+	}
+	if platform != "" {
+		options = append(options, xdb.WhereEq("platform", platform))
+	}
+	records, err := xdb.New("arena_run").Selects(options...)
+	if err != nil {
+		if errors.Is(err, xdb.ErrNotFound) || isNoSuchTableErr(err) {
+			return []ArenaRun{}, nil
+		}
+		return nil, err
+	}
+
+	runs := make([]ArenaRun, 0, len(records))
+	index := make(map[string]int, len(records))
+	runIDs := make([]any, 0, len(records))
+	for _, record := range records {
+		run := ArenaRun{
+			RunID:     record.GetString("run_id"),
+			Platform:  record.GetString("platform"),
+			Model:     record.GetString("model"),
+			Request:   record.GetString("request"),
+			Results:   []ArenaResult{},
+			CreatedAt: record.GetString("created_at"),
+		}
+		index[run.RunID] = len(runs)
+		runIDs = append(runIDs, run.RunID)
+		runs = append(runs, run)
+	}
+	if len(runIDs) == 0 {
+		return runs, nil
+	}
+
+	results, err := xdb.New("arena_result").Selects(
+		xdb.WhereIn("run_id", runIDs),
+		xdb.OrderByAsc("id"),
+	)
+	if err != nil {
+		if errors.Is(err, xdb.ErrNotFound) || isNoSuchTableErr(err) {
+			return runs, nil
+		}
+		return nil, err
+	}
+	for _, record := range results {
+		i, ok := index[record.GetString("run_id")]
+		if !ok {
+			continue
+		}
+		runs[i].Results = append(runs[i].Results, ArenaResult{
+			Provider:          record.GetString("provider"),
+			Model:             record.GetString("model"),
+			HttpCode:          record.GetInt("http_code"),
+			DurationSec:       record.GetFloat64("duration_sec"),
+			TTFTSec:           record.GetFloat64("ttft_sec"),
+			InputTokens:       record.GetInt("input_tokens"),
+			OutputTokens:      record.GetInt("output_tokens"),
+			CacheCreateTokens: record.GetInt("cache_create_tokens"),
+			CacheReadTokens:   record.GetInt("cache_read_tokens"),
+			Cost:              record.GetFloat64("cost"),
+			Response:          record.GetString("response"),
+			ErrorClass:        record.GetString("error_class"),
+			ErrorMessage:      record.GetString("error_message"),
+		})
+	}
+	return runs, nil
+}
+
+// saveArenaRun 写入对比测试及各 provider 的结果
+func saveArenaRun(run *ArenaRun) {
+	if GlobalDBQueueLogs == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err := GlobalDBQueueLogs.ExecBatchCtx(ctx, `
+		INSERT INTO arena_run (run_id, platform, model, request, created_at) VALUES (?, ?, ?, ?, ?)
+	`, run.RunID, run.Platform, run.Model, run.Request, run.CreatedAt)
+	if err != nil {
+		fmt.Printf("⚠️  写入 arena_run 失败: %v\n", err)
+		return
+	}
+	for _, result := range run.Results {
+		err := GlobalDBQueueLogs.ExecBatchCtx(ctx, `
+			INSERT INTO arena_result (
+				run_id, provider, model, http_code, duration_sec, ttft_sec,
+				input_tokens, output_tokens, cache_create_tokens, cache_read_tokens,
+				cost, response, error_class, error_message
+			) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		`,
+			run.RunID, result.Provider, result.Model, result.HttpCode, result.DurationSec, result.TTFTSec,
+			result.InputTokens, result.OutputTokens, result.CacheCreateTokens, result.CacheReadTokens,
+			result.Cost, result.Response, result.ErrorClass, result.ErrorMessage,
+		)
+		if err != nil {
+			fmt.Printf("⚠️  写入 arena_result 失败: %v\n", err)
+		}
+	}
+}
+
+// ensureArenaTables 确保 arena_run / arena_result 表存在
+func ensureArenaTables() error {
+	db, err := xdb.DB("default")
+	if err != nil {
+		return fmt.Errorf("获取数据库连接失败: %w", err)
+	}
+
+	statements := []string{
+		`CREATE TABLE IF NOT EXISTS arena_run (
+			run_id TEXT PRIMARY KEY,
+			platform TEXT,
+			model TEXT,
+			request TEXT,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		)`,
+		`CREATE TABLE IF NOT EXISTS arena_result (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			run_id TEXT,
+			provider TEXT,
+			model TEXT,
+			http_code INTEGER DEFAULT 0,
+			duration_sec REAL DEFAULT 0,
+			ttft_sec REAL DEFAULT 0,
+			input_tokens INTEGER DEFAULT 0,
+			output_tokens INTEGER DEFAULT 0,
+			cache_create_tokens INTEGER DEFAULT 0,
+			cache_read_tokens INTEGER DEFAULT 0,
+			cost REAL DEFAULT 0,
+			response TEXT DEFAULT '',
+			error_class TEXT DEFAULT '',
+			error_message TEXT DEFAULT ''
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_arena_result_run ON arena_result(run_id)`,
+	}
+	for _, stmt := range statements {
+		if _, err := db.Exec(stmt); err != nil {
+			return fmt.Errorf("创建对比测试表失败: %w", err)
+		}
+	}
+	return nil
+}
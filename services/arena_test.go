@@ -0,0 +1,56 @@
+package services
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/tidwall/gjson"
+)
+
+func TestArenaRunOne(t *testing.T) {
+	body, err := buildArenaBody(ArenaRequest{Platform: "codex", Prompt: "hi", Model: "gpt-5"})
+	if err != nil {
+		t.Fatalf("构造请求失败: %v", err)
+	}
+	if gjson.GetBytes(body, "input").String() != "hi" || gjson.GetBytes(body, "model").String() != "gpt-5" {
+		t.Errorf("提示词请求构造错误: %s", body)
+	}
+	if _, err := buildArenaBody(ArenaRequest{Platform: "claude", Prompt: "hi"}); err == nil {
+		t.Error("未指定模型应报错")
+	}
+	if _, err := buildArenaBody(ArenaRequest{Platform: "claude", Request: "[1]"}); err == nil {
+		t.Error("请求体不是 JSON 对象应报错")
+	}
+
+	var upstreamModel string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := io.ReadAll(r.Body)
+		upstreamModel = gjson.GetBytes(data, "model").String()
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"output":[{"type":"message","content":[{"type":"output_text","text":"hello"}]}],` +
+			`"usage":{"input_tokens":10,"output_tokens":3},"error":null}`))
+	}))
+	defer server.Close()
+
+	arena := &ArenaService{relay: newTestRelay(t)}
+	provider := Provider{Name: "relay-a", APIURL: server.URL, APIKey: "k",
+		SupportedModels: map[string]bool{"openai/gpt-5": true}, ModelMapping: map[string]string{"gpt-5": "openai/gpt-5"}}
+	result := arena.runOne(context.Background(), "codex", provider, "/responses", map[string]string{}, body, "gpt-5", false)
+	if result.ErrorClass != "" {
+		t.Fatalf("请求失败: %s %s", result.ErrorClass, result.ErrorMessage)
+	}
+	if upstreamModel != "openai/gpt-5" || result.Model != "openai/gpt-5" {
+		t.Errorf("应应用模型映射，上游收到 %q，结果 %q", upstreamModel, result.Model)
+	}
+	if result.Response != "hello" || result.HttpCode != 200 {
+		t.Errorf("响应记录错误: %+v", result)
+	}
+
+	missing := arena.runOne(context.Background(), "codex", Provider{Name: "relay-b"}, "/responses", nil, body, "gpt-5", false)
+	if missing.ErrorClass != relayErrorRequest {
+		t.Errorf("未配置地址的 provider 应直接失败，得到 %+v", missing)
+	}
+}
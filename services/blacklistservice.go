@@ -4,6 +4,7 @@ import (
 	"database/sql"
 	"fmt"
 	"log"
+	"sync"
 	"time"
 
 	"github.com/daodao97/xgo/xdb"
@@ -12,6 +13,9 @@ import (
 // BlacklistService 管理供应商黑名单
 type BlacklistService struct {
 	settingsService *SettingsService
+
+	// recoveryProbe 到期恢复前的健康检查（由健康探测服务注入，返回 false 表示仍不可用）
+	recoveryProbe func(platform string, providerName string) bool
 }
 
 // BlacklistStatus 黑名单状态（用于前端展示）
@@ -37,6 +41,12 @@ func NewBlacklistService(settingsService *SettingsService) *BlacklistService {
 	}
 }
 
+// SetRecoveryProbe 注入到期恢复前的健康检查
+// 注入后 AutoRecoverExpired 不再单纯按时间解除拉黑，检查失败的 provider 会被重新拉黑
+func (bs *BlacklistService) SetRecoveryProbe(probe func(platform string, providerName string) bool) {
+	bs.recoveryProbe = probe
+}
+
 // RecordSuccess 记录 provider 成功，清零连续失败计数，执行降级和宽恕逻辑
 func (bs *BlacklistService) RecordSuccess(platform string, providerName string) error {
 	db, err := xdb.DB("default")
@@ -165,16 +175,17 @@ func (bs *BlacklistService) RecordSuccess(platform string, providerName string)
 }
 
 // RecordFailure 记录 provider 失败，连续失败次数达到阈值时自动拉黑（支持等级拉黑）
-func (bs *BlacklistService) RecordFailure(platform string, providerName string) error {
+// 返回值表示本次失败是否实际计入失败计数（功能关闭、已在黑名单中、去重窗口内等情况不计入）
+func (bs *BlacklistService) RecordFailure(platform string, providerName string) (bool, error) {
 	// 检查拉黑功能是否启用
 	if !bs.settingsService.IsBlacklistEnabled() {
 		log.Printf("🚫 拉黑功能已关闭，跳过 provider %s/%s 的失败记录", platform, providerName)
-		return nil
+		return false, nil
 	}
 
 	db, err := xdb.DB("default")
 	if err != nil {
-		return fmt.Errorf("获取数据库连接失败: %w", err)
+		return false, fmt.Errorf("获取数据库连接失败: %w", err)
 	}
 
 	// 获取等级拉黑配置
@@ -221,20 +232,20 @@ func (bs *BlacklistService) RecordFailure(platform string, providerName string)
 		`, platform, providerName, now, now)
 
 		if err != nil {
-			return fmt.Errorf("插入失败记录失败: %w", err)
+			return false, fmt.Errorf("插入失败记录失败: %w", err)
 		}
 
 		log.Printf("📊 Provider %s/%s 失败计数: 1/%d（等级拉黑模式）", platform, providerName, levelConfig.FailureThreshold)
-		return nil
+		return true, nil
 	} else if err != nil {
-		return fmt.Errorf("查询黑名单记录失败: %w", err)
+		return false, fmt.Errorf("查询黑名单记录失败: %w", err)
 	}
 
 	// 如果已经拉黑且未过期，不重复计数
 	if blacklistedUntil.Valid && blacklistedUntil.Time.After(now) {
 		log.Printf("⛔ Provider %s/%s 已在黑名单中（L%d），过期时间: %s",
 			platform, providerName, blacklistLevel, blacklistedUntil.Time.Format("15:04:05"))
-		return nil
+		return false, nil
 	}
 
 	// 30秒去重窗口检测（防止客户端重试误判）
@@ -242,7 +253,7 @@ func (bs *BlacklistService) RecordFailure(platform string, providerName string)
 		timeSinceLastFailure := now.Sub(lastFailureWindowStart.Time)
 		if timeSinceLastFailure < time.Duration(levelConfig.DedupeWindowSeconds)*time.Second {
 			log.Printf("🔄 Provider %s/%s 在30秒去重窗口内，忽略此次失败", platform, providerName)
-			return nil
+			return false, nil
 		}
 	}
 
@@ -298,7 +309,7 @@ func (bs *BlacklistService) RecordFailure(platform string, providerName string)
 		`, now, blacklistedAt, blacklistedUntil, newLevel, now, id)
 
 		if err != nil {
-			return fmt.Errorf("更新拉黑状态失败: %w", err)
+			return false, fmt.Errorf("更新拉黑状态失败: %w", err)
 		}
 
 		log.Printf("⛔ Provider %s/%s 已拉黑（L%d → L%d，%d 分钟），过期时间: %s",
@@ -313,27 +324,27 @@ func (bs *BlacklistService) RecordFailure(platform string, providerName string)
 		`, failureCount, now, now, id)
 
 		if err != nil {
-			return fmt.Errorf("更新失败计数失败: %w", err)
+			return false, fmt.Errorf("更新失败计数失败: %w", err)
 		}
 
 		log.Printf("📊 Provider %s/%s 失败计数: %d/%d（当前等级: L%d）",
 			platform, providerName, failureCount, levelConfig.FailureThreshold, blacklistLevel)
 	}
 
-	return nil
+	return true, nil
 }
 
 // recordFailureFixedMode 固定拉黑模式（向后兼容）
-func (bs *BlacklistService) recordFailureFixedMode(platform string, providerName string, fallbackMode string, fallbackDuration int, failureThreshold int) error {
+func (bs *BlacklistService) recordFailureFixedMode(platform string, providerName string, fallbackMode string, fallbackDuration int, failureThreshold int) (bool, error) {
 	if fallbackMode == "none" {
 		log.Printf("🚫 Provider %s/%s 失败，但等级拉黑已关闭且 fallbackMode=none，不拉黑", platform, providerName)
-		return nil
+		return false, nil
 	}
 
 	// 使用旧的固定拉黑逻辑
 	db, err := xdb.DB("default")
 	if err != nil {
-		return fmt.Errorf("获取数据库连接失败: %w", err)
+		return false, fmt.Errorf("获取数据库连接失败: %w", err)
 	}
 
 	now := time.Now()
@@ -358,19 +369,19 @@ func (bs *BlacklistService) recordFailureFixedMode(platform string, providerName
 		`, platform, providerName, now)
 
 		if err != nil {
-			return fmt.Errorf("插入失败记录失败: %w", err)
+			return false, fmt.Errorf("插入失败记录失败: %w", err)
 		}
 
 		log.Printf("📊 Provider %s/%s 失败计数: 1/%d（固定拉黑模式）", platform, providerName, failureThreshold)
-		return nil
+		return true, nil
 	} else if err != nil {
-		return fmt.Errorf("查询黑名单记录失败: %w", err)
+		return false, fmt.Errorf("查询黑名单记录失败: %w", err)
 	}
 
 	// 如果已经拉黑且未过期，不重复计数
 	if blacklistedUntil.Valid && blacklistedUntil.Time.After(now) {
 		log.Printf("⛔ Provider %s/%s 已在黑名单中（固定模式），过期时间: %s", platform, providerName, blacklistedUntil.Time.Format("15:04:05"))
-		return nil
+		return false, nil
 	}
 
 	// 失败计数 +1
@@ -392,7 +403,7 @@ func (bs *BlacklistService) recordFailureFixedMode(platform string, providerName
 		`, failureCount, now, blacklistedAt, blacklistedUntil, id)
 
 		if err != nil {
-			return fmt.Errorf("更新拉黑状态失败: %w", err)
+			return false, fmt.Errorf("更新拉黑状态失败: %w", err)
 		}
 
 		log.Printf("⛔ Provider %s/%s 已拉黑 %d 分钟（固定模式，失败 %d 次），过期时间: %s",
@@ -407,13 +418,13 @@ func (bs *BlacklistService) recordFailureFixedMode(platform string, providerName
 		`, failureCount, now, id)
 
 		if err != nil {
-			return fmt.Errorf("更新失败计数失败: %w", err)
+			return false, fmt.Errorf("更新失败计数失败: %w", err)
 		}
 
 		log.Printf("📊 Provider %s/%s 失败计数: %d/%d（固定模式）", platform, providerName, failureCount, failureThreshold)
 	}
 
-	return nil
+	return true, nil
 }
 
 // getLevelDuration 根据等级获取拉黑时长（分钟）
@@ -612,9 +623,34 @@ func (bs *BlacklistService) AutoRecoverExpired() error {
 	var recovered []string
 	var failed []string
 
+	// 开启健康探测时先并发确认 provider 已恢复，探测不在逐条更新的循环中同步等待
+	healthy := make([]bool, len(toRecover))
+	if bs.recoveryProbe != nil {
+		sem := make(chan struct{}, healthProbeConcurrency)
+		var wg sync.WaitGroup
+		for i, item := range toRecover {
+			wg.Add(1)
+			sem <- struct{}{}
+			go func(i int, item RecoverItem) {
+				defer wg.Done()
+				defer func() { <-sem }()
+				healthy[i] = bs.recoveryProbe(item.Platform, item.ProviderName)
+			}(i, item)
+		}
+		wg.Wait()
+	}
+
 	// 批量更新所有过期的 provider（使用队列）
 	// 【修复】同时清零 blacklist_level 和记录恢复时间，避免"假恢复"问题
-	for _, item := range toRecover {
+	for i, item := range toRecover {
+		// 探测仍失败的 provider 按当前等级重新拉黑（没有真实流量失败，不升级）
+		if bs.recoveryProbe != nil && !healthy[i] {
+			if err := bs.probeBlacklist(item.Platform, item.ProviderName, false); err != nil {
+				log.Printf("⚠️  重新拉黑失败: %s/%s - %v", item.Platform, item.ProviderName, err)
+			}
+			continue
+		}
+
 		err := GlobalDBQueue.Exec(`
 			UPDATE provider_blacklist
 			SET auto_recovered = 1,
@@ -644,6 +680,106 @@ func (bs *BlacklistService) AutoRecoverExpired() error {
 	return nil
 }
 
+// ProbeBlacklist 主动拉黑（健康探测确认 provider 不可用时调用，不经过失败阈值计数）
+// 等级拉黑模式下等级 +1；固定模式下使用配置的拉黑时长
+func (bs *BlacklistService) ProbeBlacklist(platform string, providerName string) error {
+	return bs.probeBlacklist(platform, providerName, true)
+}
+
+// probeBlacklist 按探测结果拉黑，escalate 为 false 时保持当前等级（到期恢复前的探测仍失败）
+func (bs *BlacklistService) probeBlacklist(platform string, providerName string, escalate bool) error {
+	if !bs.settingsService.IsBlacklistEnabled() {
+		return nil
+	}
+
+	db, err := xdb.DB("default")
+	if err != nil {
+		return fmt.Errorf("获取数据库连接失败: %w", err)
+	}
+
+	levelConfig, err := bs.settingsService.GetBlacklistLevelConfig()
+	if err != nil {
+		log.Printf("⚠️  获取等级拉黑配置失败: %v", err)
+		levelConfig = DefaultBlacklistLevelConfig()
+	}
+
+	var blacklistLevel int
+	err = db.QueryRow(`
+		SELECT blacklist_level FROM provider_blacklist
+		WHERE platform = ? AND provider_name = ?
+	`, platform, providerName).Scan(&blacklistLevel)
+	if err != nil && err != sql.ErrNoRows {
+		return fmt.Errorf("查询黑名单记录失败: %w", err)
+	}
+
+	newLevel := blacklistLevel
+	var duration int
+	if levelConfig.EnableLevelBlacklist {
+		if escalate || newLevel == 0 {
+			newLevel = blacklistLevel + 1
+		}
+		if newLevel > 5 {
+			newLevel = 5 // 最高 L5
+		}
+		duration = bs.getLevelDuration(newLevel, levelConfig)
+	} else {
+		if levelConfig.FallbackMode == "none" {
+			log.Printf("🚫 Provider %s/%s 健康探测失败，但 fallbackMode=none，不拉黑", platform, providerName)
+			return nil
+		}
+		_, duration, err = bs.settingsService.GetBlacklistSettings()
+		if err != nil {
+			duration = levelConfig.FallbackDurationMinutes
+		}
+	}
+
+	now := time.Now()
+	blacklistedUntil := now.Add(time.Duration(duration) * time.Minute)
+	err = GlobalDBQueue.Exec(`
+		INSERT INTO provider_blacklist
+			(platform, provider_name, failure_count, last_failure_at, blacklisted_at, blacklisted_until,
+			 blacklist_level, auto_recovered, last_failure_window_start)
+		VALUES (?, ?, 0, ?, ?, ?, ?, 0, ?)
+		ON CONFLICT(platform, provider_name) DO UPDATE SET
+			failure_count = 0,
+			last_failure_at = excluded.last_failure_at,
+			blacklisted_at = excluded.blacklisted_at,
+			blacklisted_until = excluded.blacklisted_until,
+			blacklist_level = excluded.blacklist_level,
+			auto_recovered = 0,
+			last_failure_window_start = excluded.last_failure_window_start
+	`, platform, providerName, now, now, blacklistedUntil, newLevel, now)
+	if err != nil {
+		return fmt.Errorf("更新拉黑状态失败: %w", err)
+	}
+
+	log.Printf("🩺 Provider %s/%s 健康探测失败，已主动拉黑（L%d，%d 分钟），过期时间: %s",
+		platform, providerName, newLevel, duration, blacklistedUntil.Format("15:04:05"))
+	return nil
+}
+
+// ProbeRecover 提前解除拉黑（健康探测确认 provider 已恢复时调用）
+// 与 AutoRecoverExpired 的恢复逻辑一致：清零等级并记录恢复时间
+func (bs *BlacklistService) ProbeRecover(platform string, providerName string) error {
+	now := time.Now()
+	err := GlobalDBQueue.Exec(`
+		UPDATE provider_blacklist
+		SET blacklisted_until = ?,
+			auto_recovered = 1,
+			failure_count = 0,
+			blacklist_level = 0,
+			last_recovered_at = ?,
+			last_degrade_hour = 0
+		WHERE platform = ? AND provider_name = ?
+	`, now, now, platform, providerName)
+	if err != nil {
+		return fmt.Errorf("提前解除拉黑失败: %w", err)
+	}
+
+	log.Printf("🩺 Provider %s/%s 健康探测成功，已提前解除拉黑", platform, providerName)
+	return nil
+}
+
 // GetBlacklistStatus 获取所有黑名单状态（用于前端展示，支持等级拉黑）
 func (bs *BlacklistService) GetBlacklistStatus(platform string) ([]BlacklistStatus, error) {
 	db, err := xdb.DB("default")
@@ -0,0 +1,173 @@
+package services
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/tidwall/gjson"
+)
+
+// Provider 能力标识（Provider.Capabilities 的 key）
+const (
+	CapabilityVision        = "vision"         // 图片输入
+	CapabilityTools         = "tools"          // 工具调用
+	CapabilityThinking      = "thinking"       // 扩展思考 / reasoning
+	CapabilityPDF           = "pdf"            // PDF 文档输入
+	CapabilityContext1M     = "context_1m"     // 1M 上下文
+	CapabilityPromptCaching = "prompt_caching" // prompt cache（cache_control / prompt_cache_key）
+)
+
+var knownCapabilities = map[string]bool{
+	CapabilityVision:        true,
+	CapabilityTools:         true,
+	CapabilityThinking:      true,
+	CapabilityPDF:           true,
+	CapabilityContext1M:     true,
+	CapabilityPromptCaching: true,
+}
+
+// SupportsCapability 检查 provider 是否具备某项能力
+// 向后兼容：未声明的能力视为支持，只有显式声明为 false 才视为不支持
+func (p *Provider) SupportsCapability(capability string) bool {
+	supported, declared := p.Capabilities[capability]
+	return !declared || supported
+}
+
+// missingCapability 返回 provider 缺少的第一项所需能力，全部具备时返回空字符串
+// 兼容性配置会移除的内容（cache_control、thinking、anthropic-beta）不再要求 provider 具备对应能力
+func (p *Provider) missingCapability(kind string, required []string) string {
+	for _, capability := range required {
+		if !p.SupportsCapability(capability) && !p.compatNeutralizes(kind, capability) {
+			return capability
+		}
+	}
+	return ""
+}
+
+// compatNeutralizes 转发前兼容性配置是否会移除请求中用到该能力的部分
+func (p *Provider) compatNeutralizes(kind string, capability string) bool {
+	if kind != "claude" || p.Compat == nil {
+		return false
+	}
+	profile := p.Compat.resolve()
+	switch capability {
+	case CapabilityPromptCaching:
+		return profile.StripCacheControl
+	case CapabilityThinking:
+		return profile.DisableThinking
+	case CapabilityContext1M:
+		return profile.StripBetas
+	}
+	return false
+}
+
+// validateCapabilities 检查能力声明中的未知 key（多为拼写错误）
+func validateCapabilities(capabilities map[string]bool) []string {
+	var errs []string
+	for capability := range capabilities {
+		if !knownCapabilities[capability] {
+			errs = append(errs, fmt.Sprintf("未知的能力声明 '%s'（可选：vision、tools、thinking、pdf、context_1m、prompt_caching）", capability))
+		}
+	}
+	return errs
+}
+
+// requiredCapabilities 分析请求体和请求头，返回请求用到的能力
+func requiredCapabilities(kind string, body []byte, headers http.Header) []string {
+	features := make(map[string]bool)
+	switch kind {
+	case "codex":
+		detectResponsesCapabilities(body, features)
+	default:
+		detectMessagesCapabilities(body, headers, features)
+	}
+
+	required := make([]string, 0, len(features))
+	// 固定顺序，保证日志稳定
+	for _, capability := range []string{CapabilityVision, CapabilityPDF, CapabilityTools, CapabilityThinking, CapabilityContext1M, CapabilityPromptCaching} {
+		if features[capability] {
+			required = append(required, capability)
+		}
+	}
+	return required
+}
+
+// detectMessagesCapabilities Anthropic Messages API 请求
+func detectMessagesCapabilities(body []byte, headers http.Header, features map[string]bool) {
+	if gjson.GetBytes(body, "tools.#").Int() > 0 {
+		features[CapabilityTools] = true
+	}
+	if thinking := gjson.GetBytes(body, "thinking.type").String(); thinking != "" && thinking != "disabled" {
+		features[CapabilityThinking] = true
+	}
+	for _, beta := range headers.Values("anthropic-beta") {
+		if strings.Contains(beta, "context-1m") {
+			features[CapabilityContext1M] = true
+		}
+	}
+	if gjson.GetBytes(body, "system.#(cache_control)").Exists() {
+		features[CapabilityPromptCaching] = true
+	}
+
+	var visitBlocks func(blocks gjson.Result)
+	visitBlocks = func(blocks gjson.Result) {
+		blocks.ForEach(func(_, block gjson.Result) bool {
+			if block.Get("cache_control").Exists() {
+				features[CapabilityPromptCaching] = true
+			}
+			switch block.Get("type").String() {
+			case "image":
+				features[CapabilityVision] = true
+			case "document":
+				if mediaType := block.Get("source.media_type").String(); mediaType == "" || mediaType == "application/pdf" {
+					features[CapabilityPDF] = true
+				}
+			case "tool_use", "tool_result":
+				features[CapabilityTools] = true
+				if content := block.Get("content"); content.IsArray() {
+					visitBlocks(content)
+				}
+			case "thinking", "redacted_thinking":
+				features[CapabilityThinking] = true
+			}
+			return true
+		})
+	}
+	gjson.GetBytes(body, "messages").ForEach(func(_, message gjson.Result) bool {
+		if content := message.Get("content"); content.IsArray() {
+			visitBlocks(content)
+		}
+		return true
+	})
+}
+
+// detectResponsesCapabilities OpenAI Responses API 请求
+func detectResponsesCapabilities(body []byte, features map[string]bool) {
+	if gjson.GetBytes(body, "tools.#").Int() > 0 {
+		features[CapabilityTools] = true
+	}
+	if effort := gjson.GetBytes(body, "reasoning.effort").String(); effort != "" && effort != "none" {
+		features[CapabilityThinking] = true
+	}
+	if gjson.GetBytes(body, "prompt_cache_key").String() != "" {
+		features[CapabilityPromptCaching] = true
+	}
+
+	gjson.GetBytes(body, "input").ForEach(func(_, item gjson.Result) bool {
+		switch item.Get("type").String() {
+		case "function_call", "function_call_output", "custom_tool_call", "custom_tool_call_output":
+			features[CapabilityTools] = true
+		}
+		item.Get("content").ForEach(func(_, part gjson.Result) bool {
+			switch part.Get("type").String() {
+			case "input_image":
+				features[CapabilityVision] = true
+			case "input_file":
+				features[CapabilityPDF] = true
+			}
+			return true
+		})
+		return true
+	})
+}
@@ -0,0 +1,257 @@
+package services
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+// 兼容性预设：按常见中转站的兼容程度由宽到严
+const (
+	CompatPresetFull    = "full"     // 完整兼容 Anthropic API，不做处理（默认）
+	CompatPresetNoBeta  = "no_beta"  // 不支持 beta 功能：移除 betas / context_management，未知内容块转文本
+	CompatPresetNoCache = "no_cache" // 在 no_beta 基础上移除 cache_control
+	CompatPresetBasic   = "basic"    // 在 no_cache 基础上关闭 thinking
+)
+
+// 未知内容块的处理方式
+const (
+	UnknownBlocksKeep = "keep" // 原样保留
+	UnknownBlocksDrop = "drop" // 删除
+	UnknownBlocksText = "text" // 转为 text 块
+)
+
+// knownContentBlockTypes 中转站普遍支持的 Messages API 内容块类型，其余视为较新的类型
+var knownContentBlockTypes = map[string]bool{
+	"text":              true,
+	"image":             true,
+	"document":          true,
+	"tool_use":          true,
+	"tool_result":       true,
+	"thinking":          true,
+	"redacted_thinking": true,
+}
+
+// ProviderCompat provider 的兼容性配置：选择预设，再用单项配置覆盖
+// 单项配置为 nil 时沿用预设的值
+type ProviderCompat struct {
+	Preset                 string `json:"preset,omitempty"`
+	StripCacheControl      *bool  `json:"stripCacheControl,omitempty"`
+	DisableThinking        *bool  `json:"disableThinking,omitempty"`
+	StripContextManagement *bool  `json:"stripContextManagement,omitempty"`
+	StripBetas             *bool  `json:"stripBetas,omitempty"`
+	UnknownBlocks          string `json:"unknownBlocks,omitempty"` // keep / drop / text
+}
+
+// compatProfile 合并预设与覆盖项后的最终处理规则
+type compatProfile struct {
+	StripCacheControl      bool
+	DisableThinking        bool
+	StripContextManagement bool
+	StripBetas             bool
+	UnknownBlocks          string
+}
+
+var compatPresets = map[string]compatProfile{
+	CompatPresetFull: {UnknownBlocks: UnknownBlocksKeep},
+	CompatPresetNoBeta: {
+		StripContextManagement: true,
+		StripBetas:             true,
+		UnknownBlocks:          UnknownBlocksText,
+	},
+	CompatPresetNoCache: {
+		StripCacheControl:      true,
+		StripContextManagement: true,
+		StripBetas:             true,
+		UnknownBlocks:          UnknownBlocksText,
+	},
+	CompatPresetBasic: {
+		StripCacheControl:      true,
+		DisableThinking:        true,
+		StripContextManagement: true,
+		StripBetas:             true,
+		UnknownBlocks:          UnknownBlocksText,
+	},
+}
+
+// resolve 合并预设与覆盖项
+func (c *ProviderCompat) resolve() compatProfile {
+	if c == nil {
+		return compatPresets[CompatPresetFull]
+	}
+	profile, ok := compatPresets[c.Preset]
+	if !ok {
+		profile = compatPresets[CompatPresetFull]
+	}
+	if c.StripCacheControl != nil {
+		profile.StripCacheControl = *c.StripCacheControl
+	}
+	if c.DisableThinking != nil {
+		profile.DisableThinking = *c.DisableThinking
+	}
+	if c.StripContextManagement != nil {
+		profile.StripContextManagement = *c.StripContextManagement
+	}
+	if c.StripBetas != nil {
+		profile.StripBetas = *c.StripBetas
+	}
+	if c.UnknownBlocks != "" {
+		profile.UnknownBlocks = c.UnknownBlocks
+	}
+	return profile
+}
+
+// validateCompat 检查兼容性配置中的预设名和取值
+func validateCompat(c *ProviderCompat) []string {
+	if c == nil {
+		return nil
+	}
+	var errs []string
+	if _, ok := compatPresets[c.Preset]; c.Preset != "" && !ok {
+		errs = append(errs, fmt.Sprintf("未知的兼容性预设 '%s'（可选：full、no_beta、no_cache、basic）", c.Preset))
+	}
+	switch c.UnknownBlocks {
+	case "", UnknownBlocksKeep, UnknownBlocksDrop, UnknownBlocksText:
+	default:
+		errs = append(errs, fmt.Sprintf("unknownBlocks 取值无效 '%s'（可选：keep、drop、text）", c.UnknownBlocks))
+	}
+	return errs
+}
+
+// applyCompatProfile 按 provider 的兼容性配置改写 Anthropic Messages 请求
+// 返回改写后的请求体与请求头，以及本次处理的摘要（无改动时为空）
+func applyCompatProfile(kind string, compat *ProviderCompat, body []byte, headers map[string]string) ([]byte, map[string]string, []string) {
+	if kind != "claude" || compat == nil {
+		return body, headers, nil
+	}
+	profile := compat.resolve()
+	var changes []string
+
+	if profile.StripBetas {
+		for key := range headers {
+			if strings.EqualFold(key, "anthropic-beta") {
+				delete(headers, key)
+				changes = append(changes, "anthropic-beta")
+			}
+		}
+		if gjson.GetBytes(body, "betas").Exists() {
+			body, _ = sjson.DeleteBytes(body, "betas")
+			changes = append(changes, "betas")
+		}
+	}
+	if profile.StripContextManagement && gjson.GetBytes(body, "context_management").Exists() {
+		body, _ = sjson.DeleteBytes(body, "context_management")
+		changes = append(changes, "context_management")
+	}
+	if profile.DisableThinking && gjson.GetBytes(body, "thinking").Exists() {
+		body, _ = sjson.DeleteBytes(body, "thinking")
+		changes = append(changes, "thinking")
+	}
+
+	stripped, converted, dropped := 0, 0, 0
+	if profile.StripCacheControl {
+		for i := int(gjson.GetBytes(body, "system.#").Int()) - 1; i >= 0; i-- {
+			path := fmt.Sprintf("system.%d.cache_control", i)
+			if gjson.GetBytes(body, path).Exists() {
+				body, _ = sjson.DeleteBytes(body, path)
+				stripped++
+			}
+		}
+		for i := int(gjson.GetBytes(body, "tools.#").Int()) - 1; i >= 0; i-- {
+			path := fmt.Sprintf("tools.%d.cache_control", i)
+			if gjson.GetBytes(body, path).Exists() {
+				body, _ = sjson.DeleteBytes(body, path)
+				stripped++
+			}
+		}
+	}
+
+	// 倒序处理内容块，删除时不影响尚未处理的下标
+	for i := int(gjson.GetBytes(body, "messages.#").Int()) - 1; i >= 0; i-- {
+		body = rewriteContentBlocks(body, fmt.Sprintf("messages.%d.content", i), profile, &stripped, &converted, &dropped)
+	}
+
+	if stripped > 0 {
+		changes = append(changes, fmt.Sprintf("cache_control×%d", stripped))
+	}
+	if converted > 0 {
+		changes = append(changes, fmt.Sprintf("转文本×%d", converted))
+	}
+	if dropped > 0 {
+		changes = append(changes, fmt.Sprintf("删除内容块×%d", dropped))
+	}
+	return body, headers, changes
+}
+
+// rewriteContentBlocks 处理一个 content 数组（tool_result 的嵌套 content 递归处理）
+func rewriteContentBlocks(body []byte, contentPath string, profile compatProfile, stripped, converted, dropped *int) []byte {
+	content := gjson.GetBytes(body, contentPath)
+	if !content.IsArray() {
+		return body
+	}
+	for j := len(content.Array()) - 1; j >= 0; j-- {
+		blockPath := fmt.Sprintf("%s.%d", contentPath, j)
+		block := gjson.GetBytes(body, blockPath)
+		blockType := block.Get("type").String()
+
+		// 关闭 thinking 时，历史中的思考块也必须移除，否则上游会拒绝
+		if profile.DisableThinking && (blockType == "thinking" || blockType == "redacted_thinking") {
+			body, _ = sjson.DeleteBytes(body, blockPath)
+			*dropped++
+			continue
+		}
+
+		if !knownContentBlockTypes[blockType] {
+			switch profile.UnknownBlocks {
+			case UnknownBlocksDrop:
+				body, _ = sjson.DeleteBytes(body, blockPath)
+				*dropped++
+				continue
+			case UnknownBlocksText:
+				body, _ = sjson.SetBytes(body, blockPath, map[string]string{
+					"type": "text",
+					"text": unknownBlockText(block),
+				})
+				*converted++
+				continue
+			}
+		}
+
+		if blockType == "tool_result" {
+			body = rewriteContentBlocks(body, blockPath+".content", profile, stripped, converted, dropped)
+		}
+		if profile.StripCacheControl && block.Get("cache_control").Exists() {
+			body, _ = sjson.DeleteBytes(body, blockPath+".cache_control")
+			*stripped++
+		}
+	}
+	return body
+}
+
+// unknownBlockText 把未知内容块转成文本：优先取块内的文本内容，否则保留原始 JSON
+func unknownBlockText(block gjson.Result) string {
+	blockType := block.Get("type").String()
+	var texts []string
+	for _, path := range []string{"text", "content.#.text", "content"} {
+		value := block.Get(path)
+		switch {
+		case value.IsArray():
+			for _, item := range value.Array() {
+				if item.Type == gjson.String {
+					texts = append(texts, item.String())
+				}
+			}
+		case value.Type == gjson.String:
+			texts = append(texts, value.String())
+		}
+		if len(texts) > 0 {
+			break
+		}
+	}
+	if len(texts) == 0 {
+		return fmt.Sprintf("[%s] %s", blockType, block.Raw)
+	}
+	return fmt.Sprintf("[%s] %s", blockType, strings.Join(texts, "\n"))
+}
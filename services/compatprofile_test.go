@@ -0,0 +1,59 @@
+package services
+
+import (
+	"testing"
+
+	"github.com/tidwall/gjson"
+)
+
+func TestApplyCompatProfile(t *testing.T) {
+	body := []byte(`{
+		"model": "claude-sonnet-4",
+		"betas": ["context-management-2025-06-27"],
+		"context_management": {"edits": []},
+		"thinking": {"type": "enabled", "budget_tokens": 2048},
+		"system": [{"type": "text", "text": "sys", "cache_control": {"type": "ephemeral"}}],
+		"messages": [
+			{"role": "assistant", "content": [
+				{"type": "thinking", "thinking": "hmm", "signature": "sig"},
+				{"type": "server_tool_use", "id": "srv_1", "name": "web_search", "input": {}},
+				{"type": "text", "text": "done"}
+			]},
+			{"role": "user", "content": [
+				{"type": "tool_result", "tool_use_id": "t1", "content": [
+					{"type": "search_result", "content": [{"type": "text", "text": "found"}]}
+				]},
+				{"type": "text", "text": "go", "cache_control": {"type": "ephemeral"}}
+			]}
+		]
+	}`)
+	headers := map[string]string{"Anthropic-Beta": "context-1m-2025-08-07"}
+
+	disable := false
+	compat := &ProviderCompat{Preset: CompatPresetBasic, DisableThinking: &disable}
+	out, outHeaders, changes := applyCompatProfile("claude", compat, body, headers)
+	if len(changes) == 0 {
+		t.Fatal("应有兼容性处理记录")
+	}
+	if _, ok := outHeaders["Anthropic-Beta"]; ok {
+		t.Error("anthropic-beta 请求头应被移除")
+	}
+	for _, path := range []string{"betas", "context_management", "system.0.cache_control", "messages.1.content.1.cache_control"} {
+		if gjson.GetBytes(out, path).Exists() {
+			t.Errorf("%s 应被移除: %s", path, out)
+		}
+	}
+	if !gjson.GetBytes(out, "thinking").Exists() || gjson.GetBytes(out, "messages.0.content.0.type").String() != "thinking" {
+		t.Errorf("覆盖项关闭了 disableThinking，thinking 应保留: %s", out)
+	}
+	if gjson.GetBytes(out, "messages.0.content.1.type").String() != "text" {
+		t.Errorf("未知内容块应转为文本: %s", gjson.GetBytes(out, "messages.0.content").Raw)
+	}
+	if got := gjson.GetBytes(out, "messages.1.content.0.content.0.text").String(); got != "[search_result] found" {
+		t.Errorf("tool_result 内的未知内容块应转为文本，实际 %q", got)
+	}
+
+	if out, _, changes := applyCompatProfile("codex", compat, body, map[string]string{}); len(changes) != 0 || string(out) != string(body) {
+		t.Error("Codex 请求不应做 Anthropic 兼容性处理")
+	}
+}
@@ -0,0 +1,288 @@
+package services
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/tidwall/gjson"
+
+	modelpricing "codeswitch/resources/model-pricing"
+)
+
+const (
+	costEstimateCharsPerToken = 4    // 按请求体大小估算输入 token
+	costEstimateDefaultOutput = 1024 // 请求未声明输出上限时估算的输出 token
+	costEstimateMaxOutput     = 4096 // 输出上限很大时按此估算（实际输出通常远小于上限）
+)
+
+// providerScoreAlpha 近期成功率与延迟的指数平滑系数
+const providerScoreAlpha = 0.2
+
+const (
+	costRankCostBucket    = 0.01 // 费用按 1% 的对数区间分桶，同一区间视为费用相同
+	costRankSuccessBucket = 0.05 // 成功率按 5% 分桶，同一区间视为成功率相同
+)
+
+// ModelPrice 每百万 token 的价格（美元）
+type ModelPrice struct {
+	Input       float64 `json:"input"`
+	Output      float64 `json:"output"`
+	CacheCreate float64 `json:"cacheCreate,omitempty"`
+	CacheRead   float64 `json:"cacheRead,omitempty"`
+}
+
+// validatePricing 验证价格倍率与模型单价
+func validatePricing(multiplier float64, prices map[string]ModelPrice) []string {
+	var errors []string
+	if multiplier < 0 || math.IsNaN(multiplier) || math.IsInf(multiplier, 0) {
+		errors = append(errors, fmt.Sprintf("价格倍率不能为负数，当前为 %v", multiplier))
+	}
+	for model, price := range prices {
+		if strings.TrimSpace(model) == "" {
+			errors = append(errors, "模型单价的模型名不能为空")
+			continue
+		}
+		if price.Input < 0 || price.Output < 0 || price.CacheCreate < 0 || price.CacheRead < 0 {
+			errors = append(errors, fmt.Sprintf("模型 %s 的单价不能为负数", model))
+		}
+	}
+	return errors
+}
+
+// estimateRequestUsage 按请求体估算一次请求的用量（只用于比较各 provider 的相对费用）
+func estimateRequestUsage(kind string, body []byte) modelpricing.UsageSnapshot {
+	outputField := "max_tokens"
+	if kind == "codex" {
+		outputField = "max_output_tokens"
+	}
+	output := int(gjson.GetBytes(body, outputField).Int())
+	if output <= 0 {
+		output = costEstimateDefaultOutput
+	}
+	if output > costEstimateMaxOutput {
+		output = costEstimateMaxOutput
+	}
+	return modelpricing.UsageSnapshot{
+		InputTokens:  len(body) / costEstimateCharsPerToken,
+		OutputTokens: output,
+	}
+}
+
+// modelPriceFor 查找模型单价：精确匹配优先，其次按字面前缀最长的通配符 / 正则匹配（与模型映射规则一致）
+func (p *Provider) modelPriceFor(model string) (ModelPrice, bool) {
+	if price, ok := p.ModelPrices[model]; ok {
+		return price, true
+	}
+	patterns := make([]string, 0, len(p.ModelPrices))
+	for pattern := range p.ModelPrices {
+		patterns = append(patterns, pattern)
+	}
+	best, ok := findModelPattern(patterns, nil, model)
+	if !ok {
+		return ModelPrice{}, false
+	}
+	return p.ModelPrices[best.pattern], true
+}
+
+// expectedCost 按 provider 的价格配置估算一次请求的费用（美元），没有价格信息时返回 false
+// 配置了模型单价时直接使用；否则按官方价格（modelpricing）乘以价格倍率
+func (p *Provider) expectedCost(pricing *modelpricing.Service, requestedModel string, usage modelpricing.UsageSnapshot) (float64, bool) {
+	model := p.GetEffectiveModel(requestedModel)
+	if price, ok := p.modelPriceFor(model); ok {
+		cost := float64(usage.InputTokens)*price.Input +
+			float64(usage.OutputTokens)*price.Output +
+			float64(usage.CacheCreateTokens)*price.CacheCreate +
+			float64(usage.CacheReadTokens)*price.CacheRead
+		return cost / 1e6, true
+	}
+
+	breakdown := pricing.CalculateCost(model, usage)
+	if !breakdown.HasPricing && model != requestedModel {
+		// 映射后的模型名（如带厂商前缀）查不到官方价格时，按请求的模型计价
+		breakdown = pricing.CalculateCost(requestedModel, usage)
+	}
+	if !breakdown.HasPricing {
+		return 0, false
+	}
+	multiplier := p.PriceMultiplier
+	if multiplier <= 0 {
+		multiplier = 1
+	}
+	return breakdown.TotalCost * multiplier, true
+}
+
+// providerScore 一个 provider 的近期表现（指数平滑）
+type providerScore struct {
+	successRate float64
+	latencySec  float64 // 成功请求的首 token 延迟（非流式为总耗时），0 表示暂无样本
+	samples     int
+}
+
+// providerScoreboard 记录各 provider 的近期成功率与延迟，用于费用相同时的排序
+type providerScoreboard struct {
+	mu     sync.Mutex
+	scores map[string]*providerScore
+}
+
+func newProviderScoreboard() *providerScoreboard {
+	return &providerScoreboard{scores: make(map[string]*providerScore)}
+}
+
+// recordAttempt 记录一次上游尝试的结果（客户端中断不计入）
+func (b *providerScoreboard) recordAttempt(requestLog *ReqeustLog) {
+	if b == nil || requestLog.ErrorClass == relayErrorClientAbort {
+		return
+	}
+	success := requestLog.HttpCode >= 200 && requestLog.HttpCode < 300 && requestLog.ErrorClass == ""
+	latency := requestLog.TTFTSec
+	if latency <= 0 {
+		latency = requestLog.DurationSec
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	key := requestLog.Platform + "/" + requestLog.Provider
+	score := b.scores[key]
+	if score == nil {
+		score = &providerScore{successRate: 1}
+		b.scores[key] = score
+	}
+	outcome := 0.0
+	if success {
+		outcome = 1
+	}
+	if score.samples == 0 {
+		score.successRate = outcome
+	} else {
+		score.successRate += providerScoreAlpha * (outcome - score.successRate)
+	}
+	if success && latency > 0 {
+		if score.latencySec == 0 {
+			score.latencySec = latency
+		} else {
+			score.latencySec += providerScoreAlpha * (latency - score.latencySec)
+		}
+	}
+	score.samples++
+}
+
+// get 返回 provider 的近期表现，没有样本时返回 false
+func (b *providerScoreboard) get(kind string, name string) (providerScore, bool) {
+	if b == nil {
+		return providerScore{}, false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	score, ok := b.scores[kind+"/"+name]
+	if !ok {
+		return providerScore{}, false
+	}
+	return *score, true
+}
+
+// costCandidate 待排序的 provider 及其预估费用
+type costCandidate struct {
+	provider Provider
+	cost     float64
+	priced   bool
+	rank     costRankKey
+}
+
+// costRankKey 排序键：各项离散化后按字段顺序逐项比较，保证排序是严格弱序
+type costRankKey struct {
+	unpriced      bool  // 没有价格信息的排在最后
+	costBucket    int64 // 费用所在的对数区间
+	unscored      bool  // 没有近期样本的排在后面
+	successBucket int   // 成功率区间（取负值，成功率高的在前）
+	noLatency     bool  // 没有延迟样本的排在后面
+	latencySec    float64
+}
+
+func (k costRankKey) less(o costRankKey) bool {
+	switch {
+	case k.unpriced != o.unpriced:
+		return o.unpriced
+	case k.costBucket != o.costBucket:
+		return k.costBucket < o.costBucket
+	case k.unscored != o.unscored:
+		return o.unscored
+	case k.successBucket != o.successBucket:
+		return k.successBucket < o.successBucket
+	case k.noLatency != o.noLatency:
+		return o.noLatency
+	default:
+		return k.latencySec < o.latencySec
+	}
+}
+
+// costBucket 费用所在的对数区间（费用为 0 时排在最前）
+func costBucket(cost float64) int64 {
+	if cost <= 0 {
+		return math.MinInt64
+	}
+	return int64(math.Floor(math.Log(cost) / math.Log1p(costRankCostBucket)))
+}
+
+// rankByCost 按预估费用从低到高排序；没有价格信息的排在最后
+// 费用相同（落在同一个 1% 区间）时，近期成功率高的优先（按 5% 分桶），再按近期延迟从低到高；都没有样本时保持配置顺序
+func (prs *ProviderRelayService) rankByCost(kind string, providers []Provider, requestedModel string, usage modelpricing.UsageSnapshot) []costCandidate {
+	candidates := make([]costCandidate, len(providers))
+	for i, p := range providers {
+		cost, priced := p.expectedCost(prs.pricing, requestedModel, usage)
+		rank := costRankKey{unpriced: !priced, unscored: true, noLatency: true}
+		if priced {
+			rank.costBucket = costBucket(cost)
+		}
+		if score, ok := prs.scoreboard.get(kind, p.Name); ok {
+			rank.unscored = false
+			rank.successBucket = -int(math.Floor(score.successRate / costRankSuccessBucket))
+			if score.latencySec > 0 {
+				rank.noLatency, rank.latencySec = false, score.latencySec
+			}
+		}
+		candidates[i] = costCandidate{provider: p, cost: cost, priced: priced, rank: rank}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].rank.less(candidates[j].rank)
+	})
+	return candidates
+}
+
+// orderByCost 按路由模式重排各 Level 内（或全部）的 provider，返回新的 Level 列表
+// cost 模式下所有 provider 合并到最高优先级的 Level 中按费用排序
+func (prs *ProviderRelayService) orderByCost(kind string, mode string, levelGroups map[int][]Provider, levels []int,
+	requestedModel string, body []byte) []int {
+	if len(levels) == 0 {
+		return levels
+	}
+	usage := estimateRequestUsage(kind, body)
+	if mode == RoutingModeCost && len(levels) > 1 {
+		var all []Provider
+		for _, level := range levels {
+			all = append(all, levelGroups[level]...)
+			delete(levelGroups, level)
+		}
+		levelGroups[levels[0]] = all
+		levels = levels[:1]
+	}
+
+	for _, level := range levels {
+		ranked := prs.rankByCost(kind, levelGroups[level], requestedModel, usage)
+		group := make([]Provider, len(ranked))
+		fmt.Printf("[INFO] 💰 Level %d 按预估费用排序：", level)
+		for i, candidate := range ranked {
+			group[i] = candidate.provider
+			if candidate.priced {
+				fmt.Printf("%s($%.6f) ", candidate.provider.Name, candidate.cost)
+			} else {
+				fmt.Printf("%s(无价格) ", candidate.provider.Name)
+			}
+		}
+		fmt.Println()
+		levelGroups[level] = group
+	}
+	return levels
+}
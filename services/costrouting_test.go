@@ -0,0 +1,107 @@
+package services
+
+import (
+	"math"
+	"testing"
+)
+
+func TestCostRankKeyStrictWeakOrder(t *testing.T) {
+	// 相差不到 1% 的费用两两"相同"但首尾不同：容差比较会违反传递性
+	var keys []costRankKey
+	for _, cost := range []float64{0, 1, 1.004, 1.008, 1.012, 1.016, 2} {
+		for _, rate := range []float64{0.9, 0.93, 0.96, 0.99} {
+			for _, latency := range []float64{0, 0.5, 2} {
+				keys = append(keys, costRankKey{
+					costBucket:    costBucket(cost),
+					successBucket: -int(rate / costRankSuccessBucket),
+					noLatency:     latency == 0,
+					latencySec:    latency,
+				})
+			}
+		}
+	}
+	keys = append(keys, costRankKey{unpriced: true, unscored: true, noLatency: true})
+
+	equivalent := func(a, b costRankKey) bool { return !a.less(b) && !b.less(a) }
+	for _, a := range keys {
+		if a.less(a) {
+			t.Fatalf("less 应满足非自反: %+v", a)
+		}
+		for _, b := range keys {
+			for _, c := range keys {
+				if a.less(b) && b.less(c) && !a.less(c) {
+					t.Fatalf("less 应满足传递性: %+v %+v %+v", a, b, c)
+				}
+				if equivalent(a, b) && equivalent(b, c) && !equivalent(a, c) {
+					t.Fatalf("不可比较关系应满足传递性: %+v %+v %+v", a, b, c)
+				}
+			}
+		}
+	}
+
+	if costBucket(1) != costBucket(1.005) || costBucket(1) == costBucket(1.02) {
+		t.Errorf("费用应按 1%% 分桶: %d %d %d", costBucket(1), costBucket(1.005), costBucket(1.02))
+	}
+}
+
+func TestCostRouting(t *testing.T) {
+	prs := newTestRelay(t)
+	pricing := prs.pricing
+	if pricing == nil {
+		t.Fatal("加载价格失败")
+	}
+	body := []byte(`{"model":"claude-sonnet-4-5","max_tokens":64000,"messages":[{"role":"user","content":"hi"}]}`)
+	usage := estimateRequestUsage("claude", body)
+	if usage.OutputTokens != costEstimateMaxOutput || usage.InputTokens != len(body)/costEstimateCharsPerToken {
+		t.Errorf("用量估算错误: %+v", usage)
+	}
+
+	official := Provider{Name: "official"}
+	cheap := Provider{Name: "cheap", PriceMultiplier: 0.3}
+	explicit := Provider{Name: "explicit", ModelPrices: map[string]ModelPrice{"*": {Input: 0.01, Output: 0.01}}}
+	unpriced := Provider{Name: "unpriced", ModelMapping: map[string]string{"claude-sonnet-4-5": "vendor-x"}}
+	if _, ok := unpriced.expectedCost(pricing, "unknown-model", usage); ok {
+		t.Error("未知模型不应有价格")
+	}
+	officialCost, ok := official.expectedCost(pricing, "claude-sonnet-4-5", usage)
+	if !ok || officialCost <= 0 {
+		t.Fatalf("官方价格应可用: %v %v", officialCost, ok)
+	}
+	if cheapCost, _ := cheap.expectedCost(pricing, "claude-sonnet-4-5", usage); math.Abs(cheapCost-officialCost*0.3) > 1e-12 {
+		t.Errorf("价格倍率未生效: %v vs %v", cheapCost, officialCost)
+	}
+
+	levelGroups := map[int][]Provider{1: {official, unpriced}, 2: {cheap, explicit}}
+	levels := prs.orderByCost("claude", RoutingModeCost, levelGroups, []int{1, 2}, "unknown-model", body)
+	if len(levels) != 1 || len(levelGroups[1]) != 4 {
+		t.Fatalf("cost 模式应合并所有 Level: %v", levels)
+	}
+	if got := levelGroups[1][0].Name; got != "explicit" {
+		t.Errorf("只有配置了单价的 provider 有价格，应排在最前，得到 %s", got)
+	}
+
+	// 费用相同：近期成功率高的优先，再比较延迟
+	a, b := Provider{Name: "a"}, Provider{Name: "b"}
+	prs.scoreboard.recordAttempt(&ReqeustLog{Platform: "claude", Provider: "a", HttpCode: 500, ErrorClass: relayErrorUpstreamStatus})
+	prs.scoreboard.recordAttempt(&ReqeustLog{Platform: "claude", Provider: "b", HttpCode: 200, TTFTSec: 2})
+	ranked := prs.rankByCost("claude", []Provider{a, b}, "claude-sonnet-4-5", usage)
+	if ranked[0].provider.Name != "b" {
+		t.Error("同价时应优先近期成功的 provider")
+	}
+	prs.scoreboard.recordAttempt(&ReqeustLog{Platform: "claude", Provider: "a", HttpCode: 200, TTFTSec: 0.5})
+	prs.scoreboard.recordAttempt(&ReqeustLog{Platform: "claude", Provider: "b", HttpCode: 500, ErrorClass: relayErrorUpstreamStatus})
+	prs.scoreboard.recordAttempt(&ReqeustLog{Platform: "claude", Provider: "b", HttpCode: 200, TTFTSec: 2})
+	if score, _ := prs.scoreboard.get("claude", "a"); score.latencySec != 0.5 {
+		t.Errorf("失败请求不应计入延迟: %+v", score)
+	}
+
+	levelGroups = map[int][]Provider{1: {official, cheap}, 2: {explicit}}
+	levels = prs.orderByCost("claude", RoutingModeCostLevel, levelGroups, []int{1, 2}, "claude-sonnet-4-5", body)
+	if len(levels) != 2 || levelGroups[1][0].Name != "cheap" || levelGroups[2][0].Name != "explicit" {
+		t.Errorf("cost_level 模式应只在 Level 内排序: %v %+v", levels, levelGroups)
+	}
+
+	if errs := validatePricing(-1, map[string]ModelPrice{"m": {Input: -1}}); len(errs) != 2 {
+		t.Errorf("负数倍率和单价应报错: %v", errs)
+	}
+}
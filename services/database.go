@@ -66,6 +66,18 @@ func InitDatabase() error {
 	if err := ensureBlacklistTables(); err != nil {
 		return fmt.Errorf("初始化黑名单表失败: %w", err)
 	}
+	if err := ensureHealthProbeTable(); err != nil {
+		return fmt.Errorf("初始化健康探测表失败: %w", err)
+	}
+	if err := ensureShadowLogTable(); err != nil {
+		return fmt.Errorf("初始化影子流量表失败: %w", err)
+	}
+	if err := ensureArenaTables(); err != nil {
+		return fmt.Errorf("初始化对比测试表失败: %w", err)
+	}
+	if err := ensureProviderCheckTable(); err != nil {
+		return fmt.Errorf("初始化 provider 检查表失败: %w", err)
+	}
 
 	// 5. 预热连接池：强制建立数据库连接，避免首次写入时失败
 	var count int
@@ -3,11 +3,15 @@ package services
 import (
 	"encoding/json"
 	"fmt"
+	"log"
 	"os"
 	"path/filepath"
 	"strings"
 	"sync"
 	"time"
+
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
 )
 
 // GeminiAuthType 认证类型
@@ -20,6 +24,14 @@ const (
 	GeminiAuthGeneric    GeminiAuthType = "generic"          // 通用第三方
 )
 
+// Gemini provider 的上游协议
+// anthropic / openai 格式的 provider 会把 generateContent 请求转换为 Messages / Chat Completions
+const (
+	GeminiAPIFormatGemini    = "gemini"    // 原生 Gemini API（默认）
+	GeminiAPIFormatAnthropic = "anthropic" // Claude Messages API
+	GeminiAPIFormatOpenAI    = "openai"    // OpenAI Chat Completions API
+)
+
 // GeminiProvider Gemini 供应商配置
 type GeminiProvider struct {
 	ID                  string            `json:"id"`
@@ -34,8 +46,75 @@ type GeminiProvider struct {
 	PartnerPromotionKey string            `json:"partnerPromotionKey,omitempty"` // 用于识别供应商类型
 	Enabled             bool              `json:"enabled"`
 	Level               int               `json:"level,omitempty"`               // 优先级分组 (1-10, 默认 1)
+	SupportedModels     map[string]bool   `json:"supportedModels,omitempty"`     // 模型白名单（支持通配符）
+	ModelMapping        map[string]string `json:"modelMapping,omitempty"`        // 模型映射：请求模型名 -> provider 模型名
+	APIFormat           string            `json:"apiFormat,omitempty"`           // 上游协议：gemini（默认）、anthropic、openai
 	EnvConfig           map[string]string `json:"envConfig,omitempty"`           // .env 配置
 	SettingsConfig      map[string]any    `json:"settingsConfig,omitempty"`      // settings.json 配置
+
+	mappingOrder []string // ModelMapping 在配置文件中的键顺序（不持久化）
+}
+
+// geminiProviderJSON 用于自定义序列化，避免递归调用
+type geminiProviderJSON GeminiProvider
+
+// UnmarshalJSON 解析 provider 并记录 modelMapping 的声明顺序
+func (p *GeminiProvider) UnmarshalJSON(data []byte) error {
+	var raw geminiProviderJSON
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	*p = GeminiProvider(raw)
+	p.mappingOrder = jsonObjectKeys(gjson.GetBytes(data, "modelMapping"))
+	return nil
+}
+
+// MarshalJSON 序列化 provider，modelMapping 按声明顺序输出
+func (p GeminiProvider) MarshalJSON() ([]byte, error) {
+	data, err := json.Marshal(geminiProviderJSON(p))
+	if err != nil || len(p.ModelMapping) == 0 {
+		return data, err
+	}
+	mapping, err := marshalOrderedMapping(p.ModelMapping, p.mappingOrder)
+	if err != nil {
+		return nil, err
+	}
+	return sjson.SetRawBytes(data, "modelMapping", mapping)
+}
+
+// IsModelSupported 检查 provider 是否支持指定的模型（规则与 Claude/Codex provider 一致）
+func (p *GeminiProvider) IsModelSupported(modelName string) bool {
+	return isModelSupportedBy(p.SupportedModels, p.ModelMapping, modelName)
+}
+
+// GetEffectiveModel 获取实际应该使用的模型名（精确映射优先，其次通配符映射）
+func (p *GeminiProvider) GetEffectiveModel(requestedModel string) string {
+	return effectiveModelOf(p.ModelMapping, p.mappingOrder, requestedModel)
+}
+
+// ValidateConfiguration 验证 provider 的模型配置，返回验证错误列表
+func (p *GeminiProvider) ValidateConfiguration() []string {
+	return configIssueMessages(p.configIssues())
+}
+
+// configIssues 验证 provider 配置，返回带严重程度的结果
+func (p *GeminiProvider) configIssues() []configIssue {
+	issues := validateModelConfiguration(p.SupportedModels, p.ModelMapping, p.mappingOrder)
+	switch p.APIFormat {
+	case "", GeminiAPIFormatGemini, GeminiAPIFormatAnthropic, GeminiAPIFormatOpenAI:
+	default:
+		issues = append(issues, configIssue{severity: configSeverityError,
+			message: fmt.Sprintf("不支持的上游协议 '%s'（可选：gemini、anthropic、openai）", p.APIFormat)})
+	}
+	return issues
+}
+
+// UpstreamFormat 返回 provider 的上游协议（未配置时为 gemini）
+func (p *GeminiProvider) UpstreamFormat() string {
+	if p.APIFormat == "" {
+		return GeminiAPIFormatGemini
+	}
+	return p.APIFormat
 }
 
 // GeminiPreset 预设供应商
@@ -161,6 +240,10 @@ func (s *GeminiService) AddProvider(provider GeminiProvider) error {
 		provider.ID = fmt.Sprintf("gemini-%d", len(s.providers)+1)
 	}
 
+	if err := validateGeminiProvider(&provider); err != nil {
+		return err
+	}
+
 	s.providers = append(s.providers, provider)
 	return s.saveProviders()
 }
@@ -170,6 +253,10 @@ func (s *GeminiService) UpdateProvider(provider GeminiProvider) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	if err := validateGeminiProvider(&provider); err != nil {
+		return err
+	}
+
 	for i, p := range s.providers {
 		if p.ID == provider.ID {
 			s.providers[i] = provider
@@ -179,6 +266,19 @@ func (s *GeminiService) UpdateProvider(provider GeminiProvider) error {
 	return fmt.Errorf("未找到 ID 为 '%s' 的供应商", provider.ID)
 }
 
+// validateGeminiProvider 保存前验证模型白名单与映射配置
+func validateGeminiProvider(provider *GeminiProvider) error {
+	errs := blockingConfigErrors(provider.configIssues())
+	if len(errs) == 0 {
+		return nil
+	}
+	validationErrors := make([]string, 0, len(errs))
+	for _, errMsg := range errs {
+		validationErrors = append(validationErrors, fmt.Sprintf("[%s] %s", provider.Name, errMsg))
+	}
+	return fmt.Errorf("配置验证失败：\n  - %s", strings.Join(validationErrors, "\n  - "))
+}
+
 // DeleteProvider 删除供应商
 func (s *GeminiService) DeleteProvider(id string) error {
 	s.mu.Lock()
@@ -209,6 +309,11 @@ func (s *GeminiService) SwitchProvider(id string) error {
 		return fmt.Errorf("未找到 ID 为 '%s' 的供应商", id)
 	}
 
+	// 未解锁时密钥仍是引用，不能写入 ~/.gemini/.env
+	if isSecretRef(provider.APIKey) || hasSecretRef(provider.EnvConfig) {
+		return fmt.Errorf("供应商 '%s' 的密钥无法解密: %w", provider.Name, ErrSecretsLocked)
+	}
+
 	// 检测认证类型
 	authType := detectGeminiAuthType(provider)
 
@@ -588,7 +693,24 @@ func (s *GeminiService) loadProviders() error {
 		return err
 	}
 
-	return json.Unmarshal(data, &s.providers)
+	if err := json.Unmarshal(data, &s.providers); err != nil {
+		return err
+	}
+
+	// 解密 API Key 与 env；旧版本的明文配置自动迁移到密钥库
+	bindings, commit := geminiSecretBindings(s.providers)
+	plaintext, err := defaultSecretStore.openSecrets(bindings)
+	commit()
+	if err != nil {
+		log.Printf("⚠️  解密 Gemini 供应商密钥失败: %v", err)
+	} else if plaintext {
+		if err := s.saveProviders(); err != nil {
+			log.Printf("⚠️  迁移 Gemini 供应商明文密钥失败: %v", err)
+		} else {
+			log.Printf("✅ 已将 Gemini 供应商的明文密钥迁移到加密密钥库")
+		}
+	}
+	return nil
 }
 
 // saveProviders 保存供应商配置
@@ -599,18 +721,48 @@ func (s *GeminiService) saveProviders() error {
 		return err
 	}
 
-	data, err := json.MarshalIndent(s.providers, "", "  ")
+	// API Key 与 env 存入加密密钥库，文件中只保留引用
+	sealed := make([]GeminiProvider, len(s.providers))
+	for i, p := range s.providers {
+		p.EnvConfig = cloneStringMap(p.EnvConfig)
+		sealed[i] = p
+	}
+	bindings, commit := geminiSecretBindings(sealed)
+	if err := defaultSecretStore.sealSecrets("gemini", bindings); err != nil {
+		return fmt.Errorf("加密 API Key 失败: %w", err)
+	}
+	commit()
+
+	data, err := json.MarshalIndent(sealed, "", "  ")
 	if err != nil {
 		return err
 	}
 
 	tmpPath := path + ".tmp"
-	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+	if err := os.WriteFile(tmpPath, data, 0600); err != nil {
 		return err
 	}
 	return os.Rename(tmpPath, path)
 }
 
+// geminiSecretBindings Gemini 供应商的 API Key 与 env 字段，引用为 gemini/<id>/...
+func geminiSecretBindings(providers []GeminiProvider) ([]secretBinding, func()) {
+	var bindings []secretBinding
+	var commits []func()
+	for i := range providers {
+		p := &providers[i]
+		bindings = append(bindings, secretBinding{ref: secretRef("gemini", p.ID, "apiKey"), value: &p.APIKey})
+		envBindings, commit := envSecretBindings(p.EnvConfig, "gemini", p.ID)
+		bindings = append(bindings, envBindings...)
+		commits = append(commits, commit)
+	}
+	return bindings, func() {
+		for _, commit := range commits {
+			commit()
+		}
+	}
+}
+
 // CreateProviderFromPreset 从预设创建供应商
 func (s *GeminiService) CreateProviderFromPreset(presetName string, apiKey string) (*GeminiProvider, error) {
 	var preset *GeminiPreset
@@ -800,6 +952,7 @@ func (s *GeminiService) DuplicateProvider(sourceID string) (*GeminiProvider, err
 		Description:         source.Description,
 		Category:            source.Category,
 		PartnerPromotionKey: source.PartnerPromotionKey,
+		APIFormat:           source.APIFormat,
 		Enabled:             false, // 默认禁用，避免与源供应商冲突
 	}
 
@@ -811,6 +964,21 @@ func (s *GeminiService) DuplicateProvider(sourceID string) (*GeminiProvider, err
 		}
 	}
 
+	if source.SupportedModels != nil {
+		cloned.SupportedModels = make(map[string]bool, len(source.SupportedModels))
+		for k, v := range source.SupportedModels {
+			cloned.SupportedModels[k] = v
+		}
+	}
+
+	if source.ModelMapping != nil {
+		cloned.ModelMapping = make(map[string]string, len(source.ModelMapping))
+		for k, v := range source.ModelMapping {
+			cloned.ModelMapping[k] = v
+		}
+		cloned.mappingOrder = append([]string(nil), source.mappingOrder...)
+	}
+
 	if source.SettingsConfig != nil {
 		cloned.SettingsConfig = make(map[string]any, len(source.SettingsConfig))
 		for k, v := range source.SettingsConfig {
@@ -0,0 +1,899 @@
+package services
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tidwall/gjson"
+)
+
+// Gemini 协议转换
+// 当所有 Gemini provider 都不可用时，Gemini CLI 的 generateContent / streamGenerateContent 请求
+// 可以降级到 Claude（Messages）或 OpenAI（Chat Completions）格式的 provider，响应再转换回 Gemini JSON / SSE
+
+// anthropicDefaultMaxTokens Gemini 请求未指定 maxOutputTokens 时的默认值（Messages API 必填）
+const anthropicDefaultMaxTokens = 8192
+
+// errTranslatedStreamIncomplete 上游流在结束事件之前断开
+var errTranslatedStreamIncomplete = errors.New("上游流在结束事件之前断开")
+
+// isGeminiGenerateEndpoint 判断是否为可转换的生成请求
+func isGeminiGenerateEndpoint(endpoint string) bool {
+	if idx := strings.Index(endpoint, "?"); idx >= 0 {
+		endpoint = endpoint[:idx]
+	}
+	return strings.HasSuffix(endpoint, ":generateContent") || strings.HasSuffix(endpoint, ":streamGenerateContent")
+}
+
+// translatedGeminiURL 返回非 Gemini 协议 provider 的请求地址（BaseURL 已包含 /v1 时不重复拼接）
+func translatedGeminiURL(baseURL string, format string) string {
+	base := strings.TrimSuffix(baseURL, "/")
+	path := "/chat/completions"
+	if format == GeminiAPIFormatAnthropic {
+		path = "/messages"
+	}
+	if !strings.HasSuffix(base, "/v1") {
+		path = "/v1" + path
+	}
+	return base + path
+}
+
+// forwardTranslatedGeminiRequest 把 Gemini 请求转换为 Messages / Chat Completions 后转发，并将响应转换回 Gemini 格式
+// 返回 (成功, 错误信息)
+func (prs *ProviderRelayService) forwardTranslatedGeminiRequest(
+	c *gin.Context,
+	provider *GeminiProvider,
+	format string,
+	bodyBytes []byte,
+	isStream bool,
+	model string,
+	requestLog *ReqeustLog,
+) (bool, string) {
+	providerStart := time.Now()
+
+	var upstreamBody []byte
+	var err error
+	if format == GeminiAPIFormatAnthropic {
+		upstreamBody, err = geminiToAnthropicRequest(bodyBytes, model, isStream)
+	} else {
+		upstreamBody, err = geminiToOpenAIRequest(bodyBytes, model, isStream)
+	}
+	if err != nil {
+		requestLog.fail(relayErrorRequest, err.Error())
+		return false, fmt.Sprintf("转换请求失败: %v", err)
+	}
+
+	targetURL := translatedGeminiURL(provider.BaseURL, format)
+	req, err := http.NewRequestWithContext(c.Request.Context(), http.MethodPost, targetURL, bytes.NewReader(upstreamBody))
+	if err != nil {
+		requestLog.fail(relayErrorRequest, err.Error())
+		return false, fmt.Sprintf("创建请求失败: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if isStream {
+		req.Header.Set("Accept", "text/event-stream")
+	} else {
+		req.Header.Set("Accept", "application/json")
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", provider.APIKey))
+	if format == GeminiAPIFormatAnthropic {
+		req.Header.Set("x-api-key", provider.APIKey)
+		req.Header.Set("anthropic-version", "2023-06-01")
+	}
+
+	resp, err := prs.transports.Do("gemini", provider.Name, req, isStream)
+	providerDuration := time.Since(providerStart).Seconds()
+	if err != nil {
+		fmt.Printf("[Gemini]   ✗ 失败: %s (%s) | 错误: %v | 耗时: %.2fs\n", provider.Name, format, err, providerDuration)
+		requestLog.fail(geminiRequestErrorClass(c, err), err.Error())
+		return false, fmt.Sprintf("请求失败: %v", err)
+	}
+	defer resp.Body.Close()
+
+	requestLog.HttpCode = resp.StatusCode
+	requestLog.markFirstByte()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		errorBody, _ := io.ReadAll(resp.Body)
+		fmt.Printf("[Gemini]   ✗ 失败: %s (%s) | HTTP %d | 耗时: %.2fs\n", provider.Name, format, resp.StatusCode, providerDuration)
+		requestLog.fail(relayErrorUpstreamStatus, string(errorBody))
+		return false, fmt.Sprintf("HTTP %d: %s", resp.StatusCode, string(errorBody))
+	}
+
+	fmt.Printf("[Gemini]   ✓ 连接成功: %s (%s → gemini) | HTTP %d | 耗时: %.2fs\n", provider.Name, format, resp.StatusCode, providerDuration)
+
+	if !isStream {
+		body, readErr := io.ReadAll(resp.Body)
+		if readErr != nil {
+			requestLog.fail(relayErrorStream, readErr.Error())
+			return false, fmt.Sprintf("读取响应失败: %v", readErr)
+		}
+		requestLog.markFirstToken()
+		var converted []byte
+		var convertErr error
+		if format == GeminiAPIFormatAnthropic {
+			converted, convertErr = anthropicToGeminiResponse(body, model)
+		} else {
+			converted, convertErr = openAIToGeminiResponse(body, model)
+		}
+		if convertErr != nil {
+			requestLog.fail(relayErrorRequest, convertErr.Error())
+			return false, fmt.Sprintf("转换响应失败: %v", convertErr)
+		}
+		parseGeminiUsageMetadata(converted, requestLog)
+		c.Data(http.StatusOK, "application/json; charset=utf-8", converted)
+		return true, ""
+	}
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Status(http.StatusOK)
+	c.Writer.Flush()
+
+	sw := &geminiStreamWriter{writer: c.Writer, model: model, requestLog: requestLog}
+	var streamErr error
+	if format == GeminiAPIFormatAnthropic {
+		streamErr = translateAnthropicStream(resp.Body, sw)
+	} else {
+		streamErr = translateOpenAIStream(resp.Body, sw)
+	}
+	if streamErr != nil {
+		fmt.Printf("[Gemini]   ⚠️ 流式传输中断: %s | 错误: %v\n", provider.Name, streamErr)
+		requestLog.fail(relayErrorStream, streamErr.Error())
+		return false, fmt.Sprintf("流式传输中断: %v", streamErr)
+	}
+	return true, ""
+}
+
+// ==================== 请求转换 ====================
+
+// geminiToolCallIDs 为 functionCall / functionResponse 分配配对的工具调用 ID
+// Gemini 的 functionCall 可以不带 id，而 Messages / Chat Completions 要求调用与结果通过 ID 关联，
+// 未带 id 时按函数名先进先出配对
+type geminiToolCallIDs struct {
+	next    int
+	pending map[string][]string
+}
+
+func newGeminiToolCallIDs() *geminiToolCallIDs {
+	return &geminiToolCallIDs{pending: make(map[string][]string)}
+}
+
+func (ids *geminiToolCallIDs) call(fc gjson.Result) string {
+	name := fc.Get("name").String()
+	id := fc.Get("id").String()
+	if id == "" {
+		ids.next++
+		id = fmt.Sprintf("call_gemini_%d", ids.next)
+	}
+	ids.pending[name] = append(ids.pending[name], id)
+	return id
+}
+
+func (ids *geminiToolCallIDs) response(fr gjson.Result) string {
+	name := fr.Get("name").String()
+	queue := ids.pending[name]
+	if id := fr.Get("id").String(); id != "" {
+		for i, pendingID := range queue {
+			if pendingID == id {
+				ids.pending[name] = append(queue[:i], queue[i+1:]...)
+				break
+			}
+		}
+		return id
+	}
+	if len(queue) == 0 {
+		ids.next++
+		return fmt.Sprintf("call_gemini_%d", ids.next)
+	}
+	ids.pending[name] = queue[1:]
+	return queue[0]
+}
+
+// geminiSystemText 提取 systemInstruction 中的文本
+func geminiSystemText(req gjson.Result) string {
+	var texts []string
+	for _, part := range req.Get("systemInstruction.parts").Array() {
+		if text := part.Get("text").String(); text != "" {
+			texts = append(texts, text)
+		}
+	}
+	return strings.Join(texts, "\n\n")
+}
+
+// geminiFunctionResponseContent 把 functionResponse.response 转为工具结果文本
+// Gemini CLI 通常写成 {"output": "..."}，此时直接取 output
+func geminiFunctionResponseContent(fr gjson.Result) string {
+	response := fr.Get("response")
+	if output := response.Get("output"); output.Type == gjson.String {
+		return output.String()
+	}
+	if !response.Exists() {
+		return "{}"
+	}
+	return response.Raw
+}
+
+// geminiJSONObject 把 gjson 结果转为 JSON 对象（缺失或非对象时返回空对象）
+func geminiJSONObject(value gjson.Result) map[string]any {
+	if obj, ok := value.Value().(map[string]any); ok {
+		return obj
+	}
+	return map[string]any{}
+}
+
+// normalizeGeminiSchema Gemini 的 Schema 使用大写类型名（OBJECT、STRING），转换为 JSON Schema 的小写形式
+func normalizeGeminiSchema(schema any) any {
+	switch v := schema.(type) {
+	case map[string]any:
+		out := make(map[string]any, len(v))
+		for key, value := range v {
+			if key == "type" {
+				if typeName, ok := value.(string); ok {
+					out[key] = strings.ToLower(typeName)
+					continue
+				}
+			}
+			out[key] = normalizeGeminiSchema(value)
+		}
+		return out
+	case []any:
+		out := make([]any, len(v))
+		for i, value := range v {
+			out[i] = normalizeGeminiSchema(value)
+		}
+		return out
+	default:
+		return schema
+	}
+}
+
+// geminiFunctionDeclarations 展开 tools[].functionDeclarations
+func geminiFunctionDeclarations(req gjson.Result) []gjson.Result {
+	var decls []gjson.Result
+	for _, tool := range req.Get("tools").Array() {
+		decls = append(decls, tool.Get("functionDeclarations").Array()...)
+	}
+	return decls
+}
+
+// geminiDeclarationSchema 返回函数参数的 JSON Schema（优先使用 parametersJsonSchema）
+func geminiDeclarationSchema(decl gjson.Result) map[string]any {
+	var schema map[string]any
+	if s := decl.Get("parametersJsonSchema"); s.Exists() {
+		schema = geminiJSONObject(s)
+	} else if s := decl.Get("parameters"); s.Exists() {
+		schema, _ = normalizeGeminiSchema(s.Value()).(map[string]any)
+	}
+	if schema == nil {
+		schema = map[string]any{}
+	}
+	if _, ok := schema["type"]; !ok {
+		schema["type"] = "object"
+	}
+	return schema
+}
+
+// geminiToAnthropicRequest 把 generateContent 请求转换为 Messages 请求
+func geminiToAnthropicRequest(body []byte, model string, stream bool) ([]byte, error) {
+	if !gjson.ValidBytes(body) {
+		return nil, fmt.Errorf("请求体不是合法的 JSON")
+	}
+	req := gjson.ParseBytes(body)
+	ids := newGeminiToolCallIDs()
+
+	messages := make([]map[string]any, 0)
+	for _, content := range req.Get("contents").Array() {
+		role := "user"
+		if content.Get("role").String() == "model" {
+			role = "assistant"
+		}
+
+		blocks := make([]map[string]any, 0)
+		for _, part := range content.Get("parts").Array() {
+			switch {
+			case part.Get("thought").Bool():
+				// 思考内容的签名无法跨协议复用，直接丢弃
+				continue
+			case part.Get("functionCall").Exists():
+				fc := part.Get("functionCall")
+				blocks = append(blocks, map[string]any{
+					"type":  "tool_use",
+					"id":    ids.call(fc),
+					"name":  fc.Get("name").String(),
+					"input": geminiJSONObject(fc.Get("args")),
+				})
+			case part.Get("functionResponse").Exists():
+				fr := part.Get("functionResponse")
+				blocks = append(blocks, map[string]any{
+					"type":        "tool_result",
+					"tool_use_id": ids.response(fr),
+					"content":     geminiFunctionResponseContent(fr),
+				})
+			case part.Get("inlineData").Exists():
+				inline := part.Get("inlineData")
+				mimeType := inline.Get("mimeType").String()
+				blockType := "image"
+				if mimeType == "application/pdf" {
+					blockType = "document"
+				} else if !strings.HasPrefix(mimeType, "image/") {
+					continue
+				}
+				blocks = append(blocks, map[string]any{
+					"type": blockType,
+					"source": map[string]any{
+						"type":       "base64",
+						"media_type": mimeType,
+						"data":       inline.Get("data").String(),
+					},
+				})
+			case part.Get("text").Exists():
+				if text := part.Get("text").String(); text != "" {
+					blocks = append(blocks, map[string]any{"type": "text", "text": text})
+				}
+			}
+		}
+		if len(blocks) == 0 {
+			continue
+		}
+
+		// Messages API 要求 user / assistant 交替出现，连续的同角色消息合并
+		if n := len(messages); n > 0 && messages[n-1]["role"] == role {
+			messages[n-1]["content"] = append(messages[n-1]["content"].([]map[string]any), blocks...)
+			continue
+		}
+		messages = append(messages, map[string]any{"role": role, "content": blocks})
+	}
+
+	out := map[string]any{
+		"model":      model,
+		"messages":   messages,
+		"max_tokens": anthropicDefaultMaxTokens,
+		"stream":     stream,
+	}
+	if system := geminiSystemText(req); system != "" {
+		out["system"] = system
+	}
+
+	config := req.Get("generationConfig")
+	if v := config.Get("maxOutputTokens"); v.Exists() && v.Int() > 0 {
+		out["max_tokens"] = v.Int()
+	}
+	if v := config.Get("temperature"); v.Exists() {
+		out["temperature"] = v.Float()
+	}
+	if v := config.Get("topP"); v.Exists() {
+		out["top_p"] = v.Float()
+	}
+	if v := config.Get("topK"); v.Exists() {
+		out["top_k"] = v.Int()
+	}
+	if v := config.Get("stopSequences"); v.IsArray() {
+		out["stop_sequences"] = v.Value()
+	}
+
+	if decls := geminiFunctionDeclarations(req); len(decls) > 0 {
+		tools := make([]map[string]any, 0, len(decls))
+		for _, decl := range decls {
+			tools = append(tools, map[string]any{
+				"name":         decl.Get("name").String(),
+				"description":  decl.Get("description").String(),
+				"input_schema": geminiDeclarationSchema(decl),
+			})
+		}
+		out["tools"] = tools
+
+		fcConfig := req.Get("toolConfig.functionCallingConfig")
+		allowed := fcConfig.Get("allowedFunctionNames").Array()
+		switch strings.ToUpper(fcConfig.Get("mode").String()) {
+		case "ANY":
+			if len(allowed) == 1 {
+				out["tool_choice"] = map[string]any{"type": "tool", "name": allowed[0].String()}
+			} else {
+				out["tool_choice"] = map[string]any{"type": "any"}
+			}
+		case "NONE":
+			out["tool_choice"] = map[string]any{"type": "none"}
+		}
+	}
+
+	return json.Marshal(out)
+}
+
+// geminiToOpenAIRequest 把 generateContent 请求转换为 Chat Completions 请求
+func geminiToOpenAIRequest(body []byte, model string, stream bool) ([]byte, error) {
+	if !gjson.ValidBytes(body) {
+		return nil, fmt.Errorf("请求体不是合法的 JSON")
+	}
+	req := gjson.ParseBytes(body)
+	ids := newGeminiToolCallIDs()
+
+	messages := make([]map[string]any, 0)
+	if system := geminiSystemText(req); system != "" {
+		messages = append(messages, map[string]any{"role": "system", "content": system})
+	}
+
+	for _, content := range req.Get("contents").Array() {
+		var texts []string
+		var media []map[string]any
+		var toolCalls []map[string]any
+		var toolResults []map[string]any
+
+		for _, part := range content.Get("parts").Array() {
+			switch {
+			case part.Get("thought").Bool():
+				continue
+			case part.Get("functionCall").Exists():
+				fc := part.Get("functionCall")
+				args := fc.Get("args").Raw
+				if args == "" {
+					args = "{}"
+				}
+				toolCalls = append(toolCalls, map[string]any{
+					"id":   ids.call(fc),
+					"type": "function",
+					"function": map[string]any{
+						"name":      fc.Get("name").String(),
+						"arguments": args,
+					},
+				})
+			case part.Get("functionResponse").Exists():
+				fr := part.Get("functionResponse")
+				toolResults = append(toolResults, map[string]any{
+					"role":         "tool",
+					"tool_call_id": ids.response(fr),
+					"content":      geminiFunctionResponseContent(fr),
+				})
+			case part.Get("inlineData").Exists():
+				inline := part.Get("inlineData")
+				mimeType := inline.Get("mimeType").String()
+				if !strings.HasPrefix(mimeType, "image/") {
+					continue
+				}
+				media = append(media, map[string]any{
+					"type": "image_url",
+					"image_url": map[string]any{
+						"url": fmt.Sprintf("data:%s;base64,%s", mimeType, inline.Get("data").String()),
+					},
+				})
+			case part.Get("text").Exists():
+				if text := part.Get("text").String(); text != "" {
+					texts = append(texts, text)
+				}
+			}
+		}
+
+		if content.Get("role").String() == "model" {
+			if len(texts) == 0 && len(toolCalls) == 0 {
+				continue
+			}
+			msg := map[string]any{"role": "assistant", "content": nil}
+			if len(texts) > 0 {
+				msg["content"] = strings.Join(texts, "")
+			}
+			if len(toolCalls) > 0 {
+				msg["tool_calls"] = toolCalls
+			}
+			messages = append(messages, msg)
+			continue
+		}
+
+		// 工具结果必须紧跟在带 tool_calls 的 assistant 消息之后
+		messages = append(messages, toolResults...)
+		if len(media) > 0 {
+			parts := make([]map[string]any, 0, len(texts)+len(media))
+			for _, text := range texts {
+				parts = append(parts, map[string]any{"type": "text", "text": text})
+			}
+			messages = append(messages, map[string]any{"role": "user", "content": append(parts, media...)})
+		} else if len(texts) > 0 {
+			messages = append(messages, map[string]any{"role": "user", "content": strings.Join(texts, "\n")})
+		}
+	}
+
+	out := map[string]any{
+		"model":    model,
+		"messages": messages,
+		"stream":   stream,
+	}
+	if stream {
+		out["stream_options"] = map[string]any{"include_usage": true}
+	}
+
+	config := req.Get("generationConfig")
+	if v := config.Get("maxOutputTokens"); v.Exists() && v.Int() > 0 {
+		out["max_tokens"] = v.Int()
+	}
+	if v := config.Get("temperature"); v.Exists() {
+		out["temperature"] = v.Float()
+	}
+	if v := config.Get("topP"); v.Exists() {
+		out["top_p"] = v.Float()
+	}
+	if v := config.Get("stopSequences"); v.IsArray() {
+		out["stop"] = v.Value()
+	}
+
+	if decls := geminiFunctionDeclarations(req); len(decls) > 0 {
+		tools := make([]map[string]any, 0, len(decls))
+		for _, decl := range decls {
+			tools = append(tools, map[string]any{
+				"type": "function",
+				"function": map[string]any{
+					"name":        decl.Get("name").String(),
+					"description": decl.Get("description").String(),
+					"parameters":  geminiDeclarationSchema(decl),
+				},
+			})
+		}
+		out["tools"] = tools
+
+		fcConfig := req.Get("toolConfig.functionCallingConfig")
+		allowed := fcConfig.Get("allowedFunctionNames").Array()
+		switch strings.ToUpper(fcConfig.Get("mode").String()) {
+		case "ANY":
+			if len(allowed) == 1 {
+				out["tool_choice"] = map[string]any{"type": "function", "function": map[string]any{"name": allowed[0].String()}}
+			} else {
+				out["tool_choice"] = "required"
+			}
+		case "NONE":
+			out["tool_choice"] = "none"
+		}
+	}
+
+	return json.Marshal(out)
+}
+
+// ==================== 响应转换 ====================
+
+// geminiUsage 转换后的 Gemini 用量
+// promptTokenCount 包含缓存命中部分，candidatesTokenCount 不含思考 token（与原生 Gemini 一致）
+type geminiUsage struct {
+	Prompt     int64
+	Candidates int64
+	Cached     int64
+	Thoughts   int64
+}
+
+func (u geminiUsage) metadata() map[string]any {
+	meta := map[string]any{
+		"promptTokenCount":     u.Prompt,
+		"candidatesTokenCount": u.Candidates,
+		"totalTokenCount":      u.Prompt + u.Candidates + u.Thoughts,
+	}
+	if u.Cached > 0 {
+		meta["cachedContentTokenCount"] = u.Cached
+	}
+	if u.Thoughts > 0 {
+		meta["thoughtsTokenCount"] = u.Thoughts
+	}
+	return meta
+}
+
+// anthropicUsageToGemini Messages 的 input_tokens 不含缓存部分，需要加回
+func anthropicUsageToGemini(usage gjson.Result) geminiUsage {
+	cacheRead := usage.Get("cache_read_input_tokens").Int()
+	return geminiUsage{
+		Prompt:     usage.Get("input_tokens").Int() + cacheRead + usage.Get("cache_creation_input_tokens").Int(),
+		Candidates: usage.Get("output_tokens").Int(),
+		Cached:     cacheRead,
+	}
+}
+
+// openAIUsageToGemini Chat Completions 的 completion_tokens 包含推理 token，需要拆出
+func openAIUsageToGemini(usage gjson.Result) geminiUsage {
+	reasoning := usage.Get("completion_tokens_details.reasoning_tokens").Int()
+	return geminiUsage{
+		Prompt:     usage.Get("prompt_tokens").Int(),
+		Candidates: usage.Get("completion_tokens").Int() - reasoning,
+		Cached:     usage.Get("prompt_tokens_details.cached_tokens").Int(),
+		Thoughts:   reasoning,
+	}
+}
+
+func anthropicFinishReason(stopReason string) string {
+	switch stopReason {
+	case "max_tokens":
+		return "MAX_TOKENS"
+	case "refusal":
+		return "SAFETY"
+	default:
+		return "STOP"
+	}
+}
+
+func openAIFinishReason(finishReason string) string {
+	switch finishReason {
+	case "length":
+		return "MAX_TOKENS"
+	case "content_filter":
+		return "SAFETY"
+	default:
+		return "STOP"
+	}
+}
+
+// buildGeminiResponse 组装 GenerateContentResponse（finishReason 为空表示流式中间 chunk）
+func buildGeminiResponse(parts []map[string]any, finishReason string, usage *geminiUsage, model string) map[string]any {
+	if parts == nil {
+		parts = []map[string]any{}
+	}
+	candidate := map[string]any{
+		"content": map[string]any{"role": "model", "parts": parts},
+		"index":   0,
+	}
+	if finishReason != "" {
+		candidate["finishReason"] = finishReason
+	}
+	resp := map[string]any{
+		"candidates":   []map[string]any{candidate},
+		"modelVersion": model,
+	}
+	if usage != nil {
+		resp["usageMetadata"] = usage.metadata()
+	}
+	return resp
+}
+
+// anthropicToGeminiResponse 把 Messages 非流式响应转换为 GenerateContentResponse
+func anthropicToGeminiResponse(body []byte, model string) ([]byte, error) {
+	if !gjson.ValidBytes(body) {
+		return nil, fmt.Errorf("响应不是合法的 JSON")
+	}
+	resp := gjson.ParseBytes(body)
+
+	parts := make([]map[string]any, 0)
+	for _, block := range resp.Get("content").Array() {
+		switch block.Get("type").String() {
+		case "text":
+			parts = append(parts, map[string]any{"text": block.Get("text").String()})
+		case "thinking":
+			parts = append(parts, map[string]any{"text": block.Get("thinking").String(), "thought": true})
+		case "tool_use":
+			parts = append(parts, map[string]any{"functionCall": map[string]any{
+				"id":   block.Get("id").String(),
+				"name": block.Get("name").String(),
+				"args": geminiJSONObject(block.Get("input")),
+			}})
+		}
+	}
+
+	usage := anthropicUsageToGemini(resp.Get("usage"))
+	return json.Marshal(buildGeminiResponse(parts, anthropicFinishReason(resp.Get("stop_reason").String()), &usage, model))
+}
+
+// openAIToGeminiResponse 把 Chat Completions 非流式响应转换为 GenerateContentResponse
+func openAIToGeminiResponse(body []byte, model string) ([]byte, error) {
+	if !gjson.ValidBytes(body) {
+		return nil, fmt.Errorf("响应不是合法的 JSON")
+	}
+	resp := gjson.ParseBytes(body)
+	choice := resp.Get("choices.0")
+	message := choice.Get("message")
+
+	parts := make([]map[string]any, 0)
+	if reasoning := message.Get("reasoning_content").String(); reasoning != "" {
+		parts = append(parts, map[string]any{"text": reasoning, "thought": true})
+	}
+	if text := message.Get("content").String(); text != "" {
+		parts = append(parts, map[string]any{"text": text})
+	}
+	for _, call := range message.Get("tool_calls").Array() {
+		parts = append(parts, map[string]any{"functionCall": map[string]any{
+			"id":   call.Get("id").String(),
+			"name": call.Get("function.name").String(),
+			"args": geminiJSONObject(gjson.Parse(call.Get("function.arguments").String())),
+		}})
+	}
+
+	usage := openAIUsageToGemini(resp.Get("usage"))
+	return json.Marshal(buildGeminiResponse(parts, openAIFinishReason(choice.Get("finish_reason").String()), &usage, model))
+}
+
+// ==================== 流式转换 ====================
+
+// geminiStreamWriter 以 Gemini SSE 格式（data: {json}\r\n\r\n）输出转换后的 chunk
+type geminiStreamWriter struct {
+	writer     io.Writer
+	model      string
+	requestLog *ReqeustLog
+}
+
+func (sw *geminiStreamWriter) emit(parts []map[string]any, finishReason string, usage *geminiUsage) error {
+	data, err := json.Marshal(buildGeminiResponse(parts, finishReason, usage, sw.model))
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(sw.writer, "data: %s\r\n\r\n", data); err != nil {
+		return err
+	}
+	if flusher, ok := sw.writer.(http.Flusher); ok {
+		flusher.Flush()
+	}
+	if len(parts) > 0 && sw.requestLog != nil {
+		sw.requestLog.markFirstToken()
+	}
+	if usage != nil && sw.requestLog != nil {
+		mergeGeminiUsageMetadata(gjson.GetBytes(data, "usageMetadata"), sw.requestLog)
+	}
+	return nil
+}
+
+// readSSEData 逐行读取 SSE 流，对每个 data 负载调用 handle；handle 返回 true 表示流已结束
+func readSSEData(body io.Reader, handle func(data string) (bool, error)) error {
+	reader := bufio.NewReader(body)
+	for {
+		line, err := reader.ReadString('\n')
+		if trimmed := strings.TrimSpace(line); strings.HasPrefix(trimmed, "data:") {
+			data := strings.TrimSpace(strings.TrimPrefix(trimmed, "data:"))
+			if data != "" {
+				done, handleErr := handle(data)
+				if handleErr != nil {
+					return handleErr
+				}
+				if done {
+					return nil
+				}
+			}
+		}
+		if err != nil {
+			if err == io.EOF {
+				return errTranslatedStreamIncomplete
+			}
+			return err
+		}
+	}
+}
+
+// translateAnthropicStream 把 Messages SSE 流转换为 Gemini SSE 流
+func translateAnthropicStream(body io.Reader, sw *geminiStreamWriter) error {
+	type toolBlock struct {
+		id   string
+		name string
+		args strings.Builder
+	}
+	toolBlocks := make(map[int64]*toolBlock)
+	var usage geminiUsage
+	stopReason := ""
+
+	return readSSEData(body, func(data string) (bool, error) {
+		event := gjson.Parse(data)
+		switch event.Get("type").String() {
+		case "message_start":
+			usage = anthropicUsageToGemini(event.Get("message.usage"))
+		case "content_block_start":
+			block := event.Get("content_block")
+			if block.Get("type").String() == "tool_use" {
+				toolBlocks[event.Get("index").Int()] = &toolBlock{
+					id:   block.Get("id").String(),
+					name: block.Get("name").String(),
+				}
+			}
+		case "content_block_delta":
+			delta := event.Get("delta")
+			switch delta.Get("type").String() {
+			case "text_delta":
+				return false, sw.emit([]map[string]any{{"text": delta.Get("text").String()}}, "", nil)
+			case "thinking_delta":
+				return false, sw.emit([]map[string]any{{"text": delta.Get("thinking").String(), "thought": true}}, "", nil)
+			case "input_json_delta":
+				if tb, ok := toolBlocks[event.Get("index").Int()]; ok {
+					tb.args.WriteString(delta.Get("partial_json").String())
+				}
+			}
+		case "content_block_stop":
+			index := event.Get("index").Int()
+			tb, ok := toolBlocks[index]
+			if !ok {
+				return false, nil
+			}
+			delete(toolBlocks, index)
+			return false, sw.emit([]map[string]any{{"functionCall": map[string]any{
+				"id":   tb.id,
+				"name": tb.name,
+				"args": geminiJSONObject(gjson.Parse(tb.args.String())),
+			}}}, "", nil)
+		case "message_delta":
+			if reason := event.Get("delta.stop_reason").String(); reason != "" {
+				stopReason = reason
+			}
+			if v := event.Get("usage.output_tokens"); v.Exists() {
+				usage.Candidates = v.Int()
+			}
+		case "message_stop":
+			return true, sw.emit(nil, anthropicFinishReason(stopReason), &usage)
+		case "error":
+			return false, fmt.Errorf("上游返回错误事件: %s", event.Get("error.message").String())
+		}
+		return false, nil
+	})
+}
+
+// translateOpenAIStream 把 Chat Completions SSE 流转换为 Gemini SSE 流
+// 工具调用的参数分片到达，在流结束时一次性输出 functionCall
+func translateOpenAIStream(body io.Reader, sw *geminiStreamWriter) error {
+	type toolCall struct {
+		id   string
+		name string
+		args strings.Builder
+	}
+	var toolCalls []*toolCall
+	var usage geminiUsage
+	finishReason := ""
+
+	finish := func() error {
+		for _, tc := range toolCalls {
+			if tc.name == "" {
+				// 没有收到函数名的工具调用无法转换为 functionCall
+				continue
+			}
+			if err := sw.emit([]map[string]any{{"functionCall": map[string]any{
+				"id":   tc.id,
+				"name": tc.name,
+				"args": geminiJSONObject(gjson.Parse(tc.args.String())),
+			}}}, "", nil); err != nil {
+				return err
+			}
+		}
+		return sw.emit(nil, openAIFinishReason(finishReason), &usage)
+	}
+
+	err := readSSEData(body, func(data string) (bool, error) {
+		if data == "[DONE]" {
+			return true, finish()
+		}
+		chunk := gjson.Parse(data)
+		if u := chunk.Get("usage"); u.IsObject() {
+			usage = openAIUsageToGemini(u)
+		}
+		choice := chunk.Get("choices.0")
+		if !choice.Exists() {
+			return false, nil
+		}
+		if reason := choice.Get("finish_reason").String(); reason != "" {
+			finishReason = reason
+		}
+		delta := choice.Get("delta")
+		for _, call := range delta.Get("tool_calls").Array() {
+			index := int(call.Get("index").Int())
+			// index 按顺序递增，只能是已有的调用或紧接着的下一个
+			if index < 0 || index > len(toolCalls) {
+				return false, fmt.Errorf("上游返回的工具调用 index 无效: %d", index)
+			}
+			if index == len(toolCalls) {
+				toolCalls = append(toolCalls, &toolCall{})
+			}
+			tc := toolCalls[index]
+			if id := call.Get("id").String(); id != "" {
+				tc.id = id
+			}
+			if name := call.Get("function.name").String(); name != "" {
+				tc.name = name
+			}
+			tc.args.WriteString(call.Get("function.arguments").String())
+		}
+		if reasoning := delta.Get("reasoning_content").String(); reasoning != "" {
+			if err := sw.emit([]map[string]any{{"text": reasoning, "thought": true}}, "", nil); err != nil {
+				return false, err
+			}
+		}
+		if text := delta.Get("content").String(); text != "" {
+			return false, sw.emit([]map[string]any{{"text": text}}, "", nil)
+		}
+		return false, nil
+	})
+
+	// 部分兼容实现不发送 [DONE]，收到 finish_reason 后直接断开也视为正常结束
+	if errors.Is(err, errTranslatedStreamIncomplete) && finishReason != "" {
+		return finish()
+	}
+	return err
+}
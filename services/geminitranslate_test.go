@@ -0,0 +1,186 @@
+package services
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/tidwall/gjson"
+)
+
+const geminiTranslateRequest = `{
+	"systemInstruction": {"parts": [{"text": "You are a CLI agent."}]},
+	"contents": [
+		{"role": "user", "parts": [{"text": "list files"}]},
+		{"role": "model", "parts": [
+			{"text": "Sure.", "thought": true},
+			{"functionCall": {"name": "list_directory", "args": {"path": "."}}}
+		]},
+		{"role": "user", "parts": [
+			{"functionResponse": {"name": "list_directory", "response": {"output": "main.go"}}}
+		]}
+	],
+	"tools": [{"functionDeclarations": [{
+		"name": "list_directory",
+		"description": "List a directory",
+		"parameters": {"type": "OBJECT", "properties": {"path": {"type": "STRING"}}}
+	}]}],
+	"generationConfig": {"maxOutputTokens": 1024, "temperature": 0.2}
+}`
+
+func TestGeminiToAnthropicRequest(t *testing.T) {
+	out, err := geminiToAnthropicRequest([]byte(geminiTranslateRequest), "claude-sonnet-4", true)
+	if err != nil {
+		t.Fatalf("转换失败: %v", err)
+	}
+	req := gjson.ParseBytes(out)
+
+	if req.Get("model").String() != "claude-sonnet-4" || !req.Get("stream").Bool() {
+		t.Errorf("model/stream 不正确: %s", out)
+	}
+	if req.Get("system").String() != "You are a CLI agent." {
+		t.Errorf("system 不正确: %s", req.Get("system").Raw)
+	}
+	if req.Get("max_tokens").Int() != 1024 {
+		t.Errorf("max_tokens 应为 1024，实际 %d", req.Get("max_tokens").Int())
+	}
+	if req.Get("tools.0.input_schema.properties.path.type").String() != "string" {
+		t.Errorf("Schema 类型应转为小写: %s", req.Get("tools.0.input_schema").Raw)
+	}
+
+	messages := req.Get("messages").Array()
+	if len(messages) != 3 {
+		t.Fatalf("应有 3 条消息，实际 %d: %s", len(messages), req.Get("messages").Raw)
+	}
+	if messages[1].Get("content.#").Int() != 1 {
+		t.Errorf("思考内容应被丢弃: %s", messages[1].Raw)
+	}
+	callID := messages[1].Get("content.0.id").String()
+	if callID == "" || messages[2].Get("content.0.tool_use_id").String() != callID {
+		t.Errorf("tool_use 与 tool_result 的 ID 未配对: %s", req.Get("messages").Raw)
+	}
+	if messages[2].Get("content.0.content").String() != "main.go" {
+		t.Errorf("工具结果应取 output 字段: %s", messages[2].Raw)
+	}
+}
+
+func TestGeminiToOpenAIRequest(t *testing.T) {
+	out, err := geminiToOpenAIRequest([]byte(geminiTranslateRequest), "gpt-4.1", false)
+	if err != nil {
+		t.Fatalf("转换失败: %v", err)
+	}
+	req := gjson.ParseBytes(out)
+
+	messages := req.Get("messages").Array()
+	if len(messages) != 4 {
+		t.Fatalf("应有 4 条消息，实际 %d: %s", len(messages), req.Get("messages").Raw)
+	}
+	if messages[0].Get("role").String() != "system" {
+		t.Errorf("第一条应为 system 消息: %s", messages[0].Raw)
+	}
+	callID := messages[2].Get("tool_calls.0.id").String()
+	if callID == "" || messages[3].Get("role").String() != "tool" || messages[3].Get("tool_call_id").String() != callID {
+		t.Errorf("tool_calls 与 tool 消息的 ID 未配对: %s", req.Get("messages").Raw)
+	}
+	if messages[2].Get("tool_calls.0.function.arguments").String() != `{"path": "."}` {
+		t.Errorf("函数参数不正确: %s", messages[2].Raw)
+	}
+	if req.Get("tools.0.function.parameters.type").String() != "object" {
+		t.Errorf("Schema 类型应转为小写: %s", req.Get("tools").Raw)
+	}
+}
+
+func TestTranslateAnthropicStream(t *testing.T) {
+	upstream := strings.Join([]string{
+		`event: message_start`,
+		`data: {"type":"message_start","message":{"usage":{"input_tokens":10,"cache_read_input_tokens":90,"output_tokens":1}}}`,
+		``,
+		`data: {"type":"content_block_start","index":0,"content_block":{"type":"text","text":""}}`,
+		``,
+		`data: {"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"Hello"}}`,
+		``,
+		`data: {"type":"content_block_start","index":1,"content_block":{"type":"tool_use","id":"toolu_1","name":"read_file"}}`,
+		``,
+		`data: {"type":"content_block_delta","index":1,"delta":{"type":"input_json_delta","partial_json":"{\"path\":"}}`,
+		``,
+		`data: {"type":"content_block_delta","index":1,"delta":{"type":"input_json_delta","partial_json":"\"a.go\"}"}}`,
+		``,
+		`data: {"type":"content_block_stop","index":1}`,
+		``,
+		`data: {"type":"message_delta","delta":{"stop_reason":"tool_use"},"usage":{"output_tokens":25}}`,
+		``,
+		`data: {"type":"message_stop"}`,
+		``,
+	}, "\n")
+
+	var out bytes.Buffer
+	requestLog := &ReqeustLog{}
+	sw := &geminiStreamWriter{writer: &out, model: "claude-sonnet-4", requestLog: requestLog}
+	if err := translateAnthropicStream(strings.NewReader(upstream), sw); err != nil {
+		t.Fatalf("转换失败: %v", err)
+	}
+
+	var chunks []gjson.Result
+	for _, event := range strings.Split(out.String(), "\r\n\r\n") {
+		if data := strings.TrimPrefix(event, "data: "); data != "" {
+			chunks = append(chunks, gjson.Parse(data))
+		}
+	}
+	if len(chunks) != 3 {
+		t.Fatalf("应输出 3 个 chunk，实际 %d: %s", len(chunks), out.String())
+	}
+	if chunks[0].Get("candidates.0.content.parts.0.text").String() != "Hello" {
+		t.Errorf("文本 chunk 不正确: %s", chunks[0].Raw)
+	}
+	if chunks[1].Get("candidates.0.content.parts.0.functionCall.args.path").String() != "a.go" {
+		t.Errorf("functionCall chunk 不正确: %s", chunks[1].Raw)
+	}
+	last := chunks[2]
+	if last.Get("candidates.0.finishReason").String() != "STOP" {
+		t.Errorf("finishReason 不正确: %s", last.Raw)
+	}
+	if last.Get("usageMetadata.promptTokenCount").Int() != 100 || last.Get("usageMetadata.cachedContentTokenCount").Int() != 90 {
+		t.Errorf("usageMetadata 不正确: %s", last.Get("usageMetadata").Raw)
+	}
+	if requestLog.InputTokens != 100 || requestLog.OutputTokens != 25 || requestLog.CacheReadTokens != 90 {
+		t.Errorf("请求日志用量不正确: %+v", requestLog)
+	}
+}
+
+func TestTranslateOpenAIStreamIncomplete(t *testing.T) {
+	upstream := `data: {"choices":[{"index":0,"delta":{"content":"Hi"}}]}` + "\n\n"
+
+	var out bytes.Buffer
+	sw := &geminiStreamWriter{writer: &out, model: "gpt-4.1"}
+	if err := translateOpenAIStream(strings.NewReader(upstream), sw); err == nil {
+		t.Error("未收到 finish_reason 就断开的流应返回错误")
+	}
+}
+
+func TestTranslateOpenAIStreamSkipsUnnamedToolCall(t *testing.T) {
+	upstream := `data: {"choices":[{"index":0,"delta":{"tool_calls":[{"index":0,"id":"call_1","function":{"arguments":"{}"}}]}}]}` + "\n\n" +
+		`data: {"choices":[{"index":0,"delta":{"tool_calls":[{"index":1,"id":"call_2","function":{"name":"f","arguments":"{}"}}]}}]}` + "\n\n" +
+		`data: {"choices":[{"index":0,"delta":{},"finish_reason":"tool_calls"}]}` + "\n\ndata: [DONE]\n\n"
+
+	var out bytes.Buffer
+	sw := &geminiStreamWriter{writer: &out, model: "gpt-4.1"}
+	if err := translateOpenAIStream(strings.NewReader(upstream), sw); err != nil {
+		t.Fatalf("转换失败: %v", err)
+	}
+	if strings.Count(out.String(), `"functionCall"`) != 1 || !strings.Contains(out.String(), `"name":"f"`) {
+		t.Errorf("没有函数名的工具调用不应输出: %s", out.String())
+	}
+}
+
+func TestTranslateOpenAIStreamInvalidToolIndex(t *testing.T) {
+	for _, index := range []string{"-1", "1", "1000000000"} {
+		upstream := `data: {"choices":[{"index":0,"delta":{"tool_calls":[{"index":` + index + `,"id":"call_1","function":{"name":"f","arguments":"{}"}}]}}]}` + "\n\n" +
+			`data: {"choices":[{"index":0,"delta":{},"finish_reason":"tool_calls"}]}` + "\n\ndata: [DONE]\n\n"
+
+		var out bytes.Buffer
+		sw := &geminiStreamWriter{writer: &out, model: "gpt-4.1"}
+		if err := translateOpenAIStream(strings.NewReader(upstream), sw); err == nil {
+			t.Errorf("index %s 应返回转换错误", index)
+		}
+	}
+}
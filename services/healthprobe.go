@@ -0,0 +1,653 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/daodao97/xgo/xdb"
+)
+
+// healthProbeConcurrency 同时进行的探测数
+const healthProbeConcurrency = 4
+
+// healthProbeRetentionDays 探测记录保留天数
+const healthProbeRetentionDays = 7
+
+// healthProbeClientTimeout 探测请求的整体超时上限（单次探测另受配置的 TimeoutSeconds 限制）
+const healthProbeClientTimeout = 2 * time.Minute
+
+// HealthProbeConfig 健康探测配置（存储在 ~/.code-switch/health-probe.json）
+type HealthProbeConfig struct {
+	Enabled                    bool              `json:"enabled"`                    // 是否启用后台探测
+	IntervalSeconds            int               `json:"intervalSeconds"`            // 正常 provider 的探测间隔（秒）
+	BlacklistedIntervalSeconds int               `json:"blacklistedIntervalSeconds"` // 已拉黑 provider 的探测间隔（秒）
+	TimeoutSeconds             int               `json:"timeoutSeconds"`             // 单次探测超时（秒）
+	FailureThreshold           int               `json:"failureThreshold"`           // 连续探测失败多少次后主动拉黑
+	ProbeModels                map[string]string `json:"probeModels"`                // 各平台探测使用的模型（claude/codex/gemini）
+}
+
+// DefaultHealthProbeConfig 返回默认健康探测配置（默认关闭）
+func DefaultHealthProbeConfig() *HealthProbeConfig {
+	return &HealthProbeConfig{
+		Enabled:                    false,
+		IntervalSeconds:            300,
+		BlacklistedIntervalSeconds: 60,
+		TimeoutSeconds:             20,
+		FailureThreshold:           2,
+		ProbeModels: map[string]string{
+			"claude": "claude-haiku-4-5",
+			"codex":  "gpt-5-codex",
+			"gemini": "gemini-2.5-flash",
+		},
+	}
+}
+
+// HealthProbeResult 单次探测结果
+type HealthProbeResult struct {
+	ID       int64  `json:"id"`
+	Platform string `json:"platform"`
+	Provider string `json:"provider"`
+	Model    string `json:"model"`
+	Success  bool   `json:"success"`
+	// RateLimited 上游返回 429：provider 可用只是额度暂时用尽，按重置时间处理，不计入探测失败
+	RateLimited bool   `json:"rateLimited,omitempty"`
+	HttpCode    int    `json:"httpCode"`
+	LatencyMs   int64  `json:"latencyMs"`
+	Error       string `json:"error,omitempty"`
+	CreatedAt   string `json:"createdAt"`
+}
+
+// probeTarget 待探测的 provider
+type probeTarget struct {
+	platform string
+	name     string
+	model    string
+	build    func(model string) (*http.Request, error)
+}
+
+// HealthProbeService 后台健康探测
+// 定期向启用的 provider 发送最小请求（max_tokens=1），连续失败时主动拉黑，已拉黑的 provider 探测成功后提前解除拉黑。
+// 探测结果写入独立的 health_probe_log 表，不计入 request_log 的用量与费用统计。
+type HealthProbeService struct {
+	providerService  *ProviderService
+	geminiService    *GeminiService
+	blacklistService *BlacklistService
+	client           *http.Client
+	quotas           *quotaTracker // 探测收到 429 时记录重置时间（与转发共用）
+
+	mu          sync.Mutex
+	lastProbeAt map[string]time.Time
+	failures    map[string]int
+	running     atomic.Bool
+	lastCleanup time.Time
+}
+
+// NewHealthProbeService 创建健康探测服务
+func NewHealthProbeService(providerService *ProviderService, geminiService *GeminiService, blacklistService *BlacklistService) *HealthProbeService {
+	return &HealthProbeService{
+		providerService:  providerService,
+		geminiService:    geminiService,
+		blacklistService: blacklistService,
+		client:           &http.Client{Timeout: healthProbeClientTimeout},
+		lastProbeAt:      make(map[string]time.Time),
+		failures:         make(map[string]int),
+	}
+}
+
+// SetProviderRelayService 注入中转服务，探测收到的 429 与限流头计入中转的额度跟踪
+func (hs *HealthProbeService) SetProviderRelayService(relay *ProviderRelayService) {
+	hs.quotas = relay.quotas
+}
+
+// Start Wails生命周期方法
+func (hs *HealthProbeService) Start() error {
+	return nil
+}
+
+// Stop Wails生命周期方法
+func (hs *HealthProbeService) Stop() error {
+	return nil
+}
+
+// GetHealthProbeConfigPath 获取健康探测配置文件路径
+func GetHealthProbeConfigPath() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("获取用户目录失败: %w", err)
+	}
+
+	configDir := filepath.Join(home, ".code-switch")
+	if err := os.MkdirAll(configDir, 0755); err != nil {
+		return "", fmt.Errorf("创建配置目录失败: %w", err)
+	}
+
+	return filepath.Join(configDir, "health-probe.json"), nil
+}
+
+// GetConfig 获取健康探测配置（文件不存在时返回默认配置）
+func (hs *HealthProbeService) GetConfig() (*HealthProbeConfig, error) {
+	configPath, err := GetHealthProbeConfigPath()
+	if err != nil {
+		return nil, err
+	}
+
+	config := DefaultHealthProbeConfig()
+	data, err := os.ReadFile(configPath)
+	if os.IsNotExist(err) {
+		return config, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("读取配置文件失败: %w", err)
+	}
+
+	if err := json.Unmarshal(data, config); err != nil {
+		return nil, fmt.Errorf("解析配置文件失败: %w", err)
+	}
+	return config, nil
+}
+
+// UpdateConfig 更新健康探测配置
+func (hs *HealthProbeService) UpdateConfig(config *HealthProbeConfig) error {
+	if err := validateHealthProbeConfig(config); err != nil {
+		return err
+	}
+
+	configPath, err := GetHealthProbeConfigPath()
+	if err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(config, "", "  ")
+	if err != nil {
+		return fmt.Errorf("序列化配置失败: %w", err)
+	}
+
+	// 原子写入：先写临时文件，再重命名
+	tmpPath := configPath + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return fmt.Errorf("写入临时配置文件失败: %w", err)
+	}
+	if err := os.Rename(tmpPath, configPath); err != nil {
+		return fmt.Errorf("重命名配置文件失败: %w", err)
+	}
+	return nil
+}
+
+// validateHealthProbeConfig 验证健康探测配置
+func validateHealthProbeConfig(config *HealthProbeConfig) error {
+	if config.IntervalSeconds < 30 || config.IntervalSeconds > 86400 {
+		return fmt.Errorf("探测间隔必须在 30-86400 秒之间")
+	}
+	if config.BlacklistedIntervalSeconds < 15 || config.BlacklistedIntervalSeconds > config.IntervalSeconds {
+		return fmt.Errorf("已拉黑 provider 的探测间隔必须在 15 秒到正常探测间隔之间")
+	}
+	if config.TimeoutSeconds < 5 || config.TimeoutSeconds > 120 {
+		return fmt.Errorf("探测超时必须在 5-120 秒之间")
+	}
+	if config.FailureThreshold < 1 || config.FailureThreshold > 10 {
+		return fmt.Errorf("失败阈值必须在 1-10 之间")
+	}
+	return nil
+}
+
+// RunDueProbes 探测所有到期的 provider（由定时器调用）
+// 已拉黑的 provider 使用更短的探测间隔，以便尽早解除拉黑
+func (hs *HealthProbeService) RunDueProbes() {
+	config, err := hs.GetConfig()
+	if err != nil || !config.Enabled {
+		return
+	}
+	// 上一轮还没结束时跳过，避免探测堆积
+	if !hs.running.CompareAndSwap(false, true) {
+		return
+	}
+	defer hs.running.Store(false)
+
+	now := time.Now()
+	var due []probeTarget
+	for _, target := range hs.collectTargets(config) {
+		interval := time.Duration(config.IntervalSeconds) * time.Second
+		if blacklisted, _ := hs.blacklistService.IsBlacklisted(target.platform, target.name); blacklisted {
+			interval = time.Duration(config.BlacklistedIntervalSeconds) * time.Second
+		}
+		hs.mu.Lock()
+		last := hs.lastProbeAt[target.platform+"/"+target.name]
+		hs.mu.Unlock()
+		if now.Sub(last) >= interval {
+			due = append(due, target)
+		}
+	}
+
+	sem := make(chan struct{}, healthProbeConcurrency)
+	var wg sync.WaitGroup
+	for _, target := range due {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(t probeTarget) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			result := hs.probe(t, config)
+			hs.applyResult(result, config)
+		}(target)
+	}
+	wg.Wait()
+
+	hs.cleanupOldResults()
+}
+
+// ProbeNow 立即探测指定 provider（不影响黑名单，用于前端手动检查）
+func (hs *HealthProbeService) ProbeNow(platform string, providerName string) (*HealthProbeResult, error) {
+	config, err := hs.GetConfig()
+	if err != nil {
+		return nil, err
+	}
+	for _, target := range hs.collectTargets(config) {
+		if target.platform == platform && target.name == providerName {
+			result := hs.probe(target, config)
+			return &result, nil
+		}
+	}
+	return nil, fmt.Errorf("未找到已启用的 provider %s/%s", platform, providerName)
+}
+
+// VerifyRecovery 黑名单到期恢复前的健康检查（注入 BlacklistService）
+// 探测关闭或找不到 provider 时视为可恢复；只是被限流（429）时同样恢复，由额度跟踪按重置时间排到最后
+func (hs *HealthProbeService) VerifyRecovery(platform string, providerName string) bool {
+	config, err := hs.GetConfig()
+	if err != nil || !config.Enabled {
+		return true
+	}
+	for _, target := range hs.collectTargets(config) {
+		if target.platform == platform && target.name == providerName {
+			result := hs.probe(target, config)
+			if result.RateLimited {
+				log.Printf("🩺 Provider %s/%s 拉黑到期，探测被上游限流，按重置时间处理", platform, providerName)
+				return true
+			}
+			if !result.Success {
+				log.Printf("🩺 Provider %s/%s 拉黑到期但探测仍失败: %s", platform, providerName, result.Error)
+			}
+			return result.Success
+		}
+	}
+	return true
+}
+
+// GetProbeHistory 获取探测记录（platform、provider 为空时不过滤）
+func (hs *HealthProbeService) GetProbeHistory(platform string, provider string, limit int) ([]HealthProbeResult, error) {
+	if limit <= 0 || limit > 1000 {
+		limit = 100
+	}
+	model := xdb.New("health_probe_log")
+	options := []xdb.Option{
+		xdb.OrderByDesc("id"),
+		xdb.Limit(limit),
+	}
+	if platform != "" {
+		options = append(options, xdb.WhereEq("platform", platform))
+	}
+	if provider != "" {
+		options = append(options, xdb.WhereEq("provider", provider))
+	}
+	records, err := model.Selects(options...)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]HealthProbeResult, 0, len(records))
+	for _, record := range records {
+		results = append(results, HealthProbeResult{
+			ID:        record.GetInt64("id"),
+			Platform:  record.GetString("platform"),
+			Provider:  record.GetString("provider"),
+			Model:     record.GetString("model"),
+			Success:   record.GetInt("success") == 1,
+			HttpCode:  record.GetInt("http_code"),
+			LatencyMs: record.GetInt64("latency_ms"),
+			Error:     record.GetString("error"),
+			CreatedAt: record.GetString("created_at"),
+		})
+	}
+	return results, nil
+}
+
+// applyResult 根据探测结果更新黑名单
+// 探测成功只负责提前解除拉黑，不清零真实流量的失败计数（小请求成功不代表大请求一定成功）
+// 被限流（429）既不算成功也不算失败：重置时间已在探测时记录
+func (hs *HealthProbeService) applyResult(result HealthProbeResult, config *HealthProbeConfig) {
+	if result.RateLimited {
+		return
+	}
+	key := result.Platform + "/" + result.Provider
+	blacklisted, _ := hs.blacklistService.IsBlacklisted(result.Platform, result.Provider)
+
+	hs.mu.Lock()
+	if result.Success {
+		hs.failures[key] = 0
+	} else {
+		hs.failures[key]++
+	}
+	failures := hs.failures[key]
+	hs.mu.Unlock()
+
+	if result.Success {
+		if blacklisted {
+			if err := hs.blacklistService.ProbeRecover(result.Platform, result.Provider); err != nil {
+				log.Printf("⚠️  %v", err)
+			}
+		}
+		return
+	}
+
+	if !blacklisted && failures >= config.FailureThreshold {
+		if err := hs.blacklistService.ProbeBlacklist(result.Platform, result.Provider); err != nil {
+			log.Printf("⚠️  %v", err)
+			return
+		}
+		hs.mu.Lock()
+		hs.failures[key] = 0
+		hs.mu.Unlock()
+	}
+}
+
+// probe 发送探测请求并记录结果
+func (hs *HealthProbeService) probe(target probeTarget, config *HealthProbeConfig) HealthProbeResult {
+	result := HealthProbeResult{
+		Platform: target.platform,
+		Provider: target.name,
+		Model:    target.model,
+	}
+
+	hs.mu.Lock()
+	hs.lastProbeAt[target.platform+"/"+target.name] = time.Now()
+	hs.mu.Unlock()
+
+	req, err := target.build(target.model)
+	if err != nil {
+		result.Error = fmt.Sprintf("创建请求失败: %v", err)
+		hs.saveResult(result)
+		return result
+	}
+
+	timeout := time.Duration(config.TimeoutSeconds) * time.Second
+	if timeout <= 0 {
+		timeout = time.Duration(DefaultHealthProbeConfig().TimeoutSeconds) * time.Second
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	req = req.WithContext(ctx)
+
+	start := time.Now()
+	resp, err := hs.client.Do(req)
+	result.LatencyMs = time.Since(start).Milliseconds()
+	if err != nil {
+		result.Error = err.Error()
+		hs.saveResult(result)
+		return result
+	}
+	defer resp.Body.Close()
+
+	result.HttpCode = resp.StatusCode
+	hs.quotas.observe(target.platform, target.name, resp.Header, resp.StatusCode)
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	switch {
+	case resp.StatusCode == http.StatusTooManyRequests:
+		result.RateLimited = true
+		result.Error = fmt.Sprintf("HTTP %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		// 中转站常以 200 返回 HTML 错误页，不能算探测成功
+		if _, isHTML := sniffHTML(io.NopCloser(bytes.NewReader(body))); isHTML {
+			result.Error = fmt.Sprintf("HTTP %d 但响应为 HTML 页面: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+		} else {
+			result.Success = true
+		}
+	default:
+		result.Error = fmt.Sprintf("HTTP %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+
+	hs.saveResult(result)
+	return result
+}
+
+// saveResult 写入 health_probe_log（独立于 request_log，不参与费用统计）
+func (hs *HealthProbeService) saveResult(result HealthProbeResult) {
+	if GlobalDBQueueLogs == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err := GlobalDBQueueLogs.ExecBatchCtx(ctx, `
+		INSERT INTO health_probe_log (platform, provider, model, success, http_code, latency_ms, error)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+	`, result.Platform, result.Provider, result.Model, boolToInt(result.Success), result.HttpCode, result.LatencyMs, result.Error)
+	if err != nil {
+		fmt.Printf("⚠️  写入 health_probe_log 失败: %v\n", err)
+	}
+}
+
+// cleanupOldResults 每天清理一次过期的探测记录
+func (hs *HealthProbeService) cleanupOldResults() {
+	hs.mu.Lock()
+	if time.Since(hs.lastCleanup) < 24*time.Hour {
+		hs.mu.Unlock()
+		return
+	}
+	hs.lastCleanup = time.Now()
+	hs.mu.Unlock()
+
+	if GlobalDBQueue == nil {
+		return
+	}
+	cutoff := time.Now().UTC().AddDate(0, 0, -healthProbeRetentionDays).Format("2006-01-02 15:04:05") // created_at 为 UTC
+	if err := GlobalDBQueue.Exec(`DELETE FROM health_probe_log WHERE created_at < ?`, cutoff); err != nil {
+		log.Printf("⚠️  清理探测记录失败: %v", err)
+	}
+}
+
+// collectTargets 收集所有启用的 provider 及其探测请求
+func (hs *HealthProbeService) collectTargets(config *HealthProbeConfig) []probeTarget {
+	var targets []probeTarget
+
+	for _, kind := range []string{"claude", "codex"} {
+		providers, err := hs.providerService.LoadProviders(kind)
+		if err != nil {
+			continue
+		}
+		for _, p := range providers {
+			if !p.Enabled || p.APIURL == "" {
+				continue
+			}
+			model := probeModelFor(config.ProbeModels[kind], p.SupportedModels, p.IsModelSupported, p.GetEffectiveModel)
+			if model == "" {
+				continue
+			}
+			provider := p
+			platform := kind
+			targets = append(targets, probeTarget{
+				platform: platform,
+				name:     provider.Name,
+				model:    model,
+				build: func(model string) (*http.Request, error) {
+					return buildProviderProbeRequest(platform, &provider, model)
+				},
+			})
+		}
+	}
+
+	if hs.geminiService != nil {
+		for _, p := range hs.geminiService.GetProviders() {
+			if !p.Enabled || p.BaseURL == "" {
+				continue
+			}
+			model := probeModelFor(config.ProbeModels["gemini"], p.SupportedModels, p.IsModelSupported, p.GetEffectiveModel)
+			if p.UpstreamFormat() != GeminiAPIFormatGemini && model == config.ProbeModels["gemini"] && p.Model != "" {
+				// 非 Gemini 协议的 provider 不认识 Gemini 模型名，未配置映射时使用默认模型
+				model = p.Model
+			}
+			if model == "" {
+				continue
+			}
+			provider := p
+			targets = append(targets, probeTarget{
+				platform: "gemini",
+				name:     provider.Name,
+				model:    model,
+				build: func(model string) (*http.Request, error) {
+					return buildGeminiProbeRequest(&provider, model)
+				},
+			})
+		}
+	}
+
+	return targets
+}
+
+// probeModelFor 选择探测模型：配置的探测模型（经过映射）优先，provider 不支持时退回白名单中的第一个模型
+func probeModelFor(probeModel string, supportedModels map[string]bool, isSupported func(string) bool, effective func(string) string) string {
+	if probeModel != "" && isSupported(probeModel) {
+		return effective(probeModel)
+	}
+	var candidates []string
+	for model := range supportedModels {
+		if !strings.Contains(model, "*") {
+			candidates = append(candidates, model)
+		}
+	}
+	if len(candidates) == 0 {
+		return ""
+	}
+	sort.Strings(candidates)
+	return candidates[0]
+}
+
+// buildProviderProbeRequest 构造 Claude / Codex provider 的最小请求
+func buildProviderProbeRequest(kind string, provider *Provider, model string) (*http.Request, error) {
+	return buildProviderCompletionRequest(kind, provider, model, 1, false)
+}
+
+// buildProviderCompletionRequest 构造 Claude（Messages）/ Codex（Responses）provider 的简单补全请求
+func buildProviderCompletionRequest(kind string, provider *Provider, model string, maxTokens int, stream bool) (*http.Request, error) {
+	var endpoint string
+	var body map[string]any
+	if kind == "codex" {
+		// Responses API 的 max_output_tokens 最小为 16
+		endpoint = "/responses"
+		body = map[string]any{"model": model, "input": "ping", "max_output_tokens": max(maxTokens, 16)}
+	} else {
+		endpoint = "/v1/messages"
+		body = map[string]any{
+			"model":      model,
+			"max_tokens": maxTokens,
+			"messages":   []map[string]any{{"role": "user", "content": "ping"}},
+		}
+	}
+	if stream {
+		body["stream"] = true
+	}
+
+	data, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, joinURL(provider.APIURL, endpoint), bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", provider.APIKey))
+	if kind == "claude" {
+		req.Header.Set("x-api-key", provider.APIKey)
+		req.Header.Set("anthropic-version", "2023-06-01")
+	}
+	return req, nil
+}
+
+// buildGeminiProbeRequest 构造 Gemini provider 的最小请求（非 Gemini 协议的 provider 复用协议转换）
+func buildGeminiProbeRequest(provider *GeminiProvider, model string) (*http.Request, error) {
+	return buildGeminiCompletionRequest(provider, model, 1, false)
+}
+
+// buildGeminiCompletionRequest 构造 Gemini provider 的简单补全请求（按 provider 的上游协议转换）
+func buildGeminiCompletionRequest(provider *GeminiProvider, model string, maxTokens int, stream bool) (*http.Request, error) {
+	geminiBody := []byte(fmt.Sprintf(`{"contents":[{"role":"user","parts":[{"text":"ping"}]}],"generationConfig":{"maxOutputTokens":%d}}`, maxTokens))
+
+	format := provider.UpstreamFormat()
+	var targetURL string
+	var body []byte
+	var err error
+	switch format {
+	case GeminiAPIFormatAnthropic:
+		targetURL = translatedGeminiURL(provider.BaseURL, format)
+		body, err = geminiToAnthropicRequest(geminiBody, model, stream)
+	case GeminiAPIFormatOpenAI:
+		targetURL = translatedGeminiURL(provider.BaseURL, format)
+		body, err = geminiToOpenAIRequest(geminiBody, model, stream)
+	default:
+		action := ":generateContent"
+		if stream {
+			action = ":streamGenerateContent?alt=sse"
+		}
+		targetURL = strings.TrimSuffix(provider.BaseURL, "/") + "/v1beta/models/" + model + action
+		body = geminiBody
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, targetURL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	switch format {
+	case GeminiAPIFormatAnthropic:
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", provider.APIKey))
+		req.Header.Set("x-api-key", provider.APIKey)
+		req.Header.Set("anthropic-version", "2023-06-01")
+	case GeminiAPIFormatOpenAI:
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", provider.APIKey))
+	default:
+		if provider.APIKey != "" {
+			req.Header.Set("x-goog-api-key", provider.APIKey)
+		}
+	}
+	return req, nil
+}
+
+// ensureHealthProbeTable 确保 health_probe_log 表存在
+func ensureHealthProbeTable() error {
+	db, err := xdb.DB("default")
+	if err != nil {
+		return fmt.Errorf("获取数据库连接失败: %w", err)
+	}
+
+	const createSQL = `CREATE TABLE IF NOT EXISTS health_probe_log (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		platform TEXT,
+		provider TEXT,
+		model TEXT,
+		success INTEGER DEFAULT 0,
+		http_code INTEGER DEFAULT 0,
+		latency_ms INTEGER DEFAULT 0,
+		error TEXT,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	)`
+	if _, err := db.Exec(createSQL); err != nil {
+		return fmt.Errorf("创建 health_probe_log 表失败: %w", err)
+	}
+	if _, err := db.Exec(`CREATE INDEX IF NOT EXISTS idx_health_probe_log_provider ON health_probe_log(platform, provider, id)`); err != nil {
+		return fmt.Errorf("创建 health_probe_log 索引失败: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package services
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHealthProbeOutcomes(t *testing.T) {
+	var status int
+	var body string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if status == http.StatusTooManyRequests {
+			w.Header().Set("Retry-After", "30")
+		}
+		w.WriteHeader(status)
+		_, _ = w.Write([]byte(body))
+	}))
+	defer upstream.Close()
+
+	now := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	prs := newTestRelay(t)
+	prs.quotas = &quotaTracker{states: make(map[string]*providerQuotaState), now: func() time.Time { return now }}
+	hs := NewHealthProbeService(prs.providerService, nil, prs.blacklistService)
+	hs.SetProviderRelayService(prs)
+
+	provider := &Provider{Name: "relay-a", APIURL: upstream.URL, APIKey: "sk"}
+	target := probeTarget{
+		platform: "claude",
+		name:     provider.Name,
+		model:    "claude-haiku-4-5",
+		build: func(model string) (*http.Request, error) {
+			return buildProviderProbeRequest("claude", provider, model)
+		},
+	}
+	config := DefaultHealthProbeConfig()
+
+	status, body = http.StatusOK, `{"type":"message","content":[]}`
+	if result := hs.probe(target, config); !result.Success || result.RateLimited {
+		t.Errorf("JSON 200 应为探测成功: %+v", result)
+	}
+
+	status, body = http.StatusOK, "\n<html><body>502 Bad Gateway</body></html>"
+	if result := hs.probe(target, config); result.Success || result.RateLimited {
+		t.Errorf("200 的 HTML 错误页不应算探测成功: %+v", result)
+	}
+
+	// 429：单独的结论，记录重置时间，不计入探测失败
+	status, body = http.StatusTooManyRequests, `{"type":"error","error":{"type":"rate_limit_error"}}`
+	result := hs.probe(target, config)
+	if result.Success || !result.RateLimited {
+		t.Fatalf("429 应判定为限流: %+v", result)
+	}
+	if until, ok := prs.quotas.rateLimitedUntil("claude", provider.Name); !ok || !until.Equal(now.Add(30*time.Second)) {
+		t.Errorf("探测收到的 429 应按 Retry-After 记录重置时间: %v %v", until, ok)
+	}
+	for i := 0; i < config.FailureThreshold; i++ {
+		hs.applyResult(result, config)
+	}
+	if failures := hs.failures["claude/"+provider.Name]; failures != 0 {
+		t.Errorf("限流不应计入连续探测失败，得到 %d", failures)
+	}
+}
@@ -3,6 +3,7 @@ package services
 import (
 	"errors"
 	"log"
+	"math"
 	"sort"
 	"strings"
 	"time"
@@ -50,27 +51,77 @@ func (ls *LogService) ListRequestLogs(platform string, provider string, limit in
 	}
 	logs := make([]ReqeustLog, 0, len(records))
 	for _, record := range records {
-		logEntry := ReqeustLog{
-			ID:                record.GetInt64("id"),
-			Platform:          record.GetString("platform"),
-			Model:             record.GetString("model"),
-			Provider:          record.GetString("provider"),
-			HttpCode:          record.GetInt("http_code"),
-			InputTokens:       record.GetInt("input_tokens"),
-			OutputTokens:      record.GetInt("output_tokens"),
-			CacheCreateTokens: record.GetInt("cache_create_tokens"),
-			CacheReadTokens:   record.GetInt("cache_read_tokens"),
-			ReasoningTokens:   record.GetInt("reasoning_tokens"),
-			CreatedAt:         record.GetString("created_at"),
-			IsStream:          record.GetBool("is_stream"),
-			DurationSec:       record.GetFloat64("duration_sec"),
-		}
+		logEntry := requestLogFromRecord(record)
 		ls.decorateCost(&logEntry)
 		logs = append(logs, logEntry)
 	}
 	return logs, nil
 }
 
+// GetRequestTrace 返回同一客户端请求的全部尝试（按尝试顺序），还原完整的降级过程
+func (ls *LogService) GetRequestTrace(requestID string) (RequestTrace, error) {
+	requestID = strings.TrimSpace(requestID)
+	trace := RequestTrace{RequestID: requestID, Attempts: []ReqeustLog{}}
+	if requestID == "" {
+		return trace, errors.New("request id 不能为空")
+	}
+	records, err := xdb.New("request_log").Selects(
+		xdb.WhereEq("request_id", requestID),
+		xdb.OrderByAsc("attempt"),
+		xdb.OrderByAsc("id"),
+	)
+	if err != nil {
+		if errors.Is(err, xdb.ErrNotFound) || isNoSuchTableErr(err) {
+			return trace, nil
+		}
+		return trace, err
+	}
+	for _, record := range records {
+		logEntry := requestLogFromRecord(record)
+		ls.decorateCost(&logEntry)
+		trace.Attempts = append(trace.Attempts, logEntry)
+		trace.Platform = logEntry.Platform
+		trace.TotalDurationSec += logEntry.DurationSec
+		trace.TotalCost += logEntry.TotalCost
+		if logEntry.HttpCode >= 200 && logEntry.HttpCode < 300 && logEntry.ErrorClass == "" {
+			trace.Succeeded = true
+			trace.FinalProvider = logEntry.Provider
+		}
+	}
+	return trace, nil
+}
+
+func requestLogFromRecord(record xdb.Record) ReqeustLog {
+	return ReqeustLog{
+		ID:                record.GetInt64("id"),
+		Platform:          record.GetString("platform"),
+		Model:             record.GetString("model"),
+		Provider:          record.GetString("provider"),
+		HttpCode:          record.GetInt("http_code"),
+		InputTokens:       record.GetInt("input_tokens"),
+		OutputTokens:      record.GetInt("output_tokens"),
+		CacheCreateTokens: record.GetInt("cache_create_tokens"),
+		CacheReadTokens:   record.GetInt("cache_read_tokens"),
+		ReasoningTokens:   record.GetInt("reasoning_tokens"),
+		CreatedAt:         record.GetString("created_at"),
+		IsStream:          record.GetBool("is_stream"),
+		DurationSec:       record.GetFloat64("duration_sec"),
+		AffinityHit:       record.GetBool("affinity_hit"),
+		TTFBSec:           record.GetFloat64("ttfb_sec"),
+		TTFTSec:           record.GetFloat64("ttft_sec"),
+		StreamDurationSec: record.GetFloat64("stream_duration_sec"),
+		TokensPerSec:      record.GetFloat64("tokens_per_sec"),
+		RequestID:         record.GetString("request_id"),
+		Attempt:           record.GetInt("attempt"),
+		Level:             record.GetInt("level"),
+		ErrorClass:        record.GetString("error_class"),
+		ErrorMessage:      record.GetString("error_message"),
+		BlacklistCounted:  record.GetBool("blacklist_counted"),
+		ResumeCount:       record.GetInt("resume_count"),
+		FallbackFrom:      record.GetString("fallback_from"),
+	}
+}
+
 func (ls *LogService) ListProviders(platform string) ([]string, error) {
 	model := xdb.New("request_log")
 	options := []xdb.Option{
@@ -298,6 +349,327 @@ func (ls *LogService) StatsSince(platform string) (LogStats, error) {
 	return stats, nil
 }
 
+// AffinityStats 对比会话亲和命中与未命中请求的缓存读取情况（最近 days 天）
+func (ls *LogService) AffinityStats(platform string, days int) ([]AffinityStat, error) {
+	if days <= 0 {
+		days = 7
+	}
+	model := xdb.New("request_log")
+	options := []xdb.Option{
+		xdb.WhereGte("created_at", startOfDay(time.Now()).AddDate(0, 0, -(days-1)).Format(timeLayout)),
+		xdb.WhereGe("http_code", 200),
+		xdb.WhereLt("http_code", 300),
+		xdb.WhereEq("error_class", ""),
+		xdb.Field(
+			"affinity_hit",
+			"input_tokens",
+			"cache_create_tokens",
+			"cache_read_tokens",
+		),
+	}
+	if platform != "" {
+		options = append(options, xdb.WhereEq("platform", platform))
+	}
+	records, err := model.Selects(options...)
+	if err != nil {
+		if errors.Is(err, xdb.ErrNotFound) || isNoSuchTableErr(err) {
+			return []AffinityStat{}, nil
+		}
+		return nil, err
+	}
+
+	stats := []AffinityStat{{AffinityHit: true}, {AffinityHit: false}}
+	for _, record := range records {
+		stat := &stats[1]
+		if record.GetBool("affinity_hit") {
+			stat = &stats[0]
+		}
+		stat.TotalRequests++
+		stat.InputTokens += int64(record.GetInt("input_tokens"))
+		stat.CacheCreateTokens += int64(record.GetInt("cache_create_tokens"))
+		stat.CacheReadTokens += int64(record.GetInt("cache_read_tokens"))
+	}
+	for i := range stats {
+		// 缓存读取占全部输入（含缓存写入与读取）的比例
+		if total := stats[i].InputTokens + stats[i].CacheCreateTokens + stats[i].CacheReadTokens; total > 0 {
+			stats[i].CacheReadRatio = float64(stats[i].CacheReadTokens) / float64(total)
+		}
+	}
+	return stats, nil
+}
+
+// ProviderLatencyStats 按 provider 统计最近 days 天成功请求的 TTFT 与输出吞吐分位数
+// 未记录耗时指标的历史数据（ttft_sec 为 0）不参与统计
+func (ls *LogService) ProviderLatencyStats(platform string, days int) ([]ProviderLatencyStat, error) {
+	if days <= 0 {
+		days = 7
+	}
+	model := xdb.New("request_log")
+	options := []xdb.Option{
+		xdb.WhereGte("created_at", startOfDay(time.Now()).AddDate(0, 0, -(days-1)).Format(timeLayout)),
+		xdb.WhereGe("http_code", 200),
+		xdb.WhereLt("http_code", 300),
+		xdb.WhereEq("error_class", ""),
+		xdb.WhereGt("ttft_sec", 0),
+		xdb.Field(
+			"provider",
+			"ttfb_sec",
+			"ttft_sec",
+			"tokens_per_sec",
+		),
+	}
+	if platform != "" {
+		options = append(options, xdb.WhereEq("platform", platform))
+	}
+	records, err := model.Selects(options...)
+	if err != nil {
+		if errors.Is(err, xdb.ErrNotFound) || isNoSuchTableErr(err) {
+			return []ProviderLatencyStat{}, nil
+		}
+		return nil, err
+	}
+
+	type samples struct {
+		ttfb, ttft, throughput []float64
+	}
+	byProvider := make(map[string]*samples)
+	for _, record := range records {
+		provider := strings.TrimSpace(record.GetString("provider"))
+		if provider == "" {
+			provider = "(unknown)"
+		}
+		s := byProvider[provider]
+		if s == nil {
+			s = &samples{}
+			byProvider[provider] = s
+		}
+		s.ttfb = append(s.ttfb, record.GetFloat64("ttfb_sec"))
+		s.ttft = append(s.ttft, record.GetFloat64("ttft_sec"))
+		if tps := record.GetFloat64("tokens_per_sec"); tps > 0 {
+			s.throughput = append(s.throughput, tps)
+		}
+	}
+
+	stats := make([]ProviderLatencyStat, 0, len(byProvider))
+	for provider, s := range byProvider {
+		stats = append(stats, ProviderLatencyStat{
+			Provider:        provider,
+			Samples:         int64(len(s.ttft)),
+			TTFBP50:         percentile(s.ttfb, 0.50),
+			TTFTP50:         percentile(s.ttft, 0.50),
+			TTFTP95:         percentile(s.ttft, 0.95),
+			TokensPerSecP50: percentile(s.throughput, 0.50),
+			TokensPerSecP95: percentile(s.throughput, 0.95),
+		})
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].TTFTP50 == stats[j].TTFTP50 {
+			return stats[i].Provider < stats[j].Provider
+		}
+		return stats[i].TTFTP50 < stats[j].TTFTP50
+	})
+	return stats, nil
+}
+
+// ListShadowLogs 获取影子请求记录（platform、shadowProvider 为空时不过滤）
+func (ls *LogService) ListShadowLogs(platform string, shadowProvider string, limit int) ([]ShadowLog, error) {
+	if limit <= 0 || limit > 1000 {
+		limit = 100
+	}
+	options := []xdb.Option{
+		xdb.OrderByDesc("id"),
+		xdb.Limit(limit),
+	}
+	if platform != "" {
+		options = append(options, xdb.WhereEq("platform", platform))
+	}
+	if shadowProvider != "" {
+		options = append(options, xdb.WhereEq("shadow_provider", shadowProvider))
+	}
+	records, err := xdb.New("shadow_log").Selects(options...)
+	if err != nil {
+		if errors.Is(err, xdb.ErrNotFound) || isNoSuchTableErr(err) {
+			return []ShadowLog{}, nil
+		}
+		return nil, err
+	}
+	logs := make([]ShadowLog, 0, len(records))
+	for _, record := range records {
+		logs = append(logs, shadowLogFromRecord(record))
+	}
+	return logs, nil
+}
+
+func shadowLogFromRecord(record xdb.Record) ShadowLog {
+	return ShadowLog{
+		ID:                      record.GetInt64("id"),
+		RequestID:               record.GetString("request_id"),
+		Platform:                record.GetString("platform"),
+		Model:                   record.GetString("model"),
+		PrimaryProvider:         record.GetString("primary_provider"),
+		ShadowProvider:          record.GetString("shadow_provider"),
+		ShadowModel:             record.GetString("shadow_model"),
+		PrimaryHttpCode:         record.GetInt("primary_http_code"),
+		ShadowHttpCode:          record.GetInt("shadow_http_code"),
+		PrimaryDurationSec:      record.GetFloat64("primary_duration_sec"),
+		ShadowDurationSec:       record.GetFloat64("shadow_duration_sec"),
+		PrimaryTTFTSec:          record.GetFloat64("primary_ttft_sec"),
+		ShadowTTFTSec:           record.GetFloat64("shadow_ttft_sec"),
+		PrimaryOutputTokens:     record.GetInt("primary_output_tokens"),
+		ShadowInputTokens:       record.GetInt("shadow_input_tokens"),
+		ShadowOutputTokens:      record.GetInt("shadow_output_tokens"),
+		ShadowCacheCreateTokens: record.GetInt("shadow_cache_create_tokens"),
+		ShadowCacheReadTokens:   record.GetInt("shadow_cache_read_tokens"),
+		ErrorClass:              record.GetString("error_class"),
+		ErrorMessage:            record.GetString("error_message"),
+		Similarity:              record.GetFloat64("similarity"),
+		Diff:                    record.GetString("diff"),
+		CreatedAt:               record.GetString("created_at"),
+	}
+}
+
+// ShadowComparison 汇总最近 days 天各候选 provider 的影子请求，与对应主 provider 对比错误率和延迟
+// 主 provider 的错误率取同一时间段 request_log 中这些 provider 的全部尝试
+func (ls *LogService) ShadowComparison(platform string, days int) ([]ShadowComparisonStat, error) {
+	if days <= 0 {
+		days = 7
+	}
+	since := startOfDay(time.Now()).AddDate(0, 0, -(days - 1)).Format(timeLayout)
+	options := []xdb.Option{xdb.WhereGte("created_at", since)}
+	if platform != "" {
+		options = append(options, xdb.WhereEq("platform", platform))
+	}
+	records, err := xdb.New("shadow_log").Selects(options...)
+	if err != nil {
+		if errors.Is(err, xdb.ErrNotFound) || isNoSuchTableErr(err) {
+			return []ShadowComparisonStat{}, nil
+		}
+		return nil, err
+	}
+
+	type samples struct {
+		stat                                    *ShadowComparisonStat
+		primaries                               map[string]bool
+		primaryTTFT, shadowTTFT                 []float64
+		primaryDuration, shadowDuration         []float64
+		similarity                              float64
+		primaryOutputTokens, shadowOutputTokens int64
+	}
+	byProvider := make(map[string]*samples)
+	for _, record := range records {
+		entry := shadowLogFromRecord(record)
+		s := byProvider[entry.ShadowProvider]
+		if s == nil {
+			s = &samples{stat: &ShadowComparisonStat{ShadowProvider: entry.ShadowProvider}, primaries: map[string]bool{}}
+			byProvider[entry.ShadowProvider] = s
+		}
+		s.stat.Samples++
+		s.primaries[entry.PrimaryProvider] = true
+		usage := modelpricing.UsageSnapshot{
+			InputTokens:       entry.ShadowInputTokens,
+			OutputTokens:      entry.ShadowOutputTokens,
+			CacheCreateTokens: entry.ShadowCacheCreateTokens,
+			CacheReadTokens:   entry.ShadowCacheReadTokens,
+		}
+		s.stat.ShadowCost += ls.calculateCost(entry.ShadowModel, usage).TotalCost
+		if entry.ErrorClass != "" {
+			s.stat.ShadowErrors++
+			continue
+		}
+		// 延迟与内容只比较影子请求成功的样本
+		s.primaryDuration = append(s.primaryDuration, entry.PrimaryDurationSec)
+		s.shadowDuration = append(s.shadowDuration, entry.ShadowDurationSec)
+		if entry.PrimaryTTFTSec > 0 && entry.ShadowTTFTSec > 0 {
+			s.primaryTTFT = append(s.primaryTTFT, entry.PrimaryTTFTSec)
+			s.shadowTTFT = append(s.shadowTTFT, entry.ShadowTTFTSec)
+		}
+		s.similarity += entry.Similarity
+		s.primaryOutputTokens += int64(entry.PrimaryOutputTokens)
+		s.shadowOutputTokens += int64(entry.ShadowOutputTokens)
+	}
+
+	primaryAttempts, primaryFailures := ls.providerAttemptCounts(platform, since)
+	stats := make([]ShadowComparisonStat, 0, len(byProvider))
+	for _, s := range byProvider {
+		stat := s.stat
+		stat.ShadowErrorRate = float64(stat.ShadowErrors) / float64(stat.Samples)
+		var attempts, failures int64
+		for primary := range s.primaries {
+			stat.PrimaryProviders = append(stat.PrimaryProviders, primary)
+			attempts += primaryAttempts[primary]
+			failures += primaryFailures[primary]
+		}
+		sort.Strings(stat.PrimaryProviders)
+		if attempts > 0 {
+			stat.PrimaryErrorRate = float64(failures) / float64(attempts)
+		}
+		if succeeded := len(s.shadowDuration); succeeded > 0 {
+			stat.AvgSimilarity = s.similarity / float64(succeeded)
+		}
+		stat.PrimaryDurationP50 = percentile(s.primaryDuration, 0.50)
+		stat.ShadowDurationP50 = percentile(s.shadowDuration, 0.50)
+		stat.PrimaryTTFTP50 = percentile(s.primaryTTFT, 0.50)
+		stat.ShadowTTFTP50 = percentile(s.shadowTTFT, 0.50)
+		stat.PrimaryTTFTP95 = percentile(s.primaryTTFT, 0.95)
+		stat.ShadowTTFTP95 = percentile(s.shadowTTFT, 0.95)
+		if stat.PrimaryDurationP50 > 0 {
+			stat.DurationRatio = stat.ShadowDurationP50 / stat.PrimaryDurationP50
+		}
+		if stat.PrimaryTTFTP50 > 0 {
+			stat.TTFTRatio = stat.ShadowTTFTP50 / stat.PrimaryTTFTP50
+		}
+		if s.primaryOutputTokens > 0 {
+			stat.OutputTokensRatio = float64(s.shadowOutputTokens) / float64(s.primaryOutputTokens)
+		}
+		stats = append(stats, *stat)
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].ShadowProvider < stats[j].ShadowProvider
+	})
+	return stats, nil
+}
+
+// providerAttemptCounts 统计 request_log 中各 provider 的尝试次数与失败次数（截断或无效的 2xx 也算失败）
+func (ls *LogService) providerAttemptCounts(platform string, since string) (map[string]int64, map[string]int64) {
+	attempts := make(map[string]int64)
+	failures := make(map[string]int64)
+	options := []xdb.Option{
+		xdb.WhereGte("created_at", since),
+		xdb.Field("provider", "http_code", "error_class"),
+	}
+	if platform != "" {
+		options = append(options, xdb.WhereEq("platform", platform))
+	}
+	records, err := xdb.New("request_log").Selects(options...)
+	if err != nil {
+		return attempts, failures
+	}
+	for _, record := range records {
+		provider := record.GetString("provider")
+		attempts[provider]++
+		if code := record.GetInt("http_code"); code < 200 || code >= 300 || record.GetString("error_class") != "" {
+			failures[provider]++
+		}
+	}
+	return attempts, failures
+}
+
+// percentile 最近秩法计算分位数（p 取 0~1），会对 values 原地排序
+func percentile(values []float64, p float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+	sort.Float64s(values)
+	idx := int(math.Ceil(p*float64(len(values)))) - 1
+	if idx < 0 {
+		idx = 0
+	}
+	if idx >= len(values) {
+		idx = len(values) - 1
+	}
+	return values[idx]
+}
+
 func (ls *LogService) ProviderDailyStats(platform string) ([]ProviderDailyStat, error) {
 	start := startOfDay(time.Now())
 	end := start.Add(24 * time.Hour)
@@ -309,6 +681,7 @@ func (ls *LogService) ProviderDailyStats(platform string) ([]ProviderDailyStat,
 			"provider",
 			"model",
 			"http_code",
+			"error_class",
 			"input_tokens",
 			"output_tokens",
 			"reasoning_tokens",
@@ -363,8 +736,8 @@ func (ls *LogService) ProviderDailyStats(platform string) ([]ProviderDailyStat,
 		}
 		cost := ls.calculateCost(record.GetString("model"), usage)
 		stat.TotalRequests++
-		// 只有 HTTP 200-299 才算成功，其他（包括 0）都算失败
-		if httpCode >= 200 && httpCode < 300 {
+		// 只有 HTTP 200-299 且响应有效才算成功，其他（包括 0、截断或无效的 2xx）都算失败
+		if httpCode >= 200 && httpCode < 300 && record.GetString("error_class") == "" {
 			stat.SuccessfulRequests++
 		} else {
 			stat.FailedRequests++
@@ -534,6 +907,57 @@ type ProviderDailyStat struct {
 	CostTotal         float64 `json:"cost_total"`
 }
 
+type AffinityStat struct {
+	AffinityHit       bool    `json:"affinity_hit"`
+	TotalRequests     int64   `json:"total_requests"`
+	InputTokens       int64   `json:"input_tokens"`
+	CacheCreateTokens int64   `json:"cache_create_tokens"`
+	CacheReadTokens   int64   `json:"cache_read_tokens"`
+	CacheReadRatio    float64 `json:"cache_read_ratio"`
+}
+
+type RequestTrace struct {
+	RequestID        string       `json:"request_id"`
+	Platform         string       `json:"platform"`
+	Succeeded        bool         `json:"succeeded"`
+	FinalProvider    string       `json:"final_provider"`
+	TotalDurationSec float64      `json:"total_duration_sec"`
+	TotalCost        float64      `json:"total_cost"`
+	Attempts         []ReqeustLog `json:"attempts"`
+}
+
+type ProviderLatencyStat struct {
+	Provider        string  `json:"provider"`
+	Samples         int64   `json:"samples"`
+	TTFBP50         float64 `json:"ttfb_p50"`
+	TTFTP50         float64 `json:"ttft_p50"`
+	TTFTP95         float64 `json:"ttft_p95"`
+	TokensPerSecP50 float64 `json:"tokens_per_sec_p50"`
+	TokensPerSecP95 float64 `json:"tokens_per_sec_p95"`
+}
+
+// ShadowComparisonStat 候选 provider 的影子请求与主 provider 的对比
+// 各 Ratio 为影子 / 主，大于 1 表示候选更慢（或输出更长）
+type ShadowComparisonStat struct {
+	ShadowProvider     string   `json:"shadow_provider"`
+	PrimaryProviders   []string `json:"primary_providers"`
+	Samples            int64    `json:"samples"`
+	ShadowErrors       int64    `json:"shadow_errors"`
+	ShadowErrorRate    float64  `json:"shadow_error_rate"`
+	PrimaryErrorRate   float64  `json:"primary_error_rate"`
+	PrimaryDurationP50 float64  `json:"primary_duration_p50"`
+	ShadowDurationP50  float64  `json:"shadow_duration_p50"`
+	DurationRatio      float64  `json:"duration_ratio"`
+	PrimaryTTFTP50     float64  `json:"primary_ttft_p50"`
+	ShadowTTFTP50      float64  `json:"shadow_ttft_p50"`
+	PrimaryTTFTP95     float64  `json:"primary_ttft_p95"`
+	ShadowTTFTP95      float64  `json:"shadow_ttft_p95"`
+	TTFTRatio          float64  `json:"ttft_ratio"`
+	OutputTokensRatio  float64  `json:"output_tokens_ratio"`
+	AvgSimilarity      float64  `json:"avg_similarity"` // 成功样本与主响应的平均文本相似度
+	ShadowCost         float64  `json:"shadow_cost"`    // 影子请求的费用（不计入主费用统计）
+}
+
 type LogStatsSeries struct {
 	Day               string  `json:"day"`
 	TotalRequests     int64   `json:"total_requests"`
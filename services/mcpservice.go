@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"log"
 	"os"
 	"path/filepath"
 	"reflect"
@@ -159,6 +160,10 @@ func (ms *MCPService) SaveServers(servers []MCPServer) error {
 		if typ == "http" && url == "" {
 			return fmt.Errorf("%s 需要提供 url", name)
 		}
+		// 未解锁时 env 里是密钥库引用，同步出去会把引用写进 ~/.claude.json / Codex 配置
+		if hasSecretRef(env) {
+			return fmt.Errorf("%s 的 env 无法解密: %w", name, ErrSecretsLocked)
+		}
 		normalized[i] = MCPServer{
 			Name:            name,
 			Type:            typ,
@@ -236,7 +241,17 @@ func (ms *MCPService) loadConfig() (map[string]rawMCPServer, error) {
 		payload[name] = normalizeRawEntry(entry)
 	}
 
+	// 解密 env；旧版本的明文 env 自动迁移到密钥库
 	changed := false
+	bindings, commit := mcpSecretBindings(payload)
+	plaintext, err := defaultSecretStore.openSecrets(bindings)
+	commit()
+	if err != nil {
+		log.Printf("⚠️  解密 MCP env 失败: %v", err)
+	} else if plaintext {
+		changed = true
+	}
+
 	if imported, err := ms.importFromClaude(payload); err == nil {
 		if ms.mergeImportedServers(payload, imported) {
 			changed = true
@@ -321,17 +336,45 @@ func (ms *MCPService) saveConfig(payload map[string]rawMCPServer) error {
 	if err != nil {
 		return err
 	}
-	data, err := json.MarshalIndent(payload, "", "  ")
+	// env 存入加密密钥库，文件中只保留引用
+	sealed := make(map[string]rawMCPServer, len(payload))
+	for name, entry := range payload {
+		entry.Env = cloneStringMap(entry.Env)
+		sealed[name] = entry
+	}
+	bindings, commit := mcpSecretBindings(sealed)
+	if err := defaultSecretStore.sealSecrets("mcp", bindings); err != nil {
+		return fmt.Errorf("加密 MCP env 失败: %w", err)
+	}
+	commit()
+
+	data, err := json.MarshalIndent(sealed, "", "  ")
 	if err != nil {
 		return err
 	}
 	tmp := path + ".tmp"
-	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
 		return err
 	}
 	return os.Rename(tmp, path)
 }
 
+// mcpSecretBindings MCP 服务器的 env 字段，引用为 mcp/<name>/env/<KEY>
+func mcpSecretBindings(payload map[string]rawMCPServer) ([]secretBinding, func()) {
+	var bindings []secretBinding
+	var commits []func()
+	for name, entry := range payload {
+		envBindings, commit := envSecretBindings(entry.Env, "mcp", name)
+		bindings = append(bindings, envBindings...)
+		commits = append(commits, commit)
+	}
+	return bindings, func() {
+		for _, commit := range commits {
+			commit()
+		}
+	}
+}
+
 func normalizeServerType(value string) string {
 	switch strings.ToLower(strings.TrimSpace(value)) {
 	case "http":
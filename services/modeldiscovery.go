@@ -0,0 +1,499 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+const (
+	modelDiscoveryTimeout  = 20 * time.Second
+	modelDiscoveryMaxPages = 20      // 分页上限，避免异常的上游无限翻页
+	modelDiscoveryMaxBody  = 4 << 20 // 单页响应体上限
+)
+
+// ModelDiscoveryResult 一次模型发现的结果（与当前白名单、映射对比）
+type ModelDiscoveryResult struct {
+	Platform   string   `json:"platform"`
+	ProviderID string   `json:"providerId"`
+	Provider   string   `json:"provider"`
+	Models     []string `json:"models"`          // 上游返回的全部模型
+	Added      []string `json:"added"`           // 上游有、白名单未覆盖的模型
+	Removed    []string `json:"removed"`         // 白名单中有、上游已不存在的模型（只比较精确模型名）
+	Missing    []string `json:"missingTargets"`  // 映射目标在上游已不存在（请求会被映射到不存在的模型）
+	Error      string   `json:"error,omitempty"` // 定时刷新失败时的错误
+	CheckedAt  string   `json:"checkedAt"`
+	Scheduled  bool     `json:"scheduled,omitempty"` // 是否来自定时刷新
+}
+
+// discoveryTarget 待查询模型列表的 provider
+type discoveryTarget struct {
+	platform     string
+	id           string
+	name         string
+	url          string // 模型列表地址（不含分页参数）
+	headers      map[string]string
+	supported    map[string]bool
+	mapping      map[string]string
+	mappingOrder []string
+}
+
+// ModelDiscoveryService 从 provider 的模型列表接口发现模型，维护白名单
+// 支持 Anthropic / OpenAI 的 GET /v1/models 与 Gemini 的 models 列表；定时刷新（可选）检查映射目标是否还存在
+type ModelDiscoveryService struct {
+	providerService *ProviderService
+	geminiService   *GeminiService
+	settingsService *SettingsService
+	client          *http.Client
+
+	mu          sync.Mutex
+	lastRefresh time.Time
+	alerts      map[string]ModelDiscoveryResult // platform/provider -> 最近一次有问题的定时刷新结果
+	running     atomic.Bool
+}
+
+// NewModelDiscoveryService 创建模型发现服务
+func NewModelDiscoveryService(providerService *ProviderService, geminiService *GeminiService, settingsService *SettingsService) *ModelDiscoveryService {
+	return &ModelDiscoveryService{
+		providerService: providerService,
+		geminiService:   geminiService,
+		settingsService: settingsService,
+		client:          &http.Client{Timeout: modelDiscoveryTimeout},
+		alerts:          make(map[string]ModelDiscoveryResult),
+	}
+}
+
+// Start Wails生命周期方法
+func (ds *ModelDiscoveryService) Start() error {
+	return nil
+}
+
+// Stop Wails生命周期方法
+func (ds *ModelDiscoveryService) Stop() error {
+	return nil
+}
+
+// DiscoverModels 查询 provider 的模型列表，并与当前白名单、映射对比
+// providerID：Claude / Codex 为数字 ID，Gemini 为字符串 ID
+func (ds *ModelDiscoveryService) DiscoverModels(kind string, providerID string) (*ModelDiscoveryResult, error) {
+	target, err := ds.findTarget(kind, providerID)
+	if err != nil {
+		return nil, err
+	}
+	models, err := ds.listUpstreamModels(context.Background(), target)
+	if err != nil {
+		return nil, err
+	}
+	result := diffDiscoveredModels(target, models)
+	return &result, nil
+}
+
+// ApplyDiscoveredModels 把选中的新增模型加入白名单、移除选中的已下线模型，并保存配置
+func (ds *ModelDiscoveryService) ApplyDiscoveredModels(kind string, providerID string, add []string, remove []string) error {
+	switch kind {
+	case "claude", "codex":
+		id, err := strconv.ParseInt(providerID, 10, 64)
+		if err != nil {
+			return fmt.Errorf("无效的 provider ID: %s", providerID)
+		}
+		providers, err := ds.providerService.LoadProviders(kind)
+		if err != nil {
+			return err
+		}
+		for i := range providers {
+			if providers[i].ID == id {
+				providers[i].SupportedModels = applyModelChanges(providers[i].SupportedModels, add, remove)
+				return ds.providerService.SaveProviders(kind, providers)
+			}
+		}
+		return fmt.Errorf("未找到 ID 为 %d 的 provider", id)
+	case "gemini":
+		if ds.geminiService == nil {
+			return fmt.Errorf("Gemini 服务未初始化")
+		}
+		for _, p := range ds.geminiService.GetProviders() {
+			if p.ID == providerID {
+				p.SupportedModels = applyModelChanges(p.SupportedModels, add, remove)
+				return ds.geminiService.UpdateProvider(p)
+			}
+		}
+		return fmt.Errorf("未找到 ID 为 '%s' 的供应商", providerID)
+	default:
+		return fmt.Errorf("不支持的平台: %s", kind)
+	}
+}
+
+// GetModelDiscoveryAlerts 获取定时刷新发现的问题（映射目标已下线或查询失败）
+func (ds *ModelDiscoveryService) GetModelDiscoveryAlerts() []ModelDiscoveryResult {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	alerts := make([]ModelDiscoveryResult, 0, len(ds.alerts))
+	for _, alert := range ds.alerts {
+		alerts = append(alerts, alert)
+	}
+	sort.Slice(alerts, func(i, j int) bool {
+		if alerts[i].Platform != alerts[j].Platform {
+			return alerts[i].Platform < alerts[j].Platform
+		}
+		return alerts[i].Provider < alerts[j].Provider
+	})
+	return alerts
+}
+
+// RunDueRefresh 定时刷新所有配置了白名单或映射的 provider（由定时器调用，间隔为 0 时关闭）
+func (ds *ModelDiscoveryService) RunDueRefresh() {
+	hours := ds.settingsService.GetModelDiscoveryIntervalHours()
+	if hours <= 0 {
+		return
+	}
+	ds.mu.Lock()
+	due := time.Since(ds.lastRefresh) >= time.Duration(hours)*time.Hour
+	ds.mu.Unlock()
+	if !due || !ds.running.CompareAndSwap(false, true) {
+		return
+	}
+	defer ds.running.Store(false)
+
+	alerts := make(map[string]ModelDiscoveryResult)
+	for _, target := range ds.collectTargets() {
+		key := target.platform + "/" + target.name
+		models, err := ds.listUpstreamModels(context.Background(), target)
+		if err != nil {
+			log.Printf("⚠️  模型发现失败 %s: %v", key, err)
+			alerts[key] = ModelDiscoveryResult{
+				Platform:   target.platform,
+				ProviderID: target.id,
+				Provider:   target.name,
+				Error:      err.Error(),
+				CheckedAt:  time.Now().Format(time.RFC3339),
+				Scheduled:  true,
+			}
+			continue
+		}
+		result := diffDiscoveredModels(target, models)
+		result.Scheduled = true
+		if len(result.Missing) > 0 {
+			log.Printf("⚠️  %s 的映射目标模型已在上游下线: %s", key, strings.Join(result.Missing, ", "))
+			alerts[key] = result
+		}
+	}
+
+	ds.mu.Lock()
+	ds.alerts = alerts
+	ds.lastRefresh = time.Now()
+	ds.mu.Unlock()
+}
+
+// collectTargets 收集启用且配置了白名单或映射的 provider（未配置的 provider 没有需要对比的内容）
+func (ds *ModelDiscoveryService) collectTargets() []discoveryTarget {
+	var targets []discoveryTarget
+	for _, kind := range []string{"claude", "codex"} {
+		providers, err := ds.providerService.LoadProviders(kind)
+		if err != nil {
+			continue
+		}
+		for i := range providers {
+			p := &providers[i]
+			if !p.Enabled || p.APIURL == "" || (len(p.SupportedModels) == 0 && len(p.ModelMapping) == 0) {
+				continue
+			}
+			targets = append(targets, providerDiscoveryTarget(kind, p))
+		}
+	}
+	if ds.geminiService != nil {
+		for _, p := range ds.geminiService.GetProviders() {
+			if !p.Enabled || p.BaseURL == "" || (len(p.SupportedModels) == 0 && len(p.ModelMapping) == 0) {
+				continue
+			}
+			provider := p
+			targets = append(targets, geminiDiscoveryTarget(&provider))
+		}
+	}
+	return targets
+}
+
+// findTarget 按 ID 查找 provider
+func (ds *ModelDiscoveryService) findTarget(kind string, providerID string) (discoveryTarget, error) {
+	switch kind {
+	case "claude", "codex":
+		id, err := strconv.ParseInt(providerID, 10, 64)
+		if err != nil {
+			return discoveryTarget{}, fmt.Errorf("无效的 provider ID: %s", providerID)
+		}
+		providers, err := ds.providerService.LoadProviders(kind)
+		if err != nil {
+			return discoveryTarget{}, err
+		}
+		for i := range providers {
+			if providers[i].ID == id {
+				if providers[i].APIURL == "" {
+					return discoveryTarget{}, fmt.Errorf("provider %s 未配置 API 地址", providers[i].Name)
+				}
+				return providerDiscoveryTarget(kind, &providers[i]), nil
+			}
+		}
+		return discoveryTarget{}, fmt.Errorf("未找到 ID 为 %d 的 provider", id)
+	case "gemini":
+		if ds.geminiService == nil {
+			return discoveryTarget{}, fmt.Errorf("Gemini 服务未初始化")
+		}
+		for _, p := range ds.geminiService.GetProviders() {
+			if p.ID == providerID {
+				if p.BaseURL == "" {
+					return discoveryTarget{}, fmt.Errorf("provider %s 未配置 API 地址", p.Name)
+				}
+				provider := p
+				return geminiDiscoveryTarget(&provider), nil
+			}
+		}
+		return discoveryTarget{}, fmt.Errorf("未找到 ID 为 '%s' 的供应商", providerID)
+	default:
+		return discoveryTarget{}, fmt.Errorf("不支持的平台: %s", kind)
+	}
+}
+
+// providerDiscoveryTarget Claude 使用 Anthropic 的 /v1/models，Codex 使用 OpenAI 的 /v1/models
+func providerDiscoveryTarget(kind string, p *Provider) discoveryTarget {
+	headers := map[string]string{"Authorization": fmt.Sprintf("Bearer %s", p.APIKey)}
+	if kind == "claude" {
+		headers["x-api-key"] = p.APIKey
+		headers["anthropic-version"] = "2023-06-01"
+	}
+	return discoveryTarget{
+		platform:     kind,
+		id:           strconv.FormatInt(p.ID, 10),
+		name:         p.Name,
+		url:          modelsListURL(p.APIURL),
+		headers:      headers,
+		supported:    p.SupportedModels,
+		mapping:      p.ModelMapping,
+		mappingOrder: p.mappingOrder,
+	}
+}
+
+// geminiDiscoveryTarget Gemini 协议使用 /v1beta/models，其他协议按对应厂商的 /v1/models
+func geminiDiscoveryTarget(p *GeminiProvider) discoveryTarget {
+	target := discoveryTarget{
+		platform:     "gemini",
+		id:           p.ID,
+		name:         p.Name,
+		headers:      map[string]string{},
+		supported:    p.SupportedModels,
+		mapping:      p.ModelMapping,
+		mappingOrder: p.mappingOrder,
+	}
+	switch p.UpstreamFormat() {
+	case GeminiAPIFormatAnthropic:
+		target.url = modelsListURL(p.BaseURL)
+		target.headers["Authorization"] = fmt.Sprintf("Bearer %s", p.APIKey)
+		target.headers["x-api-key"] = p.APIKey
+		target.headers["anthropic-version"] = "2023-06-01"
+	case GeminiAPIFormatOpenAI:
+		target.url = modelsListURL(p.BaseURL)
+		target.headers["Authorization"] = fmt.Sprintf("Bearer %s", p.APIKey)
+	default:
+		target.url = strings.TrimSuffix(p.BaseURL, "/") + "/v1beta/models"
+		if p.APIKey != "" {
+			target.headers["x-goog-api-key"] = p.APIKey
+		}
+	}
+	return target
+}
+
+// modelsListURL 拼接 /v1/models（base 已以 /v1 结尾时不重复添加）
+func modelsListURL(base string) string {
+	base = strings.TrimSuffix(base, "/")
+	if strings.HasSuffix(base, "/v1") {
+		return base + "/models"
+	}
+	return base + "/v1/models"
+}
+
+// listUpstreamModels 分页读取上游模型列表（去重、排序）
+func (ds *ModelDiscoveryService) listUpstreamModels(ctx context.Context, target discoveryTarget) ([]string, error) {
+	seen := make(map[string]bool)
+	query := url.Values{}
+	for page := 0; page < modelDiscoveryMaxPages; page++ {
+		pageURL := target.url
+		if len(query) > 0 {
+			pageURL += "?" + query.Encode()
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, pageURL, nil)
+		if err != nil {
+			return nil, fmt.Errorf("创建请求失败: %w", err)
+		}
+		req.Header.Set("Accept", "application/json")
+		for key, value := range target.headers {
+			req.Header.Set(key, value)
+		}
+
+		resp, err := ds.client.Do(req)
+		if err != nil {
+			return nil, fmt.Errorf("请求模型列表失败: %w", err)
+		}
+		body, err := io.ReadAll(io.LimitReader(resp.Body, modelDiscoveryMaxBody))
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("读取模型列表失败: %w", err)
+		}
+		if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+			return nil, fmt.Errorf("模型列表接口返回 HTTP %d: %s", resp.StatusCode, truncateErrorBody(strings.TrimSpace(string(body))))
+		}
+		if !gjson.ValidBytes(body) {
+			return nil, fmt.Errorf("模型列表接口返回的不是 JSON: %s", truncateErrorBody(strings.TrimSpace(string(body))))
+		}
+
+		models, next := parseModelList(body)
+		for _, model := range models {
+			seen[model] = true
+		}
+		if len(next) == 0 {
+			break
+		}
+		query = next
+	}
+
+	models := make([]string, 0, len(seen))
+	for model := range seen {
+		models = append(models, model)
+	}
+	sort.Strings(models)
+	return models, nil
+}
+
+// parseModelList 解析模型列表，返回模型名与下一页的查询参数（没有下一页时为空）
+// Anthropic: {"data":[{"id":...}],"has_more":true,"last_id":...}
+// OpenAI:    {"data":[{"id":...}]}
+// Gemini:    {"models":[{"name":"models/...","supportedGenerationMethods":[...]}],"nextPageToken":...}
+func parseModelList(body []byte) ([]string, url.Values) {
+	parsed := gjson.ParseBytes(body)
+	var models []string
+	next := url.Values{}
+
+	if list := parsed.Get("models"); list.IsArray() {
+		list.ForEach(func(_, item gjson.Result) bool {
+			methods := item.Get("supportedGenerationMethods")
+			if methods.Exists() && !strings.Contains(methods.Raw, `"generateContent"`) {
+				return true // 只保留可用于生成内容的模型（跳过 embedding 等）
+			}
+			if name := strings.TrimPrefix(item.Get("name").String(), "models/"); name != "" {
+				models = append(models, name)
+			}
+			return true
+		})
+		if token := parsed.Get("nextPageToken").String(); token != "" {
+			next.Set("pageToken", token)
+		}
+		return models, next
+	}
+
+	parsed.Get("data").ForEach(func(_, item gjson.Result) bool {
+		if id := item.Get("id").String(); id != "" {
+			models = append(models, id)
+		}
+		return true
+	})
+	if parsed.Get("has_more").Bool() {
+		if lastID := parsed.Get("last_id").String(); lastID != "" {
+			next.Set("after_id", lastID)
+			next.Set("limit", "1000")
+		}
+	}
+	return models, next
+}
+
+// diffDiscoveredModels 对比上游模型与白名单、映射
+func diffDiscoveredModels(target discoveryTarget, models []string) ModelDiscoveryResult {
+	result := ModelDiscoveryResult{
+		Platform:   target.platform,
+		ProviderID: target.id,
+		Provider:   target.name,
+		Models:     models,
+		Added:      []string{},
+		Removed:    []string{},
+		Missing:    []string{},
+		CheckedAt:  time.Now().Format(time.RFC3339),
+	}
+	upstream := make(map[string]bool, len(models))
+	for _, model := range models {
+		upstream[model] = true
+	}
+
+	for _, model := range models {
+		covered := false
+		for pattern, supported := range target.supported {
+			if supported && matchWildcard(pattern, model) {
+				covered = true
+				break
+			}
+		}
+		if !covered {
+			result.Added = append(result.Added, model)
+		}
+	}
+
+	for model := range target.supported {
+		if isConcreteModelName(model) && !upstream[model] {
+			result.Removed = append(result.Removed, model)
+		}
+	}
+	sort.Strings(result.Removed)
+
+	for _, key := range declarationOrder(mapKeys(target.mapping), target.mappingOrder) {
+		mapped := target.mapping[key]
+		if isConcreteModelName(mapped) && !upstream[mapped] && !containsModel(result.Missing, mapped) {
+			result.Missing = append(result.Missing, mapped)
+		}
+	}
+	return result
+}
+
+// isConcreteModelName 不含通配符、正则引用的模型名
+func isConcreteModelName(model string) bool {
+	return model != "" && !strings.ContainsAny(model, "*?$^")
+}
+
+// applyModelChanges 返回修改后的白名单副本（不修改原 map）
+func applyModelChanges(supported map[string]bool, add []string, remove []string) map[string]bool {
+	updated := make(map[string]bool, len(supported)+len(add))
+	for model, ok := range supported {
+		updated[model] = ok
+	}
+	for _, model := range remove {
+		delete(updated, model)
+	}
+	for _, model := range add {
+		if model = strings.TrimSpace(model); model != "" {
+			updated[model] = true
+		}
+	}
+	return updated
+}
+
+func mapKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+func containsModel(models []string, model string) bool {
+	for _, m := range models {
+		if m == model {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,86 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestModelDiscovery(t *testing.T) {
+	var pages []string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/models" || r.Header.Get("x-api-key") != "sk-test" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		pages = append(pages, r.URL.RawQuery)
+		if r.URL.Query().Get("after_id") == "" {
+			fmt.Fprint(w, `{"data":[{"id":"claude-sonnet-4-5","type":"model"},{"id":"claude-opus-4-1","type":"model"}],"has_more":true,"last_id":"claude-opus-4-1"}`)
+			return
+		}
+		fmt.Fprint(w, `{"data":[{"id":"claude-haiku-4-5","type":"model"}],"has_more":false}`)
+	}))
+	defer upstream.Close()
+
+	provider := &Provider{
+		ID:     7,
+		Name:   "reseller",
+		APIURL: upstream.URL,
+		APIKey: "sk-test",
+		SupportedModels: map[string]bool{
+			"claude-sonnet-*":   true,
+			"claude-3-5-sonnet": true,
+		},
+		ModelMapping: map[string]string{
+			"claude-3-opus": "claude-3-opus-20240229",
+			"claude-opus-*": "claude-opus-*",
+		},
+	}
+	ds := &ModelDiscoveryService{client: upstream.Client()}
+	target := providerDiscoveryTarget("claude", provider)
+	if target.url != upstream.URL+"/v1/models" || modelsListURL("https://api.openai.com/v1/") != "https://api.openai.com/v1/models" {
+		t.Fatalf("unexpected models url: %s", target.url)
+	}
+	models, err := ds.listUpstreamModels(context.Background(), target)
+	if err != nil {
+		t.Fatalf("listUpstreamModels: %v", err)
+	}
+	if strings.Join(models, ",") != "claude-haiku-4-5,claude-opus-4-1,claude-sonnet-4-5" || len(pages) != 2 {
+		t.Fatalf("models = %v, pages = %v", models, pages)
+	}
+
+	result := diffDiscoveredModels(target, models)
+	if strings.Join(result.Added, ",") != "claude-haiku-4-5,claude-opus-4-1" {
+		t.Errorf("added = %v", result.Added)
+	}
+	if strings.Join(result.Removed, ",") != "claude-3-5-sonnet" {
+		t.Errorf("removed = %v", result.Removed)
+	}
+	if strings.Join(result.Missing, ",") != "claude-3-opus-20240229" {
+		t.Errorf("missing targets = %v", result.Missing)
+	}
+
+	// Gemini 列表：去掉 models/ 前缀，跳过不能生成内容的模型，按 nextPageToken 翻页
+	geminiModels, next := parseModelList([]byte(`{"models":[
+		{"name":"models/gemini-2.5-pro","supportedGenerationMethods":["generateContent","countTokens"]},
+		{"name":"models/text-embedding-004","supportedGenerationMethods":["embedContent"]}
+	],"nextPageToken":"abc"}`))
+	if strings.Join(geminiModels, ",") != "gemini-2.5-pro" || next.Get("pageToken") != "abc" {
+		t.Errorf("gemini models = %v, next = %v", geminiModels, next)
+	}
+
+	// 接受变更时不修改原白名单
+	updated := applyModelChanges(provider.SupportedModels, result.Added, result.Removed)
+	if len(provider.SupportedModels) != 2 || updated["claude-3-5-sonnet"] || !updated["claude-haiku-4-5"] || !updated["claude-sonnet-*"] {
+		t.Errorf("applyModelChanges = %v", updated)
+	}
+
+	// 鉴权失败时返回上游错误
+	target.headers["x-api-key"] = "bad"
+	if _, err := ds.listUpstreamModels(context.Background(), target); err == nil || !strings.Contains(err.Error(), "401") {
+		t.Errorf("expected HTTP 401 error, got %v", err)
+	}
+}
@@ -0,0 +1,85 @@
+package services
+
+import (
+	"fmt"
+	"strings"
+)
+
+// 模型降级时告知客户端实际使用的模型
+const (
+	requestedModelHeader = "X-Code-Switch-Requested-Model" // 客户端原本请求的模型
+	fallbackModelHeader  = "X-Code-Switch-Fallback-Model"  // 实际使用的降级模型
+)
+
+// ModelFallbackChain 模型降级链：请求模型的 provider 全部不可用或可重试地失败（5xx、429、网络错误）后，依次改用 Fallbacks 中的模型
+// 上游以不可重试的 4xx 拒绝请求时不降级；拉黑模式下只尝试每个模型的第一个 provider
+type ModelFallbackChain struct {
+	Platform  string   `json:"platform"`  // claude / codex
+	Model     string   `json:"model"`     // 请求的模型，支持通配符（如 claude-opus-*）
+	Fallbacks []string `json:"fallbacks"` // 依次尝试的降级模型
+}
+
+// validateModelFallbackChains 验证降级链配置
+func validateModelFallbackChains(chains []ModelFallbackChain) error {
+	for i, chain := range chains {
+		if chain.Platform != "claude" && chain.Platform != "codex" {
+			return fmt.Errorf("第 %d 条降级链的平台无效: %s", i+1, chain.Platform)
+		}
+		if strings.TrimSpace(chain.Model) == "" {
+			return fmt.Errorf("第 %d 条降级链未设置模型", i+1)
+		}
+		if len(chain.Fallbacks) == 0 {
+			return fmt.Errorf("降级链 %s 未设置降级模型", chain.Model)
+		}
+		for _, fallback := range chain.Fallbacks {
+			if strings.TrimSpace(fallback) == "" || strings.Contains(fallback, "*") {
+				return fmt.Errorf("降级链 %s 的降级模型必须是具体的模型名: %q", chain.Model, fallback)
+			}
+		}
+	}
+	return nil
+}
+
+// resolveModelFallbacks 返回请求模型依次尝试的模型（第一个是请求模型本身）
+// 精确匹配的降级链优先，其次按配置顺序取第一个通配符匹配；降级模型去重且不含请求模型
+func resolveModelFallbacks(chains []ModelFallbackChain, kind string, requestedModel string) []string {
+	models := []string{requestedModel}
+	if requestedModel == "" {
+		return models
+	}
+	var matched *ModelFallbackChain
+	for i := range chains {
+		chain := &chains[i]
+		if chain.Platform != kind {
+			continue
+		}
+		if chain.Model == requestedModel {
+			matched = chain
+			break
+		}
+		if matched == nil && matchWildcard(chain.Model, requestedModel) {
+			matched = chain
+		}
+	}
+	if matched == nil {
+		return models
+	}
+	seen := map[string]bool{requestedModel: true}
+	for _, fallback := range matched.Fallbacks {
+		if !seen[fallback] {
+			seen[fallback] = true
+			models = append(models, fallback)
+		}
+	}
+	return models
+}
+
+// modelFallbackChain 按设置返回本次请求依次尝试的模型
+func (prs *ProviderRelayService) modelFallbackChain(kind string, requestedModel string) []string {
+	chains, err := prs.settingsService.GetModelFallbackChains()
+	if err != nil {
+		fmt.Printf("[WARN] 读取模型降级链失败: %v\n", err)
+		return []string{requestedModel}
+	}
+	return resolveModelFallbacks(chains, kind, requestedModel)
+}
@@ -0,0 +1,100 @@
+package services
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestRelayModelFallbackDecision(t *testing.T) {
+	body := `{"model":"claude-opus-4-1","messages":[{"role":"user","content":"hi"}]}`
+	relay := func(prs *ProviderRelayService) (func(), bool, *gin.Context) {
+		c, _ := newTestContext("/v1/messages", body)
+		writeError, retryable := prs.relayModel(c, "claude", "/v1/messages", "req", clientPin{}, nil, false, "claude-opus-4-1", []byte(body), "")
+		return writeError, retryable, c
+	}
+
+	tests := []struct {
+		name          string
+		status        int
+		blacklistMode bool
+		wantRetryable bool
+	}{
+		{"invalid request is not retried on fallback models", http.StatusBadRequest, false, false},
+		{"upstream error walks the fallback chain", http.StatusBadGateway, false, true},
+		{"blacklist mode still walks the fallback chain", http.StatusBadGateway, true, true},
+		{"blacklist mode does not retry invalid requests", http.StatusBadRequest, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			prs := newTestRelay(t)
+			if tt.blacklistMode {
+				config := DefaultBlacklistLevelConfig()
+				config.EnableLevelBlacklist = true
+				if err := prs.settingsService.SaveBlacklistLevelConfig(config); err != nil {
+					t.Fatal(err)
+				}
+			}
+			upstream, hits := newStatusUpstream(t, tt.status, `{"type":"error","error":{"type":"api_error","message":"boom"}}`)
+			backup, _ := newStatusUpstream(t, tt.status, `{}`)
+			saveTestProviders(t, prs, "claude",
+				Provider{ID: 1, Name: "primary", APIURL: upstream.URL, APIKey: "sk", Enabled: true, Level: 1},
+				Provider{ID: 2, Name: "backup", APIURL: backup.URL, APIKey: "sk", Enabled: true, Level: 2})
+
+			writeError, retryable, c := relay(prs)
+			if writeError == nil {
+				t.Fatalf("expected a deferred error writer")
+			}
+			if c.Writer.Written() {
+				t.Errorf("error should be left to the caller so fallback models can be tried")
+			}
+			if retryable != tt.wantRetryable {
+				t.Errorf("expected retryable=%v, got %v", tt.wantRetryable, retryable)
+			}
+			if *hits != 1 {
+				t.Errorf("primary should be tried once, got %d", *hits)
+			}
+		})
+	}
+}
+
+func TestResolveModelFallbacks(t *testing.T) {
+	chains := []ModelFallbackChain{
+		{Platform: "claude", Model: "claude-opus-*", Fallbacks: []string{"claude-sonnet-4-5", "reseller-sonnet"}},
+		{Platform: "claude", Model: "claude-opus-4-1", Fallbacks: []string{"claude-opus-4-1", "claude-sonnet-4", "claude-sonnet-4"}},
+		{Platform: "codex", Model: "gpt-5*", Fallbacks: []string{"gpt-5-mini"}},
+	}
+	cases := []struct {
+		kind, model string
+		want        []string
+	}{
+		{"claude", "claude-opus-4-5", []string{"claude-opus-4-5", "claude-sonnet-4-5", "reseller-sonnet"}},
+		{"claude", "claude-opus-4-1", []string{"claude-opus-4-1", "claude-sonnet-4"}}, // 精确匹配优先，去重并跳过自身
+		{"claude", "claude-haiku-4-5", []string{"claude-haiku-4-5"}},
+		{"claude", "gpt-5", []string{"gpt-5"}}, // 平台不同
+		{"codex", "gpt-5-codex", []string{"gpt-5-codex", "gpt-5-mini"}},
+		{"codex", "", []string{""}},
+	}
+	for _, tc := range cases {
+		got := resolveModelFallbacks(chains, tc.kind, tc.model)
+		if strings.Join(got, ",") != strings.Join(tc.want, ",") {
+			t.Errorf("%s/%s: 期望 %v，得到 %v", tc.kind, tc.model, tc.want, got)
+		}
+	}
+
+	if err := validateModelFallbackChains(chains); err != nil {
+		t.Errorf("有效配置不应报错: %v", err)
+	}
+	invalid := [][]ModelFallbackChain{
+		{{Platform: "gemini", Model: "m", Fallbacks: []string{"n"}}},
+		{{Platform: "claude", Model: "m"}},
+		{{Platform: "claude", Model: "m", Fallbacks: []string{"claude-*"}}},
+	}
+	for _, chains := range invalid {
+		if err := validateModelFallbackChains(chains); err == nil {
+			t.Errorf("无效配置应报错: %+v", chains)
+		}
+	}
+}
@@ -0,0 +1,404 @@
+package services
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/tidwall/gjson"
+)
+
+// modelPattern 编译后的模型匹配规则
+// 支持三种写法：精确模型名；通配符（* 匹配任意字符，? 匹配单个字符，可出现多次）；
+// 以 ^ 开头、$ 结尾的正则表达式（映射目标中可用 $1、${name} 引用分组）
+type modelPattern struct {
+	pattern string
+	exact   bool
+	regex   bool           // 用户写的正则
+	re      *regexp.Regexp // 通配符与正则都编译为正则；通配符的每个 * / ? 对应一个分组
+	stars   []int          // 通配符中 * 对应的分组序号（映射目标中的 * 依次替换为这些分组）
+	prefix  int            // 字面前缀长度，越长越具体
+	order   int            // 声明顺序
+}
+
+// modelPatternAdvisory 提示性验证结果的消息前缀（只用于显示，是否跳过 provider 由 severity 决定）
+const modelPatternAdvisory = "提示：模型映射"
+
+// 配置验证结果的严重程度
+const (
+	configSeverityError   = "error"   // provider 会被跳过，保存时拒绝
+	configSeverityWarning = "warning" // 只是提示：被覆盖 / 有歧义的映射，匹配顺序已确定，不影响使用
+)
+
+// configIssue 一条配置验证结果
+type configIssue struct {
+	severity string
+	message  string
+}
+
+// configErrorIssues 把验证错误消息包装为 error 级别的结果
+func configErrorIssues(messages []string) []configIssue {
+	issues := make([]configIssue, 0, len(messages))
+	for _, message := range messages {
+		issues = append(issues, configIssue{severity: configSeverityError, message: message})
+	}
+	return issues
+}
+
+// configIssueMessages 返回全部验证结果的消息（含提示）
+func configIssueMessages(issues []configIssue) []string {
+	messages := make([]string, 0, len(issues))
+	for _, issue := range issues {
+		messages = append(messages, issue.message)
+	}
+	return messages
+}
+
+// modelPatternCache 已编译的规则（模型名匹配在每次请求中都会执行）
+var modelPatternCache sync.Map // pattern -> *modelPattern 或 error
+
+// orderedPatternCacheLimit 排好序的规则列表最多缓存的配置数（超出时整体清空）
+const orderedPatternCacheLimit = 1024
+
+// orderedPatternCache 按声明顺序排好序的规则列表（每个 provider 的映射 / 白名单一份）
+var orderedPatternCache = struct {
+	sync.Mutex
+	entries map[string][]*modelPattern // 声明顺序拼接的键 -> 排序结果（只读，调用方不能修改）
+}{entries: make(map[string][]*modelPattern)}
+
+// isRegexModelPattern 以 ^ 开头的规则按正则处理
+func isRegexModelPattern(pattern string) bool {
+	return strings.HasPrefix(pattern, "^")
+}
+
+// compileModelPattern 编译一条规则（结果缓存，order 由调用方设置在副本上）
+func compileModelPattern(pattern string) (*modelPattern, error) {
+	if cached, ok := modelPatternCache.Load(pattern); ok {
+		if err, isErr := cached.(error); isErr {
+			return nil, err
+		}
+		return cached.(*modelPattern), nil
+	}
+
+	compiled, err := buildModelPattern(pattern)
+	if err != nil {
+		modelPatternCache.Store(pattern, err)
+		return nil, err
+	}
+	modelPatternCache.Store(pattern, compiled)
+	return compiled, nil
+}
+
+func buildModelPattern(pattern string) (*modelPattern, error) {
+	if isRegexModelPattern(pattern) {
+		if !strings.HasSuffix(pattern, "$") {
+			return nil, fmt.Errorf("正则规则 '%s' 必须以 ^ 开头、以 $ 结尾", pattern)
+		}
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("正则规则 '%s' 无效: %v", pattern, err)
+		}
+		prefix, _ := re.LiteralPrefix()
+		return &modelPattern{pattern: pattern, regex: true, re: re, prefix: len(prefix)}, nil
+	}
+
+	if !strings.ContainsAny(pattern, "*?") {
+		return &modelPattern{pattern: pattern, exact: true, prefix: len(pattern)}, nil
+	}
+	var expr strings.Builder
+	expr.WriteString("^")
+	compiled := &modelPattern{pattern: pattern, prefix: strings.IndexAny(pattern, "*?")}
+	group := 0
+	for _, r := range pattern {
+		switch r {
+		case '*':
+			group++
+			compiled.stars = append(compiled.stars, group)
+			expr.WriteString("(.*)")
+		case '?':
+			group++
+			expr.WriteString("(.)")
+		default:
+			expr.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	expr.WriteString("$")
+	re, err := regexp.Compile(expr.String())
+	if err != nil {
+		return nil, err
+	}
+	compiled.re = re
+	return compiled, nil
+}
+
+// match 判断模型名是否匹配
+func (p *modelPattern) match(model string) bool {
+	if p.exact {
+		return p.pattern == model
+	}
+	return p.re.MatchString(model)
+}
+
+// apply 按规则把模型名映射为目标（通配符目标中的 * 依次替换为匹配部分，正则目标展开 $1 / ${name}）
+func (p *modelPattern) apply(target string, model string) string {
+	if p.exact {
+		return target
+	}
+	submatches := p.re.FindStringSubmatchIndex(model)
+	if submatches == nil {
+		return target
+	}
+	if p.regex {
+		return string(p.re.ExpandString(nil, target, model, submatches))
+	}
+	if !strings.Contains(target, "*") {
+		return target
+	}
+	var b strings.Builder
+	star := 0
+	for _, r := range target {
+		if r == '*' && star < len(p.stars) {
+			group := p.stars[star]
+			b.WriteString(model[submatches[2*group]:submatches[2*group+1]])
+			star++
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// less 匹配优先级：精确匹配 > 字面前缀更长 > 声明在前
+func (p *modelPattern) less(other *modelPattern) bool {
+	if p.exact != other.exact {
+		return p.exact
+	}
+	if p.prefix != other.prefix {
+		return p.prefix > other.prefix
+	}
+	return p.order < other.order
+}
+
+// orderedModelPatterns 按匹配优先级排列规则（无法编译的规则跳过，由配置验证报告）
+// order 为声明顺序（来自配置文件中的键顺序）；未出现在 order 中的规则按名称排在其后，保证结果稳定
+// 结果按声明顺序缓存，调用方不能修改返回的规则
+func orderedModelPatterns(keys []string, order []string) []*modelPattern {
+	declared := declarationOrder(keys, order)
+	cacheKey := strings.Join(declared, "\x00")
+	orderedPatternCache.Lock()
+	cached, ok := orderedPatternCache.entries[cacheKey]
+	orderedPatternCache.Unlock()
+	if ok {
+		return cached
+	}
+
+	patterns := make([]*modelPattern, 0, len(declared))
+	for i, key := range declared {
+		compiled, err := compileModelPattern(key)
+		if err != nil {
+			continue
+		}
+		p := *compiled
+		p.order = i
+		patterns = append(patterns, &p)
+	}
+	sort.SliceStable(patterns, func(i, j int) bool {
+		return patterns[i].less(patterns[j])
+	})
+
+	orderedPatternCache.Lock()
+	if len(orderedPatternCache.entries) >= orderedPatternCacheLimit {
+		orderedPatternCache.entries = make(map[string][]*modelPattern)
+	}
+	orderedPatternCache.entries[cacheKey] = patterns
+	orderedPatternCache.Unlock()
+	return patterns
+}
+
+// declarationOrder 先按 order 中的顺序，其余的键按名称排序
+func declarationOrder(keys []string, order []string) []string {
+	present := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		present[key] = true
+	}
+	declared := make([]string, 0, len(keys))
+	for _, key := range order {
+		if present[key] {
+			declared = append(declared, key)
+			delete(present, key)
+		}
+	}
+	rest := make([]string, 0, len(present))
+	for key := range present {
+		rest = append(rest, key)
+	}
+	sort.Strings(rest)
+	return append(declared, rest...)
+}
+
+// findModelPattern 返回匹配模型名的最高优先级规则
+func findModelPattern(keys []string, order []string, model string) (*modelPattern, bool) {
+	for _, p := range orderedModelPatterns(keys, order) {
+		if p.match(model) {
+			return p, true
+		}
+	}
+	return nil, false
+}
+
+// validateModelPatterns 检查映射规则：无法编译、被更高优先级规则完全覆盖（永远不会生效）、
+// 或与同等优先级的规则重叠且目标不同（结果取决于声明顺序）
+func validateModelPatterns(mapping map[string]string, order []string) []configIssue {
+	keys := make([]string, 0, len(mapping))
+	for key := range mapping {
+		keys = append(keys, key)
+	}
+	var issues []configIssue
+	for _, key := range declarationOrder(keys, order) {
+		if _, err := compileModelPattern(key); err != nil {
+			issues = append(issues, configIssue{severity: configSeverityError, message: fmt.Sprintf("模型映射无效：%v", err)})
+		}
+	}
+
+	patterns := orderedModelPatterns(keys, order)
+	for i, later := range patterns {
+		if later.exact {
+			continue
+		}
+		for _, earlier := range patterns[:i] {
+			if earlier.exact {
+				continue
+			}
+			// 更高优先级的规则能匹配这条通配符的各种展开，说明它能匹配的模型名都会先被截走
+			if !later.regex && patternCovers(earlier, later) {
+				issues = append(issues, configIssue{severity: configSeverityWarning, message: fmt.Sprintf(
+					modelPatternAdvisory+" '%s' 被优先级更高的 '%s' 完全覆盖，永远不会生效", later.pattern, earlier.pattern)})
+				break
+			}
+			// 优先级相同、部分重叠（不是包含关系）且目标不同：重叠部分只能靠声明顺序决定
+			if earlier.prefix == later.prefix && mapping[earlier.pattern] != mapping[later.pattern] &&
+				!later.regex && !patternCovers(later, earlier) && patternsOverlap(earlier, later) {
+				issues = append(issues, configIssue{severity: configSeverityWarning, message: fmt.Sprintf(
+					modelPatternAdvisory+" '%s' 与 '%s' 优先级相同且存在重叠，重叠的模型按声明顺序使用 '%s'",
+					earlier.pattern, later.pattern, earlier.pattern)})
+				break
+			}
+		}
+	}
+	return issues
+}
+
+// patternCovers 粗略判断 a 是否能匹配 b 能匹配的所有模型名：把 b 的 * 展开为不同长度、? 展开为单个字符后都能被 a 匹配
+func patternCovers(a *modelPattern, b *modelPattern) bool {
+	for _, fill := range []string{"", "\x00", "\x00\x00\x00\x00"} {
+		sample := strings.NewReplacer("*", fill, "?", "\x00").Replace(b.pattern)
+		if !a.match(sample) {
+			return false
+		}
+	}
+	return true
+}
+
+// patternsOverlap 判断两条通配符是否存在同时匹配的模型名（按两条规则同步消费字符搜索，正则规则不判断）
+func patternsOverlap(a *modelPattern, b *modelPattern) bool {
+	if a.regex || b.regex {
+		return false
+	}
+	pa, pb := []rune(a.pattern), []rune(b.pattern)
+	type state struct{ i, j int }
+	seen := map[state]bool{}
+	queue := []state{{0, 0}}
+	for len(queue) > 0 {
+		cur := queue[0]
+		queue = queue[1:]
+		if seen[cur] {
+			continue
+		}
+		seen[cur] = true
+		if cur.i == len(pa) && cur.j == len(pb) {
+			return true
+		}
+		// * 可以匹配空串
+		if cur.i < len(pa) && pa[cur.i] == '*' {
+			queue = append(queue, state{cur.i + 1, cur.j})
+		}
+		if cur.j < len(pb) && pb[cur.j] == '*' {
+			queue = append(queue, state{cur.i, cur.j + 1})
+		}
+		// 两条规则同时消费一个字符
+		if cur.i == len(pa) || cur.j == len(pb) {
+			continue
+		}
+		ca, cb := pa[cur.i], pb[cur.j]
+		if ca != '*' && ca != '?' && cb != '*' && cb != '?' && ca != cb {
+			continue
+		}
+		next := cur
+		if ca != '*' {
+			next.i++
+		}
+		if cb != '*' {
+			next.j++
+		}
+		if next != cur {
+			queue = append(queue, next)
+		}
+	}
+	return false
+}
+
+// blockingConfigErrors 过滤掉提示性的验证结果，返回会导致 provider 被跳过的错误
+func blockingConfigErrors(issues []configIssue) []string {
+	blocking := make([]string, 0, len(issues))
+	for _, issue := range issues {
+		if issue.severity == configSeverityError {
+			blocking = append(blocking, issue.message)
+		}
+	}
+	return blocking
+}
+
+// jsonObjectKeys 返回 JSON 对象的键（保持原文顺序）
+func jsonObjectKeys(raw gjson.Result) []string {
+	if !raw.IsObject() {
+		return nil
+	}
+	var keys []string
+	raw.ForEach(func(key, _ gjson.Result) bool {
+		keys = append(keys, key.String())
+		return true
+	})
+	return keys
+}
+
+// marshalOrderedMapping 按声明顺序序列化模型映射（encoding/json 会按键名排序，丢失声明顺序）
+func marshalOrderedMapping(mapping map[string]string, order []string) ([]byte, error) {
+	keys := make([]string, 0, len(mapping))
+	for key := range mapping {
+		keys = append(keys, key)
+	}
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, key := range declarationOrder(keys, order) {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		k, err := json.Marshal(key)
+		if err != nil {
+			return nil, err
+		}
+		v, err := json.Marshal(mapping[key])
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(k)
+		buf.WriteByte(':')
+		buf.Write(v)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
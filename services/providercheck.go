@@ -0,0 +1,550 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/daodao97/xgo/xdb"
+	"github.com/tidwall/gjson"
+)
+
+const (
+	providerCheckMaxTokens = 16               // 检查请求的输出上限（足够返回几个 token，又不会产生明显费用）
+	providerCheckTimeout   = 60 * time.Second // 单次检查超时
+)
+
+// 检查结论
+const (
+	ProviderCheckOK                = "ok"                 // 流式请求成功
+	ProviderCheckAuthFailed        = "auth_failed"        // 401 / 403，密钥无效或已过期
+	ProviderCheckModelUnavailable  = "model_unavailable"  // 模型不存在或无权使用
+	ProviderCheckEndpointNotFound  = "endpoint_not_found" // 404 且不是模型错误：API 地址或路径配置有误
+	ProviderCheckStreamUnsupported = "stream_unsupported" // 非流式可用，流式失败
+	ProviderCheckRateLimited       = "rate_limited"       // 上游限流
+	ProviderCheckUpstreamError     = "upstream_error"     // 其他上游错误
+	ProviderCheckConnectionError   = "connection_error"   // 连接失败或超时
+)
+
+// 检查请求使用的上游协议
+const (
+	checkWireAnthropic = "anthropic" // Messages API
+	checkWireResponses = "responses" // OpenAI Responses API
+	checkWireChat      = "chat"      // OpenAI Chat Completions API
+	checkWireGemini    = "gemini"    // Gemini generateContent
+)
+
+// ProviderCheckResult 一次 provider 补全检查的结果
+type ProviderCheckResult struct {
+	ID              int64  `json:"id"`
+	Platform        string `json:"platform"`
+	Provider        string `json:"provider"`
+	RequestedModel  string `json:"requestedModel"`
+	Model           string `json:"model"` // 映射后实际发送的模型
+	Status          string `json:"status"`
+	KeyValid        bool   `json:"keyValid"`
+	ModelAvailable  bool   `json:"modelAvailable"`
+	StreamSupported bool   `json:"streamSupported"`
+	HttpCode        int    `json:"httpCode"`
+	TTFTMs          int64  `json:"ttftMs"`    // 首个内容 token 耗时（流式）
+	LatencyMs       int64  `json:"latencyMs"` // 总耗时
+	InputTokens     int    `json:"inputTokens"`
+	OutputTokens    int    `json:"outputTokens"`
+	Error           string `json:"error,omitempty"`
+	CreatedAt       string `json:"createdAt"`
+}
+
+// providerCheckTarget 待检查的 provider
+type providerCheckTarget struct {
+	platform string
+	name     string
+	wire     string
+	build    func(stream bool) (*http.Request, error)
+}
+
+// checkAttempt 一次检查请求的结果
+type checkAttempt struct {
+	httpCode     int
+	contentType  string
+	errorBody    string
+	err          error
+	ttft         time.Duration
+	latency      time.Duration
+	inputTokens  int
+	outputTokens int
+	completed    bool // 流式：收到结束事件；非流式：响应为有效 JSON
+}
+
+// CheckProvider 向 provider 发送一次最小的真实补全请求（流式），检查密钥、模型与流式是否可用
+// model 为空时使用默认检查模型（与健康探测相同的选择规则），按 provider 的模型映射转换后发送；结果写入 provider_check_log
+func (s *SpeedTestService) CheckProvider(platform string, providerName string, model string) (*ProviderCheckResult, error) {
+	target, requested, effective, err := s.findCheckTarget(platform, providerName, model)
+	if err != nil {
+		return nil, err
+	}
+
+	result := runProviderCheck(s.checkClient(), target)
+	result.RequestedModel = requested
+	result.Model = effective
+	saveProviderCheckResult(result)
+	return result, nil
+}
+
+// GetProviderCheckHistory 获取检查记录（platform、provider 为空时不过滤），用于发现密钥过期或服务退化
+func (s *SpeedTestService) GetProviderCheckHistory(platform string, provider string, limit int) ([]ProviderCheckResult, error) {
+	if limit <= 0 || limit > 1000 {
+		limit = 100
+	}
+	options := []xdb.Option{
+		xdb.OrderByDesc("id"),
+		xdb.Limit(limit),
+	}
+	if platform != "" {
+		options = append(options, xdb.WhereEq("platform", platform))
+	}
+	if provider != "" {
+		options = append(options, xdb.WhereEq("provider", provider))
+	}
+	records, err := xdb.New("provider_check_log").Selects(options...)
+	if err != nil {
+		if isNoSuchTableErr(err) || errors.Is(err, xdb.ErrNotFound) {
+			return []ProviderCheckResult{}, nil
+		}
+		return nil, err
+	}
+
+	results := make([]ProviderCheckResult, 0, len(records))
+	for _, record := range records {
+		results = append(results, ProviderCheckResult{
+			ID:              record.GetInt64("id"),
+			Platform:        record.GetString("platform"),
+			Provider:        record.GetString("provider"),
+			RequestedModel:  record.GetString("requested_model"),
+			Model:           record.GetString("model"),
+			Status:          record.GetString("status"),
+			KeyValid:        record.GetInt("key_valid") == 1,
+			ModelAvailable:  record.GetInt("model_available") == 1,
+			StreamSupported: record.GetInt("stream_supported") == 1,
+			HttpCode:        record.GetInt("http_code"),
+			TTFTMs:          record.GetInt64("ttft_ms"),
+			LatencyMs:       record.GetInt64("latency_ms"),
+			InputTokens:     record.GetInt("input_tokens"),
+			OutputTokens:    record.GetInt("output_tokens"),
+			Error:           record.GetString("error"),
+			CreatedAt:       record.GetString("created_at"),
+		})
+	}
+	return results, nil
+}
+
+// findCheckTarget 查找 provider（未启用的也可以检查）并确定检查模型
+func (s *SpeedTestService) findCheckTarget(platform string, providerName string, model string) (providerCheckTarget, string, string, error) {
+	defaults := DefaultHealthProbeConfig().ProbeModels
+	switch platform {
+	case "claude", "codex":
+		if s.providerService == nil {
+			return providerCheckTarget{}, "", "", fmt.Errorf("provider 服务未初始化")
+		}
+		providers, err := s.providerService.LoadProviders(platform)
+		if err != nil {
+			return providerCheckTarget{}, "", "", err
+		}
+		for i := range providers {
+			p := providers[i]
+			if p.Name != providerName {
+				continue
+			}
+			if p.APIURL == "" || p.APIKey == "" {
+				return providerCheckTarget{}, "", "", fmt.Errorf("provider %s 未配置 API 地址或密钥", p.Name)
+			}
+			requested, effective := checkModelFor(model, defaults[platform], p.SupportedModels, p.IsModelSupported, p.GetEffectiveModel)
+			if effective == "" {
+				return providerCheckTarget{}, "", "", fmt.Errorf("provider %s 未配置可用于检查的模型，请指定模型", p.Name)
+			}
+			wire := checkWireAnthropic
+			if platform == "codex" {
+				wire = checkWireResponses
+			}
+			return providerCheckTarget{
+				platform: platform,
+				name:     p.Name,
+				wire:     wire,
+				build: func(stream bool) (*http.Request, error) {
+					return buildProviderCompletionRequest(platform, &p, effective, providerCheckMaxTokens, stream)
+				},
+			}, requested, effective, nil
+		}
+	case "gemini":
+		if s.geminiService == nil {
+			return providerCheckTarget{}, "", "", fmt.Errorf("Gemini 服务未初始化")
+		}
+		for _, p := range s.geminiService.GetProviders() {
+			if p.Name != providerName {
+				continue
+			}
+			provider := p
+			if provider.BaseURL == "" {
+				return providerCheckTarget{}, "", "", fmt.Errorf("provider %s 未配置 API 地址", provider.Name)
+			}
+			fallback := defaults["gemini"]
+			if provider.UpstreamFormat() != GeminiAPIFormatGemini && provider.Model != "" {
+				// 非 Gemini 协议的 provider 不认识 Gemini 模型名，默认使用 provider 配置的模型
+				fallback = provider.Model
+			}
+			requested, effective := checkModelFor(model, fallback, provider.SupportedModels, provider.IsModelSupported, provider.GetEffectiveModel)
+			if effective == "" {
+				return providerCheckTarget{}, "", "", fmt.Errorf("provider %s 未配置可用于检查的模型，请指定模型", provider.Name)
+			}
+			wire := checkWireGemini
+			switch provider.UpstreamFormat() {
+			case GeminiAPIFormatAnthropic:
+				wire = checkWireAnthropic
+			case GeminiAPIFormatOpenAI:
+				wire = checkWireChat
+			}
+			return providerCheckTarget{
+				platform: platform,
+				name:     provider.Name,
+				wire:     wire,
+				build: func(stream bool) (*http.Request, error) {
+					return buildGeminiCompletionRequest(&provider, effective, providerCheckMaxTokens, stream)
+				},
+			}, requested, effective, nil
+		}
+	default:
+		return providerCheckTarget{}, "", "", fmt.Errorf("不支持的平台: %s", platform)
+	}
+	return providerCheckTarget{}, "", "", fmt.Errorf("未找到 provider %s/%s", platform, providerName)
+}
+
+// checkModelFor 返回请求模型与映射后的模型：指定了模型时直接使用（即使不在白名单中，检查结果会说明模型是否可用）
+func checkModelFor(model string, fallback string, supportedModels map[string]bool, isSupported func(string) bool, effective func(string) string) (string, string) {
+	if model = strings.TrimSpace(model); model != "" {
+		return model, effective(model)
+	}
+	if fallback != "" && isSupported(fallback) {
+		return fallback, effective(fallback)
+	}
+	picked := probeModelFor("", supportedModels, isSupported, effective)
+	return picked, picked
+}
+
+// checkClient 检查请求使用的客户端，整体超时与单次检查超时一致（包括读完流式响应）
+func (s *SpeedTestService) checkClient() *http.Client {
+	if s.client != nil {
+		return s.client
+	}
+	return &http.Client{Timeout: providerCheckTimeout}
+}
+
+// runProviderCheck 先发送流式请求；流式失败但不是鉴权 / 模型问题时，再用非流式请求区分是否只是流式不可用
+func runProviderCheck(client *http.Client, target providerCheckTarget) *ProviderCheckResult {
+	result := &ProviderCheckResult{Platform: target.platform, Provider: target.name}
+
+	stream := sendCheckRequest(client, target, true)
+	result.HttpCode = stream.httpCode
+	result.LatencyMs = stream.latency.Milliseconds()
+	result.TTFTMs = stream.ttft.Milliseconds()
+	result.InputTokens = stream.inputTokens
+	result.OutputTokens = stream.outputTokens
+
+	if status, known := classifyCheckFailure(stream); known {
+		result.Status = status
+		result.KeyValid = checkKeyValid(status)
+		result.Error = checkAttemptError(stream)
+		return result
+	}
+	if stream.httpCode >= 200 && stream.httpCode < 300 && stream.completed {
+		result.Status = ProviderCheckOK
+		result.KeyValid = true
+		result.ModelAvailable = true
+		result.StreamSupported = true
+		return result
+	}
+
+	// 流式失败：用非流式请求判断密钥和模型是否可用
+	plain := sendCheckRequest(client, target, false)
+	if status, known := classifyCheckFailure(plain); known {
+		result.Status = status
+		result.HttpCode = plain.httpCode
+		result.KeyValid = checkKeyValid(status)
+		result.Error = checkAttemptError(plain)
+		return result
+	}
+	if plain.httpCode >= 200 && plain.httpCode < 300 && plain.completed {
+		result.Status = ProviderCheckStreamUnsupported
+		result.KeyValid = true
+		result.ModelAvailable = true
+		result.LatencyMs = plain.latency.Milliseconds()
+		result.TTFTMs = 0
+		result.InputTokens = plain.inputTokens
+		result.OutputTokens = plain.outputTokens
+		result.Error = "流式请求失败: " + checkAttemptError(stream)
+		return result
+	}
+	// 其他错误无法判断密钥是否有效，KeyValid 保持 false
+	result.Status = ProviderCheckUpstreamError
+	result.Error = checkAttemptError(stream)
+	return result
+}
+
+// classifyCheckFailure 归类可以直接下结论的失败（连接、鉴权、模型、限流）
+func classifyCheckFailure(attempt checkAttempt) (string, bool) {
+	if attempt.httpCode == 0 {
+		return ProviderCheckConnectionError, true
+	}
+	switch attempt.httpCode {
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return ProviderCheckAuthFailed, true
+	case http.StatusNotFound:
+		// 404 也可能是 API 地址或路径错误，只有错误体指向模型时才认为模型不可用
+		if isModelNotFoundError(attempt.errorBody) {
+			return ProviderCheckModelUnavailable, true
+		}
+		return ProviderCheckEndpointNotFound, true
+	case http.StatusTooManyRequests:
+		return ProviderCheckRateLimited, true
+	}
+	if attempt.httpCode >= 400 && attempt.httpCode < 500 && mentionsModelError(attempt.errorBody) {
+		return ProviderCheckModelUnavailable, true
+	}
+	return "", false
+}
+
+// checkKeyValid 检查结论能否说明密钥有效（鉴权失败、连接失败、地址错误时无法判断）
+func checkKeyValid(status string) bool {
+	switch status {
+	case ProviderCheckAuthFailed, ProviderCheckConnectionError, ProviderCheckEndpointNotFound:
+		return false
+	}
+	return true
+}
+
+// isModelNotFoundError 404 错误体是否为模型不存在
+// OpenAI: error.code = model_not_found；Anthropic: error.type = not_found_error 且 message 指向模型；其他按关键字判断
+func isModelNotFoundError(body string) bool {
+	errorResult := gjson.Get(body, "error")
+	if errorResult.Get("code").String() == "model_not_found" {
+		return true
+	}
+	message := strings.ToLower(errorResult.Get("message").String())
+	if errorResult.Get("type").String() == "not_found_error" && strings.Contains(message, "model") {
+		return true
+	}
+	return mentionsModelError(body)
+}
+
+// mentionsModelError 错误体是否指向模型不存在或无权使用
+func mentionsModelError(body string) bool {
+	lower := strings.ToLower(body)
+	if !strings.Contains(lower, "model") {
+		return false
+	}
+	for _, hint := range []string{"not found", "not exist", "does not exist", "not supported", "unsupported", "invalid model", "unknown model", "no access", "not available", "模型不存在", "不支持"} {
+		if strings.Contains(lower, hint) {
+			return true
+		}
+	}
+	return false
+}
+
+func checkAttemptError(attempt checkAttempt) string {
+	if attempt.err != nil {
+		return attempt.err.Error()
+	}
+	if attempt.errorBody != "" {
+		return fmt.Sprintf("HTTP %d: %s", attempt.httpCode, attempt.errorBody)
+	}
+	if attempt.httpCode >= 200 && attempt.httpCode < 300 && !attempt.completed {
+		return fmt.Sprintf("响应不完整（Content-Type: %s）", attempt.contentType)
+	}
+	return fmt.Sprintf("HTTP %d", attempt.httpCode)
+}
+
+// sendCheckRequest 发送一次检查请求并读取响应
+func sendCheckRequest(client *http.Client, target providerCheckTarget, stream bool) checkAttempt {
+	var attempt checkAttempt
+	req, err := target.build(stream)
+	if err != nil {
+		attempt.err = fmt.Errorf("创建请求失败: %w", err)
+		return attempt
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), providerCheckTimeout)
+	defer cancel()
+	req = req.WithContext(ctx)
+
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		attempt.latency = time.Since(start)
+		attempt.err = err
+		return attempt
+	}
+	defer resp.Body.Close()
+	attempt.httpCode = resp.StatusCode
+	attempt.contentType = resp.Header.Get("Content-Type")
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorBodyBytes))
+		attempt.errorBody = truncateErrorBody(strings.TrimSpace(string(body)))
+		attempt.latency = time.Since(start)
+		return attempt
+	}
+
+	if !stream {
+		body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+		attempt.latency = time.Since(start)
+		if err != nil {
+			attempt.err = err
+			return attempt
+		}
+		attempt.completed = gjson.ValidBytes(body) && !gjson.GetBytes(body, "error").Exists()
+		if !attempt.completed {
+			attempt.errorBody = truncateErrorBody(strings.TrimSpace(string(body)))
+		}
+		applyCheckUsage(target.wire, string(body), &attempt)
+		return attempt
+	}
+
+	if !strings.Contains(attempt.contentType, "text/event-stream") {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorBodyBytes))
+		attempt.latency = time.Since(start)
+		attempt.err = fmt.Errorf("上游没有返回流式响应（Content-Type: %s）: %s", attempt.contentType, truncateErrorBody(strings.TrimSpace(string(body))))
+		return attempt
+	}
+	err = readSSEData(resp.Body, func(data string) (bool, error) {
+		if data == "[DONE]" {
+			return true, nil
+		}
+		if gjson.Get(data, "error").Exists() || gjson.Get(data, "type").String() == "error" {
+			return false, fmt.Errorf("流中返回错误: %s", truncateErrorBody(data))
+		}
+		if attempt.ttft == 0 && checkEventHasContent(target.wire, data) {
+			attempt.ttft = time.Since(start)
+		}
+		applyCheckUsage(target.wire, data, &attempt)
+		return checkEventDone(target.wire, data), nil
+	})
+	attempt.latency = time.Since(start)
+	if err != nil {
+		attempt.err = err
+		return attempt
+	}
+	attempt.completed = true
+	return attempt
+}
+
+// checkEventHasContent 事件是否包含内容增量（文本或思考）
+func checkEventHasContent(wire string, data string) bool {
+	switch wire {
+	case checkWireResponses:
+		return strings.HasSuffix(gjson.Get(data, "type").String(), ".delta")
+	case checkWireChat:
+		delta := gjson.Get(data, "choices.0.delta")
+		return delta.Get("content").String() != "" || delta.Get("reasoning_content").String() != ""
+	case checkWireGemini:
+		return gjson.Get(data, "candidates.0.content.parts.#").Int() > 0
+	default:
+		return gjson.Get(data, "type").String() == "content_block_delta"
+	}
+}
+
+// checkEventDone 事件是否表示响应结束
+func checkEventDone(wire string, data string) bool {
+	switch wire {
+	case checkWireResponses:
+		return gjson.Get(data, "type").String() == "response.completed"
+	case checkWireChat:
+		return false // 以 [DONE] 结束（usage 在 [DONE] 之前的最后一个事件中）
+	case checkWireGemini:
+		return gjson.Get(data, "candidates.0.finishReason").String() != ""
+	default:
+		return gjson.Get(data, "type").String() == "message_stop"
+	}
+}
+
+// applyCheckUsage 读取响应（或流式事件）中的用量，取最大值（各协议的累计方式不同）
+func applyCheckUsage(wire string, data string, attempt *checkAttempt) {
+	var input, output int64
+	switch wire {
+	case checkWireResponses:
+		usage := gjson.Get(data, "response.usage")
+		if !usage.Exists() {
+			usage = gjson.Get(data, "usage")
+		}
+		input, output = usage.Get("input_tokens").Int(), usage.Get("output_tokens").Int()
+	case checkWireChat:
+		usage := gjson.Get(data, "usage")
+		input, output = usage.Get("prompt_tokens").Int(), usage.Get("completion_tokens").Int()
+	case checkWireGemini:
+		usage := gjson.Get(data, "usageMetadata")
+		input, output = usage.Get("promptTokenCount").Int(), usage.Get("candidatesTokenCount").Int()
+	default:
+		usage := gjson.Get(data, "usage")
+		if !usage.Exists() {
+			usage = gjson.Get(data, "message.usage")
+		}
+		input = usage.Get("input_tokens").Int() + usage.Get("cache_creation_input_tokens").Int() + usage.Get("cache_read_input_tokens").Int()
+		output = usage.Get("output_tokens").Int()
+	}
+	attempt.inputTokens = max(attempt.inputTokens, int(input))
+	attempt.outputTokens = max(attempt.outputTokens, int(output))
+}
+
+// saveProviderCheckResult 写入 provider_check_log（独立于 request_log，不参与费用统计）
+func saveProviderCheckResult(result *ProviderCheckResult) {
+	result.CreatedAt = time.Now().Format(timeLayout)
+	if GlobalDBQueueLogs == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err := GlobalDBQueueLogs.ExecBatchCtx(ctx, `
+		INSERT INTO provider_check_log (platform, provider, requested_model, model, status, key_valid, model_available,
+			stream_supported, http_code, ttft_ms, latency_ms, input_tokens, output_tokens, error)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, result.Platform, result.Provider, result.RequestedModel, result.Model, result.Status, boolToInt(result.KeyValid),
+		boolToInt(result.ModelAvailable), boolToInt(result.StreamSupported), result.HttpCode, result.TTFTMs, result.LatencyMs,
+		result.InputTokens, result.OutputTokens, result.Error)
+	if err != nil {
+		fmt.Printf("⚠️  写入 provider_check_log 失败: %v\n", err)
+	}
+}
+
+// ensureProviderCheckTable 确保 provider_check_log 表存在
+func ensureProviderCheckTable() error {
+	db, err := xdb.DB("default")
+	if err != nil {
+		return fmt.Errorf("获取数据库连接失败: %w", err)
+	}
+
+	const createSQL = `CREATE TABLE IF NOT EXISTS provider_check_log (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		platform TEXT,
+		provider TEXT,
+		requested_model TEXT,
+		model TEXT,
+		status TEXT,
+		key_valid INTEGER DEFAULT 0,
+		model_available INTEGER DEFAULT 0,
+		stream_supported INTEGER DEFAULT 0,
+		http_code INTEGER DEFAULT 0,
+		ttft_ms INTEGER DEFAULT 0,
+		latency_ms INTEGER DEFAULT 0,
+		input_tokens INTEGER DEFAULT 0,
+		output_tokens INTEGER DEFAULT 0,
+		error TEXT,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	)`
+	if _, err := db.Exec(createSQL); err != nil {
+		return fmt.Errorf("创建 provider_check_log 表失败: %w", err)
+	}
+	if _, err := db.Exec(`CREATE INDEX IF NOT EXISTS idx_provider_check_log_provider ON provider_check_log(platform, provider, id)`); err != nil {
+		return fmt.Errorf("创建 provider_check_log 索引失败: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,117 @@
+package services
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/tidwall/gjson"
+)
+
+func TestProviderCheck(t *testing.T) {
+	var mode string
+	var gotModel string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		gotModel = gjson.GetBytes(body, "model").String()
+		stream := gjson.GetBytes(body, "stream").Bool()
+		switch {
+		case mode == "wrong-path":
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `404 page not found`)
+		case mode == "model-404":
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"error":{"message":"The model does not exist","type":"invalid_request_error","code":"model_not_found"}}`)
+		case r.Header.Get("x-api-key") != "sk-good":
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprint(w, `{"type":"error","error":{"type":"authentication_error","message":"invalid x-api-key"}}`)
+		case gotModel != "claude-haiku-4-5-20251001":
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, `{"type":"error","error":{"type":"invalid_request_error","message":"model: %s not found"}}`, gotModel)
+		case stream && mode == "no-stream":
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprint(w, `{"error":{"message":"stream is not supported"}}`)
+		case stream:
+			w.Header().Set("Content-Type", "text/event-stream")
+			fmt.Fprint(w, "event: message_start\ndata: {\"type\":\"message_start\",\"message\":{\"usage\":{\"input_tokens\":8,\"output_tokens\":1}}}\n\n")
+			fmt.Fprint(w, "event: content_block_delta\ndata: {\"type\":\"content_block_delta\",\"delta\":{\"type\":\"text_delta\",\"text\":\"pong\"}}\n\n")
+			fmt.Fprint(w, "event: message_delta\ndata: {\"type\":\"message_delta\",\"usage\":{\"output_tokens\":3}}\n\n")
+			fmt.Fprint(w, "event: message_stop\ndata: {\"type\":\"message_stop\"}\n\n")
+		default:
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprint(w, `{"type":"message","content":[{"type":"text","text":"pong"}],"usage":{"input_tokens":8,"output_tokens":2}}`)
+		}
+	}))
+	defer upstream.Close()
+
+	provider := Provider{
+		Name:            "reseller",
+		APIURL:          upstream.URL,
+		APIKey:          "sk-good",
+		SupportedModels: map[string]bool{"claude-haiku-4-5-20251001": true},
+		ModelMapping:    map[string]string{"claude-haiku-4-5": "claude-haiku-4-5-20251001"},
+	}
+	check := func(p Provider, model string) *ProviderCheckResult {
+		requested, effective := checkModelFor(model, "claude-haiku-4-5", p.SupportedModels, p.IsModelSupported, p.GetEffectiveModel)
+		if requested == "" {
+			t.Fatalf("no check model")
+		}
+		return runProviderCheck(upstream.Client(), providerCheckTarget{
+			platform: "claude",
+			name:     p.Name,
+			wire:     checkWireAnthropic,
+			build: func(stream bool) (*http.Request, error) {
+				return buildProviderCompletionRequest("claude", &p, effective, providerCheckMaxTokens, stream)
+			},
+		})
+	}
+
+	result := check(provider, "")
+	if gotModel != "claude-haiku-4-5-20251001" {
+		t.Errorf("check should use mapped model, sent %q", gotModel)
+	}
+	if result.Status != ProviderCheckOK || !result.KeyValid || !result.ModelAvailable || !result.StreamSupported {
+		t.Fatalf("unexpected result: %+v", result)
+	}
+	if result.InputTokens != 8 || result.OutputTokens != 3 || result.TTFTMs > result.LatencyMs {
+		t.Errorf("unexpected usage / timing: %+v", result)
+	}
+
+	mode = "no-stream"
+	result = check(provider, "")
+	if result.Status != ProviderCheckStreamUnsupported || !result.KeyValid || !result.ModelAvailable || result.StreamSupported || result.OutputTokens != 2 {
+		t.Errorf("expected stream_unsupported, got %+v", result)
+	}
+	mode = ""
+
+	result = check(provider, "claude-opus-9")
+	if result.Status != ProviderCheckModelUnavailable || !result.KeyValid || result.ModelAvailable {
+		t.Errorf("expected model_unavailable, got %+v", result)
+	}
+
+	// 404：错误体指向模型时为 model_unavailable，否则是 API 地址或路径错误
+	mode = "model-404"
+	result = check(provider, "")
+	if result.Status != ProviderCheckModelUnavailable || !result.KeyValid {
+		t.Errorf("expected model_unavailable for model_not_found 404, got %+v", result)
+	}
+	mode = "wrong-path"
+	result = check(provider, "")
+	if result.Status != ProviderCheckEndpointNotFound || result.KeyValid || result.ModelAvailable {
+		t.Errorf("expected endpoint_not_found for bare 404, got %+v", result)
+	}
+	mode = ""
+
+	expired := provider
+	expired.APIKey = "sk-expired"
+	result = check(expired, "")
+	if result.Status != ProviderCheckAuthFailed || result.KeyValid || result.HttpCode != http.StatusUnauthorized {
+		t.Errorf("expected auth_failed, got %+v", result)
+	}
+
+	if client := NewSpeedTestService(nil, nil).checkClient(); client == http.DefaultClient || client.Timeout != providerCheckTimeout {
+		t.Errorf("check client should have a %v timeout, got %v", providerCheckTimeout, client.Timeout)
+	}
+}
@@ -0,0 +1,97 @@
+package services
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 客户端指定 provider 的请求头（调试、A/B 对比用，需在设置中开启）
+const (
+	pinProviderHeader = "X-Code-Switch-Provider" // 只使用该名称的 provider
+	pinLevelHeader    = "X-Code-Switch-Level"    // 只在该 Level 内选择 provider
+)
+
+// clientPin 客户端通过请求头指定的 provider / Level
+type clientPin struct {
+	provider string
+	level    int
+}
+
+// parseClientPin 解析请求头的值，同时指定时以 provider 为准
+func parseClientPin(provider string, level string) (clientPin, error) {
+	pin := clientPin{provider: strings.TrimSpace(provider)}
+	if level = strings.TrimSpace(level); level != "" && pin.provider == "" {
+		value, err := strconv.Atoi(level)
+		if err != nil || value <= 0 {
+			return clientPin{}, fmt.Errorf("%s 必须是正整数: %q", pinLevelHeader, level)
+		}
+		pin.level = value
+	}
+	return pin, nil
+}
+
+// takeClientPin 读取并移除指定 provider 的请求头，无论是否生效都不会转发给上游
+// 设置未开启时忽略请求头
+func (prs *ProviderRelayService) takeClientPin(c *gin.Context) (clientPin, error) {
+	pin, ignored, err := prs.clientPinFromHeader(c.Request.Header)
+	c.Request.Header.Del(pinProviderHeader)
+	c.Request.Header.Del(pinLevelHeader)
+	if ignored {
+		fmt.Printf("[WARN] 收到 %s / %s 请求头，但未开启客户端指定 provider，已忽略\n", pinProviderHeader, pinLevelHeader)
+	}
+	if err != nil {
+		return clientPin{}, err
+	}
+	if pin.provider != "" {
+		fmt.Printf("[INFO] 📍 客户端指定 Provider: %s\n", pin.provider)
+	} else if pin.level > 0 {
+		fmt.Printf("[INFO] 📍 客户端指定 Level: %d\n", pin.level)
+	}
+	return pin, nil
+}
+
+// clientPinFromHeader 从请求头解析指定的 provider / Level（转发与路由演练共用）
+// 设置未开启时 ignored 为 true，返回空的 clientPin
+func (prs *ProviderRelayService) clientPinFromHeader(header http.Header) (pin clientPin, ignored bool, err error) {
+	provider := header.Get(pinProviderHeader)
+	level := header.Get(pinLevelHeader)
+	if provider == "" && level == "" {
+		return clientPin{}, false, nil
+	}
+	enabled, err := prs.settingsService.GetProviderPinningEnabled()
+	if err != nil || !enabled {
+		return clientPin{}, true, nil
+	}
+	pin, err = parseClientPin(provider, level)
+	return pin, false, err
+}
+
+// active 是否指定了 provider 或 Level
+func (p clientPin) active() bool {
+	return p.provider != "" || p.level > 0
+}
+
+// pinned 是否为客户端指定的 provider（指定的 provider 不受启用状态、能力声明和黑名单限制）
+func (p clientPin) pinned(name string) bool {
+	return p.provider != "" && p.provider == name
+}
+
+// matches provider 是否在客户端指定的范围内
+func (p clientPin) matches(name string, level int) bool {
+	if p.provider != "" {
+		return p.provider == name
+	}
+	return p.level <= 0 || providerLevel(level) == p.level
+}
+
+// describe 用于错误信息
+func (p clientPin) describe() string {
+	if p.provider != "" {
+		return fmt.Sprintf("%s: %s", pinProviderHeader, p.provider)
+	}
+	return fmt.Sprintf("%s: %d", pinLevelHeader, p.level)
+}
@@ -0,0 +1,34 @@
+package services
+
+import "testing"
+
+func TestClientPin(t *testing.T) {
+	pin, err := parseClientPin(" relay-b ", "2")
+	if err != nil {
+		t.Fatalf("解析失败: %v", err)
+	}
+	if !pin.matches("relay-b", 1) || pin.matches("relay-a", 2) {
+		t.Error("同时指定时应以 provider 为准，忽略 Level")
+	}
+	if !pin.pinned("relay-b") || pin.pinned("relay-a") {
+		t.Error("只有指定的 provider 才绕过启用状态和黑名单")
+	}
+
+	pin, err = parseClientPin("", "1")
+	if err != nil {
+		t.Fatalf("解析失败: %v", err)
+	}
+	if !pin.matches("relay-a", 0) || !pin.matches("relay-b", 1) || pin.matches("relay-c", 2) {
+		t.Error("指定 Level 时只保留该 Level 的 provider（未配置 Level 视为 1）")
+	}
+	if pin.pinned("relay-a") {
+		t.Error("只指定 Level 时不应绕过常规过滤")
+	}
+
+	if _, err := parseClientPin("", "abc"); err == nil {
+		t.Error("非数字 Level 应报错")
+	}
+	if pin, _ := parseClientPin("", ""); pin.active() || !pin.matches("any", 3) {
+		t.Error("未指定时不应限制 provider")
+	}
+}
@@ -8,7 +8,6 @@ import (
 	"fmt"
 	"io"
 	"net/http"
-	"sort"
 	"strings"
 	"time"
 
@@ -17,12 +16,24 @@ import (
 	"github.com/gin-gonic/gin"
 	"github.com/tidwall/gjson"
 	"github.com/tidwall/sjson"
+
+	modelpricing "codeswitch/resources/model-pricing"
 )
 
 type ProviderRelayService struct {
 	providerService  *ProviderService
 	geminiService    *GeminiService
 	blacklistService *BlacklistService
+	settingsService  *SettingsService
+	transports       *relayTransportPool
+	affinity         *providerAffinity
+	responseOwners   *providerAffinity // Codex response ID -> 创建它的 provider
+	thinkingOwners   *providerAffinity // 思考块签名哈希 -> 生成它的 provider
+	pricing          *modelpricing.Service
+	scoreboard       *providerScoreboard // 近期成功率与延迟，费用优先路由时用于同价排序
+	quotas           *quotaTracker       // 上游限流头与套餐用量窗口
+	shadowSlots      chan struct{}       // 同时进行的影子请求（已满时丢弃新的影子请求）
+	appSettings      *AppSettingsService
 	server           *http.Server
 	addr             string
 }
@@ -30,7 +41,7 @@ type ProviderRelayService struct {
 // errClientAbort 表示客户端中断连接，不应计入 provider 失败次数
 var errClientAbort = errors.New("client aborted, skip failure count")
 
-func NewProviderRelayService(providerService *ProviderService, geminiService *GeminiService, blacklistService *BlacklistService, addr string) *ProviderRelayService {
+func NewProviderRelayService(providerService *ProviderService, geminiService *GeminiService, blacklistService *BlacklistService, settingsService *SettingsService, addr string) *ProviderRelayService {
 	if addr == "" {
 		addr = "127.0.0.1:18100" // 【安全修复】仅监听本地回环地址，防止 API Key 暴露到局域网
 	}
@@ -38,10 +49,24 @@ func NewProviderRelayService(providerService *ProviderService, geminiService *Ge
 	// 【修复】数据库初始化已移至 main.go 的 InitDatabase()
 	// 此处不再调用 xdb.Inits()、ensureRequestLogTable()、ensureBlacklistTables()
 
+	pricing, err := modelpricing.DefaultService()
+	if err != nil {
+		fmt.Printf("[WARN] 加载模型价格失败，费用优先路由不可用: %v\n", err)
+	}
+
 	return &ProviderRelayService{
 		providerService:  providerService,
 		geminiService:    geminiService,
 		blacklistService: blacklistService,
+		settingsService:  settingsService,
+		transports:       newRelayTransportPool(defaultRelayTransportConfig()),
+		affinity:         newProviderAffinity(affinityTTL),
+		responseOwners:   newProviderAffinity(responseAffinityTTL),
+		thinkingOwners:   newProviderAffinity(thinkingSignatureTTL),
+		pricing:          pricing,
+		scoreboard:       newProviderScoreboard(),
+		quotas:           newQuotaTracker(),
+		shadowSlots:      make(chan struct{}, maxConcurrentShadows),
 		addr:             addr,
 	}
 }
@@ -114,6 +139,18 @@ func (prs *ProviderRelayService) validateConfig() []string {
 		}
 	}
 
+	// Gemini provider 的模型配置验证
+	if prs.geminiService != nil {
+		for _, p := range prs.geminiService.GetProviders() {
+			if !p.Enabled {
+				continue
+			}
+			for _, errMsg := range p.ValidateConfiguration() {
+				warnings = append(warnings, fmt.Sprintf("[gemini/%s] %s", p.Name, errMsg))
+			}
+		}
+	}
+
 	return warnings
 }
 
@@ -123,13 +160,20 @@ func (prs *ProviderRelayService) Stop() error {
 	}
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
-	return prs.server.Shutdown(ctx)
+	err := prs.server.Shutdown(ctx)
+	prs.transports.CloseIdleConnections()
+	return err
 }
 
 func (prs *ProviderRelayService) Addr() string {
 	return prs.addr
 }
 
+// GetTransportStats 获取各 provider 的上游连接复用统计
+func (prs *ProviderRelayService) GetTransportStats() []RelayTransportStats {
+	return prs.transports.Stats()
+}
+
 func (prs *ProviderRelayService) registerRoutes(router gin.IRouter) {
 	router.POST("/v1/messages", prs.proxyHandler("claude", "/v1/messages"))
 	router.POST("/responses", prs.proxyHandler("codex", "/responses"))
@@ -141,11 +185,15 @@ func (prs *ProviderRelayService) registerRoutes(router gin.IRouter) {
 
 func (prs *ProviderRelayService) proxyHandler(kind string, endpoint string) gin.HandlerFunc {
 	return func(c *gin.Context) {
+		// 同一客户端请求的所有尝试共用一个请求 ID，便于追溯降级过程
+		requestID := newRequestID()
+		c.Header(requestIDHeader, requestID)
+
 		var bodyBytes []byte
 		if c.Request.Body != nil {
 			data, err := io.ReadAll(c.Request.Body)
 			if err != nil {
-				c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request body"})
+				prs.writeRelayError(c, kind, http.StatusBadRequest, relayCodeInvalidRequest)
 				return
 			}
 			bodyBytes = data
@@ -155,379 +203,609 @@ func (prs *ProviderRelayService) proxyHandler(kind string, endpoint string) gin.
 		isStream := gjson.GetBytes(bodyBytes, "stream").Bool()
 		requestedModel := gjson.GetBytes(bodyBytes, "model").String()
 
+		// 流式中断续传（可选）：上游中途断开时用已输出内容续写
+		resume := prs.newStreamResume(kind, isStream)
+
+		// 客户端通过请求头指定 provider / Level（需在设置中开启）
+		pin, err := prs.takeClientPin(c)
+		if err != nil {
+			prs.writeRelayError(c, kind, http.StatusBadRequest, relayCodeInvalidPin, err)
+			return
+		}
+
 		// 如果未指定模型，记录警告但不拦截
 		if requestedModel == "" {
 			fmt.Printf("[WARN] 请求未指定模型名，无法执行模型智能降级\n")
 		}
 
-		providers, err := prs.providerService.LoadProviders(kind)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to load providers"})
-			return
+		// 模型降级链：请求模型的所有 provider 都不可用或可重试地失败后，依次改用链上的下一个模型
+		var writeError func()
+		for i, model := range prs.modelFallbackChain(kind, requestedModel) {
+			currentBody := bodyBytes
+			fallbackFrom := ""
+			if i > 0 {
+				// 客户端已收到部分内容或已断开时不再降级
+				if c.Writer.Written() || c.Request.Context().Err() != nil {
+					break
+				}
+				modified, err := ReplaceModelInRequestBody(bodyBytes, model)
+				if err != nil {
+					fmt.Printf("[ERROR] 降级模型 %s 替换模型名失败: %v\n", model, err)
+					break
+				}
+				currentBody = modified
+				fallbackFrom = requestedModel
+				c.Header(requestedModelHeader, requestedModel)
+				c.Header(fallbackModelHeader, model)
+				fmt.Printf("[WARN] ⤵️ 模型降级: %s -> %s\n", requestedModel, model)
+			}
+			var retryable bool
+			writeError, retryable = prs.relayModel(c, kind, endpoint, requestID, pin, resume, isStream, model, currentBody, fallbackFrom)
+			if writeError == nil {
+				return
+			}
+			// 上游以不可重试的 4xx 拒绝了请求（请求本身无效），换模型也不会成功
+			if !retryable {
+				break
+			}
 		}
+		writeError()
+	}
+}
 
-		active := make([]Provider, 0, len(providers))
-		skippedCount := 0
-		for _, provider := range providers {
-			// 基础过滤：enabled、URL、APIKey
-			if !provider.Enabled || provider.APIURL == "" || provider.APIKey == "" {
-				continue
+// relayModel 在支持该模型的 provider 之间选择并转发（会话亲和、Level、拉黑 / 降级模式）
+// 返回 nil 表示已响应客户端；否则所有 provider 均不可用或失败，返回的函数写出对应的错误，
+// 第二个返回值表示失败是否可重试（没有可用 provider、5xx、429、网络错误），只有可重试时调用方才尝试降级模型
+// fallbackFrom 非空表示这是模型降级后的请求，值为客户端原本请求的模型
+func (prs *ProviderRelayService) relayModel(c *gin.Context, kind string, endpoint string, requestID string, pin clientPin,
+	resume *streamResume, isStream bool, requestedModel string, bodyBytes []byte, fallbackFrom string) (func(), bool) {
+	providers, err := prs.providerService.LoadProviders(kind)
+	if err != nil {
+		prs.writeRelayError(c, kind, http.StatusInternalServerError, relayCodeConfigLoadFailed, kind)
+		return nil, false
+	}
+	names := make([]string, 0, len(providers))
+	for _, p := range providers {
+		names = append(names, p.Name)
+	}
+	prs.transports.retain(kind, names)
+
+	// 请求用到的能力（图片、工具、思考等），不具备的 provider 直接跳过
+	required := requiredCapabilities(kind, bodyBytes, c.Request.Header)
+	active, skipped := prs.filterProviders(kind, providers, pin, requestedModel, required)
+	skippedCount := countedSkips(skipped)
+
+	// Codex 的 previous_response_id 只有创建该 response 的 provider 能解析，必须固定到该 provider
+	if kind == "codex" {
+		if previousID, owner, ok := prs.previousResponseOwner(bodyBytes); ok {
+			pinned := pinToProvider(active, owner)
+			if len(pinned) == 0 {
+				fmt.Printf("[WARN] previous_response_id %s 所属 Provider %s 当前不可用\n", previousID, owner)
+				prs.writeRelayErrorParam(c, kind, http.StatusServiceUnavailable, relayCodePreviousResponsePinned, "previous_response_id",
+					previousID, owner, requestedModel)
+				return nil, false
 			}
+			fmt.Printf("[INFO] 📌 previous_response_id %s 固定到 Provider %s\n", previousID, owner)
+			active = pinned
+		}
+	}
 
-			// 配置验证：失败则自动跳过
-			if errs := provider.ValidateConfiguration(); len(errs) > 0 {
-				fmt.Printf("[WARN] Provider %s 配置验证失败，已自动跳过: %v\n", provider.Name, errs)
-				skippedCount++
-				continue
+	if len(active) == 0 {
+		return func() {
+			if pin.active() {
+				prs.writeRelayError(c, kind, http.StatusBadRequest, relayCodePinnedUnavailable, pin.describe(), requestedModel)
+			} else if requestedModel != "" {
+				prs.writeRelayError(c, kind, relayUnavailableStatus(kind), relayCodeModelUnsupported, requestedModel, skippedCount)
+			} else {
+				prs.writeRelayError(c, kind, relayUnavailableStatus(kind), relayCodeNoProvider, kind)
 			}
+		}, true
+	}
 
-			// 核心过滤：只保留支持请求模型的 provider
-			if requestedModel != "" && !provider.IsModelSupported(requestedModel) {
-				fmt.Printf("[INFO] Provider %s 不支持模型 %s，已跳过\n", provider.Name, requestedModel)
-				skippedCount++
-				continue
-			}
+	fmt.Printf("[INFO] 找到 %d 个可用的 provider（已过滤 %d 个）：", len(active), skippedCount)
+	for _, p := range active {
+		fmt.Printf("%s ", p.Name)
+	}
+	fmt.Println()
 
-			// 黑名单检查：跳过已拉黑的 provider
-			if isBlacklisted, until := prs.blacklistService.IsBlacklisted(kind, provider.Name); isBlacklisted {
-				fmt.Printf("⛔ Provider %s 已拉黑，过期时间: %v\n", provider.Name, until.Format("15:04:05"))
-				skippedCount++
-				continue
+	// 按 Level 分组并排序（费用优先、会话亲和、额度感知）
+	levelGroups, levels, affinityKey, affinityProvider := prs.orderProviders(kind, active, requestedModel, bodyBytes)
+
+	query := flattenQuery(c.Request.URL.Query())
+	clientHeaders := cloneHeaders(c.Request.Header)
+
+	// 获取拉黑功能开关状态
+	blacklistEnabled := prs.blacklistService.IsLevelBlacklistEnabled()
+
+	// 【拉黑模式】：只尝试第一个 provider，失败不切换到其他 provider
+	// 只有当 provider 被拉黑后，下次请求才会自动使用下一个；可重试的失败仍会按模型降级链换模型
+	if blacklistEnabled {
+		fmt.Printf("[INFO] 🔒 拉黑模式已开启，禁用自动降级\n")
+
+		// 找到第一个 provider（按 Level 升序）
+		var firstProvider *Provider
+		var firstLevel int
+		for _, level := range levels {
+			if len(levelGroups[level]) > 0 {
+				p := levelGroups[level][0]
+				firstProvider = &p
+				firstLevel = level
+				break
 			}
+		}
 
-			active = append(active, provider)
+		if firstProvider == nil {
+			return func() {
+				prs.writeRelayError(c, kind, relayUnavailableStatus(kind), relayCodeNoProvider, kind)
+			}, true
 		}
 
-		if len(active) == 0 {
-			if requestedModel != "" {
-				c.JSON(http.StatusNotFound, gin.H{
-					"error": fmt.Sprintf("没有可用的 provider 支持模型 '%s'（已跳过 %d 个不兼容的 provider）", requestedModel, skippedCount),
-				})
-			} else {
-				c.JSON(http.StatusNotFound, gin.H{"error": "no providers available"})
+		// 获取实际模型名
+		effectiveModel := firstProvider.GetEffectiveModel(requestedModel)
+		currentBodyBytes := bodyBytes
+		if effectiveModel != requestedModel && requestedModel != "" {
+			fmt.Printf("[INFO] Provider %s 映射模型: %s -> %s\n", firstProvider.Name, requestedModel, effectiveModel)
+			modifiedBody, err := ReplaceModelInRequestBody(bodyBytes, effectiveModel)
+			if err != nil {
+				prs.writeRelayError(c, kind, http.StatusInternalServerError, relayCodeModelMappingFailed, firstProvider.Name, err)
+				return nil, false
 			}
-			return
+			currentBodyBytes = modifiedBody
 		}
 
-		fmt.Printf("[INFO] 找到 %d 个可用的 provider（已过滤 %d 个）：", len(active), skippedCount)
-		for _, p := range active {
-			fmt.Printf("%s ", p.Name)
+		fmt.Printf("[INFO] [拉黑模式] 使用 Provider: %s (Level %d) | Model: %s\n", firstProvider.Name, firstLevel, effectiveModel)
+
+		requestLog := &ReqeustLog{
+			Platform:     kind,
+			Provider:     firstProvider.Name,
+			Model:        effectiveModel,
+			IsStream:     isStream,
+			AffinityHit:  firstProvider.Name == affinityProvider,
+			RequestID:    requestID,
+			Attempt:      1,
+			Level:        providerLevel(firstProvider.Level),
+			FallbackFrom: fallbackFrom,
+			resume:       resume,
+			shadowText:   newShadowCapture(providers),
 		}
-		fmt.Println()
-
-		// 按 Level 分组
-		levelGroups := make(map[int][]Provider)
-		for _, p := range active {
-			level := p.Level
-			if level <= 0 {
-				level = 1 // 默认 Level 1
+		startTime := time.Now()
+		ok, err := prs.forwardRequest(c, kind, *firstProvider, endpoint, query, clientHeaders, currentBodyBytes, isStream, requestLog)
+		duration := time.Since(startTime)
+
+		if ok {
+			fmt.Printf("[INFO] ✓ 成功: %s | 耗时: %.2fs\n", firstProvider.Name, duration.Seconds())
+			prs.affinity.Set(affinityKey, firstProvider.Name)
+			if err := prs.blacklistService.RecordSuccess(kind, firstProvider.Name); err != nil {
+				fmt.Printf("[WARN] 清零失败计数失败: %v\n", err)
 			}
-			levelGroups[level] = append(levelGroups[level], p)
+			prs.saveRequestLog(requestLog)
+			prs.mirrorShadow(kind, endpoint, query, clientHeaders, bodyBytes, requestedModel, isStream, providers, requestLog)
+			return nil, false
 		}
 
-		// 获取排序后的 Level 列表
-		var levels []int
-		for level := range levelGroups {
-			levels = append(levels, level)
+		// 失败：记录失败次数并返回错误（不降级到下一个 provider）
+		errorMsg := "未知错误"
+		if err != nil {
+			errorMsg = err.Error()
 		}
-		sort.Ints(levels)
+		fmt.Printf("[WARN] ✗ 失败: %s | 错误: %s | 耗时: %.2fs（拉黑模式，不降级）\n",
+			firstProvider.Name, errorMsg, duration.Seconds())
 
-		query := flattenQuery(c.Request.URL.Query())
-		clientHeaders := cloneHeaders(c.Request.Header)
+		// 客户端中断不计入失败次数
+		prs.recordAttemptFailure(kind, requestLog)
+		prs.saveRequestLog(requestLog)
 
-		// 获取拉黑功能开关状态
-		blacklistEnabled := prs.blacklistService.IsLevelBlacklistEnabled()
-
-		// 【拉黑模式】：只尝试第一个 provider，失败直接返回错误（不自动降级）
-		// 只有当 provider 被拉黑后，下次请求才会自动使用下一个
-		if blacklistEnabled {
-			fmt.Printf("[INFO] 🔒 拉黑模式已开启，禁用自动降级\n")
+		var failures relayFailures
+		failures.add(requestLog.HttpCode)
+		writeError := func() {
+			prs.writeRelayError(c, kind, failures.status(kind), relayCodeProviderFailed, firstProvider.Name, errorMsg)
+		}
+		// 客户端已收到部分内容时不能再换模型重新输出
+		if c.Writer.Written() {
+			writeError()
+			return nil, false
+		}
+		return writeError, !failures.allRejected()
+	}
 
-			// 找到第一个 provider（按 Level 升序）
-			var firstProvider *Provider
-			var firstLevel int
-			for _, level := range levels {
-				if len(levelGroups[level]) > 0 {
-					p := levelGroups[level][0]
-					firstProvider = &p
-					firstLevel = level
-					break
-				}
+	// 【降级模式】：拉黑功能关闭，失败自动尝试下一个 provider
+	fmt.Printf("[INFO] 🔄 降级模式（拉黑功能已关闭）\n")
+
+	var lastError error
+	var lastProvider string
+	var lastDuration time.Duration
+	totalAttempts := 0
+	var failures relayFailures
+
+levelLoop:
+	for _, level := range levels {
+		providersInLevel := levelGroups[level]
+		fmt.Printf("[INFO] === 尝试 Level %d（%d 个 provider）===\n", level, len(providersInLevel))
+
+		for i, provider := range providersInLevel {
+			// 客户端已收到部分内容且无法续传时，不能再换 provider 重新输出
+			if c.Writer.Written() && (resume == nil || resume.exhausted()) {
+				fmt.Printf("[WARN] 响应已开始发送给客户端且无法续传，停止降级\n")
+				break levelLoop
 			}
+			totalAttempts++
 
-			if firstProvider == nil {
-				c.JSON(http.StatusNotFound, gin.H{"error": "no providers available"})
-				return
-			}
+			// 获取实际应该使用的模型名
+			effectiveModel := provider.GetEffectiveModel(requestedModel)
 
-			// 获取实际模型名
-			effectiveModel := firstProvider.GetEffectiveModel(requestedModel)
+			// 如果需要映射，修改请求体
 			currentBodyBytes := bodyBytes
 			if effectiveModel != requestedModel && requestedModel != "" {
-				fmt.Printf("[INFO] Provider %s 映射模型: %s -> %s\n", firstProvider.Name, requestedModel, effectiveModel)
+				fmt.Printf("[INFO] Provider %s 映射模型: %s -> %s\n", provider.Name, requestedModel, effectiveModel)
+
 				modifiedBody, err := ReplaceModelInRequestBody(bodyBytes, effectiveModel)
 				if err != nil {
-					c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("模型映射失败: %v", err)})
-					return
+					fmt.Printf("[ERROR] 替换模型名失败: %v\n", err)
+					// 映射失败不应阻止尝试其他 provider
+					continue
 				}
 				currentBodyBytes = modifiedBody
 			}
 
-			fmt.Printf("[INFO] [拉黑模式] 使用 Provider: %s (Level %d) | Model: %s\n", firstProvider.Name, firstLevel, effectiveModel)
-
+			fmt.Printf("[INFO]   [%d/%d] Provider: %s | Model: %s\n", i+1, len(providersInLevel), provider.Name, effectiveModel)
+
+			// 尝试发送请求
+			requestLog := &ReqeustLog{
+				Platform:     kind,
+				Provider:     provider.Name,
+				Model:        effectiveModel,
+				IsStream:     isStream,
+				AffinityHit:  provider.Name == affinityProvider,
+				RequestID:    requestID,
+				Attempt:      totalAttempts,
+				Level:        providerLevel(provider.Level),
+				FallbackFrom: fallbackFrom,
+				resume:       resume,
+				shadowText:   newShadowCapture(providers),
+			}
 			startTime := time.Now()
-			ok, err := prs.forwardRequest(c, kind, *firstProvider, endpoint, query, clientHeaders, currentBodyBytes, isStream, effectiveModel)
+			ok, err := prs.forwardRequest(c, kind, provider, endpoint, query, clientHeaders, currentBodyBytes, isStream, requestLog)
 			duration := time.Since(startTime)
 
 			if ok {
-				fmt.Printf("[INFO] ✓ 成功: %s | 耗时: %.2fs\n", firstProvider.Name, duration.Seconds())
-				if err := prs.blacklistService.RecordSuccess(kind, firstProvider.Name); err != nil {
+				fmt.Printf("[INFO]   ✓ Level %d 成功: %s | 耗时: %.2fs\n", level, provider.Name, duration.Seconds())
+				prs.affinity.Set(affinityKey, provider.Name)
+
+				// 成功：清零连续失败计数
+				if err := prs.blacklistService.RecordSuccess(kind, provider.Name); err != nil {
 					fmt.Printf("[WARN] 清零失败计数失败: %v\n", err)
 				}
-				return
+				prs.saveRequestLog(requestLog)
+				prs.mirrorShadow(kind, endpoint, query, clientHeaders, bodyBytes, requestedModel, isStream, providers, requestLog)
+
+				return nil, false // 成功，立即返回
 			}
 
-			// 失败：记录失败次数并返回错误（不降级到下一个 provider）
+			// 失败：记录错误并尝试下一个
+			lastError = err
+			lastProvider = provider.Name
+			lastDuration = duration
+			failures.add(requestLog.HttpCode)
+
 			errorMsg := "未知错误"
 			if err != nil {
 				errorMsg = err.Error()
 			}
-			fmt.Printf("[WARN] ✗ 失败: %s | 错误: %s | 耗时: %.2fs（拉黑模式，不降级）\n",
-				firstProvider.Name, errorMsg, duration.Seconds())
+			fmt.Printf("[WARN]   ✗ Level %d 失败: %s | 错误: %s | 耗时: %.2fs\n",
+				level, provider.Name, errorMsg, duration.Seconds())
 
 			// 客户端中断不计入失败次数
-			if errors.Is(err, errClientAbort) {
-				fmt.Printf("[INFO] 客户端中断，跳过失败计数: %s\n", firstProvider.Name)
-			} else if err := prs.blacklistService.RecordFailure(kind, firstProvider.Name); err != nil {
-				fmt.Printf("[ERROR] 记录失败到黑名单失败: %v\n", err)
-			}
-
-			c.JSON(http.StatusBadGateway, gin.H{
-				"error":    fmt.Sprintf("Provider %s 请求失败: %s", firstProvider.Name, errorMsg),
-				"provider": firstProvider.Name,
-				"level":    firstLevel,
-				"duration": fmt.Sprintf("%.2fs", duration.Seconds()),
-				"mode":     "blacklist",
-				"hint":     "拉黑模式已开启，不自动降级。如需自动降级请关闭拉黑功能",
-			})
-			return
+			prs.recordAttemptFailure(kind, requestLog)
+			prs.saveRequestLog(requestLog)
 		}
 
-		// 【降级模式】：拉黑功能关闭，失败自动尝试下一个 provider
-		fmt.Printf("[INFO] 🔄 降级模式（拉黑功能已关闭）\n")
-
-		var lastError error
-		var lastProvider string
-		var lastDuration time.Duration
-		totalAttempts := 0
-
-		for _, level := range levels {
-			providersInLevel := levelGroups[level]
-			fmt.Printf("[INFO] === 尝试 Level %d（%d 个 provider）===\n", level, len(providersInLevel))
-
-			for i, provider := range providersInLevel {
-				totalAttempts++
-
-				// 获取实际应该使用的模型名
-				effectiveModel := provider.GetEffectiveModel(requestedModel)
-
-				// 如果需要映射，修改请求体
-				currentBodyBytes := bodyBytes
-				if effectiveModel != requestedModel && requestedModel != "" {
-					fmt.Printf("[INFO] Provider %s 映射模型: %s -> %s\n", provider.Name, requestedModel, effectiveModel)
-
-					modifiedBody, err := ReplaceModelInRequestBody(bodyBytes, effectiveModel)
-					if err != nil {
-						fmt.Printf("[ERROR] 替换模型名失败: %v\n", err)
-						// 映射失败不应阻止尝试其他 provider
-						continue
-					}
-					currentBodyBytes = modifiedBody
-				}
-
-				fmt.Printf("[INFO]   [%d/%d] Provider: %s | Model: %s\n", i+1, len(providersInLevel), provider.Name, effectiveModel)
-
-				// 尝试发送请求
-				startTime := time.Now()
-				ok, err := prs.forwardRequest(c, kind, provider, endpoint, query, clientHeaders, currentBodyBytes, isStream, effectiveModel)
-				duration := time.Since(startTime)
-
-				if ok {
-					fmt.Printf("[INFO]   ✓ Level %d 成功: %s | 耗时: %.2fs\n", level, provider.Name, duration.Seconds())
-
-					// 成功：清零连续失败计数
-					if err := prs.blacklistService.RecordSuccess(kind, provider.Name); err != nil {
-						fmt.Printf("[WARN] 清零失败计数失败: %v\n", err)
-					}
-
-					return // 成功，立即返回
-				}
+		fmt.Printf("[WARN] Level %d 的所有 %d 个 provider 均失败，尝试下一 Level\n", level, len(providersInLevel))
+	}
 
-				// 失败：记录错误并尝试下一个
-				lastError = err
-				lastProvider = provider.Name
-				lastDuration = duration
+	// 所有 provider 都失败：全部限流时返回 429，全部被拒绝时透传上游的 4xx，否则返回服务不可用
+	errorMsg := "未知错误"
+	if lastError != nil {
+		errorMsg = lastError.Error()
+	}
+	fmt.Printf("[ERROR] 所有 %d 个 provider 均失败，最后尝试: %s | 错误: %s | 耗时: %.2fs\n",
+		totalAttempts, lastProvider, errorMsg, lastDuration.Seconds())
+
+	writeError := func() {
+		switch {
+		case failures.allRateLimited():
+			prs.writeRelayError(c, kind, failures.status(kind), relayCodeUpstreamRateLimited, totalAttempts, lastProvider)
+		case failures.allRejected():
+			prs.writeRelayError(c, kind, failures.status(kind), relayCodeUpstreamRejected, totalAttempts, failures.lastStatus, lastProvider, errorMsg)
+		default:
+			prs.writeRelayError(c, kind, failures.status(kind), relayCodeAllProvidersFailed, totalAttempts, lastProvider, errorMsg)
+		}
+	}
+	// 客户端已收到部分内容时不能再换模型重新输出
+	if c.Writer.Written() {
+		writeError()
+		return nil, false
+	}
+	return writeError, !failures.allRejected()
+}
 
-				errorMsg := "未知错误"
-				if err != nil {
-					errorMsg = err.Error()
-				}
-				fmt.Printf("[WARN]   ✗ Level %d 失败: %s | 错误: %s | 耗时: %.2fs\n",
-					level, provider.Name, errorMsg, duration.Seconds())
-
-				// 客户端中断不计入失败次数
-				if errors.Is(err, errClientAbort) {
-					fmt.Printf("[INFO] 客户端中断，跳过失败计数: %s\n", provider.Name)
-				} else if err := prs.blacklistService.RecordFailure(kind, provider.Name); err != nil {
-					fmt.Printf("[ERROR] 记录失败到黑名单失败: %v\n", err)
-				}
+// preferAffinityProvider 把会话亲和的 provider 移到其所在 Level 的最前面
+// 只在 Level 内调整顺序，不会越过优先级更高的 Level
+func preferAffinityProvider(levelGroups map[int][]Provider, levels []int, name string) bool {
+	for _, level := range levels {
+		group := levelGroups[level]
+		for i, p := range group {
+			if p.Name != name {
+				continue
 			}
-
-			fmt.Printf("[WARN] Level %d 的所有 %d 个 provider 均失败，尝试下一 Level\n", level, len(providersInLevel))
+			if i > 0 {
+				reordered := make([]Provider, 0, len(group))
+				reordered = append(reordered, p)
+				reordered = append(reordered, group[:i]...)
+				reordered = append(reordered, group[i+1:]...)
+				levelGroups[level] = reordered
+			}
+			return true
 		}
+	}
+	return false
+}
 
-		// 所有 provider 都失败，返回 502
-		errorMsg := "未知错误"
-		if lastError != nil {
-			errorMsg = lastError.Error()
+func (prs *ProviderRelayService) forwardRequest(
+	c *gin.Context,
+	kind string,
+	provider Provider,
+	endpoint string,
+	query map[string]string,
+	clientHeaders map[string]string,
+	bodyBytes []byte,
+	isStream bool,
+	requestLog *ReqeustLog,
+) (bool, error) {
+	originalBody := bodyBytes
+	resume := requestLog.resume
+	if resume != nil && resume.started {
+		continued, err := resume.continuationBody(bodyBytes)
+		if err != nil {
+			requestLog.fail(relayErrorStream, err.Error())
+			return false, err
 		}
-		fmt.Printf("[ERROR] 所有 %d 个 provider 均失败，最后尝试: %s | 错误: %s\n",
-			totalAttempts, lastProvider, errorMsg)
-
-		c.JSON(http.StatusBadGateway, gin.H{
-			"error":          fmt.Sprintf("所有 %d 个 provider 均失败，最后错误: %s", totalAttempts, errorMsg),
-			"last_provider":  lastProvider,
-			"last_duration":  fmt.Sprintf("%.2fs", lastDuration.Seconds()),
-			"total_attempts": totalAttempts,
-		})
+		bodyBytes = continued
+		requestLog.ResumeCount++
+		fmt.Printf("[INFO] Provider %s 续传中断的流式响应（第 %d 次）\n", provider.Name, resume.resumes)
 	}
+	return prs.forwardAttempt(c, kind, provider, endpoint, query, clientHeaders, originalBody, bodyBytes, isStream, requestLog)
 }
 
-func (prs *ProviderRelayService) forwardRequest(
+// forwardAttempt 发送一次上游请求；bodyBytes 为已拼接续传预填充的请求体，originalBody 为续传前的请求体
+// 签名重试直接复用本次的续传请求体，每次尝试只生成一次续传
+func (prs *ProviderRelayService) forwardAttempt(
 	c *gin.Context,
 	kind string,
 	provider Provider,
 	endpoint string,
 	query map[string]string,
 	clientHeaders map[string]string,
+	originalBody []byte,
 	bodyBytes []byte,
 	isStream bool,
-	model string,
+	requestLog *ReqeustLog,
 ) (bool, error) {
 	targetURL := joinURL(provider.APIURL, endpoint)
+	resume := requestLog.resume
+	requestBody := bodyBytes
 	headers := cloneMap(clientHeaders)
 	headers["Authorization"] = fmt.Sprintf("Bearer %s", provider.APIKey)
 	if _, ok := headers["Accept"]; !ok {
 		headers["Accept"] = "application/json"
 	}
 
-	requestLog := &ReqeustLog{
-		Platform: kind,
-		Provider: provider.Name,
-		Model:    model,
-		IsStream: isStream,
+	// 兼容性处理：移除或降级该 provider 不支持的字段
+	bodyBytes, headers, compatChanges := applyCompatProfile(kind, provider.Compat, bodyBytes, headers)
+	if len(compatChanges) > 0 {
+		fmt.Printf("[INFO] Provider %s 兼容性处理: %s\n", provider.Name, strings.Join(compatChanges, ", "))
+	}
+	// 思考块签名只能由生成它的 provider 校验，切换 provider 后需要移除历史中的外来思考块
+	if kind == "claude" {
+		bodyBytes = prs.stripForeignThinking(provider.Name, bodyBytes)
 	}
+
 	start := time.Now()
+	requestLog.beginAttempt()
 	defer func() {
 		requestLog.DurationSec = time.Since(start).Seconds()
-
-		// 【修复】判空保护：避免队列未初始化时 panic
-		if GlobalDBQueueLogs == nil {
-			fmt.Printf("⚠️  写入 request_log 失败: 队列未初始化\n")
-			return
-		}
-
-		// 使用批量队列写入 request_log（高频同构操作，批量提交）
-		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-		defer cancel()
-
-		err := GlobalDBQueueLogs.ExecBatchCtx(ctx, `
-			INSERT INTO request_log (
-				platform, model, provider, http_code,
-				input_tokens, output_tokens, cache_create_tokens, cache_read_tokens,
-				reasoning_tokens, is_stream, duration_sec
-			) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
-		`,
-			requestLog.Platform,
-			requestLog.Model,
-			requestLog.Provider,
-			requestLog.HttpCode,
-			requestLog.InputTokens,
-			requestLog.OutputTokens,
-			requestLog.CacheCreateTokens,
-			requestLog.CacheReadTokens,
-			requestLog.ReasoningTokens,
-			boolToInt(requestLog.IsStream),
-			requestLog.DurationSec,
-		)
-
-		if err != nil {
-			fmt.Printf("写入 request_log 失败: %v\n", err)
-		}
+		requestLog.finishTiming()
 	}()
 
-	req := xrequest.New().
-		SetHeaders(headers).
-		SetQueryParams(query).
-		SetRetry(1, 500*time.Millisecond).
-		SetTimeout(3 * time.Hour) // 3小时超时，适配大型项目分析
-
-	reqBody := bytes.NewReader(bodyBytes)
-	req = req.SetBody(reqBody)
-
-	resp, err := req.Post(targetURL)
-
-	// 无论成功失败，先尝试记录 HttpCode
-	if resp != nil {
-		requestLog.HttpCode = resp.StatusCode()
+	// 直接构造请求：bytes.Reader 让标准库设置 ContentLength 和 GetBody，请求体零拷贝且可在 HTTP/2 重试时重放
+	req, err := http.NewRequestWithContext(c.Request.Context(), http.MethodPost, targetURL, bytes.NewReader(bodyBytes))
+	if err != nil {
+		requestLog.fail(relayErrorRequest, err.Error())
+		return false, err
+	}
+	for key, value := range headers {
+		req.Header[key] = []string{value}
+	}
+	if req.Header.Get("Content-Type") == "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if len(query) > 0 {
+		values := req.URL.Query()
+		for key, value := range query {
+			values.Add(key, value)
+		}
+		req.URL.RawQuery = values.Encode()
 	}
 
+	rawResp, err := prs.transports.Do(kind, provider.Name, req, isStream)
 	if err != nil {
-		// resp 存在但 err != nil：可能是客户端中断，不计入失败
-		if resp != nil && requestLog.HttpCode == 0 {
-			fmt.Printf("[INFO] Provider %s 响应存在但状态码为0，判定为客户端中断\n", provider.Name)
+		// 客户端已断开：请求 context 被取消，不计入 provider 失败
+		if c.Request.Context().Err() != nil {
+			fmt.Printf("[INFO] Provider %s 请求被取消，判定为客户端中断\n", provider.Name)
+			requestLog.fail(relayErrorClientAbort, err.Error())
 			return false, fmt.Errorf("%w: %v", errClientAbort, err)
 		}
+		requestLog.fail(classifyRelayError(err), err.Error())
 		return false, err
 	}
+	requestLog.markFirstByte()
+	resp := xrequest.NewResponse(rawResp)
+	defer rawResp.Body.Close() // 错误响应也要关闭响应体，连接才能回到连接池
 
-	if resp == nil {
-		return false, fmt.Errorf("empty response")
-	}
-
+	// 无论成功失败，先记录 HttpCode
+	requestLog.HttpCode = resp.StatusCode()
 	status := requestLog.HttpCode
+	prs.quotas.observe(kind, provider.Name, rawResp.Header, status)
 
-	if resp.Error() != nil {
-		// resp 存在、有错误、但状态码为 0：客户端中断，不计入失败
-		if status == 0 {
-			fmt.Printf("[INFO] Provider %s 响应错误但状态码为0，判定为客户端中断\n", provider.Name)
-			return false, fmt.Errorf("%w: %v", errClientAbort, resp.Error())
+	if status >= http.StatusOK && status < http.StatusMultipleChoices {
+		// 中转站常以 200 返回 HTML 错误页：此时客户端尚未收到任何内容，直接判定失败以便降级
+		var isHTML bool
+		if rawResp.Body, isHTML = sniffHTML(rawResp.Body); isHTML {
+			body, _ := io.ReadAll(io.LimitReader(rawResp.Body, maxErrorBodyBytes+1))
+			requestLog.fail(relayErrorInvalidResp, "响应为 HTML 页面: "+string(body))
+			return false, fmt.Errorf("invalid response: status %d with HTML body", status)
 		}
-		return false, resp.Error()
-	}
 
-	// 状态码为 0 且无错误：当作成功处理
-	if status == 0 {
-		fmt.Printf("[WARN] Provider %s 返回状态码 0，但无错误，当作成功处理\n", provider.Name)
-		_, copyErr := resp.ToHttpResponseWriter(c.Writer, ReqeustLogHook(c, kind, requestLog))
-		if copyErr != nil {
+		validator := newResponseValidator(isStream)
+		logHook := ReqeustLogHook(c, kind, requestLog)
+		var copyErr error
+		switch {
+		case resume != nil:
+			copyErr = resume.relay(c, rawResp, func(data []byte) (bool, []byte) {
+				validator.hook(data)
+				return logHook(data)
+			})
+			if errors.Is(copyErr, errStreamInterrupted) {
+				// 先在同一 provider 上续传一次，仍失败再交给下一个 provider
+				if resume.retried != provider.Name && !resume.exhausted() {
+					resume.retried = provider.Name
+					fmt.Printf("[WARN] Provider %s 流式响应中断，尝试续传: %v\n", provider.Name, copyErr)
+					rawResp.Body.Close()
+					return prs.forwardRequest(c, kind, provider, endpoint, query, clientHeaders, originalBody, isStream, requestLog)
+				}
+				requestLog.fail(relayErrorStream, copyErr.Error())
+				return false, copyErr
+			}
+		case !isStream:
+			copyErr = writeValidatedResponse(c, rawResp, validator, logHook)
+		default:
+			_, copyErr = resp.ToHttpResponseWriter(c.Writer, logHook, validator.hook)
+		}
+
+		// 客户端中断导致的不完整不算 provider 的问题
+		if copyErr != nil && c.Request.Context().Err() != nil {
 			fmt.Printf("[WARN] 复制响应到客户端失败（不影响provider成功判定）: %v\n", copyErr)
+		} else {
+			if copyErr != nil {
+				validator.invalid(relayErrorTruncated, "读取上游响应失败: %v", copyErr)
+			}
+			if class, problem := validator.result(); class != "" {
+				fmt.Printf("[WARN] Provider %s 返回 %d 但响应无效（%s）: %s\n", provider.Name, status, class, problem)
+				requestLog.fail(class, problem)
+				return false, fmt.Errorf("%s: %s", class, problem)
+			}
 		}
+
+		// 记录 response ID 的归属，后续 previous_response_id 请求固定到该 provider
+		if kind == "codex" && requestLog.ResponseID != "" {
+			prs.responseOwners.Set(requestLog.ResponseID, provider.Name)
+		}
+		// 记录思考块签名的归属，会话切换到其他 provider 时据此移除
+		for _, signature := range requestLog.thinkingSignatures {
+			prs.thinkingOwners.Set(signatureKey(signature), provider.Name)
+		}
+		// 响应完整有效才算成功（复制失败是客户端问题，不是provider问题）
 		return true, nil
 	}
 
-	if status >= http.StatusOK && status < http.StatusMultipleChoices {
-		_, copyErr := resp.ToHttpResponseWriter(c.Writer, ReqeustLogHook(c, kind, requestLog))
-		if copyErr != nil {
-			fmt.Printf("[WARN] 复制响应到客户端失败（不影响provider成功判定）: %v\n", copyErr)
+	// 保留上游错误体（截断），便于追溯失败原因
+	errorBody, _ := io.ReadAll(io.LimitReader(rawResp.Body, maxErrorBodyBytes+1))
+
+	// 签名来源未知（如重启后）时，上游拒绝签名则去掉全部思考块重试一次
+	if kind == "claude" && status == http.StatusBadRequest && !requestLog.signatureRetried &&
+		isThinkingSignatureError(string(errorBody)) {
+		mode := prs.settingsService.GetThinkingSignatureMode()
+		all := func(string) bool { return true }
+		stripped, removed := stripThinkingBlocks(requestBody, mode, all)
+		if removed > 0 {
+			fmt.Printf("[INFO] Provider %s 拒绝思考块签名，移除 %d 个思考块后重试\n", provider.Name, removed)
+			requestLog.signatureRetried = true
+			rawResp.Body.Close()
+			// 续传前的请求体同样去掉思考块，之后再次续传时不会重新带上被拒绝的签名
+			strippedOriginal, _ := stripThinkingBlocks(originalBody, mode, all)
+			return prs.forwardAttempt(c, kind, provider, endpoint, query, clientHeaders, strippedOriginal, stripped, isStream, requestLog)
 		}
-		// 只要provider返回了2xx状态码，就算成功（复制失败是客户端问题，不是provider问题）
-		return true, nil
 	}
 
+	requestLog.fail(relayErrorUpstreamStatus, string(errorBody))
 	return false, fmt.Errorf("upstream status %d", status)
 }
 
+// saveRequestLog 写入一次上游尝试的 request_log 记录
+func (prs *ProviderRelayService) saveRequestLog(requestLog *ReqeustLog) {
+	prs.scoreboard.recordAttempt(requestLog)
+	if requestLog.HttpCode >= 200 && requestLog.HttpCode < 300 && requestLog.ErrorClass == "" && quotaTracked(requestLog.Platform) {
+		prs.quotas.recordUsage(requestLog.Platform, requestLog.Provider, requestLog.InputTokens+requestLog.OutputTokens)
+	}
+
+	// 【修复】判空保护：避免队列未初始化时 panic
+	if GlobalDBQueueLogs == nil {
+		fmt.Printf("⚠️  写入 request_log 失败: 队列未初始化\n")
+		return
+	}
+
+	// 使用批量队列写入 request_log（高频同构操作，批量提交）
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	err := GlobalDBQueueLogs.ExecBatchCtx(ctx, `
+		INSERT INTO request_log (
+			platform, model, provider, http_code,
+			input_tokens, output_tokens, cache_create_tokens, cache_read_tokens,
+			reasoning_tokens, is_stream, duration_sec, affinity_hit,
+			ttfb_sec, ttft_sec, stream_duration_sec, tokens_per_sec,
+			request_id, attempt, level, error_class, error_message, blacklist_counted,
+			resume_count, fallback_from
+		) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`,
+		requestLog.Platform,
+		requestLog.Model,
+		requestLog.Provider,
+		requestLog.HttpCode,
+		requestLog.InputTokens,
+		requestLog.OutputTokens,
+		requestLog.CacheCreateTokens,
+		requestLog.CacheReadTokens,
+		requestLog.ReasoningTokens,
+		boolToInt(requestLog.IsStream),
+		requestLog.DurationSec,
+		boolToInt(requestLog.AffinityHit),
+		requestLog.TTFBSec,
+		requestLog.TTFTSec,
+		requestLog.StreamDurationSec,
+		requestLog.TokensPerSec,
+		requestLog.RequestID,
+		requestLog.Attempt,
+		requestLog.Level,
+		requestLog.ErrorClass,
+		requestLog.ErrorMessage,
+		boolToInt(requestLog.BlacklistCounted),
+		requestLog.ResumeCount,
+		requestLog.FallbackFrom,
+	)
+
+	if err != nil {
+		fmt.Printf("写入 request_log 失败: %v\n", err)
+	}
+}
+
+// providerLevel 返回 provider 的有效 Level（未配置时为 1）
+func providerLevel(level int) int {
+	if level <= 0 {
+		return 1
+	}
+	return level
+}
+
 func cloneHeaders(header http.Header) map[string]string {
 	cloned := make(map[string]string, len(header))
 	for key, values := range header {
@@ -629,6 +907,48 @@ func ensureRequestLogTableWithDB(db *sql.DB) error {
 	if err := ensureRequestLogColumn(db, "duration_sec", "REAL DEFAULT 0"); err != nil {
 		return err
 	}
+	if err := ensureRequestLogColumn(db, "affinity_hit", "INTEGER DEFAULT 0"); err != nil {
+		return err
+	}
+	if err := ensureRequestLogColumn(db, "ttfb_sec", "REAL DEFAULT 0"); err != nil {
+		return err
+	}
+	if err := ensureRequestLogColumn(db, "ttft_sec", "REAL DEFAULT 0"); err != nil {
+		return err
+	}
+	if err := ensureRequestLogColumn(db, "stream_duration_sec", "REAL DEFAULT 0"); err != nil {
+		return err
+	}
+	if err := ensureRequestLogColumn(db, "tokens_per_sec", "REAL DEFAULT 0"); err != nil {
+		return err
+	}
+	if err := ensureRequestLogColumn(db, "request_id", "TEXT DEFAULT ''"); err != nil {
+		return err
+	}
+	if err := ensureRequestLogColumn(db, "attempt", "INTEGER DEFAULT 1"); err != nil {
+		return err
+	}
+	if err := ensureRequestLogColumn(db, "level", "INTEGER DEFAULT 0"); err != nil {
+		return err
+	}
+	if err := ensureRequestLogColumn(db, "error_class", "TEXT DEFAULT ''"); err != nil {
+		return err
+	}
+	if err := ensureRequestLogColumn(db, "error_message", "TEXT DEFAULT ''"); err != nil {
+		return err
+	}
+	if err := ensureRequestLogColumn(db, "blacklist_counted", "INTEGER DEFAULT 0"); err != nil {
+		return err
+	}
+	if err := ensureRequestLogColumn(db, "resume_count", "INTEGER DEFAULT 0"); err != nil {
+		return err
+	}
+	if err := ensureRequestLogColumn(db, "fallback_from", "TEXT DEFAULT ''"); err != nil {
+		return err
+	}
+	if _, err := db.Exec(`CREATE INDEX IF NOT EXISTS idx_request_log_request_id ON request_log(request_id)`); err != nil {
+		return err
+	}
 
 	return nil
 }
@@ -637,6 +957,19 @@ func ReqeustLogHook(c *gin.Context, kind string, usage *ReqeustLog) func(data []
 	return func(data []byte) (bool, []byte) {
 		payload := strings.TrimSpace(string(data))
 
+		if kind == "codex" && usage.ResponseID == "" {
+			usage.ResponseID = codexResponseID(payload)
+		}
+		if kind == "claude" {
+			usage.thinkingSignatures = append(usage.thinkingSignatures, thinkingSignaturesFrom(payload)...)
+		}
+		if usage.shadowText != nil {
+			usage.shadowText.WriteString(responseText(kind, payload))
+		}
+		if usage.timing.firstTokenAt.IsZero() && hasContentDelta(kind, payload) {
+			usage.markFirstToken()
+		}
+
 		parserFn := ClaudeCodeParseTokenUsageFromResponse
 		switch kind {
 		case "codex":
@@ -673,6 +1006,20 @@ type ReqeustLog struct {
 	ReasoningTokens   int     `json:"reasoning_tokens"`
 	IsStream          bool    `json:"is_stream"`
 	DurationSec       float64 `json:"duration_sec"`
+	AffinityHit       bool    `json:"affinity_hit"`        // 是否命中会话亲和
+	TTFBSec           float64 `json:"ttfb_sec"`            // 首字节耗时（响应头到达）
+	TTFTSec           float64 `json:"ttft_sec"`            // 首个内容 token 耗时
+	StreamDurationSec float64 `json:"stream_duration_sec"` // 响应体传输耗时
+	TokensPerSec      float64 `json:"tokens_per_sec"`      // 输出吞吐（tokens/s）
+	RequestID         string  `json:"request_id"`          // 同一客户端请求的所有尝试共用
+	Attempt           int     `json:"attempt"`             // 第几次尝试（从 1 开始）
+	Level             int     `json:"level"`               // provider 的 Level
+	ErrorClass        string  `json:"error_class"`         // 失败原因分类（成功为空）
+	ErrorMessage      string  `json:"error_message"`       // 上游错误体或错误信息（截断）
+	BlacklistCounted  bool    `json:"blacklist_counted"`   // 该次失败是否计入拉黑统计
+	ResumeCount       int     `json:"resume_count"`        // 流式中断后续传的次数
+	FallbackFrom      string  `json:"fallback_from"`       // 模型降级时客户端原本请求的模型（未降级为空）
+	ResponseID        string  `json:"-"`                   // Codex response ID（不落库）
 	CreatedAt         string  `json:"created_at"`
 	InputCost         float64 `json:"input_cost"`
 	OutputCost        float64 `json:"output_cost"`
@@ -682,6 +1029,12 @@ type ReqeustLog struct {
 	Ephemeral1hCost   float64 `json:"ephemeral_1h_cost"`
 	TotalCost         float64 `json:"total_cost"`
 	HasPricing        bool    `json:"has_pricing"`
+
+	timing             requestTiming
+	thinkingSignatures []string         // 响应中的思考块签名
+	signatureRetried   bool             // 是否已因签名被拒而重试
+	resume             *streamResume    // 流式中断续传状态（同一请求的各次尝试共享）
+	shadowText         *strings.Builder // 响应文本（配置了影子 provider 时收集，用于对比）
 }
 
 // claude code usage parser
@@ -824,6 +1177,9 @@ func parseGeminiSSELine(event string, requestLog *ReqeustLog) {
 		if data == "[DONE]" || data == "" {
 			continue
 		}
+		if requestLog.timing.firstTokenAt.IsZero() && hasContentDelta("gemini", line) {
+			requestLog.markFirstToken()
+		}
 		// 【优化】快速检查是否包含 usageMetadata，避免无效解析
 		if !strings.Contains(data, "usageMetadata") {
 			continue
@@ -850,6 +1206,60 @@ func ReplaceModelInRequestBody(bodyBytes []byte, newModel string) ([]byte, error
 	return modified, nil
 }
 
+// geminiModelFromPath 从 Gemini 请求路径中提取模型名
+// 例如 /v1beta/models/gemini-2.5-pro:streamGenerateContent?alt=sse -> gemini-2.5-pro
+func geminiModelFromPath(path string) string {
+	if idx := strings.Index(path, "?"); idx >= 0 {
+		path = path[:idx]
+	}
+	idx := strings.Index(path, "/models/")
+	if idx < 0 {
+		return ""
+	}
+	model := path[idx+len("/models/"):]
+	if end := strings.IndexAny(model, ":/"); end >= 0 {
+		model = model[:end]
+	}
+	return model
+}
+
+// ReplaceModelInGeminiPath 替换 Gemini 请求路径中的模型段，保留方法名与查询参数
+// 例如 /v1beta/models/gemini-pro:generateContent -> /v1beta/models/gemini-2.5-pro:generateContent
+func ReplaceModelInGeminiPath(path string, newModel string) string {
+	query := ""
+	if idx := strings.Index(path, "?"); idx >= 0 {
+		path, query = path[:idx], path[idx:]
+	}
+	idx := strings.Index(path, "/models/")
+	if idx < 0 {
+		return path + query
+	}
+	start := idx + len("/models/")
+	end := len(path)
+	if rel := strings.IndexAny(path[start:], ":/"); rel >= 0 {
+		end = start + rel
+	}
+	return path[:start] + newModel + path[end:] + query
+}
+
+// geminiEndpointForProvider 按 provider 的模型映射改写请求路径
+// 返回改写后的 endpoint 和实际使用的模型名（路径中没有模型时回退到 provider 默认模型）
+func geminiEndpointForProvider(provider *GeminiProvider, endpoint string, requestedModel string) (string, string) {
+	if requestedModel == "" {
+		return endpoint, provider.Model
+	}
+	effectiveModel := provider.GetEffectiveModel(requestedModel)
+	if effectiveModel == requestedModel {
+		// 非 Gemini 协议的 provider 不认识 Gemini 模型名，未配置映射时使用 provider 默认模型
+		if provider.UpstreamFormat() != GeminiAPIFormatGemini && provider.Model != "" {
+			return endpoint, provider.Model
+		}
+		return endpoint, requestedModel
+	}
+	fmt.Printf("[Gemini] Provider %s 映射模型: %s -> %s\n", provider.Name, requestedModel, effectiveModel)
+	return ReplaceModelInGeminiPath(endpoint, effectiveModel), effectiveModel
+}
+
 // geminiProxyHandler 处理 Gemini API 请求（支持 Level 分组降级和黑名单）
 func (prs *ProviderRelayService) geminiProxyHandler(apiVersion string) gin.HandlerFunc {
 	return func(c *gin.Context) {
@@ -865,12 +1275,16 @@ func (prs *ProviderRelayService) geminiProxyHandler(apiVersion string) gin.Handl
 
 		fmt.Printf("[Gemini] 收到请求: %s\n", endpoint)
 
+		// 同一客户端请求的所有尝试共用一个请求 ID，每次尝试单独记录 request_log
+		requestID := newRequestID()
+		c.Header(requestIDHeader, requestID)
+
 		// 读取请求体
 		var bodyBytes []byte
 		if c.Request.Body != nil {
 			data, err := io.ReadAll(c.Request.Body)
 			if err != nil {
-				c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request body"})
+				prs.writeRelayError(c, "gemini", http.StatusBadRequest, relayCodeInvalidRequest)
 				return
 			}
 			bodyBytes = data
@@ -880,82 +1294,50 @@ func (prs *ProviderRelayService) geminiProxyHandler(apiVersion string) gin.Handl
 		// 判断是否为流式请求
 		isStream := strings.Contains(endpoint, ":streamGenerateContent") || strings.Contains(query, "alt=sse")
 
+		// 客户端通过请求头指定 provider / Level（需在设置中开启）
+		pin, err := prs.takeClientPin(c)
+		if err != nil {
+			prs.writeRelayError(c, "gemini", http.StatusBadRequest, relayCodeInvalidPin, err)
+			return
+		}
+
+		// 从路径中提取请求的模型名（如 gemini-2.5-pro）
+		requestedModel := geminiModelFromPath(fullPath)
+
 		// 加载 Gemini providers
 		providers := prs.geminiService.GetProviders()
+		names := make([]string, 0, len(providers))
+		for _, p := range providers {
+			names = append(names, p.Name)
+		}
+		prs.transports.retain("gemini", names)
 		if len(providers) == 0 {
-			c.JSON(http.StatusNotFound, gin.H{"error": "no gemini providers configured"})
+			prs.writeRelayError(c, "gemini", http.StatusServiceUnavailable, relayCodeNoProvider, "gemini")
 			return
 		}
 
-		// 1. 过滤可用的 providers（启用 + BaseURL 配置 + 未被拉黑）
-		var activeProviders []GeminiProvider
-		for _, p := range providers {
-			if !p.Enabled || p.BaseURL == "" {
-				continue
-			}
-			// 检查黑名单
-			if isBlacklisted, until := prs.blacklistService.IsBlacklisted("gemini", p.Name); isBlacklisted {
-				fmt.Printf("[Gemini] ⛔ Provider %s 已拉黑，过期时间: %v\n", p.Name, until.Format("15:04:05"))
-				continue
-			}
-			// Level 默认值处理
-			if p.Level <= 0 {
-				p.Level = 1
-			}
-			activeProviders = append(activeProviders, p)
-		}
+		// 1. 过滤可用的 providers（启用 + BaseURL 配置 + 配置有效 + 支持模型 + 未被拉黑）
+		activeProviders, skipped := prs.filterGeminiProviders(providers, pin, requestedModel, endpoint, fullPath)
+		skippedCount := countedSkips(skipped)
 
 		if len(activeProviders) == 0 {
-			c.JSON(http.StatusNotFound, gin.H{"error": "no active gemini provider (all disabled or blacklisted)"})
+			if pin.active() {
+				prs.writeRelayError(c, "gemini", http.StatusBadRequest, relayCodePinnedUnavailable, pin.describe(), requestedModel)
+			} else if requestedModel != "" {
+				prs.writeRelayError(c, "gemini", http.StatusServiceUnavailable, relayCodeModelUnsupported, requestedModel, skippedCount)
+			} else {
+				prs.writeRelayError(c, "gemini", http.StatusServiceUnavailable, relayCodeNoProvider, "gemini")
+			}
 			return
 		}
 
 		// 2. 按 Level 分组
-		levelGroups := make(map[int][]GeminiProvider)
-		for _, p := range activeProviders {
-			levelGroups[p.Level] = append(levelGroups[p.Level], p)
-		}
-
-		// 获取排序后的 Level 列表
-		var sortedLevels []int
-		for level := range levelGroups {
-			sortedLevels = append(sortedLevels, level)
-		}
-		sort.Ints(sortedLevels)
+		levelGroups, sortedLevels := groupGeminiProviders(activeProviders)
 
 		fmt.Printf("[Gemini] 共 %d 个 Level 分组: %v\n", len(sortedLevels), sortedLevels)
 
-		// 请求日志
-		requestLog := &ReqeustLog{
-			Platform:     "gemini",
-			IsStream:     isStream,
-			InputTokens:  0,
-			OutputTokens: 0,
-		}
 		start := time.Now()
 
-		// 保存日志的 defer
-		defer func() {
-			requestLog.DurationSec = time.Since(start).Seconds()
-			if GlobalDBQueueLogs == nil {
-				return
-			}
-			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-			defer cancel()
-			_ = GlobalDBQueueLogs.ExecBatchCtx(ctx, `
-				INSERT INTO request_log (
-					platform, model, provider, http_code,
-					input_tokens, output_tokens, cache_create_tokens, cache_read_tokens,
-					reasoning_tokens, is_stream, duration_sec
-				) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
-			`,
-				requestLog.Platform, requestLog.Model, requestLog.Provider, requestLog.HttpCode,
-				requestLog.InputTokens, requestLog.OutputTokens, requestLog.CacheCreateTokens,
-				requestLog.CacheReadTokens, requestLog.ReasoningTokens,
-				boolToInt(requestLog.IsStream), requestLog.DurationSec,
-			)
-		}()
-
 		// 获取拉黑功能开关状态
 		blacklistEnabled := prs.blacklistService.IsLevelBlacklistEnabled()
 
@@ -974,34 +1356,44 @@ func (prs *ProviderRelayService) geminiProxyHandler(apiVersion string) gin.Handl
 			}
 
 			if firstProvider == nil {
-				c.JSON(http.StatusNotFound, gin.H{"error": "no providers available"})
+				prs.writeRelayError(c, "gemini", http.StatusServiceUnavailable, relayCodeNoProvider, "gemini")
 				return
 			}
 
+			// 应用模型映射（改写路径中的模型段）
+			providerEndpoint, effectiveModel := geminiEndpointForProvider(firstProvider, endpoint, requestedModel)
+
 			// 预填日志（失败也能记录尝试的 provider 与模型）
-			requestLog.Provider = firstProvider.Name
-			requestLog.Model = firstProvider.Model
+			requestLog := &ReqeustLog{
+				Platform:  "gemini",
+				Provider:  firstProvider.Name,
+				Model:     effectiveModel,
+				IsStream:  isStream,
+				RequestID: requestID,
+				Attempt:   1,
+				Level:     providerLevel(firstProvider.Level),
+			}
 
 			// 尝试第一个 provider
-			ok, err := prs.forwardGeminiRequest(c, firstProvider, endpoint, bodyBytes, isStream, requestLog)
+			ok, err := prs.forwardGeminiRequest(c, firstProvider, providerEndpoint, bodyBytes, isStream, effectiveModel, requestLog)
 			if ok {
 				_ = prs.blacklistService.RecordSuccess("gemini", firstProvider.Name)
 			} else {
-				_ = prs.blacklistService.RecordFailure("gemini", firstProvider.Name)
-				if requestLog.HttpCode == 0 {
-					requestLog.HttpCode = http.StatusBadGateway
-				}
-				c.JSON(http.StatusBadGateway, gin.H{
-					"error":   fmt.Sprintf("provider %s failed", firstProvider.Name),
-					"details": err,
-					"hint":    "拉黑模式已开启，不会自动降级。请等待 provider 恢复或手动切换。",
-				})
+				prs.recordAttemptFailure("gemini", requestLog)
+				var failures relayFailures
+				failures.add(requestLog.HttpCode)
+				prs.writeRelayError(c, "gemini", failures.status("gemini"), relayCodeProviderFailed, firstProvider.Name, truncateErrorBody(err))
 			}
+			prs.saveRequestLog(requestLog)
 			return
 		}
 
 		// 【降级模式】：按 Level 顺序尝试所有 provider
 		var lastError string
+		var lastProvider string
+		totalAttempts := 0
+		var failures relayFailures
+	levelLoop:
 		for _, level := range sortedLevels {
 			providersInLevel := levelGroups[level]
 			fmt.Printf("[Gemini] === 尝试 Level %d（%d 个 provider）===\n", level, len(providersInLevel))
@@ -1009,33 +1401,55 @@ func (prs *ProviderRelayService) geminiProxyHandler(apiVersion string) gin.Handl
 			for idx, provider := range providersInLevel {
 				fmt.Printf("[Gemini]   [%d/%d] Provider: %s\n", idx+1, len(providersInLevel), provider.Name)
 
+				// 应用模型映射（改写路径中的模型段）
+				providerEndpoint, effectiveModel := geminiEndpointForProvider(&provider, endpoint, requestedModel)
+
 				// 预填日志，失败也能落库
-				requestLog.Provider = provider.Name
-				requestLog.Model = provider.Model
+				totalAttempts++
+				requestLog := &ReqeustLog{
+					Platform:  "gemini",
+					Provider:  provider.Name,
+					Model:     effectiveModel,
+					IsStream:  isStream,
+					RequestID: requestID,
+					Attempt:   totalAttempts,
+					Level:     providerLevel(provider.Level),
+				}
 
-				ok, errMsg := prs.forwardGeminiRequest(c, &provider, endpoint, bodyBytes, isStream, requestLog)
+				ok, errMsg := prs.forwardGeminiRequest(c, &provider, providerEndpoint, bodyBytes, isStream, effectiveModel, requestLog)
 				if ok {
 					_ = prs.blacklistService.RecordSuccess("gemini", provider.Name)
+					prs.saveRequestLog(requestLog)
 					fmt.Printf("[Gemini] ✓ 请求完成 | Provider: %s | 总耗时: %.2fs\n", provider.Name, time.Since(start).Seconds())
 					return // 成功，退出
 				}
 
 				// 失败，记录并继续
 				lastError = errMsg
-				_ = prs.blacklistService.RecordFailure("gemini", provider.Name)
+				lastProvider = provider.Name
+				failures.add(requestLog.HttpCode)
+				prs.recordAttemptFailure("gemini", requestLog)
+				prs.saveRequestLog(requestLog)
+
+				// 响应已开始发送（流式中途失败）时不能再换 provider，否则会向同一响应写入第二份内容
+				if c.Writer.Written() {
+					fmt.Printf("[Gemini] 响应已开始发送给客户端，停止降级\n")
+					break levelLoop
+				}
 			}
 
 			fmt.Printf("[Gemini] Level %d 的所有 %d 个 provider 均失败，尝试下一 Level\n", level, len(providersInLevel))
 		}
 
-		// 所有 Level 都失败
-		if requestLog.HttpCode == 0 {
-			requestLog.HttpCode = http.StatusBadGateway
+		// 所有 Level 都失败：全部限流时返回 429，全部被拒绝时透传上游的 4xx，否则返回服务不可用
+		switch {
+		case failures.allRateLimited():
+			prs.writeRelayError(c, "gemini", failures.status("gemini"), relayCodeUpstreamRateLimited, totalAttempts, lastProvider)
+		case failures.allRejected():
+			prs.writeRelayError(c, "gemini", failures.status("gemini"), relayCodeUpstreamRejected, totalAttempts, failures.lastStatus, lastProvider, truncateErrorBody(lastError))
+		default:
+			prs.writeRelayError(c, "gemini", failures.status("gemini"), relayCodeAllProvidersFailed, totalAttempts, lastProvider, truncateErrorBody(lastError))
 		}
-		c.JSON(http.StatusBadGateway, gin.H{
-			"error":   "all gemini providers failed",
-			"details": lastError,
-		})
 		fmt.Printf("[Gemini] ✗ 所有 provider 均失败 | 最后错误: %s\n", lastError)
 	}
 }
@@ -1048,20 +1462,33 @@ func (prs *ProviderRelayService) forwardGeminiRequest(
 	endpoint string,
 	bodyBytes []byte,
 	isStream bool,
+	model string,
 	requestLog *ReqeustLog,
 ) (bool, string) {
+	// 预先填充日志，保证失败也能记录 provider 和模型
+	requestLog.Provider = provider.Name
+	requestLog.Model = model
+	requestLog.beginAttempt()
+	attemptStart := time.Now()
+	defer func() {
+		requestLog.DurationSec = time.Since(attemptStart).Seconds()
+		requestLog.finishTiming()
+	}()
+
+	// 非 Gemini 协议的 provider：转换为 Messages / Chat Completions 请求
+	if format := provider.UpstreamFormat(); format != GeminiAPIFormatGemini {
+		return prs.forwardTranslatedGeminiRequest(c, provider, format, bodyBytes, isStream, model, requestLog)
+	}
+
 	providerStart := time.Now()
 
 	// 构建目标 URL
 	targetURL := strings.TrimSuffix(provider.BaseURL, "/") + endpoint
 
-	// 预先填充日志，保证失败也能记录 provider 和模型
-	requestLog.Provider = provider.Name
-	requestLog.Model = provider.Model
-
-	// 创建 HTTP 请求
-	req, err := http.NewRequest("POST", targetURL, bytes.NewReader(bodyBytes))
+	// 创建 HTTP 请求（绑定客户端请求的 context，客户端断开时同步取消上游请求）
+	req, err := http.NewRequestWithContext(c.Request.Context(), http.MethodPost, targetURL, bytes.NewReader(bodyBytes))
 	if err != nil {
+		requestLog.fail(relayErrorRequest, err.Error())
 		return false, fmt.Sprintf("创建请求失败: %v", err)
 	}
 
@@ -1077,24 +1504,26 @@ func (prs *ProviderRelayService) forwardGeminiRequest(
 		req.Header.Set("x-goog-api-key", provider.APIKey)
 	}
 
-	// 发送请求
-	client := &http.Client{Timeout: 300 * time.Second}
-	resp, err := client.Do(req)
+	// 发送请求（复用 provider 连接池）
+	resp, err := prs.transports.Do("gemini", provider.Name, req, isStream)
 	providerDuration := time.Since(providerStart).Seconds()
 
 	if err != nil {
 		fmt.Printf("[Gemini]   ✗ 失败: %s | 错误: %v | 耗时: %.2fs\n", provider.Name, err, providerDuration)
+		requestLog.fail(geminiRequestErrorClass(c, err), err.Error())
 		return false, fmt.Sprintf("请求失败: %v", err)
 	}
 	defer resp.Body.Close()
 
 	// 先记录上游状态码，失败场景也能落库
 	requestLog.HttpCode = resp.StatusCode
+	requestLog.markFirstByte()
 
 	// 检查响应状态
 	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
 		errorBody, _ := io.ReadAll(resp.Body)
 		fmt.Printf("[Gemini]   ✗ 失败: %s | HTTP %d | 耗时: %.2fs\n", provider.Name, resp.StatusCode, providerDuration)
+		requestLog.fail(relayErrorUpstreamStatus, string(errorBody))
 		return false, fmt.Sprintf("HTTP %d: %s", resp.StatusCode, string(errorBody))
 	}
 
@@ -1117,14 +1546,17 @@ func (prs *ProviderRelayService) forwardGeminiRequest(
 			fmt.Printf("[Gemini]   ⚠️ 流式传输中断: %s | 错误: %v\n", provider.Name, copyErr)
 			// 【修复】流式传输中断应标记为失败（虽然无法重试，但需记录健康度）
 			// 注意：已写入部分响应，客户端会收到不完整数据
+			requestLog.fail(relayErrorStream, copyErr.Error())
 			return false, fmt.Sprintf("流式传输中断: %v", copyErr)
 		}
 	} else {
 		body, readErr := io.ReadAll(resp.Body)
 		if readErr != nil {
 			fmt.Printf("[Gemini]   ⚠️ 读取响应失败: %s | 错误: %v\n", provider.Name, readErr)
+			requestLog.fail(relayErrorStream, readErr.Error())
 			return false, fmt.Sprintf("读取响应失败: %v", readErr)
 		}
+		requestLog.markFirstToken()
 		// 解析 Gemini 用量数据
 		parseGeminiUsageMetadata(body, requestLog)
 		c.Data(resp.StatusCode, resp.Header.Get("Content-Type"), body)
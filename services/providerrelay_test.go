@@ -2,6 +2,10 @@ package services
 
 import (
 	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
 
 	"github.com/tidwall/gjson"
@@ -253,6 +257,126 @@ func TestProviderConfigValidation(t *testing.T) {
 	}
 }
 
+func TestGeminiModelPath(t *testing.T) {
+	tests := []struct {
+		name          string
+		path          string
+		newModel      string
+		expectedModel string
+		expectedPath  string
+	}{
+		{
+			name:          "非流式请求",
+			path:          "/v1beta/models/gemini-pro:generateContent",
+			newModel:      "gemini-2.5-pro",
+			expectedModel: "gemini-pro",
+			expectedPath:  "/v1beta/models/gemini-2.5-pro:generateContent",
+		},
+		{
+			name:          "流式请求保留查询参数",
+			path:          "/v1beta/models/gemini-2.5-flash:streamGenerateContent?alt=sse",
+			newModel:      "gemini-2.5-pro",
+			expectedModel: "gemini-2.5-flash",
+			expectedPath:  "/v1beta/models/gemini-2.5-pro:streamGenerateContent?alt=sse",
+		},
+		{
+			name:          "模型详情请求",
+			path:          "/v1beta/models/gemini-pro",
+			newModel:      "gemini-2.5-pro",
+			expectedModel: "gemini-pro",
+			expectedPath:  "/v1beta/models/gemini-2.5-pro",
+		},
+		{
+			name:          "路径中没有模型",
+			path:          "/v1beta/files?pageSize=10",
+			newModel:      "gemini-2.5-pro",
+			expectedModel: "",
+			expectedPath:  "/v1beta/files?pageSize=10",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := geminiModelFromPath(tt.path); got != tt.expectedModel {
+				t.Errorf("geminiModelFromPath(%q) = %q, 期望 %q", tt.path, got, tt.expectedModel)
+			}
+			if got := ReplaceModelInGeminiPath(tt.path, tt.newModel); got != tt.expectedPath {
+				t.Errorf("ReplaceModelInGeminiPath(%q) = %q, 期望 %q", tt.path, got, tt.expectedPath)
+			}
+		})
+	}
+}
+
+func TestGeminiProviderModelMapping(t *testing.T) {
+	provider := &GeminiProvider{
+		Name: "Relay",
+		SupportedModels: map[string]bool{
+			"gemini-2.5-pro":   true,
+			"gemini-2.5-flash": true,
+		},
+		ModelMapping: map[string]string{
+			"gemini-pro":   "gemini-2.5-pro",
+			"gemini-exp-*": "gemini-2.5-*",
+		},
+	}
+
+	if errs := provider.ValidateConfiguration(); len(errs) > 0 {
+		t.Fatalf("配置应该有效，但得到错误: %v", errs)
+	}
+
+	endpoint, model := geminiEndpointForProvider(provider, "/v1beta/models/gemini-pro:generateContent", "gemini-pro")
+	if model != "gemini-2.5-pro" || endpoint != "/v1beta/models/gemini-2.5-pro:generateContent" {
+		t.Errorf("精确映射失败: endpoint=%s model=%s", endpoint, model)
+	}
+
+	endpoint, model = geminiEndpointForProvider(provider, "/v1beta/models/gemini-exp-flash:streamGenerateContent?alt=sse", "gemini-exp-flash")
+	if model != "gemini-2.5-flash" || endpoint != "/v1beta/models/gemini-2.5-flash:streamGenerateContent?alt=sse" {
+		t.Errorf("通配符映射失败: endpoint=%s model=%s", endpoint, model)
+	}
+
+	if provider.IsModelSupported("gemini-1.0-pro") {
+		t.Error("未声明的模型不应被支持")
+	}
+
+	invalid := &GeminiProvider{
+		Name:            "Invalid",
+		SupportedModels: map[string]bool{"gemini-2.5-pro": true},
+		ModelMapping:    map[string]string{"gemini-pro": "gemini-3.0-ultra"},
+	}
+	if errs := invalid.ValidateConfiguration(); len(errs) == 0 {
+		t.Error("映射目标不在白名单中时应返回配置错误")
+	}
+}
+
+func TestGeminiRelayStopsAfterPartialStream(t *testing.T) {
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, `data: {"choices":[{"index":0,"delta":{"content":"partial"}}]}`+"\n\n")
+		fmt.Fprint(w, `data: {"choices":[{"index":0,"delta":{"tool_calls":[{"index":-1,"function":{"name":"f"}}]}}]}`+"\n\n")
+	}))
+	defer broken.Close()
+	backupHits := 0
+	backup := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		backupHits++
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, `data: {"choices":[{"index":0,"delta":{"content":"second"},"finish_reason":"stop"}]}`+"\n\ndata: [DONE]\n\n")
+	}))
+	defer backup.Close()
+
+	prs := newTestRelay(t,
+		GeminiProvider{ID: "1", Name: "broken", BaseURL: broken.URL, APIKey: "k", APIFormat: GeminiAPIFormatOpenAI, Enabled: true, Level: 1},
+		GeminiProvider{ID: "2", Name: "backup", BaseURL: backup.URL, APIKey: "k", APIFormat: GeminiAPIFormatOpenAI, Enabled: true, Level: 2},
+	)
+	resp := serveRelay(prs, "/gemini/v1beta/models/gpt-4.1:streamGenerateContent?alt=sse", `{"contents":[{"role":"user","parts":[{"text":"hi"}]}]}`)
+
+	if backupHits != 0 {
+		t.Errorf("响应已开始发送后不应再尝试下一个 provider，backup 被请求 %d 次", backupHits)
+	}
+	if body := resp.Body.String(); !strings.Contains(body, "partial") || strings.Contains(body, "second") {
+		t.Errorf("unexpected response body:\n%s", body)
+	}
+}
+
 // ==================== 性能测试 ====================
 
 func BenchmarkIsModelSupported(b *testing.B) {
@@ -3,10 +3,15 @@ package services
 import (
 	"encoding/json"
 	"fmt"
+	"log"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
+
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
 )
 
 type Provider struct {
@@ -25,15 +30,66 @@ type Provider struct {
 	SupportedModels map[string]bool `json:"supportedModels,omitempty"`
 
 	// 模型映射 - 外部模型名 -> Provider 内部模型名
-	// 支持精确匹配和通配符（如 "claude-*" -> "anthropic/claude-*"）
+	// 支持精确匹配、通配符（如 "claude-*" -> "anthropic/claude-*"，可含多个 * 和 ?）
+	// 以及 ^...$ 正则（目标中用 $1 引用分组）；匹配顺序：精确 > 字面前缀最长 > 声明顺序
 	ModelMapping map[string]string `json:"modelMapping,omitempty"`
 
 	// 优先级分组 - 数字越小优先级越高（1-10，默认 1）
 	// 使用 omitempty 确保零值不序列化，向后兼容
 	Level int `json:"level,omitempty"`
 
+	// 能力声明 - 能力名 -> 是否支持（vision、tools、thinking、pdf、context_1m、prompt_caching）
+	// 未声明的能力视为支持，只需把不支持的能力标记为 false
+	Capabilities map[string]bool `json:"capabilities,omitempty"`
+
+	// 兼容性配置 - 转发前按预设（及覆盖项）移除或降级上游不支持的字段
+	Compat *ProviderCompat `json:"compat,omitempty"`
+
+	// 影子流量比例（0-100）- 按比例把成功的请求复制一份发给该 provider 做评估，客户端只收到主响应
+	// 不要求启用，结果写入 shadow_log，不计入费用统计
+	ShadowPercent int `json:"shadowPercent,omitempty"`
+
+	// 价格倍率 - 相对官方价格的倍数（如中转站按 0.3x 计费），0 视为 1
+	PriceMultiplier float64 `json:"priceMultiplier,omitempty"`
+
+	// 模型单价 - 实际模型名（映射后，支持通配符）-> 每百万 token 的价格（美元），优先于价格倍率
+	ModelPrices map[string]ModelPrice `json:"modelPrices,omitempty"`
+
+	// 套餐用量窗口 - 如 5 小时 / 每周的请求数或 token 上限，接近上限时降低优先级
+	UsageWindows []UsageWindow `json:"usageWindows,omitempty"`
+
 	// 内部字段：配置验证错误（不持久化）
 	configErrors []string `json:"-"`
+
+	// 内部字段：ModelMapping 在配置文件中的键顺序（map 本身无序，用于同等优先级规则的取舍）
+	mappingOrder []string `json:"-"`
+}
+
+// providerJSON 用于自定义序列化，避免递归调用
+type providerJSON Provider
+
+// UnmarshalJSON 解析 provider 并记录 modelMapping 的声明顺序
+func (p *Provider) UnmarshalJSON(data []byte) error {
+	var raw providerJSON
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	*p = Provider(raw)
+	p.mappingOrder = jsonObjectKeys(gjson.GetBytes(data, "modelMapping"))
+	return nil
+}
+
+// MarshalJSON 序列化 provider，modelMapping 按声明顺序输出
+func (p Provider) MarshalJSON() ([]byte, error) {
+	data, err := json.Marshal(providerJSON(p))
+	if err != nil || len(p.ModelMapping) == 0 {
+		return data, err
+	}
+	mapping, err := marshalOrderedMapping(p.ModelMapping, p.mappingOrder)
+	if err != nil {
+		return nil, err
+	}
+	return sjson.SetRawBytes(data, "modelMapping", mapping)
 }
 
 type providerEnvelope struct {
@@ -98,8 +154,8 @@ func (ps *ProviderService) SaveProviders(kind string, providers []Provider) erro
 			return fmt.Errorf("provider id %d 的 name 不可修改", p.ID)
 		}
 
-		// 规则 2：验证模型配置
-		if errs := p.ValidateConfiguration(); len(errs) > 0 {
+		// 规则 2：验证模型配置（提示性结果不阻止保存）
+		if errs := blockingConfigErrors(p.configIssues()); len(errs) > 0 {
 			for _, errMsg := range errs {
 				validationErrors = append(validationErrors, fmt.Sprintf("[%s] %s", p.Name, errMsg))
 			}
@@ -111,18 +167,49 @@ func (ps *ProviderService) SaveProviders(kind string, providers []Provider) erro
 		return fmt.Errorf("配置验证失败：\n  - %s", strings.Join(validationErrors, "\n  - "))
 	}
 
-	data, err := json.MarshalIndent(providerEnvelope{Providers: providers}, "", "  ")
+	return writeProviderFile(path, providers)
+}
+
+// writeProviderFile 写入 provider 配置：API Key 存入加密密钥库，文件中只保留引用
+func writeProviderFile(path string, providers []Provider) error {
+	sealed := append([]Provider(nil), providers...)
+	if err := defaultSecretStore.sealSecrets(providerSecretScope(path), providerSecretBindings(path, sealed)); err != nil {
+		return fmt.Errorf("加密 API Key 失败: %w", err)
+	}
+
+	data, err := json.MarshalIndent(providerEnvelope{Providers: sealed}, "", "  ")
 	if err != nil {
 		return err
 	}
 
 	tmp := path + ".tmp"
-	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
 		return err
 	}
 	return os.Rename(tmp, path)
 }
 
+// providerSecretScope 密钥库中的引用前缀：claude-code / codex
+func providerSecretScope(path string) string {
+	return strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+}
+
+// providerSecretBindings provider 的 API Key 字段，引用为 <scope>/<id>/apiKey（ID 重复时追加序号）
+func providerSecretBindings(path string, providers []Provider) []secretBinding {
+	scope := providerSecretScope(path)
+	bindings := make([]secretBinding, 0, len(providers))
+	seen := make(map[string]bool, len(providers))
+	for i := range providers {
+		ref := secretRef(scope, strconv.FormatInt(providers[i].ID, 10), "apiKey")
+		if seen[ref] {
+			ref = secretRef(scope, fmt.Sprintf("%d-%d", providers[i].ID, i), "apiKey")
+		}
+		seen[ref] = true
+		bindings = append(bindings, secretBinding{ref: ref, value: &providers[i].APIKey})
+	}
+	return bindings
+}
+
 func (ps *ProviderService) LoadProviders(kind string) ([]Provider, error) {
 	path, err := providerFilePath(kind)
 	if err != nil {
@@ -145,6 +232,18 @@ func (ps *ProviderService) LoadProviders(kind string) ([]Provider, error) {
 	if err := json.Unmarshal(data, &envelope); err != nil {
 		return nil, err
 	}
+
+	// 解密 API Key；旧版本的明文配置自动迁移到密钥库
+	plaintext, err := defaultSecretStore.openSecrets(providerSecretBindings(path, envelope.Providers))
+	if err != nil {
+		log.Printf("⚠️  解密 %s 中的 API Key 失败: %v", filepath.Base(path), err)
+	} else if plaintext {
+		if err := writeProviderFile(path, envelope.Providers); err != nil {
+			log.Printf("⚠️  迁移 %s 中的明文 API Key 失败: %v", filepath.Base(path), err)
+		} else {
+			log.Printf("✅ 已将 %s 中的明文 API Key 迁移到加密密钥库", filepath.Base(path))
+		}
+	}
 	return envelope.Providers, nil
 }
 
@@ -208,8 +307,31 @@ func (ps *ProviderService) DuplicateProvider(kind string, sourceID int64) (*Prov
 		for k, v := range source.ModelMapping {
 			cloned.ModelMapping[k] = v
 		}
+		cloned.mappingOrder = append([]string(nil), source.mappingOrder...)
 	}
 
+	if source.Capabilities != nil {
+		cloned.Capabilities = make(map[string]bool, len(source.Capabilities))
+		for k, v := range source.Capabilities {
+			cloned.Capabilities[k] = v
+		}
+	}
+
+	if source.Compat != nil {
+		compat := *source.Compat
+		cloned.Compat = &compat
+	}
+	cloned.PriceMultiplier = source.PriceMultiplier
+	cloned.UsageWindows = append([]UsageWindow(nil), source.UsageWindows...)
+	if source.ModelPrices != nil {
+		cloned.ModelPrices = make(map[string]ModelPrice, len(source.ModelPrices))
+		for k, v := range source.ModelPrices {
+			cloned.ModelPrices[k] = v
+		}
+	}
+
+	// 影子流量比例不复制，避免副本立即收到镜像请求
+
 	// 6. 添加到列表并保存
 	providers = append(providers, *cloned)
 	if err := ps.SaveProviders(kind, providers); err != nil {
@@ -223,92 +345,114 @@ func (ps *ProviderService) DuplicateProvider(kind string, sourceID int64) (*Prov
 // 支持条件：1) 模型在 SupportedModels 中（精确或通配符匹配）
 //          2) 模型在 ModelMapping 的 key 中（精确或通配符匹配）
 func (p *Provider) IsModelSupported(modelName string) bool {
-	// 向后兼容：如果未配置白名单和映射，假设支持所有模型
-	if (p.SupportedModels == nil || len(p.SupportedModels) == 0) &&
-		(p.ModelMapping == nil || len(p.ModelMapping) == 0) {
-		return true
-	}
+	return isModelSupportedBy(p.SupportedModels, p.ModelMapping, modelName)
+}
 
-	// 场景 A：Provider 原生支持该模型（精确匹配）
-	if p.SupportedModels != nil && p.SupportedModels[modelName] {
+// GetEffectiveModel 获取实际应该使用的模型名
+// 如果存在映射（精确或通配符），返回映射后的模型名；否则返回原模型名
+func (p *Provider) GetEffectiveModel(requestedModel string) string {
+	return effectiveModelOf(p.ModelMapping, p.mappingOrder, requestedModel)
+}
+
+// ValidateConfiguration 验证 provider 的模型配置
+// 返回验证错误列表（空则表示验证通过）
+func (p *Provider) ValidateConfiguration() []string {
+	return configIssueMessages(p.configIssues())
+}
+
+// configIssues 验证 provider 配置，返回带严重程度的结果
+func (p *Provider) configIssues() []configIssue {
+	var errors []string
+	errors = append(errors, validateCapabilities(p.Capabilities)...)
+	errors = append(errors, validateCompat(p.Compat)...)
+	if p.ShadowPercent < 0 || p.ShadowPercent > 100 {
+		errors = append(errors, fmt.Sprintf("影子流量比例必须在 0-100 之间，当前为 %d", p.ShadowPercent))
+	}
+	errors = append(errors, validatePricing(p.PriceMultiplier, p.ModelPrices)...)
+	errors = append(errors, validateUsageWindows(p.UsageWindows)...)
+	issues := append(validateModelConfiguration(p.SupportedModels, p.ModelMapping, p.mappingOrder), configErrorIssues(errors)...)
+	p.configErrors = configIssueMessages(issues)
+	return issues
+}
+
+// isModelSupportedBy 按白名单和映射判断是否支持模型（Claude/Codex/Gemini provider 共用）
+func isModelSupportedBy(supportedModels map[string]bool, modelMapping map[string]string, modelName string) bool {
+	// 向后兼容：如果未配置白名单和映射，假设支持所有模型
+	if len(supportedModels) == 0 && len(modelMapping) == 0 {
 		return true
 	}
 
-	// 场景 A+：Provider 原生支持该模型（通配符匹配）
-	if p.SupportedModels != nil {
-		for supportedModel := range p.SupportedModels {
-			if matchWildcard(supportedModel, modelName) {
-				return true
-			}
+	// 场景 A：Provider 原生支持该模型（精确、通配符或正则匹配，值为 false 的条目不算支持）
+	for supportedModel, supported := range supportedModels {
+		if supported && matchWildcard(supportedModel, modelName) {
+			return true
 		}
 	}
 
-	// 场景 B：Provider 通过映射支持该模型（精确匹配）
-	if p.ModelMapping != nil {
-		if _, exists := p.ModelMapping[modelName]; exists {
+	// 场景 B：Provider 通过映射支持该模型
+	for pattern := range modelMapping {
+		if matchWildcard(pattern, modelName) {
 			return true
 		}
-
-		// 场景 B+：通过通配符映射支持
-		for pattern := range p.ModelMapping {
-			if matchWildcard(pattern, modelName) {
-				return true
-			}
-		}
 	}
 
 	// 场景 C：不支持
 	return false
 }
 
-// GetEffectiveModel 获取实际应该使用的模型名
-// 如果存在映射（精确或通配符），返回映射后的模型名；否则返回原模型名
-func (p *Provider) GetEffectiveModel(requestedModel string) string {
-	if p.ModelMapping == nil || len(p.ModelMapping) == 0 {
+// effectiveModelOf 按映射计算实际模型名（Claude/Codex/Gemini provider 共用）
+// 精确匹配优先，其次是字面前缀最长的规则，前缀相同时按声明顺序（order 为配置中的键顺序）
+func effectiveModelOf(modelMapping map[string]string, order []string, requestedModel string) string {
+	if len(modelMapping) == 0 {
 		return requestedModel
 	}
 
 	// 优先查找精确映射
-	if mappedModel, exists := p.ModelMapping[requestedModel]; exists {
+	if mappedModel, exists := modelMapping[requestedModel]; exists {
 		return mappedModel
 	}
 
-	// 查找通配符映射
-	for pattern, replacement := range p.ModelMapping {
-		if matchWildcard(pattern, requestedModel) {
-			return applyWildcardMapping(pattern, replacement, requestedModel)
-		}
+	// 按优先级查找通配符 / 正则映射
+	keys := make([]string, 0, len(modelMapping))
+	for key := range modelMapping {
+		keys = append(keys, key)
+	}
+	if p, ok := findModelPattern(keys, order, requestedModel); ok {
+		return p.apply(modelMapping[p.pattern], requestedModel)
 	}
 
 	// 无映射，返回原模型名
 	return requestedModel
 }
 
-// ValidateConfiguration 验证 provider 的模型配置
-// 返回验证错误列表（空则表示验证通过）
-func (p *Provider) ValidateConfiguration() []string {
+// validateModelConfiguration 验证白名单与映射配置（Claude/Codex/Gemini provider 共用）
+func validateModelConfiguration(supportedModels map[string]bool, modelMapping map[string]string, mappingOrder []string) []configIssue {
 	errors := make([]string, 0)
 
+	// 规则 0：规则本身有效，且没有被覆盖或存在歧义的映射
+	for pattern := range supportedModels {
+		if _, err := compileModelPattern(pattern); err != nil {
+			errors = append(errors, fmt.Sprintf("模型白名单无效：%v", err))
+		}
+	}
+	issues := append(configErrorIssues(errors), validateModelPatterns(modelMapping, mappingOrder)...)
+	errors = errors[:0]
+
 	// 规则 1：ModelMapping 的 value 必须在 SupportedModels 中
-	if p.ModelMapping != nil && p.SupportedModels != nil {
-		for externalModel, internalModel := range p.ModelMapping {
-			// 检查是否为通配符映射
-			if strings.Contains(internalModel, "*") {
+	if modelMapping != nil && supportedModels != nil {
+		for externalModel, internalModel := range modelMapping {
+			// 检查是否为通配符 / 正则映射
+			if strings.Contains(internalModel, "*") || strings.Contains(internalModel, "$") {
 				// 通配符映射暂不验证（需要具体请求才能展开）
 				continue
 			}
 
-			// 精确映射需要验证
+			// 精确映射需要验证（白名单支持通配符）
 			supported := false
-			if p.SupportedModels[internalModel] {
-				supported = true
-			} else {
-				// 检查通配符白名单
-				for supportedPattern := range p.SupportedModels {
-					if matchWildcard(supportedPattern, internalModel) {
-						supported = true
-						break
-					}
+			for supportedPattern, ok := range supportedModels {
+				if ok && matchWildcard(supportedPattern, internalModel) {
+					supported = true
+					break
 				}
 			}
 
@@ -322,75 +466,44 @@ func (p *Provider) ValidateConfiguration() []string {
 	}
 
 	// 规则 2：如果配置了 ModelMapping 但未配置 SupportedModels，给出警告
-	if p.ModelMapping != nil && len(p.ModelMapping) > 0 &&
-		(p.SupportedModels == nil || len(p.SupportedModels) == 0) {
+	if len(modelMapping) > 0 && len(supportedModels) == 0 {
 		errors = append(errors,
 			"警告：配置了 modelMapping 但未配置 supportedModels，映射的目标模型无法验证",
 		)
 	}
 
 	// 规则 3：检测自映射（通常无意义，但不是错误）
-	if p.ModelMapping != nil {
-		for external, internal := range p.ModelMapping {
-			if external == internal {
-				errors = append(errors, fmt.Sprintf(
-					"警告：模型 '%s' 映射到自身，这通常无意义",
-					external,
-				))
-			}
+	for external, internal := range modelMapping {
+		if external == internal {
+			errors = append(errors, fmt.Sprintf(
+				"警告：模型 '%s' 映射到自身，这通常无意义",
+				external,
+			))
 		}
 	}
 
-	p.configErrors = errors
-	return errors
+	return append(issues, configErrorIssues(errors)...)
 }
 
-// matchWildcard 通配符匹配函数
-// 支持 * 通配符，如 "claude-*" 匹配 "claude-sonnet-4"
+// matchWildcard 模型名匹配函数
+// 支持精确名称、多个 * / ? 通配符（如 "claude-*-4*"）以及 ^...$ 正则，无效规则不匹配任何模型
 func matchWildcard(pattern, text string) bool {
-	// 如果没有通配符，使用精确匹配
-	if !strings.Contains(pattern, "*") {
-		return pattern == text
-	}
-
-	// 简化实现：只支持单个 * 通配符
-	parts := strings.Split(pattern, "*")
-	if len(parts) == 2 {
-		// 前缀 + * 或 * + 后缀
-		prefix, suffix := parts[0], parts[1]
-		return strings.HasPrefix(text, prefix) && strings.HasSuffix(text, suffix)
+	compiled, err := compileModelPattern(pattern)
+	if err != nil {
+		return false
 	}
-
-	// 多个 * 的情况（更复杂，暂不支持）
-	return false
+	return compiled.match(text)
 }
 
 // applyWildcardMapping 应用通配符映射
-// 将 pattern 中的 * 匹配部分替换到 replacement 的 * 位置
+// 将 pattern 中各 * 匹配的部分依次替换到 replacement 的 * 位置；正则规则展开 replacement 中的 $1 / ${name}
 // 示例: pattern="claude-*", replacement="anthropic/claude-*", input="claude-sonnet-4"
-//      输出: "anthropic/claude-sonnet-4"
+//
+//	输出: "anthropic/claude-sonnet-4"
 func applyWildcardMapping(pattern, replacement, input string) string {
-	// 如果 pattern 或 replacement 没有通配符，直接返回 replacement
-	if !strings.Contains(pattern, "*") || !strings.Contains(replacement, "*") {
-		return replacement
-	}
-
-	// 提取通配符匹配的部分
-	parts := strings.Split(pattern, "*")
-	if len(parts) != 2 {
-		return replacement // 不支持多个通配符
-	}
-
-	prefix, suffix := parts[0], parts[1]
-
-	// 验证 input 确实匹配 pattern
-	if !strings.HasPrefix(input, prefix) || !strings.HasSuffix(input, suffix) {
+	compiled, err := compileModelPattern(pattern)
+	if err != nil {
 		return replacement
 	}
-
-	// 提取中间部分
-	wildcardPart := input[len(prefix) : len(input)-len(suffix)]
-
-	// 替换 replacement 中的 *
-	return strings.Replace(replacement, "*", wildcardPart, 1)
+	return compiled.apply(replacement, input)
 }
@@ -2,7 +2,12 @@ package services
 
 import (
 	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
 	"sort"
+	"strings"
 	"testing"
 )
 
@@ -520,6 +525,81 @@ func TestProvider_ValidateConfiguration(t *testing.T) {
 	}
 }
 
+// ==================== 能力路由测试 ====================
+
+func TestRequiredCapabilities(t *testing.T) {
+	claudeBody := []byte(`{
+		"model": "claude-sonnet-4",
+		"thinking": {"type": "enabled", "budget_tokens": 1024},
+		"tools": [{"name": "read_file"}],
+		"messages": [{"role": "user", "content": [
+			{"type": "image", "source": {"type": "base64", "media_type": "image/png", "data": ""}},
+			{"type": "text", "text": "describe", "cache_control": {"type": "ephemeral"}}
+		]}]
+	}`)
+	headers := http.Header{}
+	headers.Set("anthropic-beta", "context-1m-2025-08-07")
+	got := requiredCapabilities("claude", claudeBody, headers)
+	want := []string{CapabilityVision, CapabilityTools, CapabilityThinking, CapabilityContext1M, CapabilityPromptCaching}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("Claude 请求能力 = %v，期望 %v", got, want)
+	}
+
+	codexBody := []byte(`{
+		"model": "gpt-5",
+		"reasoning": {"effort": "medium"},
+		"input": [{"type": "message", "role": "user", "content": [
+			{"type": "input_text", "text": "read"},
+			{"type": "input_file", "filename": "a.pdf", "file_data": ""}
+		]}]
+	}`)
+	got = requiredCapabilities("codex", codexBody, http.Header{})
+	want = []string{CapabilityPDF, CapabilityThinking}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("Codex 请求能力 = %v，期望 %v", got, want)
+	}
+
+	if got := requiredCapabilities("claude", []byte(`{"messages":[{"role":"user","content":"hi"}]}`), http.Header{}); len(got) != 0 {
+		t.Errorf("纯文本请求不应需要额外能力: %v", got)
+	}
+}
+
+func TestProvider_MissingCapability(t *testing.T) {
+	legacy := Provider{Name: "legacy"}
+	if missing := legacy.missingCapability("claude", []string{CapabilityVision, CapabilityTools}); missing != "" {
+		t.Errorf("未声明能力的 provider 应视为全部支持，实际缺少 %s", missing)
+	}
+
+	cheap := Provider{Name: "cheap", Capabilities: map[string]bool{CapabilityVision: false, CapabilityTools: true}}
+	if missing := cheap.missingCapability("claude", []string{CapabilityTools, CapabilityVision}); missing != CapabilityVision {
+		t.Errorf("应缺少 vision，实际 %q", missing)
+	}
+
+	// 兼容性配置会移除 cache_control / thinking / anthropic-beta，对应能力不再要求
+	basic := Provider{Name: "basic", Compat: &ProviderCompat{Preset: CompatPresetBasic},
+		Capabilities: map[string]bool{CapabilityPromptCaching: false, CapabilityThinking: false, CapabilityContext1M: false, CapabilityVision: false}}
+	if missing := basic.missingCapability("claude", []string{CapabilityThinking, CapabilityContext1M, CapabilityPromptCaching}); missing != "" {
+		t.Errorf("兼容性配置已移除的能力不应视为缺少，实际 %q", missing)
+	}
+	if missing := basic.missingCapability("claude", []string{CapabilityPromptCaching, CapabilityVision}); missing != CapabilityVision {
+		t.Errorf("兼容性配置不处理的能力仍应缺少 vision，实际 %q", missing)
+	}
+	if missing := basic.missingCapability("codex", []string{CapabilityThinking}); missing != CapabilityThinking {
+		t.Errorf("兼容性配置只作用于 claude，实际 %q", missing)
+	}
+	disable := false
+	keepThinking := Provider{Name: "keep", Compat: &ProviderCompat{Preset: CompatPresetBasic, DisableThinking: &disable},
+		Capabilities: map[string]bool{CapabilityThinking: false}}
+	if missing := keepThinking.missingCapability("claude", []string{CapabilityThinking}); missing != CapabilityThinking {
+		t.Errorf("覆盖项关闭 DisableThinking 后仍应缺少 thinking，实际 %q", missing)
+	}
+
+	typo := Provider{Name: "typo", Capabilities: map[string]bool{"visoin": false}}
+	if errs := typo.ValidateConfiguration(); len(errs) != 1 {
+		t.Errorf("未知能力声明应报错，实际 %v", errs)
+	}
+}
+
 // ==================== Level 分组测试 ====================
 
 func TestProviderLevelGrouping(t *testing.T) {
@@ -845,3 +925,307 @@ func TestDuplicateProvider(t *testing.T) {
 		})
 	}
 }
+
+// ==================== 确定性模型映射测试 ====================
+
+func TestDeterministicModelMapping(t *testing.T) {
+	// 精确 > 字面前缀更长 > 声明顺序
+	mapping := map[string]string{
+		"claude-*":        "a-*",
+		"claude-sonnet-*": "b-*",
+		"claude-sonnet-4": "exact",
+	}
+	cases := map[string]string{
+		"claude-sonnet-4":   "exact",
+		"claude-sonnet-4-5": "b-4-5",
+		"claude-opus-4":     "a-opus-4",
+		"gpt-4o":            "gpt-4o",
+	}
+	for i := 0; i < 20; i++ {
+		for input, want := range cases {
+			if got := effectiveModelOf(mapping, nil, input); got != want {
+				t.Fatalf("effectiveModelOf(%q) = %q, want %q", input, got, want)
+			}
+		}
+	}
+
+	// 多个 *、? 与正则分组
+	if got := applyWildcardMapping("claude-*-4-*", "vendor/*/v4.*", "claude-opus-4-1"); got != "vendor/opus/v4.1" {
+		t.Errorf("multi-star mapping = %q", got)
+	}
+	if !matchWildcard("gpt-4?", "gpt-4o") || matchWildcard("gpt-4?", "gpt-4o-mini") {
+		t.Error("? should match exactly one character")
+	}
+	if got := applyWildcardMapping(`^claude-(\w+)-(\d+)$`, "anthropic/$1-v$2", "claude-haiku-3"); got != "anthropic/haiku-v3" {
+		t.Errorf("regex mapping = %q", got)
+	}
+	if matchWildcard("^claude-(", "claude-") || matchWildcard("^claude-.*", "claude-x") {
+		t.Error("invalid or unanchored regex should not match")
+	}
+
+	// 同等优先级按配置中的声明顺序，JSON 往返保持顺序
+	for _, tc := range []struct {
+		raw  string
+		want string
+	}{
+		{`{"name":"p","modelMapping":{"gpt-*-mini":"x","gpt-*o*":"y"}}`, "x"},
+		{`{"name":"p","modelMapping":{"gpt-*o*":"y","gpt-*-mini":"x"}}`, "y"},
+	} {
+		var p Provider
+		if err := json.Unmarshal([]byte(tc.raw), &p); err != nil {
+			t.Fatalf("unmarshal: %v", err)
+		}
+		if got := p.GetEffectiveModel("gpt-4o-mini"); got != tc.want {
+			t.Errorf("%s: got %q, want %q", tc.raw, got, tc.want)
+		}
+		data, err := json.Marshal(p)
+		if err != nil {
+			t.Fatalf("marshal: %v", err)
+		}
+		var again Provider
+		if err := json.Unmarshal(data, &again); err != nil {
+			t.Fatalf("unmarshal again: %v", err)
+		}
+		if got := again.GetEffectiveModel("gpt-4o-mini"); got != tc.want {
+			t.Errorf("round trip %s: got %q, want %q", data, got, tc.want)
+		}
+	}
+
+	// 被覆盖与有歧义的规则给出提示，但不阻止使用
+	issues := validateModelPatterns(map[string]string{
+		"gpt-*":      "x",
+		"gpt-?":      "y",
+		"gpt-*-mini": "m",
+		"gpt-4*":     "z",
+		"gpt-4o":     "exact",
+	}, []string{"gpt-*", "gpt-?", "gpt-*-mini", "gpt-4*", "gpt-4o"})
+	warnings := configIssueMessages(issues)
+	joined := strings.Join(warnings, "\n")
+	if !strings.Contains(joined, "'gpt-?' 被优先级更高的 'gpt-*' 完全覆盖") {
+		t.Errorf("expected shadow warning, got %v", warnings)
+	}
+	if !strings.Contains(joined, "'gpt-*-mini' 被优先级更高的 'gpt-*' 完全覆盖") {
+		t.Errorf("expected shadow warning for gpt-*-mini, got %v", warnings)
+	}
+	if strings.Contains(joined, "gpt-4*") || strings.Contains(joined, "gpt-4o") {
+		t.Errorf("more specific rules should not be flagged: %v", warnings)
+	}
+	if len(blockingConfigErrors(issues)) != 0 {
+		t.Errorf("advisory warnings should not block: %v", warnings)
+	}
+	for _, issue := range issues {
+		if issue.severity != configSeverityWarning {
+			t.Errorf("shadowed rules should be warnings: %+v", issue)
+		}
+	}
+	ambiguous := validateModelPatterns(map[string]string{"gpt-*-mini": "x", "gpt-*o*": "y"}, []string{"gpt-*-mini", "gpt-*o*"})
+	if len(ambiguous) != 1 || ambiguous[0].severity != configSeverityWarning || !strings.Contains(ambiguous[0].message, "存在重叠") {
+		t.Errorf("expected ambiguity warning, got %v", ambiguous)
+	}
+	if errs := validateModelPatterns(map[string]string{"^bad(": "x"}, nil); len(blockingConfigErrors(errs)) != 1 {
+		t.Errorf("invalid regex should be a blocking error, got %v", errs)
+	}
+	// 是否阻止只看 severity，与消息文本无关
+	if errs := blockingConfigErrors([]configIssue{{severity: configSeverityError, message: modelPatternAdvisory + " x"}}); len(errs) != 1 {
+		t.Errorf("error severity should block regardless of message, got %v", errs)
+	}
+
+	// 排好序的规则按声明顺序缓存
+	keys := []string{"gpt-*", "gpt-4o"}
+	first := orderedModelPatterns(keys, keys)
+	if second := orderedModelPatterns(keys, keys); len(first) != 2 || &first[0] != &second[0] || first[0].pattern != "gpt-4o" {
+		t.Errorf("ordered patterns should be cached and sorted by priority: %v", first)
+	}
+}
+
+// ==================== 加密密钥库测试 ====================
+
+func TestSecretStore(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv(secretPassphraseEnv, "")
+	previous := defaultSecretStore
+	defaultSecretStore = &SecretStore{}
+	t.Cleanup(func() { defaultSecretStore = previous })
+
+	dir := filepath.Join(home, ".code-switch")
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	read := func(name string) string {
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatalf("read %s: %v", name, err)
+		}
+		return string(data)
+	}
+
+	// 旧版本明文配置：加载时透明迁移
+	legacy := `{"providers":[{"id":1,"name":"relay","apiUrl":"https://relay.example.com","apiKey":"sk-plain-1","enabled":true},` +
+		`{"id":2,"name":"backup","apiUrl":"https://backup.example.com","apiKey":"sk-plain-2","enabled":true}]}`
+	if err := os.WriteFile(filepath.Join(dir, "claude-code.json"), []byte(legacy), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	mcpLegacy := `{"github":{"type":"stdio","command":"npx","env":{"GITHUB_TOKEN":"ghp-plain"},"enable_platform":[]}}`
+	if err := os.WriteFile(filepath.Join(dir, "mcp.json"), []byte(mcpLegacy), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	ps := NewProviderService()
+	providers, err := ps.LoadProviders("claude")
+	if err != nil {
+		t.Fatalf("load providers: %v", err)
+	}
+	if len(providers) != 2 || providers[0].APIKey != "sk-plain-1" || providers[1].APIKey != "sk-plain-2" {
+		t.Fatalf("expected decrypted keys, got %+v", providers)
+	}
+	stored := read("claude-code.json")
+	if strings.Contains(stored, "sk-plain") || !strings.Contains(stored, `"secret://claude-code/1/apiKey"`) {
+		t.Errorf("provider file should hold only references:\n%s", stored)
+	}
+	if info, err := os.Stat(filepath.Join(dir, "claude-code.json")); err != nil || info.Mode().Perm() != 0o600 {
+		t.Errorf("provider file should be 0600, got %v (%v)", info.Mode().Perm(), err)
+	}
+	if strings.Contains(read(secretVaultFile), "sk-plain") {
+		t.Errorf("vault should not contain plaintext")
+	}
+
+	ms := NewMCPService()
+	servers, err := ms.ListServers()
+	if err != nil {
+		t.Fatalf("list mcp servers: %v", err)
+	}
+	for _, server := range servers {
+		if server.Name == "github" && server.Env["GITHUB_TOKEN"] != "ghp-plain" {
+			t.Errorf("expected decrypted mcp env, got %+v", server.Env)
+		}
+	}
+	if strings.Contains(read("mcp.json"), "ghp-plain") {
+		t.Errorf("mcp.json should hold only references")
+	}
+
+	// 修改与删除：未使用的密钥从密钥库中清理
+	providers = providers[:1]
+	providers[0].APIKey = "sk-rotated"
+	if err := ps.SaveProviders("claude", providers); err != nil {
+		t.Fatalf("save providers: %v", err)
+	}
+	if vault := read(secretVaultFile); strings.Contains(vault, "claude-code/2/apiKey") || !strings.Contains(vault, "claude-code/1/apiKey") {
+		t.Errorf("unexpected vault entries:\n%s", vault)
+	}
+
+	// 密钥轮换：密钥文件更换，已保存的密钥仍可解密
+	ss := NewSecretService(ps, nil, ms)
+	oldKey := read(secretKeyFile)
+	if err := ss.RotateSecretKey(); err != nil {
+		t.Fatalf("rotate: %v", err)
+	}
+	if read(secretKeyFile) == oldKey {
+		t.Errorf("key file should change after rotation")
+	}
+	if providers, _ = ps.LoadProviders("claude"); providers[0].APIKey != "sk-rotated" {
+		t.Errorf("expected key after rotation, got %q", providers[0].APIKey)
+	}
+
+	// 口令模式：重启后未解锁时只能看到引用，解锁后恢复
+	if err := ss.SetSecretPassphrase("correct horse"); err != nil {
+		t.Fatalf("set passphrase: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, secretKeyFile)); !os.IsNotExist(err) {
+		t.Errorf("key file should be removed in passphrase mode")
+	}
+	defaultSecretStore = &SecretStore{}
+	if status, _ := ss.GetSecretStoreStatus(); !status.Locked || status.Mode != SecretModePassphrase || status.SecretCount != 2 {
+		t.Errorf("unexpected status: %+v", status)
+	}
+	if providers, _ = ps.LoadProviders("claude"); !isSecretRef(providers[0].APIKey) {
+		t.Errorf("locked store should leave references, got %q", providers[0].APIKey)
+	}
+	// 未解锁时不能把引用同步到外部配置，也不能导出
+	servers, _ = ms.ListServers()
+	if err := ms.SaveServers(servers); !errors.Is(err, ErrSecretsLocked) {
+		t.Errorf("mcp sync should be refused while locked, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(home, ".claude.json")); !os.IsNotExist(err) {
+		t.Errorf("~/.claude.json should not be written while locked")
+	}
+	gs := &GeminiService{providers: []GeminiProvider{{ID: "g1", Name: "gemini", APIKey: secretRefPrefix + "gemini/g1/apiKey"}}}
+	if err := gs.SwitchProvider("g1"); !errors.Is(err, ErrSecretsLocked) {
+		t.Errorf("gemini switch should be refused while locked, got %v", err)
+	}
+	if _, err := ss.ExportConfig(true); !errors.Is(err, ErrSecretsLocked) {
+		t.Errorf("export with secrets should be refused while locked, got %v", err)
+	}
+	if err := ss.UnlockSecrets("wrong"); err == nil {
+		t.Errorf("expected wrong passphrase error")
+	}
+	if err := ss.UnlockSecrets("correct horse"); err != nil {
+		t.Fatalf("unlock: %v", err)
+	}
+	if providers, _ = ps.LoadProviders("claude"); providers[0].APIKey != "sk-rotated" {
+		t.Errorf("expected key after unlock, got %q", providers[0].APIKey)
+	}
+
+	// 导出：默认不含密钥
+	exported, err := ss.ExportConfig(false)
+	if err != nil {
+		t.Fatalf("export: %v", err)
+	}
+	if strings.Contains(exported, "sk-rotated") || strings.Contains(exported, "ghp-plain") || !strings.Contains(exported, `"relay"`) {
+		t.Errorf("export without secrets leaked or lost data:\n%s", exported)
+	}
+	exported, err = ss.ExportConfig(true)
+	if err != nil {
+		t.Fatalf("export with secrets: %v", err)
+	}
+	if !strings.Contains(exported, "sk-rotated") || !strings.Contains(exported, "ghp-plain") {
+		t.Errorf("export with secrets should include decrypted values:\n%s", exported)
+	}
+}
+
+func TestSecretStoreCachesVault(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv(secretPassphraseEnv, "")
+	store := &SecretStore{}
+
+	key := "sk-cached"
+	if err := store.sealSecrets("claude-code", []secretBinding{{ref: "claude-code/1/apiKey", value: &key}}); err != nil {
+		t.Fatalf("seal: %v", err)
+	}
+	open := func() string {
+		t.Helper()
+		value := key
+		if _, err := store.openSecrets([]secretBinding{{ref: "claude-code/1/apiKey", value: &value}}); err != nil {
+			t.Fatalf("open: %v", err)
+		}
+		return value
+	}
+	if got := open(); got != "sk-cached" {
+		t.Fatalf("expected decrypted key, got %q", got)
+	}
+
+	// 热路径只使用缓存：删除密钥库与密钥文件后仍能解密
+	dir := filepath.Join(home, ".code-switch")
+	for _, name := range []string{secretVaultFile, secretKeyFile} {
+		if err := os.Remove(filepath.Join(dir, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := open(); got != "sk-cached" {
+		t.Errorf("expected cached vault to decrypt, got %q", got)
+	}
+
+	// 写入后缓存随之更新
+	second := "sk-second"
+	if err := store.sealSecrets("codex", []secretBinding{{ref: "codex/1/apiKey", value: &second}}); err != nil {
+		t.Fatalf("seal: %v", err)
+	}
+	value := second
+	if _, err := store.openSecrets([]secretBinding{{ref: "codex/1/apiKey", value: &value}}); err != nil || value != "sk-second" {
+		t.Errorf("expected updated cache, got %q (%v)", value, err)
+	}
+	if data, err := os.ReadFile(filepath.Join(dir, secretVaultFile)); err != nil || !strings.Contains(string(data), "codex/1/apiKey") {
+		t.Errorf("vault should be rewritten on seal: %v", err)
+	}
+}
@@ -0,0 +1,563 @@
+package services
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/daodao97/xgo/xdb"
+)
+
+const (
+	quotaNearLimitRatio = 0.9                 // 已用超过 90% 视为接近上限
+	quotaHeaderStaleAge = time.Minute         // 没有重置时间的限流头在多久后失效
+	quotaMaxWindow      = 31 * 24 * time.Hour // 本地用量最多保留的时长
+)
+
+// 额度压力：决定 provider 在本次请求中的排序
+const (
+	quotaOK        = iota
+	quotaNearLimit // 接近上限：排到其他 provider 之后
+	quotaExhausted // 已用尽或上游 429：排到最后，直到重置
+)
+
+// UsageWindow 套餐用量窗口（如 5 小时、每周），在最近 Hours 小时内滚动统计本地转发的用量
+type UsageWindow struct {
+	Name        string `json:"name"`                  // 显示名称，如 "5h" / "weekly"
+	Hours       int    `json:"hours"`                 // 窗口长度（小时）
+	MaxRequests int    `json:"maxRequests,omitempty"` // 窗口内最多请求数，0 表示不限
+	MaxTokens   int    `json:"maxTokens,omitempty"`   // 窗口内最多 token 数（输入 + 输出），0 表示不限
+}
+
+// validateUsageWindows 验证用量窗口配置
+func validateUsageWindows(windows []UsageWindow) []string {
+	var errors []string
+	for i, w := range windows {
+		name := w.Name
+		if name == "" {
+			name = fmt.Sprintf("#%d", i+1)
+		}
+		if w.Hours <= 0 || time.Duration(w.Hours)*time.Hour > quotaMaxWindow {
+			errors = append(errors, fmt.Sprintf("用量窗口 %s 的时长必须在 1-%d 小时之间", name, int(quotaMaxWindow.Hours())))
+		}
+		if w.MaxRequests < 0 || w.MaxTokens < 0 {
+			errors = append(errors, fmt.Sprintf("用量窗口 %s 的上限不能为负数", name))
+		}
+		if w.MaxRequests == 0 && w.MaxTokens == 0 {
+			errors = append(errors, fmt.Sprintf("用量窗口 %s 未设置请求数或 token 上限", name))
+		}
+	}
+	return errors
+}
+
+// RateLimitStatus 上游限流头报告的一项额度
+type RateLimitStatus struct {
+	Dimension string `json:"dimension"` // requests / tokens / input-tokens / output-tokens
+	Limit     int64  `json:"limit"`
+	Remaining int64  `json:"remaining"`
+	ResetAt   string `json:"resetAt,omitempty"`
+}
+
+// UsageWindowStatus 一个用量窗口的本地统计
+type UsageWindowStatus struct {
+	UsageWindow
+	Requests int    `json:"requests"`
+	Tokens   int    `json:"tokens"`
+	ResetAt  string `json:"resetAt,omitempty"` // 窗口内最早一次请求滚出窗口的时间
+}
+
+// ProviderQuota provider 的剩余额度
+type ProviderQuota struct {
+	Platform       string              `json:"platform"`
+	Provider       string              `json:"provider"`
+	Headers        []RateLimitStatus   `json:"headers"`                  // 最近一次响应的限流头
+	HeadersAt      string              `json:"headersAt,omitempty"`      // 限流头的更新时间
+	Windows        []UsageWindowStatus `json:"windows"`                  // 配置的用量窗口
+	NearLimit      bool                `json:"nearLimit"`                // 接近上限，路由时排在其他 provider 之后
+	Exhausted      bool                `json:"exhausted"`                // 已用尽，路由时排在最后
+	ExhaustedUntil string              `json:"exhaustedUntil,omitempty"` // 上游 429 给出的重置时间
+}
+
+// rateLimitDimension 限流头中的一项
+type rateLimitDimension struct {
+	limit     int64
+	remaining int64
+	resetAt   time.Time
+}
+
+// quotaEvent 一次成功请求的本地用量
+type quotaEvent struct {
+	at     time.Time
+	tokens int
+}
+
+// providerQuotaState 单个 provider 的额度状态
+type providerQuotaState struct {
+	dimensions     map[string]rateLimitDimension
+	headersAt      time.Time
+	exhaustedUntil time.Time
+	events         []quotaEvent
+	seeded         bool
+	seeding        bool // 正在锁外加载历史用量，其他请求不重复加载
+}
+
+// quotaTracker 记录各 provider 的上游限流头和本地窗口用量
+type quotaTracker struct {
+	mu     sync.Mutex
+	states map[string]*providerQuotaState
+	now    func() time.Time
+	// seed 首次统计某个 provider 时从 request_log 加载窗口内的历史用量（重启后窗口仍然有效）
+	seed func(kind string, name string, since time.Time) []quotaEvent
+}
+
+func newQuotaTracker() *quotaTracker {
+	return &quotaTracker{
+		states: make(map[string]*providerQuotaState),
+		now:    time.Now,
+		seed:   loadQuotaEvents,
+	}
+}
+
+// quotaTracked 平台是否统计额度：Gemini 走独立的转发路径，不解析限流头也不记录本地用量
+func quotaTracked(kind string) bool {
+	return kind == "claude" || kind == "codex"
+}
+
+// state 返回 provider 的额度状态（调用方持有锁）
+func (t *quotaTracker) state(kind string, name string) *providerQuotaState {
+	key := kind + "/" + name
+	s := t.states[key]
+	if s == nil {
+		s = &providerQuotaState{dimensions: make(map[string]rateLimitDimension)}
+		t.states[key] = s
+	}
+	return s
+}
+
+// ensureSeeded 首次统计某个 provider 时在锁外加载历史用量（查询 request_log 较慢，不能阻塞其他请求）
+func (t *quotaTracker) ensureSeeded(kind string, name string) {
+	if t.seed == nil {
+		return
+	}
+	t.mu.Lock()
+	s := t.state(kind, name)
+	if s.seeded || s.seeding {
+		t.mu.Unlock()
+		return
+	}
+	s.seeding = true
+	t.mu.Unlock()
+
+	events := t.seed(kind, name, t.now().Add(-quotaMaxWindow))
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s.seeded, s.seeding = true, false
+	// 加载期间新记录的用量可能已写入 request_log，只保留早于内存中第一条记录的历史
+	if len(s.events) > 0 {
+		cutoff := s.events[0].at.Truncate(time.Second)
+		kept := 0
+		for kept < len(events) && events[kept].at.Before(cutoff) {
+			kept++
+		}
+		events = events[:kept]
+	}
+	s.events = append(events, s.events...)
+}
+
+// observe 记录上游响应的限流头；429 时按 Retry-After 或限流头的重置时间标记用尽
+func (t *quotaTracker) observe(kind string, name string, header http.Header, status int) {
+	if t == nil {
+		return
+	}
+	now := t.now()
+	dimensions, unifiedReset := parseRateLimitHeaders(header, now)
+	retryAfter, hasRetryAfter := parseRetryAfter(header.Get("Retry-After"), now)
+	if len(dimensions) == 0 && unifiedReset.IsZero() && status != http.StatusTooManyRequests {
+		return
+	}
+
+	t.ensureSeeded(kind, name)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s := t.state(kind, name)
+	if len(dimensions) > 0 {
+		s.dimensions = dimensions
+		s.headersAt = now
+	}
+	if !unifiedReset.IsZero() {
+		s.exhaustedUntil = unifiedReset
+	}
+	if status != http.StatusTooManyRequests {
+		return
+	}
+	until := time.Time{}
+	if hasRetryAfter {
+		until = retryAfter
+	} else {
+		for _, d := range dimensions {
+			if d.remaining <= 0 && d.resetAt.After(now) && (until.IsZero() || d.resetAt.Before(until)) {
+				until = d.resetAt
+			}
+		}
+	}
+	if until.After(s.exhaustedUntil) {
+		s.exhaustedUntil = until
+	}
+}
+
+// recordUsage 记录一次成功请求的本地用量
+func (t *quotaTracker) recordUsage(kind string, name string, tokens int) {
+	if t == nil {
+		return
+	}
+	t.ensureSeeded(kind, name)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s := t.state(kind, name)
+	now := t.now()
+	s.events = append(s.events, quotaEvent{at: now, tokens: tokens})
+	// 丢弃超出最长窗口的记录
+	cutoff := now.Add(-quotaMaxWindow)
+	drop := 0
+	for drop < len(s.events) && s.events[drop].at.Before(cutoff) {
+		drop++
+	}
+	s.events = s.events[drop:]
+}
+
+// rateLimitedUntil 上游 429 给出的重置时间（仍在未来时返回 true）
+func (t *quotaTracker) rateLimitedUntil(kind string, name string) (time.Time, bool) {
+	if t == nil {
+		return time.Time{}, false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s, ok := t.states[kind+"/"+name]
+	if !ok || !s.exhaustedUntil.After(t.now()) {
+		return time.Time{}, false
+	}
+	return s.exhaustedUntil, true
+}
+
+// pressure 计算 provider 当前的额度压力与原因
+func (t *quotaTracker) pressure(kind string, provider Provider) (int, string) {
+	if t == nil {
+		return quotaOK, ""
+	}
+	t.mu.Lock()
+	_, tracked := t.states[kind+"/"+provider.Name]
+	t.mu.Unlock()
+	if !tracked && len(provider.UsageWindows) == 0 {
+		return quotaOK, ""
+	}
+	t.ensureSeeded(kind, provider.Name)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s := t.state(kind, provider.Name)
+	now := t.now()
+	if s.exhaustedUntil.After(now) {
+		return quotaExhausted, "上游限流至 " + s.exhaustedUntil.Format("15:04:05")
+	}
+
+	level, reason := quotaOK, ""
+	raise := func(l int, r string) {
+		if l > level {
+			level, reason = l, r
+		}
+	}
+	for name, d := range s.dimensions {
+		if !headerDimensionFresh(d, s.headersAt, now) || d.limit <= 0 {
+			continue
+		}
+		if d.remaining <= 0 {
+			raise(quotaExhausted, fmt.Sprintf("%s 额度已用尽", name))
+		} else if float64(d.remaining) <= float64(d.limit)*(1-quotaNearLimitRatio) {
+			raise(quotaNearLimit, fmt.Sprintf("%s 剩余 %d/%d", name, d.remaining, d.limit))
+		}
+	}
+	for _, w := range provider.UsageWindows {
+		status := windowUsage(s.events, w, now)
+		for _, check := range []struct {
+			used, max int
+			unit      string
+		}{{status.Requests, w.MaxRequests, "请求"}, {status.Tokens, w.MaxTokens, "token"}} {
+			if check.max <= 0 {
+				continue
+			}
+			if check.used >= check.max {
+				raise(quotaExhausted, fmt.Sprintf("窗口 %s %s已用尽（%d/%d）", w.Name, check.unit, check.used, check.max))
+			} else if float64(check.used) >= float64(check.max)*quotaNearLimitRatio {
+				raise(quotaNearLimit, fmt.Sprintf("窗口 %s %s接近上限（%d/%d）", w.Name, check.unit, check.used, check.max))
+			}
+		}
+	}
+	return level, reason
+}
+
+// snapshot 返回 provider 的剩余额度
+func (t *quotaTracker) snapshot(kind string, provider Provider) ProviderQuota {
+	level, _ := t.pressure(kind, provider)
+	quota := ProviderQuota{
+		Platform:  kind,
+		Provider:  provider.Name,
+		Headers:   []RateLimitStatus{},
+		Windows:   []UsageWindowStatus{},
+		NearLimit: level == quotaNearLimit,
+		Exhausted: level == quotaExhausted,
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s, ok := t.states[kind+"/"+provider.Name]
+	if !ok {
+		return quota
+	}
+	now := t.now()
+	if s.exhaustedUntil.After(now) {
+		quota.ExhaustedUntil = s.exhaustedUntil.Format(timeLayout)
+	}
+	if !s.headersAt.IsZero() {
+		quota.HeadersAt = s.headersAt.Format(timeLayout)
+	}
+	for name, d := range s.dimensions {
+		status := RateLimitStatus{Dimension: name, Limit: d.limit, Remaining: d.remaining}
+		if !d.resetAt.IsZero() {
+			status.ResetAt = d.resetAt.Format(timeLayout)
+		}
+		quota.Headers = append(quota.Headers, status)
+	}
+	sort.Slice(quota.Headers, func(i, j int) bool {
+		return quota.Headers[i].Dimension < quota.Headers[j].Dimension
+	})
+	for _, w := range provider.UsageWindows {
+		quota.Windows = append(quota.Windows, windowUsage(s.events, w, now))
+	}
+	return quota
+}
+
+// windowUsage 统计滚动窗口内的用量
+func windowUsage(events []quotaEvent, w UsageWindow, now time.Time) UsageWindowStatus {
+	status := UsageWindowStatus{UsageWindow: w}
+	window := time.Duration(w.Hours) * time.Hour
+	since := now.Add(-window)
+	for _, e := range events {
+		if e.at.Before(since) {
+			continue
+		}
+		if status.Requests == 0 {
+			status.ResetAt = e.at.Add(window).Format(timeLayout)
+		}
+		status.Requests++
+		status.Tokens += e.tokens
+	}
+	return status
+}
+
+// headerDimensionFresh 限流头是否仍然有效：未到重置时间，或没有重置时间但刚收到
+func headerDimensionFresh(d rateLimitDimension, headersAt time.Time, now time.Time) bool {
+	if !d.resetAt.IsZero() {
+		return d.resetAt.After(now)
+	}
+	return now.Sub(headersAt) < quotaHeaderStaleAge
+}
+
+// parseRateLimitHeaders 解析 anthropic-ratelimit-* 与 x-ratelimit-* 限流头
+// Anthropic: anthropic-ratelimit-{requests,tokens,input-tokens,output-tokens}-{limit,remaining,reset}（reset 为 RFC 3339）
+// 订阅套餐: anthropic-ratelimit-unified-status 为 rejected 时，anthropic-ratelimit-unified-reset（Unix 秒）为恢复时间
+// OpenAI 风格: x-ratelimit-{limit,remaining,reset}-{requests,tokens}（reset 为 "6m0s" 之类的时长或秒数）
+func parseRateLimitHeaders(header http.Header, now time.Time) (map[string]rateLimitDimension, time.Time) {
+	dimensions := make(map[string]rateLimitDimension)
+	update := func(name string, apply func(*rateLimitDimension)) {
+		d := dimensions[name]
+		apply(&d)
+		dimensions[name] = d
+	}
+
+	var unifiedReset time.Time
+	for key, values := range header {
+		if len(values) == 0 {
+			continue
+		}
+		lower := strings.ToLower(key)
+		value := strings.TrimSpace(values[0])
+		switch {
+		case strings.HasPrefix(lower, "anthropic-ratelimit-unified-"):
+			continue
+		case strings.HasPrefix(lower, "anthropic-ratelimit-"):
+			rest := strings.TrimPrefix(lower, "anthropic-ratelimit-")
+			for _, field := range []string{"-limit", "-remaining", "-reset"} {
+				name, ok := strings.CutSuffix(rest, field)
+				if !ok {
+					continue
+				}
+				switch field {
+				case "-limit":
+					if n, err := strconv.ParseInt(value, 10, 64); err == nil {
+						update(name, func(d *rateLimitDimension) { d.limit = n })
+					}
+				case "-remaining":
+					if n, err := strconv.ParseInt(value, 10, 64); err == nil {
+						update(name, func(d *rateLimitDimension) { d.remaining = n })
+					}
+				case "-reset":
+					if reset, err := time.Parse(time.RFC3339, value); err == nil {
+						update(name, func(d *rateLimitDimension) { d.resetAt = reset })
+					}
+				}
+				break
+			}
+		case strings.HasPrefix(lower, "x-ratelimit-"):
+			rest := strings.TrimPrefix(lower, "x-ratelimit-")
+			field, name, ok := strings.Cut(rest, "-")
+			if !ok {
+				continue
+			}
+			switch field {
+			case "limit":
+				if n, err := strconv.ParseInt(value, 10, 64); err == nil {
+					update(name, func(d *rateLimitDimension) { d.limit = n })
+				}
+			case "remaining":
+				if n, err := strconv.ParseInt(value, 10, 64); err == nil {
+					update(name, func(d *rateLimitDimension) { d.remaining = n })
+				}
+			case "reset":
+				if after, ok := parseResetDuration(value); ok {
+					update(name, func(d *rateLimitDimension) { d.resetAt = now.Add(after) })
+				}
+			}
+		}
+	}
+
+	if strings.EqualFold(header.Get("anthropic-ratelimit-unified-status"), "rejected") {
+		if seconds, err := strconv.ParseInt(header.Get("anthropic-ratelimit-unified-reset"), 10, 64); err == nil {
+			unifiedReset = time.Unix(seconds, 0)
+		}
+	}
+	// 只保留带上限的项（部分上游只返回 remaining，无法判断比例）
+	for name, d := range dimensions {
+		if d.limit <= 0 {
+			delete(dimensions, name)
+		}
+	}
+	return dimensions, unifiedReset
+}
+
+// parseResetDuration 解析 "1s"、"6m0s"、"20ms" 或纯秒数
+func parseResetDuration(value string) (time.Duration, bool) {
+	if d, err := time.ParseDuration(value); err == nil {
+		return d, true
+	}
+	if seconds, err := strconv.ParseFloat(value, 64); err == nil && seconds >= 0 {
+		return time.Duration(seconds * float64(time.Second)), true
+	}
+	return 0, false
+}
+
+// parseRetryAfter 解析 Retry-After（秒数或 HTTP 日期）
+func parseRetryAfter(value string, now time.Time) (time.Time, bool) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return time.Time{}, false
+	}
+	if seconds, err := strconv.ParseFloat(value, 64); err == nil && seconds >= 0 {
+		return now.Add(time.Duration(seconds * float64(time.Second))), true
+	}
+	if at, err := http.ParseTime(value); err == nil {
+		return at, true
+	}
+	return time.Time{}, false
+}
+
+// loadQuotaEvents 从 request_log 加载 provider 窗口内成功请求的用量
+func loadQuotaEvents(kind string, name string, since time.Time) []quotaEvent {
+	records, err := xdb.New("request_log").Selects(
+		xdb.WhereEq("platform", kind),
+		xdb.WhereEq("provider", name),
+		xdb.WhereGte("created_at", since.UTC().Format(timeLayout)),
+		xdb.WhereEq("error_class", ""),
+		xdb.Field("http_code", "input_tokens", "output_tokens", "created_at"),
+		xdb.OrderByAsc("id"),
+	)
+	if err != nil {
+		return nil
+	}
+	events := make([]quotaEvent, 0, len(records))
+	for _, record := range records {
+		if code := record.GetInt("http_code"); code < 200 || code >= 300 {
+			continue
+		}
+		at, ok := parseCreatedAt(record)
+		if !ok {
+			continue
+		}
+		events = append(events, quotaEvent{at: at, tokens: record.GetInt("input_tokens") + record.GetInt("output_tokens")})
+	}
+	return events
+}
+
+// deprioritizeByQuota 把接近额度上限或已用尽的 provider 移到所有 Level 之后（用尽的排在最后）
+func (prs *ProviderRelayService) deprioritizeByQuota(kind string, levelGroups map[int][]Provider, levels []int) []int {
+	if len(levels) == 0 {
+		return levels
+	}
+	var nearLimit, exhausted []Provider
+	var kept []int
+	for _, level := range levels {
+		var ok []Provider
+		for _, p := range levelGroups[level] {
+			switch pressure, reason := prs.quotas.pressure(kind, p); pressure {
+			case quotaNearLimit:
+				fmt.Printf("[INFO] 📉 Provider %s %s，降低优先级\n", p.Name, reason)
+				nearLimit = append(nearLimit, p)
+			case quotaExhausted:
+				fmt.Printf("[INFO] ⏳ Provider %s %s，排到最后\n", p.Name, reason)
+				exhausted = append(exhausted, p)
+			default:
+				ok = append(ok, p)
+			}
+		}
+		if len(ok) == 0 {
+			delete(levelGroups, level)
+			continue
+		}
+		levelGroups[level] = ok
+		kept = append(kept, level)
+	}
+	if len(nearLimit) == 0 && len(exhausted) == 0 {
+		return levels
+	}
+
+	next := levels[len(levels)-1] + 1
+	for _, group := range [][]Provider{nearLimit, exhausted} {
+		if len(group) == 0 {
+			continue
+		}
+		levelGroups[next] = group
+		kept = append(kept, next)
+		next++
+	}
+	return kept
+}
+
+// GetProviderQuotas 获取平台下各 provider 的剩余额度（上游限流头与本地用量窗口）
+func (prs *ProviderRelayService) GetProviderQuotas(kind string) ([]ProviderQuota, error) {
+	if !quotaTracked(kind) {
+		return nil, fmt.Errorf("平台 %s 不支持额度统计", kind)
+	}
+	providers, err := prs.providerService.LoadProviders(kind)
+	if err != nil {
+		return nil, err
+	}
+	quotas := make([]ProviderQuota, 0, len(providers))
+	for _, p := range providers {
+		quotas = append(quotas, prs.quotas.snapshot(kind, p))
+	}
+	return quotas, nil
+}
@@ -0,0 +1,118 @@
+package services
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestQuotaTrackerSeedsOutsideLock(t *testing.T) {
+	now := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	release := make(chan struct{})
+	started := make(chan struct{})
+	tracker := &quotaTracker{
+		states: make(map[string]*providerQuotaState),
+		now:    func() time.Time { return now },
+		seed: func(kind string, name string, since time.Time) []quotaEvent {
+			if name != "slow" {
+				return nil
+			}
+			close(started)
+			<-release
+			// 历史记录中包含加载期间刚写入的一条（与内存中的记录重复）
+			return []quotaEvent{{at: now.Add(-time.Hour), tokens: 10}, {at: now, tokens: 20}}
+		},
+	}
+
+	done := make(chan struct{})
+	go func() {
+		tracker.recordUsage("claude", "slow", 0)
+		close(done)
+	}()
+	<-started
+
+	// 加载 slow 的历史时，其他 provider 不应被阻塞
+	other := make(chan struct{})
+	go func() {
+		tracker.recordUsage("claude", "fast", 5)
+		tracker.pressure("claude", Provider{Name: "fast"})
+		close(other)
+	}()
+	select {
+	case <-other:
+	case <-time.After(2 * time.Second):
+		t.Fatal("加载历史用量时不应持有锁")
+	}
+
+	tracker.recordUsage("claude", "slow", 20)
+	close(release)
+	<-done
+
+	windowed := Provider{Name: "slow", UsageWindows: []UsageWindow{{Name: "5h", Hours: 5, MaxRequests: 100}}}
+	quota := tracker.snapshot("claude", windowed)
+	if len(quota.Windows) != 1 || quota.Windows[0].Requests != 3 || quota.Windows[0].Tokens != 30 {
+		t.Errorf("历史用量应合并且去重: %+v", quota.Windows)
+	}
+}
+
+func TestQuotaTracker(t *testing.T) {
+	now := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	tracker := &quotaTracker{states: make(map[string]*providerQuotaState), now: func() time.Time { return now }}
+
+	header := http.Header{}
+	header.Set("anthropic-ratelimit-requests-limit", "100")
+	header.Set("anthropic-ratelimit-requests-remaining", "5")
+	header.Set("anthropic-ratelimit-requests-reset", now.Add(time.Minute).Format(time.RFC3339))
+	header.Set("x-ratelimit-limit-tokens", "1000")
+	header.Set("x-ratelimit-remaining-tokens", "900")
+	header.Set("x-ratelimit-reset-tokens", "6m0s")
+	tracker.observe("claude", "relay-a", header, http.StatusOK)
+	quota := tracker.snapshot("claude", Provider{Name: "relay-a"})
+	if len(quota.Headers) != 2 || quota.Headers[0].Dimension != "requests" || quota.Headers[1].Remaining != 900 {
+		t.Fatalf("限流头解析错误: %+v", quota.Headers)
+	}
+	if !quota.NearLimit || quota.Exhausted {
+		t.Errorf("剩余 5%% 应视为接近上限: %+v", quota)
+	}
+
+	// 429 带 Retry-After：按重置时间暂停，不计入黑名单
+	tracker.observe("claude", "relay-b", http.Header{"Retry-After": []string{"30"}}, http.StatusTooManyRequests)
+	until, ok := tracker.rateLimitedUntil("claude", "relay-b")
+	if !ok || !until.Equal(now.Add(30*time.Second)) {
+		t.Errorf("应按 Retry-After 记录重置时间: %v %v", until, ok)
+	}
+	if _, ok := tracker.rateLimitedUntil("claude", "relay-c"); ok {
+		t.Error("未收到 429 的 provider 不应被限流")
+	}
+
+	// 本地用量窗口
+	windowed := Provider{Name: "relay-c", UsageWindows: []UsageWindow{{Name: "5h", Hours: 5, MaxRequests: 10}}}
+	for i := 0; i < 9; i++ {
+		tracker.recordUsage("claude", "relay-c", 100)
+	}
+	if level, _ := tracker.pressure("claude", windowed); level != quotaNearLimit {
+		t.Errorf("窗口用量 9/10 应接近上限，得到 %d", level)
+	}
+	tracker.recordUsage("claude", "relay-c", 100)
+	if level, _ := tracker.pressure("claude", windowed); level != quotaExhausted {
+		t.Errorf("窗口用量 10/10 应已用尽，得到 %d", level)
+	}
+	now = now.Add(6 * time.Hour)
+	if level, _ := tracker.pressure("claude", windowed); level != quotaOK {
+		t.Errorf("窗口滚动后应恢复，得到 %d", level)
+	}
+
+	now = now.Add(-6 * time.Hour)
+	prs := newTestRelay(t)
+	prs.quotas = tracker
+	levelGroups := map[int][]Provider{1: {{Name: "relay-a"}, {Name: "relay-d"}}, 2: {{Name: "relay-b"}}}
+	levels := prs.deprioritizeByQuota("claude", levelGroups, []int{1, 2})
+	if len(levels) != 3 || levelGroups[levels[0]][0].Name != "relay-d" ||
+		levelGroups[levels[1]][0].Name != "relay-a" || levelGroups[levels[2]][0].Name != "relay-b" {
+		t.Errorf("接近上限和已限流的 provider 应依次排到最后: %v %+v", levels, levelGroups)
+	}
+
+	if errs := validateUsageWindows([]UsageWindow{{Name: "w", Hours: 0}}); len(errs) != 2 {
+		t.Errorf("无效窗口应报错: %v", errs)
+	}
+}
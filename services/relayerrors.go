@@ -0,0 +1,306 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 中转错误的稳定错误码，客户端和脚本可据此判断错误类型（不随语言变化）
+const (
+	relayCodeInvalidRequest         = "invalid_request_body"
+	relayCodeConfigLoadFailed       = "provider_config_load_failed"
+	relayCodeNoProvider             = "no_provider_available"
+	relayCodeModelUnsupported       = "model_not_supported"
+	relayCodeModelMappingFailed     = "model_mapping_failed"
+	relayCodeProviderFailed         = "provider_failed"
+	relayCodeAllProvidersFailed     = "all_providers_failed"
+	relayCodeUpstreamRateLimited    = "upstream_rate_limited"
+	relayCodeUpstreamRejected       = "upstream_rejected_request"
+	relayCodePreviousResponsePinned = "previous_response_provider_unavailable"
+	relayCodeInvalidPin             = "invalid_pin_header"
+	relayCodePinnedUnavailable      = "pinned_provider_unavailable"
+)
+
+// relayErrorMessages 错误码对应的说明（中文、英文），按应用设置的语言选择
+var relayErrorMessages = map[string][2]string{
+	relayCodeInvalidRequest: {
+		"无法读取请求体",
+		"Failed to read the request body",
+	},
+	relayCodeConfigLoadFailed: {
+		"加载 %s provider 配置失败",
+		"Failed to load %s provider configuration",
+	},
+	relayCodeNoProvider: {
+		"没有可用的 %s provider（全部已禁用或已拉黑）",
+		"No %s provider is available (all disabled or blacklisted)",
+	},
+	relayCodeModelUnsupported: {
+		"没有可用的 provider 支持模型 '%s'（已跳过 %d 个不兼容或已拉黑的 provider）",
+		"No available provider supports model '%s' (%d incompatible or blacklisted providers skipped)",
+	},
+	relayCodeModelMappingFailed: {
+		"Provider %s 模型映射失败: %v",
+		"Model mapping failed for provider %s: %v",
+	},
+	relayCodeProviderFailed: {
+		"Provider %s 请求失败: %s（拉黑模式已开启，不自动降级，请等待 provider 恢复或手动切换）",
+		"Provider %s failed: %s (blacklist mode is on, so there is no automatic failover; wait for recovery or switch manually)",
+	},
+	relayCodeAllProvidersFailed: {
+		"所有 %d 个 provider 均失败，最后尝试: %s，错误: %s",
+		"All %d providers failed; last attempt: %s, error: %s",
+	},
+	relayCodeUpstreamRateLimited: {
+		"所有 %d 个 provider 均触发限流，最后尝试: %s",
+		"All %d providers are rate limited; last attempt: %s",
+	},
+	relayCodeUpstreamRejected: {
+		"所有 %d 个 provider 均拒绝了该请求（HTTP %d），最后尝试: %s，错误: %s",
+		"All %d providers rejected the request (HTTP %d); last attempt: %s, error: %s",
+	},
+	relayCodePreviousResponsePinned: {
+		"previous_response_id '%s' 由 provider '%s' 创建，该 provider 当前不可用（已禁用、已拉黑或不支持模型 '%s'），请稍后重试或开启新会话",
+		"previous_response_id '%s' was created by provider '%s', which is currently unavailable (disabled, blacklisted or not serving model '%s'). Retry later or start a new conversation.",
+	},
+	relayCodeInvalidPin: {
+		"请求头无效: %v",
+		"Invalid request header: %v",
+	},
+	relayCodePinnedUnavailable: {
+		"请求头指定的 provider 不可用（%s）：不存在、未配置 URL / API Key、配置无效或不支持模型 '%s'",
+		"The provider requested by header is unavailable (%s): not found, missing URL / API key, invalid configuration, or model '%s' not supported",
+	},
+}
+
+// relayUnavailableStatus 没有 provider 能处理请求时返回的状态码
+// Anthropic 使用 529（Claude Code 会按 overloaded 退避重试），OpenAI / Gemini 使用 503
+func relayUnavailableStatus(kind string) int {
+	if kind == "claude" {
+		return 529
+	}
+	return http.StatusServiceUnavailable
+}
+
+// isRetryableStatus 上游状态码是否值得换 provider / 模型重试
+// 网络错误（0）、流中断（2xx）、408、429 和 5xx 可重试；其余 4xx 是请求本身的问题，换上游也不会成功
+func isRetryableStatus(status int) bool {
+	return status < 400 || status >= 500 || status == http.StatusRequestTimeout || status == http.StatusTooManyRequests
+}
+
+// relayFailures 汇总一次请求各次尝试的上游状态码，决定返回给客户端的状态码
+type relayFailures struct {
+	attempts    int
+	rateLimited int
+	rejected    int // 不可重试的 4xx（请求无效、鉴权失败、请求过大等）
+	lastStatus  int // 最后一个不可重试 4xx 的状态码
+}
+
+// add 记录一次失败的尝试
+func (f *relayFailures) add(status int) {
+	f.attempts++
+	switch {
+	case status == http.StatusTooManyRequests:
+		f.rateLimited++
+	case !isRetryableStatus(status):
+		f.rejected++
+		f.lastStatus = status
+	}
+}
+
+// allRateLimited 所有尝试都被上游限流
+func (f *relayFailures) allRateLimited() bool {
+	return f.attempts > 0 && f.rateLimited == f.attempts
+}
+
+// allRejected 所有尝试都被上游以不可重试的 4xx 拒绝
+func (f *relayFailures) allRejected() bool {
+	return f.attempts > 0 && f.rejected == f.attempts
+}
+
+// status 返回给客户端的状态码：全部限流透传 429，全部被拒绝透传上游的 4xx，否则视为服务不可用
+func (f *relayFailures) status(kind string) int {
+	switch {
+	case f.allRateLimited():
+		return http.StatusTooManyRequests
+	case f.allRejected():
+		return f.lastStatus
+	default:
+		return relayUnavailableStatus(kind)
+	}
+}
+
+// SetAppSettingsService 注入应用设置，用于选择错误说明的语言
+func (prs *ProviderRelayService) SetAppSettingsService(appSettings *AppSettingsService) {
+	prs.appSettings = appSettings
+}
+
+// relayErrorMessage 按应用设置的语言格式化错误说明
+func (prs *ProviderRelayService) relayErrorMessage(code string, args ...any) string {
+	messages, ok := relayErrorMessages[code]
+	if !ok {
+		return code
+	}
+	format := messages[0]
+	if prs.appSettings != nil && prs.appSettings.Language() == "en" {
+		format = messages[1]
+	}
+	return fmt.Sprintf(format, args...)
+}
+
+// writeRelayError 以客户端所用协议的错误格式返回中转错误
+func (prs *ProviderRelayService) writeRelayError(c *gin.Context, kind string, status int, code string, args ...any) {
+	prs.writeRelayErrorParam(c, kind, status, code, "", args...)
+}
+
+// writeRelayErrorParam 同 writeRelayError，param 标明导致错误的请求字段（OpenAI 格式）
+func (prs *ProviderRelayService) writeRelayErrorParam(c *gin.Context, kind string, status int, code string, param string, args ...any) {
+	message := prs.relayErrorMessage(code, args...)
+	requestID := c.Writer.Header().Get(requestIDHeader)
+	body := relayErrorBody(kind, status, code, message, param, requestID)
+	// 流式响应已开始（如续传失败），只能按客户端协议的流式格式在流中发送错误
+	if c.Writer.Written() {
+		_ = writeStreamRelayError(c.Writer, kind, body)
+		return
+	}
+	c.JSON(status, body)
+}
+
+// writeStreamRelayError 在已开始的流式响应中发送错误
+// Anthropic: event: error，data 为完整错误体
+// OpenAI Responses: event: error，data 为 {"type":"error","code":...,"message":...,"param":...}
+// Gemini:    没有事件名，data 为完整错误体（与上游流中返回错误的格式一致）
+func writeStreamRelayError(w gin.ResponseWriter, kind string, body gin.H) error {
+	switch kind {
+	case "codex":
+		detail, _ := body["error"].(gin.H)
+		data, _ := json.Marshal(gin.H{
+			"type":    "error",
+			"code":    detail["code"],
+			"message": detail["message"],
+			"param":   detail["param"],
+		})
+		return writeSSEEvent(w, "error", data)
+	case "gemini":
+		data, _ := json.Marshal(body)
+		return writeSSEData(w, data)
+	default:
+		data, _ := json.Marshal(body)
+		return writeSSEEvent(w, "error", data)
+	}
+}
+
+// relayErrorBody 构造各协议的错误体
+// Anthropic: {"type":"error","error":{"type":...,"message":...}}
+// OpenAI:    {"error":{"message":...,"type":...,"param":...,"code":...}}
+// Gemini:    {"error":{"code":...,"message":...,"status":...,"details":[ErrorInfo]}}
+func relayErrorBody(kind string, status int, code string, message string, param string, requestID string) gin.H {
+	switch kind {
+	case "codex":
+		var paramValue any
+		if param != "" {
+			paramValue = param
+		}
+		return gin.H{
+			"error": gin.H{
+				"message": message,
+				"type":    openAIErrorType(status),
+				"param":   paramValue,
+				"code":    code,
+			},
+		}
+	case "gemini":
+		metadata := gin.H{"code": code}
+		if requestID != "" {
+			metadata["request_id"] = requestID
+		}
+		return gin.H{
+			"error": gin.H{
+				"code":    status,
+				"message": message,
+				"status":  geminiErrorStatus(status),
+				"details": []gin.H{{
+					"@type":    "type.googleapis.com/google.rpc.ErrorInfo",
+					"reason":   strings.ToUpper(code),
+					"domain":   "code-switch",
+					"metadata": metadata,
+				}},
+			},
+		}
+	default:
+		body := gin.H{
+			"type": "error",
+			"error": gin.H{
+				"type":    anthropicErrorType(status),
+				"message": message,
+				"code":    code,
+			},
+		}
+		if requestID != "" {
+			body["request_id"] = requestID
+		}
+		return body
+	}
+}
+
+func anthropicErrorType(status int) string {
+	switch status {
+	case http.StatusBadRequest:
+		return "invalid_request_error"
+	case http.StatusUnauthorized:
+		return "authentication_error"
+	case http.StatusForbidden:
+		return "permission_error"
+	case http.StatusNotFound:
+		return "not_found_error"
+	case http.StatusRequestEntityTooLarge:
+		return "request_too_large"
+	case http.StatusTooManyRequests:
+		return "rate_limit_error"
+	case http.StatusServiceUnavailable, 529:
+		return "overloaded_error"
+	default:
+		if status >= 400 && status < 500 {
+			return "invalid_request_error"
+		}
+		return "api_error"
+	}
+}
+
+func openAIErrorType(status int) string {
+	switch {
+	case status == http.StatusTooManyRequests:
+		return "rate_limit_error"
+	case status == http.StatusUnauthorized:
+		return "authentication_error"
+	case status == http.StatusForbidden:
+		return "permission_error"
+	case status >= 400 && status < 500:
+		return "invalid_request_error"
+	default:
+		return "server_error"
+	}
+}
+
+func geminiErrorStatus(status int) string {
+	switch status {
+	case http.StatusBadRequest, http.StatusRequestEntityTooLarge, http.StatusUnprocessableEntity:
+		return "INVALID_ARGUMENT"
+	case http.StatusUnauthorized:
+		return "UNAUTHENTICATED"
+	case http.StatusForbidden:
+		return "PERMISSION_DENIED"
+	case http.StatusNotFound:
+		return "NOT_FOUND"
+	case http.StatusTooManyRequests:
+		return "RESOURCE_EXHAUSTED"
+	case http.StatusServiceUnavailable:
+		return "UNAVAILABLE"
+	default:
+		return "INTERNAL"
+	}
+}
@@ -0,0 +1,125 @@
+package services
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/tidwall/gjson"
+)
+
+func TestRelayFailureStatus(t *testing.T) {
+	invalid := `{"type":"error","error":{"type":"invalid_request_error","message":"prompt is too long"}}`
+	tests := []struct {
+		name       string
+		statuses   []int
+		wantStatus int
+		wantType   string
+	}{
+		{"all rejected passes 400 through", []int{http.StatusBadRequest, http.StatusBadRequest}, http.StatusBadRequest, "invalid_request_error"},
+		{"all unauthorized passes 401 through", []int{http.StatusUnauthorized, http.StatusUnauthorized}, http.StatusUnauthorized, "authentication_error"},
+		{"mixed failures are unavailability", []int{http.StatusBadRequest, http.StatusBadGateway}, 529, "overloaded_error"},
+		{"all rate limited", []int{http.StatusTooManyRequests, http.StatusTooManyRequests}, http.StatusTooManyRequests, "rate_limit_error"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			prs := newTestRelay(t)
+			var providers []Provider
+			for i, status := range tt.statuses {
+				upstream, _ := newStatusUpstream(t, status, invalid)
+				providers = append(providers, Provider{ID: int64(i + 1), Name: upstream.URL, APIURL: upstream.URL, APIKey: "sk", Enabled: true, Level: 1})
+			}
+			saveTestProviders(t, prs, "claude", providers...)
+
+			resp := serveRelay(prs, "/v1/messages", `{"model":"claude-sonnet-4-5","messages":[{"role":"user","content":"hi"}]}`)
+			if resp.Code != tt.wantStatus {
+				t.Fatalf("expected status %d, got %d: %s", tt.wantStatus, resp.Code, resp.Body.String())
+			}
+			if got := gjson.Get(resp.Body.String(), "error.type").String(); got != tt.wantType {
+				t.Errorf("expected error type %s, got %s", tt.wantType, got)
+			}
+		})
+	}
+
+	var failures relayFailures
+	failures.add(http.StatusRequestEntityTooLarge)
+	if failures.status("codex") != http.StatusRequestEntityTooLarge || openAIErrorType(failures.status("codex")) != "invalid_request_error" {
+		t.Errorf("413 should pass through for codex, got %d", failures.status("codex"))
+	}
+	failures.add(0)
+	if failures.status("codex") != http.StatusServiceUnavailable {
+		t.Errorf("network failure should make the result unavailable, got %d", failures.status("codex"))
+	}
+}
+
+func TestStreamRelayErrorFormat(t *testing.T) {
+	prs := newTestRelay(t)
+	tests := []struct {
+		kind      string
+		wantEvent string // 空表示没有事件名
+		wantPath  string // 错误码所在的 JSON 路径
+	}{
+		{"claude", "error", "error.code"},
+		{"codex", "error", "code"},
+		{"gemini", "", "error.details.0.reason"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.kind, func(t *testing.T) {
+			c, recorder := newTestContext("/", "")
+			c.Writer.WriteHeaderNow()
+			_, _ = c.Writer.Write([]byte("data: {}\n\n"))
+
+			prs.writeRelayError(c, tt.kind, http.StatusServiceUnavailable, relayCodeNoProvider, tt.kind)
+
+			frame := strings.TrimPrefix(recorder.Body.String(), "data: {}\n\n")
+			event, data := "", ""
+			for _, line := range strings.Split(strings.TrimSpace(frame), "\n") {
+				if value, ok := strings.CutPrefix(line, "event: "); ok {
+					event = value
+				} else if value, ok := strings.CutPrefix(line, "data: "); ok {
+					data = value
+				}
+			}
+			if event != tt.wantEvent {
+				t.Errorf("expected event %q, got %q in %q", tt.wantEvent, event, frame)
+			}
+			code := gjson.Get(data, tt.wantPath).String()
+			if !strings.EqualFold(code, relayCodeNoProvider) {
+				t.Errorf("expected code %s at %s, got %q in %s", relayCodeNoProvider, tt.wantPath, code, data)
+			}
+			if tt.kind == "codex" && gjson.Get(data, "type").String() != "error" {
+				t.Errorf("codex stream error should be a Responses error event: %s", data)
+			}
+		})
+	}
+}
+
+func TestRelayErrorBody(t *testing.T) {
+	status := relayUnavailableStatus("claude")
+	claude, _ := json.Marshal(relayErrorBody("claude", status, relayCodeAllProvidersFailed, "all failed", "", "req_1"))
+	if status != 529 || gjson.GetBytes(claude, "type").String() != "error" ||
+		gjson.GetBytes(claude, "error.type").String() != "overloaded_error" ||
+		gjson.GetBytes(claude, "request_id").String() != "req_1" {
+		t.Errorf("Anthropic 错误格式不正确: %d %s", status, claude)
+	}
+
+	codex, _ := json.Marshal(relayErrorBody("codex", http.StatusTooManyRequests, relayCodeUpstreamRateLimited, "limited", "", ""))
+	if gjson.GetBytes(codex, "error.code").String() != relayCodeUpstreamRateLimited ||
+		gjson.GetBytes(codex, "error.type").String() != "rate_limit_error" ||
+		gjson.GetBytes(codex, "error.param").Type != gjson.Null {
+		t.Errorf("OpenAI 错误格式不正确: %s", codex)
+	}
+
+	gemini, _ := json.Marshal(relayErrorBody("gemini", http.StatusServiceUnavailable, relayCodeNoProvider, "none", "", ""))
+	if gjson.GetBytes(gemini, "error.code").Int() != 503 ||
+		gjson.GetBytes(gemini, "error.status").String() != "UNAVAILABLE" ||
+		gjson.GetBytes(gemini, "error.details.0.reason").String() != "NO_PROVIDER_AVAILABLE" {
+		t.Errorf("Gemini 错误格式不正确: %s", gemini)
+	}
+
+	prs := &ProviderRelayService{}
+	if msg := prs.relayErrorMessage(relayCodeModelUnsupported, "claude-x", 2); !strings.Contains(msg, "claude-x") || !strings.Contains(msg, "2") {
+		t.Errorf("错误说明格式化不正确: %s", msg)
+	}
+}
@@ -0,0 +1,71 @@
+package services
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// newTestRelay 在临时 HOME 下创建中转服务
+// 不初始化数据库：拉黑、请求日志等读写失败时按默认值处理；设置与配置文件写入临时目录
+func newTestRelay(t *testing.T, geminiProviders ...GeminiProvider) *ProviderRelayService {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv(secretPassphraseEnv, "")
+	previous := defaultSecretStore
+	defaultSecretStore = &SecretStore{}
+	t.Cleanup(func() { defaultSecretStore = previous })
+
+	geminiService := &GeminiService{providers: geminiProviders}
+	settingsService := NewSettingsService()
+	return NewProviderRelayService(NewProviderService(), geminiService, NewBlacklistService(settingsService), settingsService, "")
+}
+
+// serveRelay 通过中转路由处理一次请求，headers 为键值对
+func serveRelay(prs *ProviderRelayService, path string, body string, headers ...string) *httptest.ResponseRecorder {
+	router := gin.New()
+	prs.registerRoutes(router)
+	req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, req)
+	return recorder
+}
+
+// newTestContext 创建写入 recorder 的 gin 上下文，用于直接调用中转的内部方法
+func newTestContext(path string, body string) (*gin.Context, *httptest.ResponseRecorder) {
+	gin.SetMode(gin.TestMode)
+	recorder := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(recorder)
+	c.Request = httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+	return c, recorder
+}
+
+// saveTestProviders 保存 Claude / Codex provider 配置（写入临时 HOME）
+func saveTestProviders(t *testing.T, prs *ProviderRelayService, kind string, providers ...Provider) {
+	t.Helper()
+	if err := prs.providerService.SaveProviders(kind, providers); err != nil {
+		t.Fatalf("save %s providers: %v", kind, err)
+	}
+}
+
+// newStatusUpstream 固定返回指定状态码与响应体的上游，返回服务与请求计数
+func newStatusUpstream(t *testing.T, status int, body string) (*httptest.Server, *int) {
+	t.Helper()
+	hits := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits++
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		_, _ = w.Write([]byte(body))
+	}))
+	t.Cleanup(server.Close)
+	return server, &hits
+}
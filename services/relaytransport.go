@@ -0,0 +1,319 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// errUpstreamHeaderTimeout 上游在规定时间内未返回响应头
+var errUpstreamHeaderTimeout = errors.New("upstream response header timeout")
+
+// errUpstreamIdleTimeout 上游响应体长时间没有新数据（流式响应卡死）
+var errUpstreamIdleTimeout = errors.New("upstream idle read timeout")
+
+// hopByHopHeaders 逐跳头，不能转发给上游（HTTP/2 会直接拒绝携带 Connection 等头的请求）
+var hopByHopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Connection",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// relayTransportConfig 上游连接参数
+type relayTransportConfig struct {
+	DialTimeout                 time.Duration // TCP 建连超时
+	TLSHandshakeTimeout         time.Duration // TLS 握手超时
+	StreamResponseHeaderTimeout time.Duration // 流式请求等待响应头的超时
+	ResponseHeaderTimeout       time.Duration // 非流式请求等待响应头的超时（上游生成完才返回头）
+	IdleReadTimeout             time.Duration // 响应体两次读取之间允许的最长空闲
+	IdleConnTimeout             time.Duration // 空闲连接保留时间
+	MaxIdleConnsPerHost         int           // 每个上游 host 保留的空闲连接数
+}
+
+// defaultRelayTransportConfig 返回默认连接参数
+// 非流式请求的响应头要等上游生成完毕才返回，因此超时放宽到 30 分钟（适配大型项目分析）
+func defaultRelayTransportConfig() relayTransportConfig {
+	return relayTransportConfig{
+		DialTimeout:                 10 * time.Second,
+		TLSHandshakeTimeout:         10 * time.Second,
+		StreamResponseHeaderTimeout: 5 * time.Minute,
+		ResponseHeaderTimeout:       30 * time.Minute,
+		IdleReadTimeout:             5 * time.Minute,
+		IdleConnTimeout:             90 * time.Second,
+		MaxIdleConnsPerHost:         16,
+	}
+}
+
+// RelayTransportStats 单个 provider 的上游连接统计（用于前端展示）
+type RelayTransportStats struct {
+	Platform       string  `json:"platform"`
+	Provider       string  `json:"provider"`
+	Requests       int64   `json:"requests"`       // 发出的请求数
+	NewConns       int64   `json:"newConns"`       // 新建连接数（需要 TCP + TLS 握手）
+	ReusedConns    int64   `json:"reusedConns"`    // 复用连接数
+	HTTP2Requests  int64   `json:"http2Requests"`  // 走 HTTP/2 的请求数
+	HeaderTimeouts int64   `json:"headerTimeouts"` // 响应头超时次数
+	IdleTimeouts   int64   `json:"idleTimeouts"`   // 响应体空闲超时次数
+	ReuseRate      float64 `json:"reuseRate"`      // 连接复用率
+}
+
+// providerTransport 单个 provider 独享的连接池
+type providerTransport struct {
+	platform  string
+	provider  string
+	client    *http.Client
+	transport *http.Transport
+
+	requests       atomic.Int64
+	newConns       atomic.Int64
+	reusedConns    atomic.Int64
+	http2Requests  atomic.Int64
+	headerTimeouts atomic.Int64
+	idleTimeouts   atomic.Int64
+}
+
+// relayTransportPool 按 provider 维护长连接池，失败切换时不必重复 TLS 握手
+type relayTransportPool struct {
+	mu     sync.Mutex
+	config relayTransportConfig
+	pools  map[string]*providerTransport
+}
+
+func newRelayTransportPool(config relayTransportConfig) *relayTransportPool {
+	return &relayTransportPool{
+		config: config,
+		pools:  make(map[string]*providerTransport),
+	}
+}
+
+// get 获取（或创建）provider 的连接池
+func (p *relayTransportPool) get(platform string, providerName string) *providerTransport {
+	key := platform + "/" + providerName
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if pt, ok := p.pools[key]; ok {
+		return pt
+	}
+
+	dialer := &net.Dialer{
+		Timeout:   p.config.DialTimeout,
+		KeepAlive: 30 * time.Second,
+	}
+	transport := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialer.DialContext,
+		ForceAttemptHTTP2:     true, // 自定义 DialContext 后需显式开启 HTTP/2
+		TLSHandshakeTimeout:   p.config.TLSHandshakeTimeout,
+		IdleConnTimeout:       p.config.IdleConnTimeout,
+		MaxIdleConns:          p.config.MaxIdleConnsPerHost * 4,
+		MaxIdleConnsPerHost:   p.config.MaxIdleConnsPerHost,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+
+	pt := &providerTransport{
+		platform:  platform,
+		provider:  providerName,
+		transport: transport,
+		// 不设置 Client.Timeout：它会限制整个响应体的读取时间，长流式输出会被截断
+		client: &http.Client{Transport: transport},
+	}
+	p.pools[key] = pt
+	return pt
+}
+
+// Do 通过 provider 的连接池发送请求
+// 响应头超时按是否流式区分；返回的响应体带空闲读取超时，关闭响应体时释放关联的 context
+func (p *relayTransportPool) Do(platform string, providerName string, req *http.Request, isStream bool) (*http.Response, error) {
+	pt := p.get(platform, providerName)
+	pt.requests.Add(1)
+
+	stripHopByHopHeaders(req.Header)
+	// 响应体需要校验、续传和统计用量，必须是明文：不转发客户端的 Accept-Encoding，
+	// 由 Transport 自行协商 gzip 并透明解压（解压后的响应不带 Content-Encoding / Content-Length）
+	req.Header.Del("Accept-Encoding")
+
+	ctx, cancel := context.WithCancel(req.Context())
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if info.Reused {
+				pt.reusedConns.Add(1)
+			} else {
+				pt.newConns.Add(1)
+			}
+		},
+	}
+	req = req.WithContext(httptrace.WithClientTrace(ctx, trace))
+
+	headerTimeout := p.config.ResponseHeaderTimeout
+	if isStream {
+		headerTimeout = p.config.StreamResponseHeaderTimeout
+	}
+	var headerTimedOut atomic.Bool
+	headerTimer := time.AfterFunc(headerTimeout, func() {
+		headerTimedOut.Store(true)
+		cancel()
+	})
+
+	resp, err := pt.client.Do(req)
+	headerTimer.Stop()
+	if err != nil {
+		cancel()
+		if headerTimedOut.Load() {
+			pt.headerTimeouts.Add(1)
+			return nil, fmt.Errorf("%w (%s)", errUpstreamHeaderTimeout, headerTimeout)
+		}
+		return nil, err
+	}
+
+	if resp.ProtoMajor == 2 {
+		pt.http2Requests.Add(1)
+	}
+	resp.Body = newIdleTimeoutBody(resp.Body, p.config.IdleReadTimeout, cancel, pt)
+	return resp, nil
+}
+
+// Stats 返回所有 provider 的连接统计（按 platform、provider 排序）
+func (p *relayTransportPool) Stats() []RelayTransportStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	stats := make([]RelayTransportStats, 0, len(p.pools))
+	for _, pt := range p.pools {
+		s := RelayTransportStats{
+			Platform:       pt.platform,
+			Provider:       pt.provider,
+			Requests:       pt.requests.Load(),
+			NewConns:       pt.newConns.Load(),
+			ReusedConns:    pt.reusedConns.Load(),
+			HTTP2Requests:  pt.http2Requests.Load(),
+			HeaderTimeouts: pt.headerTimeouts.Load(),
+			IdleTimeouts:   pt.idleTimeouts.Load(),
+		}
+		if total := s.NewConns + s.ReusedConns; total > 0 {
+			s.ReuseRate = float64(s.ReusedConns) / float64(total)
+		}
+		stats = append(stats, s)
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Platform == stats[j].Platform {
+			return stats[i].Provider < stats[j].Provider
+		}
+		return stats[i].Platform < stats[j].Platform
+	})
+	return stats
+}
+
+// retain 移除该 platform 下不在当前配置中的 provider 的连接池（provider 删除或改名后不再保留）
+// 正在进行的请求仍持有原连接池，结束后其连接随之释放
+func (p *relayTransportPool) retain(platform string, names []string) {
+	keep := make(map[string]bool, len(names))
+	for _, name := range names {
+		keep[name] = true
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for key, pt := range p.pools {
+		if pt.platform == platform && !keep[pt.provider] {
+			pt.transport.CloseIdleConnections()
+			delete(p.pools, key)
+		}
+	}
+}
+
+// CloseIdleConnections 关闭所有空闲连接（relay 停止时调用）
+func (p *relayTransportPool) CloseIdleConnections() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, pt := range p.pools {
+		pt.transport.CloseIdleConnections()
+	}
+}
+
+// stripHopByHopHeaders 移除逐跳头以及 Connection 头中声明的字段
+func stripHopByHopHeaders(header http.Header) {
+	for _, value := range header.Values("Connection") {
+		for _, field := range splitHeaderTokens(value) {
+			header.Del(field)
+		}
+	}
+	for _, key := range hopByHopHeaders {
+		header.Del(key)
+	}
+}
+
+func splitHeaderTokens(value string) []string {
+	var tokens []string
+	start := 0
+	for i := 0; i <= len(value); i++ {
+		if i == len(value) || value[i] == ',' {
+			token := trimSpace(value[start:i])
+			if token != "" {
+				tokens = append(tokens, token)
+			}
+			start = i + 1
+		}
+	}
+	return tokens
+}
+
+// idleTimeoutBody 为响应体增加空闲读取超时
+// 每次读到数据都会重置计时器；超时后取消请求 context，阻塞中的 Read 随即返回
+type idleTimeoutBody struct {
+	body     io.ReadCloser
+	timeout  time.Duration
+	timer    *time.Timer
+	cancel   context.CancelFunc
+	timedOut atomic.Bool
+	stats    *providerTransport
+}
+
+func newIdleTimeoutBody(body io.ReadCloser, timeout time.Duration, cancel context.CancelFunc, stats *providerTransport) *idleTimeoutBody {
+	b := &idleTimeoutBody{
+		body:    body,
+		timeout: timeout,
+		cancel:  cancel,
+		stats:   stats,
+	}
+	b.timer = time.AfterFunc(timeout, func() {
+		b.timedOut.Store(true)
+		if b.stats != nil {
+			b.stats.idleTimeouts.Add(1)
+		}
+		cancel()
+	})
+	return b
+}
+
+func (b *idleTimeoutBody) Read(p []byte) (int, error) {
+	n, err := b.body.Read(p)
+	if n > 0 {
+		b.timer.Reset(b.timeout)
+	}
+	if err != nil && err != io.EOF && b.timedOut.Load() {
+		return n, fmt.Errorf("%w (%s)", errUpstreamIdleTimeout, b.timeout)
+	}
+	return n, err
+}
+
+func (b *idleTimeoutBody) Close() error {
+	b.timer.Stop()
+	err := b.body.Close()
+	b.cancel()
+	return err
+}
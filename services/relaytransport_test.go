@@ -0,0 +1,99 @@
+package services
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRelayTransportPoolReusesConnections(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Connection") != "" || r.Header.Get("Keep-Alive") != "" {
+			t.Errorf("逐跳头不应转发给上游: %v", r.Header)
+		}
+		_, _ = w.Write([]byte(`{"ok":true}`))
+	}))
+	defer server.Close()
+
+	pool := newRelayTransportPool(defaultRelayTransportConfig())
+	for i := 0; i < 3; i++ {
+		req, _ := http.NewRequest(http.MethodPost, server.URL, nil)
+		req.Header.Set("Connection", "keep-alive")
+		req.Header.Set("Keep-Alive", "timeout=5")
+		resp, err := pool.Do("claude", "p1", req, false)
+		if err != nil {
+			t.Fatalf("请求失败: %v", err)
+		}
+		_, _ = io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+
+	stats := pool.Stats()
+	if len(stats) != 1 {
+		t.Fatalf("期望 1 个连接池，实际 %d", len(stats))
+	}
+	if stats[0].Requests != 3 || stats[0].NewConns != 1 || stats[0].ReusedConns != 2 {
+		t.Errorf("连接统计不符合预期: %+v", stats[0])
+	}
+}
+
+func TestRelayTransportPoolIdleReadTimeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		_, _ = w.Write([]byte("data: {}\n\n"))
+		w.(http.Flusher).Flush()
+		<-r.Context().Done() // 模拟上游卡死
+	}))
+	defer server.Close()
+
+	config := defaultRelayTransportConfig()
+	config.IdleReadTimeout = 100 * time.Millisecond
+	pool := newRelayTransportPool(config)
+
+	req, _ := http.NewRequest(http.MethodPost, server.URL, nil)
+	resp, err := pool.Do("claude", "p1", req, true)
+	if err != nil {
+		t.Fatalf("请求失败: %v", err)
+	}
+	defer resp.Body.Close()
+
+	_, err = io.ReadAll(resp.Body)
+	if !errors.Is(err, errUpstreamIdleTimeout) {
+		t.Errorf("期望空闲读取超时错误，实际: %v", err)
+	}
+	if class := classifyRelayError(err); class != relayErrorTimeout {
+		t.Errorf("空闲读取超时应归类为 %s，实际 %s", relayErrorTimeout, class)
+	}
+	if stats := pool.Stats(); stats[0].IdleTimeouts != 1 {
+		t.Errorf("期望记录 1 次空闲超时，实际 %d", stats[0].IdleTimeouts)
+	}
+}
+
+func TestRelayTransportPoolDropsRemovedProviders(t *testing.T) {
+	upstream, _ := newStatusUpstream(t, http.StatusOK, `{"id":"msg_1","type":"message","content":[{"type":"text","text":"hi"}]}`)
+	prs := newTestRelay(t)
+	body := `{"model":"claude-sonnet-4-5","messages":[{"role":"user","content":"hi"}]}`
+
+	saveTestProviders(t, prs, "claude", Provider{ID: 1, Name: "old", APIURL: upstream.URL, APIKey: "sk", Enabled: true, Level: 1})
+	if resp := serveRelay(prs, "/v1/messages", body); resp.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", resp.Code, resp.Body.String())
+	}
+	// 其他 platform 的同名连接池不受影响
+	prs.transports.get("codex", "old")
+
+	saveTestProviders(t, prs, "claude", Provider{ID: 2, Name: "new", APIURL: upstream.URL, APIKey: "sk", Enabled: true, Level: 1})
+	if resp := serveRelay(prs, "/v1/messages", body); resp.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", resp.Code, resp.Body.String())
+	}
+
+	var pools []string
+	for _, s := range prs.transports.Stats() {
+		pools = append(pools, s.Platform+"/"+s.Provider)
+	}
+	if len(pools) != 2 || pools[0] != "claude/new" || pools[1] != "codex/old" {
+		t.Errorf("已删除 provider 的连接池应被移除: %v", pools)
+	}
+}
@@ -0,0 +1,89 @@
+package services
+
+import (
+	"strings"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+// requestTiming 单次上游尝试的时间点，用于计算 TTFB / TTFT / 流时长 / 吞吐
+type requestTiming struct {
+	startedAt    time.Time // 开始请求上游
+	firstByteAt  time.Time // 收到响应头
+	firstTokenAt time.Time // 收到第一个内容增量
+}
+
+// beginAttempt 开始一次新的上游尝试（降级重试时重置计时）
+func (l *ReqeustLog) beginAttempt() {
+	l.timing = requestTiming{startedAt: time.Now()}
+	l.TTFBSec, l.TTFTSec, l.StreamDurationSec, l.TokensPerSec = 0, 0, 0, 0
+}
+
+// markFirstByte 记录首字节（响应头到达）时间
+func (l *ReqeustLog) markFirstByte() {
+	if l.timing.firstByteAt.IsZero() {
+		l.timing.firstByteAt = time.Now()
+	}
+}
+
+// markFirstToken 记录第一个内容 token 到达时间
+func (l *ReqeustLog) markFirstToken() {
+	if l.timing.firstTokenAt.IsZero() {
+		l.timing.firstTokenAt = time.Now()
+	}
+}
+
+// finishTiming 根据记录的时间点计算各项耗时指标
+func (l *ReqeustLog) finishTiming() {
+	t := l.timing
+	if t.startedAt.IsZero() || t.firstByteAt.IsZero() {
+		return
+	}
+	end := time.Now()
+	l.TTFBSec = t.firstByteAt.Sub(t.startedAt).Seconds()
+	l.StreamDurationSec = end.Sub(t.firstByteAt).Seconds()
+	if t.firstTokenAt.IsZero() {
+		return
+	}
+	l.TTFTSec = t.firstTokenAt.Sub(t.startedAt).Seconds()
+
+	// 流式按首个 token 之后的生成时间计算；非流式无法区分生成阶段，使用整个尝试的耗时
+	generation := end.Sub(t.firstTokenAt).Seconds()
+	if !l.IsStream {
+		generation = end.Sub(t.startedAt).Seconds()
+	}
+	if generation > 0 && l.OutputTokens > 0 {
+		l.TokensPerSec = float64(l.OutputTokens) / generation
+	}
+}
+
+// hasContentDelta 判断上游数据是否包含内容增量（文本、思考或工具参数）
+// 非流式响应一次性到达，整个 JSON 体即视为首个内容
+func hasContentDelta(kind string, payload string) bool {
+	if strings.HasPrefix(payload, "{") {
+		return true
+	}
+	for _, line := range strings.Split(payload, "\n") {
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, "data:") {
+			continue
+		}
+		data := strings.TrimSpace(strings.TrimPrefix(line, "data:"))
+		switch kind {
+		case "codex":
+			if strings.HasSuffix(gjson.Get(data, "type").String(), ".delta") {
+				return true
+			}
+		case "gemini":
+			if gjson.Get(data, "candidates.0.content.parts.#").Int() > 0 {
+				return true
+			}
+		default:
+			if gjson.Get(data, "type").String() == "content_block_delta" {
+				return true
+			}
+		}
+	}
+	return false
+}
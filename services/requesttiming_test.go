@@ -0,0 +1,36 @@
+package services
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRequestTimingMetrics(t *testing.T) {
+	requestLog := &ReqeustLog{IsStream: true}
+	requestLog.beginAttempt()
+	requestLog.timing.startedAt = time.Now().Add(-3 * time.Second)
+	requestLog.timing.firstByteAt = requestLog.timing.startedAt.Add(500 * time.Millisecond)
+	requestLog.timing.firstTokenAt = requestLog.timing.startedAt.Add(time.Second)
+	requestLog.OutputTokens = 200
+	requestLog.finishTiming()
+
+	if requestLog.TTFBSec < 0.49 || requestLog.TTFBSec > 0.51 {
+		t.Errorf("TTFB 应约为 0.5s，实际 %.3f", requestLog.TTFBSec)
+	}
+	if requestLog.TTFTSec < 0.99 || requestLog.TTFTSec > 1.01 {
+		t.Errorf("TTFT 应约为 1s，实际 %.3f", requestLog.TTFTSec)
+	}
+	if requestLog.TokensPerSec < 95 || requestLog.TokensPerSec > 101 {
+		t.Errorf("吞吐应约为 100 tokens/s，实际 %.2f", requestLog.TokensPerSec)
+	}
+
+	if !hasContentDelta("claude", `data: {"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"Hi"}}`) {
+		t.Error("content_block_delta 应视为内容增量")
+	}
+	if hasContentDelta("codex", `data: {"type":"response.created","response":{"id":"resp_1"}}`) {
+		t.Error("response.created 不应视为内容增量")
+	}
+	if got := percentile([]float64{5, 1, 4, 2, 3}, 0.5); got != 3 {
+		t.Errorf("p50 应为 3，实际 %v", got)
+	}
+}
@@ -0,0 +1,112 @@
+package services
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+)
+
+// requestIDHeader 返回给客户端的请求 ID 响应头，可用于 LogService.GetRequestTrace 查询
+const requestIDHeader = "X-Code-Switch-Request-Id"
+
+// maxErrorBodyBytes 落库的上游错误体最大长度
+const maxErrorBodyBytes = 2048
+
+// 失败原因分类
+const (
+	relayErrorTimeout        = "timeout"          // 连接或响应超时
+	relayErrorConnection     = "connection"       // 连接失败（DNS、拒绝连接、TLS 等）
+	relayErrorUpstreamStatus = "upstream_status"  // 上游返回非 2xx
+	relayErrorClientAbort    = "client_abort"     // 客户端中断
+	relayErrorStream         = "stream"           // 流式传输中断
+	relayErrorRequest        = "request"          // 构造或转换请求/响应失败
+	relayErrorTruncated      = "truncated"        // 2xx 流式响应缺少结束事件
+	relayErrorInvalidResp    = "invalid_response" // 2xx 响应格式无效（HTML 错误页、非 JSON、流中错误等）
+)
+
+// newRequestID 生成一次客户端请求的 ID，所有降级尝试共用
+func newRequestID() string {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return fmt.Sprintf("req_%x", time.Now().UnixNano())
+	}
+	return "req_" + hex.EncodeToString(buf)
+}
+
+// classifyRelayError 按错误类型归类失败原因
+func classifyRelayError(err error) string {
+	if err == nil {
+		return ""
+	}
+	// 连接池的响应头 / 空闲读取超时通过取消 context 实现，需先于 context.Canceled 判断
+	if errors.Is(err, errUpstreamHeaderTimeout) || errors.Is(err, errUpstreamIdleTimeout) {
+		return relayErrorTimeout
+	}
+	if errors.Is(err, errClientAbort) || errors.Is(err, context.Canceled) {
+		return relayErrorClientAbort
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return relayErrorTimeout
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return relayErrorTimeout
+	}
+	return relayErrorConnection
+}
+
+// truncateErrorBody 截断错误信息，避免超大错误页撑大日志表
+func truncateErrorBody(body string) string {
+	if len(body) <= maxErrorBodyBytes {
+		return body
+	}
+	cut := maxErrorBodyBytes
+	for cut > 0 && !utf8.RuneStart(body[cut]) {
+		cut--
+	}
+	return body[:cut] + "...(truncated)"
+}
+
+// recordAttemptFailure 把失败计入黑名单统计，是否实际计入记录在 requestLog.BlacklistCounted
+// 客户端中断不算 provider 的问题；RecordFailure 跳过的失败（功能关闭、已拉黑、去重窗口内等）同样不算计入
+func (prs *ProviderRelayService) recordAttemptFailure(kind string, requestLog *ReqeustLog) {
+	if requestLog.ErrorClass == relayErrorClientAbort {
+		fmt.Printf("[INFO] 客户端中断，跳过失败计数: %s\n", requestLog.Provider)
+		return
+	}
+	// 上游 429 带有重置时间时按重置时间暂停（排到最后），不进入黑名单等级
+	if requestLog.HttpCode == http.StatusTooManyRequests {
+		if until, ok := prs.quotas.rateLimitedUntil(kind, requestLog.Provider); ok {
+			fmt.Printf("[INFO] ⏳ Provider %s 被上游限流，%s 后恢复，跳过失败计数\n", requestLog.Provider, until.Format("15:04:05"))
+			return
+		}
+	}
+	counted, err := prs.blacklistService.RecordFailure(kind, requestLog.Provider)
+	if err != nil {
+		fmt.Printf("[ERROR] 记录失败到黑名单失败: %v\n", err)
+		return
+	}
+	requestLog.BlacklistCounted = counted
+}
+
+// fail 记录本次尝试的失败原因
+func (l *ReqeustLog) fail(class string, message string) {
+	l.ErrorClass = class
+	l.ErrorMessage = truncateErrorBody(message)
+}
+
+// geminiRequestErrorClass Gemini 转发失败时区分客户端中断与上游连接问题
+func geminiRequestErrorClass(c *gin.Context, err error) string {
+	if c.Request.Context().Err() != nil {
+		return relayErrorClientAbort
+	}
+	return classifyRelayError(err)
+}
@@ -0,0 +1,39 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestClassifyRelayError(t *testing.T) {
+	cases := []struct {
+		err  error
+		want string
+	}{
+		{nil, ""},
+		{fmt.Errorf("%w: context canceled", errClientAbort), relayErrorClientAbort},
+		{context.DeadlineExceeded, relayErrorTimeout},
+		{fmt.Errorf("%w (%s)", errUpstreamHeaderTimeout, "5m0s"), relayErrorTimeout},
+		{fmt.Errorf("%w (%s)", errUpstreamIdleTimeout, "5m0s"), relayErrorTimeout},
+		{&net.OpError{Op: "dial", Err: errors.New("connection refused")}, relayErrorConnection},
+	}
+	for _, tc := range cases {
+		if got := classifyRelayError(tc.err); got != tc.want {
+			t.Errorf("classifyRelayError(%v) = %q，期望 %q", tc.err, got, tc.want)
+		}
+	}
+
+	long := strings.Repeat("错", maxErrorBodyBytes)
+	truncated := truncateErrorBody(long)
+	if !utf8.ValidString(truncated) || !strings.HasSuffix(truncated, "...(truncated)") {
+		t.Errorf("截断后的错误体应保持 UTF-8 完整并带截断标记")
+	}
+	if len(truncated) > maxErrorBodyBytes+len("...(truncated)") {
+		t.Errorf("截断后长度 %d 超过上限", len(truncated))
+	}
+}
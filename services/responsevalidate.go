@@ -0,0 +1,162 @@
+package services
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tidwall/gjson"
+)
+
+// responseValidator 校验上游 2xx 响应是否完整有效
+// 流式响应检查 SSE 格式、data 是否为 JSON 以及是否收到结束事件；非流式响应检查是否为合法的 JSON 对象
+type responseValidator struct {
+	isStream bool
+	lines    int    // 收到的非空行数
+	terminal bool   // 已收到结束事件（message_stop / response.completed）
+	class    string // 首个问题的分类，为空表示正常
+	problem  string // 首个问题的说明
+}
+
+func newResponseValidator(isStream bool) *responseValidator {
+	return &responseValidator{isStream: isStream}
+}
+
+// invalid 只保留第一个问题
+func (v *responseValidator) invalid(class string, format string, args ...any) {
+	if v.class == "" {
+		v.class = class
+		v.problem = fmt.Sprintf(format, args...)
+	}
+}
+
+// hook 作为响应钩子观察上游数据，不修改内容
+func (v *responseValidator) hook(data []byte) (bool, []byte) {
+	payload := bytes.TrimSpace(data)
+	if len(payload) == 0 {
+		return true, data
+	}
+	v.lines++
+	// 流式请求也可能收到一次性的 JSON 响应（如上游忽略了 stream 参数）
+	if payload[0] == '{' || !v.isStream {
+		v.checkBody(payload)
+		return true, data
+	}
+	for _, line := range bytes.Split(payload, []byte("\n")) {
+		v.checkLine(bytes.TrimSpace(line))
+	}
+	return true, data
+}
+
+// checkLine 校验一行 SSE
+func (v *responseValidator) checkLine(line []byte) {
+	switch {
+	case len(line) == 0, line[0] == ':':
+		return
+	case bytes.HasPrefix(line, []byte("event:")), bytes.HasPrefix(line, []byte("id:")), bytes.HasPrefix(line, []byte("retry:")):
+		return
+	case !bytes.HasPrefix(line, []byte("data:")):
+		v.invalid(relayErrorInvalidResp, "SSE 格式无效: %s", truncateErrorBody(string(line)))
+		return
+	}
+
+	data := bytes.TrimSpace(bytes.TrimPrefix(line, []byte("data:")))
+	if string(data) == "[DONE]" {
+		return
+	}
+	if !gjson.ValidBytes(data) {
+		v.invalid(relayErrorInvalidResp, "SSE data 不是有效的 JSON: %s", truncateErrorBody(string(data)))
+		return
+	}
+	event := gjson.ParseBytes(data)
+	switch eventType := event.Get("type").String(); eventType {
+	case "message_stop", "response.completed", "response.incomplete":
+		v.terminal = true
+	case "error", "response.failed":
+		message := event.Get("error.message").String()
+		if message == "" {
+			message = event.Get("response.error.message").String()
+		}
+		v.invalid(relayErrorInvalidResp, "上游在流中返回错误 %s: %s", eventType, message)
+	}
+}
+
+// checkBody 校验非流式响应体
+func (v *responseValidator) checkBody(body []byte) {
+	if !gjson.ValidBytes(body) || !gjson.ParseBytes(body).IsObject() {
+		v.invalid(relayErrorInvalidResp, "响应不是有效的 JSON: %s", truncateErrorBody(string(body)))
+		return
+	}
+	result := gjson.ParseBytes(body)
+	// Responses API 的响应总带有 "error": null，只有错误对象才算错误
+	if result.Get("error").IsObject() || result.Get("type").String() == "error" {
+		v.invalid(relayErrorInvalidResp, "2xx 响应中包含错误: %s", truncateErrorBody(string(body)))
+		return
+	}
+	v.terminal = true
+}
+
+// result 数据接收完毕后的校验结论，返回错误分类与说明（均为空表示有效）
+func (v *responseValidator) result() (string, string) {
+	if v.class != "" {
+		return v.class, v.problem
+	}
+	if v.lines == 0 {
+		return relayErrorInvalidResp, "响应体为空"
+	}
+	if !v.terminal {
+		return relayErrorTruncated, "流式响应在结束事件（message_stop / response.completed）之前中断"
+	}
+	return "", ""
+}
+
+// sniffHTML 在向客户端写出任何内容之前检查响应是否以 HTML 开头（常见于中转站返回 200 的错误页）
+// 只 Peek 不消费，检查过的数据仍保留在返回的 body 中
+func sniffHTML(body io.ReadCloser) (io.ReadCloser, bool) {
+	reader := bufio.NewReader(body)
+	wrapped := struct {
+		io.Reader
+		io.Closer
+	}{reader, body}
+	for i := 0; i < 64; i++ {
+		b, err := reader.Peek(i + 1)
+		if err != nil || len(b) <= i {
+			return wrapped, false
+		}
+		switch b[i] {
+		case ' ', '\t', '\r', '\n':
+			continue
+		}
+		return wrapped, b[i] == '<'
+	}
+	return wrapped, false
+}
+
+// writeValidatedResponse 非流式响应先读完并校验，通过后再写给客户端
+// 校验失败时客户端尚未收到任何内容，可以降级到下一个 provider；返回值只表示写客户端的错误
+func writeValidatedResponse(c *gin.Context, resp *http.Response, validator *responseValidator, logHook func([]byte) (bool, []byte)) error {
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		validator.invalid(relayErrorTruncated, "读取响应失败: %v", err)
+		return nil
+	}
+	logHook(body)
+	validator.hook(body)
+	if class, _ := validator.result(); class != "" {
+		return nil
+	}
+
+	for key, values := range resp.Header {
+		if strings.EqualFold(key, "Content-Length") {
+			continue
+		}
+		c.Writer.Header()[key] = append([]string(nil), values...)
+	}
+	c.Writer.WriteHeader(resp.StatusCode)
+	_, err = c.Writer.Write(body)
+	return err
+}
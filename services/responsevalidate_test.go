@@ -0,0 +1,89 @@
+package services
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/tidwall/gjson"
+)
+
+func TestResponseValidator(t *testing.T) {
+	feed := func(isStream bool, lines ...string) *responseValidator {
+		v := newResponseValidator(isStream)
+		for _, line := range lines {
+			v.hook([]byte(line))
+		}
+		return v
+	}
+	tests := []struct {
+		name      string
+		validator *responseValidator
+		want      string
+	}{
+		{"完整的 Claude 流", feed(true, "event: message_start", `data: {"type":"message_start"}`, "event: message_stop", `data: {"type":"message_stop"}`), ""},
+		{"完整的 Codex 流", feed(true, ": keep-alive", `data: {"type":"response.created"}`, `data: {"type":"response.completed","response":{}}`), ""},
+		{"缺少 message_stop", feed(true, `data: {"type":"message_start"}`, `data: {"type":"content_block_delta"}`), relayErrorTruncated},
+		{"流中返回错误", feed(true, `data: {"type":"error","error":{"type":"overloaded_error","message":"Overloaded"}}`, `data: {"type":"message_stop"}`), relayErrorInvalidResp},
+		{"SSE data 不是 JSON", feed(true, `data: {"type":`, `data: {"type":"message_stop"}`), relayErrorInvalidResp},
+		{"SSE 中混入 HTML", feed(true, "<html>", `data: {"type":"message_stop"}`), relayErrorInvalidResp},
+		{"流式请求收到 JSON", feed(true, `{"id":"msg_1","type":"message","content":[]}`), ""},
+		{"空响应", feed(false), relayErrorInvalidResp},
+		{"非流式 JSON", feed(false, `{"id":"resp_1","object":"response","error":null,"output":[]}`), ""},
+		{"非流式 HTML", feed(false, "<!DOCTYPE html><html></html>"), relayErrorInvalidResp},
+		{"2xx 中的错误对象", feed(false, `{"error":{"message":"quota exceeded"}}`), relayErrorInvalidResp},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got, problem := tt.validator.result(); got != tt.want {
+				t.Errorf("期望 %q，实际 %q（%s）", tt.want, got, problem)
+			}
+		})
+	}
+
+	body, isHTML := sniffHTML(io.NopCloser(strings.NewReader("\n  <html><body>Bad Gateway</body></html>")))
+	if !isHTML {
+		t.Error("应识别 HTML 响应")
+	}
+	if data, _ := io.ReadAll(body); !strings.HasPrefix(string(data), "\n  <html>") {
+		t.Errorf("检查后响应体应保持不变，实际 %q", data)
+	}
+	if _, isHTML := sniffHTML(io.NopCloser(strings.NewReader("event: message_start\n"))); isHTML {
+		t.Error("SSE 不应被识别为 HTML")
+	}
+}
+
+func TestRelayDecompressesGzipResponse(t *testing.T) {
+	var acceptEncoding string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		acceptEncoding = r.Header.Get("Accept-Encoding")
+		w.Header().Set("Content-Type", "application/json")
+		if !strings.Contains(acceptEncoding, "gzip") {
+			_, _ = io.WriteString(w, `{"id":"msg_1","type":"message","content":[{"type":"text","text":"hi"}]}`)
+			return
+		}
+		w.Header().Set("Content-Encoding", "gzip")
+		gz := gzip.NewWriter(w)
+		_, _ = io.WriteString(gz, `{"id":"msg_1","type":"message","content":[{"type":"text","text":"hi"}]}`)
+		_ = gz.Close()
+	}))
+	defer upstream.Close()
+
+	prs := newTestRelay(t)
+	saveTestProviders(t, prs, "claude", Provider{ID: 1, Name: "gzip", APIURL: upstream.URL, APIKey: "sk", Enabled: true, Level: 1})
+	resp := serveRelay(prs, "/v1/messages", `{"model":"claude-sonnet-4-5","messages":[{"role":"user","content":"hi"}]}`,
+		"Accept-Encoding", "gzip, br")
+
+	if resp.Code != http.StatusOK {
+		t.Fatalf("gzip 响应应视为有效，实际 %d: %s", resp.Code, resp.Body.String())
+	}
+	if strings.Contains(acceptEncoding, "br") {
+		t.Errorf("客户端的 Accept-Encoding 不应转发给上游: %q", acceptEncoding)
+	}
+	if got := gjson.Get(resp.Body.String(), "content.0.text").String(); got != "hi" || resp.Header().Get("Content-Encoding") != "" {
+		t.Errorf("客户端应收到解压后的响应，实际 %q（Content-Encoding %q）", resp.Body.String(), resp.Header().Get("Content-Encoding"))
+	}
+}
@@ -0,0 +1,421 @@
+package services
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/tidwall/gjson"
+)
+
+// provider 被跳过的原因
+const (
+	RouteSkipPinned           = "not_pinned"           // 不在客户端指定的 provider / Level 范围内
+	RouteSkipDisabled         = "disabled"             // 未启用
+	RouteSkipNoCredentials    = "missing_credentials"  // 未配置 API 地址或密钥
+	RouteSkipInvalidConfig    = "invalid_config"       // 配置验证失败
+	RouteSkipModel            = "model_unsupported"    // 不支持请求的模型
+	RouteSkipCapability       = "capability_missing"   // 缺少请求所需能力
+	RouteSkipEndpoint         = "endpoint_unsupported" // 上游协议不支持该接口（Gemini）
+	RouteSkipBlacklisted      = "blacklisted"          // 已拉黑
+	RouteSkipPreviousResponse = "previous_response"    // previous_response_id 固定到其他 provider（Codex）
+)
+
+// RouteSkip 被跳过的 provider
+type RouteSkip struct {
+	Provider string `json:"provider"`
+	Reason   string `json:"reason"`
+	Detail   string `json:"detail,omitempty"`
+	counted  bool   // 是否计入"已过滤"数量（与转发日志、错误信息一致）
+}
+
+// RouteCandidate 按尝试顺序排列的候选 provider
+type RouteCandidate struct {
+	Provider       string   `json:"provider"`
+	Level          int      `json:"level"`          // 配置的 Level
+	Group          int      `json:"group"`          // 排序后所在的分组（会话亲和只在本 Level 内提前，额度不足的排在最后的分组）
+	EffectiveModel string   `json:"effectiveModel"` // 映射后发送给上游的模型
+	Affinity       bool     `json:"affinity,omitempty"`
+	Quota          string   `json:"quota,omitempty"` // near_limit / exhausted
+	QuotaReason    string   `json:"quotaReason,omitempty"`
+	EstimatedCost  *float64 `json:"estimatedCost,omitempty"` // 费用优先模式下的预估费用（美元）
+	WillTry        bool     `json:"willTry"`                 // 拉黑模式下只会尝试第一个
+}
+
+// RouteExplanation 路由演练结果
+type RouteExplanation struct {
+	Platform             string           `json:"platform"`
+	Model                string           `json:"model"`
+	RoutingMode          string           `json:"routingMode"`
+	BlacklistMode        bool             `json:"blacklistMode"` // 拉黑模式：只尝试第一个 provider，失败不降级
+	RequiredCapabilities []string         `json:"requiredCapabilities"`
+	Candidates           []RouteCandidate `json:"candidates"`
+	Skipped              []RouteSkip      `json:"skipped"`
+	FallbackModels       []string         `json:"fallbackModels"` // 候选 provider 全部失败后依次尝试的模型
+	Notes                []string         `json:"notes"`
+}
+
+// ExplainRoute 演练一次请求的 provider 选择（与转发使用同一套过滤和排序逻辑），不发送任何上游请求
+// sampleBody 可选：用于推导所需能力、会话亲和与费用估算；model 为空时取 sampleBody 中的模型
+// headers 可选：客户端请求头（anthropic-beta 推导所需能力，X-Code-Switch-Provider / Level 指定 provider）
+func (prs *ProviderRelayService) ExplainRoute(platform string, model string, sampleBody string, headers map[string]string) (*RouteExplanation, error) {
+	body := []byte(strings.TrimSpace(sampleBody))
+	if len(body) > 0 && !gjson.ValidBytes(body) {
+		return nil, fmt.Errorf("示例请求体不是有效的 JSON")
+	}
+	header := http.Header{}
+	for name, value := range headers {
+		header.Set(name, value)
+	}
+	pin, ignored, err := prs.clientPinFromHeader(header)
+	if err != nil {
+		return nil, err
+	}
+	if model == "" {
+		model = gjson.GetBytes(body, "model").String()
+	}
+	if len(body) == 0 {
+		body = []byte(`{}`)
+	}
+
+	explanation := &RouteExplanation{
+		Platform:             platform,
+		Model:                model,
+		RoutingMode:          RoutingModePriority,
+		BlacklistMode:        prs.blacklistService.IsLevelBlacklistEnabled(),
+		RequiredCapabilities: []string{},
+		Candidates:           []RouteCandidate{},
+		Skipped:              []RouteSkip{},
+		FallbackModels:       []string{},
+		Notes:                []string{},
+	}
+	if model == "" {
+		explanation.Notes = append(explanation.Notes, "未指定模型：不按模型过滤 provider")
+	}
+	if ignored {
+		explanation.Notes = append(explanation.Notes, fmt.Sprintf("未开启客户端指定 provider：%s / %s 请求头会被忽略", pinProviderHeader, pinLevelHeader))
+	}
+
+	switch platform {
+	case "claude", "codex":
+		if model != "" && gjson.GetBytes(body, "model").String() != model {
+			if replaced, err := ReplaceModelInRequestBody(body, model); err == nil {
+				body = replaced
+			}
+		}
+		prs.explainProviderRoute(platform, model, body, header, pin, explanation)
+		// 模型降级只作用于 Claude / Codex，Gemini 没有降级链
+		if chain := prs.modelFallbackChain(platform, model); len(chain) > 1 {
+			explanation.FallbackModels = chain[1:]
+		}
+	case "gemini":
+		prs.explainGeminiRoute(model, pin, explanation)
+	default:
+		return nil, fmt.Errorf("不支持的平台: %s", platform)
+	}
+	return explanation, nil
+}
+
+// explainProviderRoute Claude / Codex 的路由演练
+func (prs *ProviderRelayService) explainProviderRoute(kind string, model string, body []byte, header http.Header, pin clientPin,
+	explanation *RouteExplanation) {
+	providers, err := prs.providerService.LoadProviders(kind)
+	if err != nil {
+		explanation.Notes = append(explanation.Notes, fmt.Sprintf("加载 provider 配置失败: %v", err))
+		return
+	}
+	explanation.RoutingMode = prs.settingsService.GetRoutingMode()
+
+	required := requiredCapabilities(kind, body, header)
+	explanation.RequiredCapabilities = append(explanation.RequiredCapabilities, required...)
+	active, skipped := prs.filterProviders(kind, providers, pin, model, required)
+	explanation.Skipped = append(explanation.Skipped, skipped...)
+
+	if kind == "codex" {
+		if previousID, owner, ok := prs.previousResponseOwner(body); ok {
+			pinned := pinToProvider(active, owner)
+			for _, p := range active {
+				if p.Name != owner {
+					explanation.Skipped = append(explanation.Skipped, RouteSkip{
+						Provider: p.Name,
+						Reason:   RouteSkipPreviousResponse,
+						Detail:   fmt.Sprintf("previous_response_id %s 固定到 %s", previousID, owner),
+					})
+				}
+			}
+			if len(pinned) == 0 {
+				explanation.Notes = append(explanation.Notes, fmt.Sprintf("previous_response_id %s 所属 Provider %s 当前不可用，请求会直接失败", previousID, owner))
+			}
+			active = pinned
+		}
+	}
+	if len(active) == 0 {
+		explanation.Notes = append(explanation.Notes, "没有可用的 provider")
+		return
+	}
+
+	levelGroups, levels, _, affinityProvider := prs.orderProviders(kind, active, model, body)
+	usage := estimateRequestUsage(kind, body)
+	for _, level := range levels {
+		for _, p := range levelGroups[level] {
+			candidate := RouteCandidate{
+				Provider:       p.Name,
+				Level:          providerLevel(p.Level),
+				Group:          level,
+				EffectiveModel: p.GetEffectiveModel(model),
+				Affinity:       p.Name == affinityProvider,
+				WillTry:        !explanation.BlacklistMode || len(explanation.Candidates) == 0,
+			}
+			switch pressure, reason := prs.quotas.pressure(kind, p); pressure {
+			case quotaNearLimit:
+				candidate.Quota, candidate.QuotaReason = "near_limit", reason
+			case quotaExhausted:
+				candidate.Quota, candidate.QuotaReason = "exhausted", reason
+			}
+			if explanation.RoutingMode != RoutingModePriority {
+				if cost, ok := p.expectedCost(prs.pricing, model, usage); ok {
+					candidate.EstimatedCost = &cost
+				}
+			}
+			explanation.Candidates = append(explanation.Candidates, candidate)
+		}
+	}
+	if explanation.BlacklistMode {
+		explanation.Notes = append(explanation.Notes, "拉黑模式已开启：只尝试第一个 provider，失败不降级")
+	}
+}
+
+// explainGeminiRoute Gemini 的路由演练（按 generateContent 接口判断）
+func (prs *ProviderRelayService) explainGeminiRoute(model string, pin clientPin, explanation *RouteExplanation) {
+	if prs.geminiService == nil {
+		explanation.Notes = append(explanation.Notes, "Gemini 服务未初始化")
+		return
+	}
+	fullPath := "/models/" + model + ":generateContent"
+	active, skipped := prs.filterGeminiProviders(prs.geminiService.GetProviders(), pin, model, "/v1beta"+fullPath, fullPath)
+	explanation.Skipped = append(explanation.Skipped, skipped...)
+	if len(active) == 0 {
+		explanation.Notes = append(explanation.Notes, "没有可用的 provider")
+		return
+	}
+
+	levelGroups, levels := groupGeminiProviders(active)
+	for _, level := range levels {
+		for _, p := range levelGroups[level] {
+			_, effective := geminiEndpointForProvider(&p, "/v1beta"+fullPath, model)
+			explanation.Candidates = append(explanation.Candidates, RouteCandidate{
+				Provider:       p.Name,
+				Level:          p.Level,
+				Group:          level,
+				EffectiveModel: effective,
+				WillTry:        !explanation.BlacklistMode || len(explanation.Candidates) == 0,
+			})
+		}
+	}
+	if explanation.BlacklistMode {
+		explanation.Notes = append(explanation.Notes, "拉黑模式已开启：只尝试第一个 provider，失败不降级")
+	}
+}
+
+// filterProviders 过滤可用的 provider（客户端指定范围、启用、配置有效、支持模型、具备所需能力、未被拉黑）
+// 转发与路由演练共用，返回可用的 provider 与被跳过的 provider 及原因
+func (prs *ProviderRelayService) filterProviders(kind string, providers []Provider, pin clientPin, requestedModel string,
+	required []string) ([]Provider, []RouteSkip) {
+	active := make([]Provider, 0, len(providers))
+	var skipped []RouteSkip
+	for _, provider := range providers {
+		// 客户端指定了 provider / Level 时只在指定范围内选择
+		if !pin.matches(provider.Name, provider.Level) {
+			skipped = append(skipped, RouteSkip{Provider: provider.Name, Reason: RouteSkipPinned, Detail: pin.describe()})
+			continue
+		}
+		pinned := pin.pinned(provider.Name)
+
+		// 基础过滤：enabled、URL、APIKey（客户端指定的 provider 即使未启用也可使用）
+		if !provider.Enabled && !pinned {
+			skipped = append(skipped, RouteSkip{Provider: provider.Name, Reason: RouteSkipDisabled})
+			continue
+		}
+		if provider.APIURL == "" || provider.APIKey == "" {
+			skipped = append(skipped, RouteSkip{Provider: provider.Name, Reason: RouteSkipNoCredentials})
+			continue
+		}
+		if isSecretRef(provider.APIKey) {
+			fmt.Printf("[WARN] Provider %s 的 API Key 无法解密（密钥库未解锁？），已跳过\n", provider.Name)
+			skipped = append(skipped, RouteSkip{Provider: provider.Name, Reason: RouteSkipNoCredentials, Detail: "密钥库未解锁"})
+			continue
+		}
+
+		// 配置验证：失败则自动跳过
+		if errs := blockingConfigErrors(provider.configIssues()); len(errs) > 0 {
+			fmt.Printf("[WARN] Provider %s 配置验证失败，已自动跳过: %v\n", provider.Name, errs)
+			skipped = append(skipped, RouteSkip{Provider: provider.Name, Reason: RouteSkipInvalidConfig, Detail: strings.Join(errs, "; "), counted: true})
+			continue
+		}
+
+		// 核心过滤：只保留支持请求模型的 provider
+		if requestedModel != "" && !provider.IsModelSupported(requestedModel) {
+			fmt.Printf("[INFO] Provider %s 不支持模型 %s，已跳过\n", provider.Name, requestedModel)
+			skipped = append(skipped, RouteSkip{Provider: provider.Name, Reason: RouteSkipModel, Detail: requestedModel, counted: true})
+			continue
+		}
+
+		// 能力过滤：跳过缺少请求所需能力的 provider
+		if missing := provider.missingCapability(kind, required); missing != "" && !pinned {
+			fmt.Printf("[INFO] Provider %s 不支持请求所需能力 %s，已跳过\n", provider.Name, missing)
+			skipped = append(skipped, RouteSkip{Provider: provider.Name, Reason: RouteSkipCapability, Detail: missing, counted: true})
+			continue
+		}
+
+		// 黑名单检查：跳过已拉黑的 provider
+		if isBlacklisted, until := prs.blacklistService.IsBlacklisted(kind, provider.Name); isBlacklisted && !pinned {
+			fmt.Printf("⛔ Provider %s 已拉黑，过期时间: %v\n", provider.Name, until.Format("15:04:05"))
+			skipped = append(skipped, RouteSkip{Provider: provider.Name, Reason: RouteSkipBlacklisted, Detail: "拉黑至 " + until.Format("15:04:05"), counted: true})
+			continue
+		}
+
+		active = append(active, provider)
+	}
+	return active, skipped
+}
+
+// filterGeminiProviders 过滤可用的 Gemini provider（规则与 filterProviders 一致，另外检查上游协议是否支持该接口）
+func (prs *ProviderRelayService) filterGeminiProviders(providers []GeminiProvider, pin clientPin, requestedModel string,
+	endpoint string, fullPath string) ([]GeminiProvider, []RouteSkip) {
+	var active []GeminiProvider
+	var skipped []RouteSkip
+	for _, p := range providers {
+		// 客户端指定了 provider / Level 时只在指定范围内选择
+		if !pin.matches(p.Name, p.Level) {
+			skipped = append(skipped, RouteSkip{Provider: p.Name, Reason: RouteSkipPinned, Detail: pin.describe()})
+			continue
+		}
+		pinned := pin.pinned(p.Name)
+		if !p.Enabled && !pinned {
+			skipped = append(skipped, RouteSkip{Provider: p.Name, Reason: RouteSkipDisabled})
+			continue
+		}
+		if p.BaseURL == "" {
+			skipped = append(skipped, RouteSkip{Provider: p.Name, Reason: RouteSkipNoCredentials})
+			continue
+		}
+		if isSecretRef(p.APIKey) {
+			fmt.Printf("[Gemini] [WARN] Provider %s 的 API Key 无法解密（密钥库未解锁？），已跳过\n", p.Name)
+			skipped = append(skipped, RouteSkip{Provider: p.Name, Reason: RouteSkipNoCredentials, Detail: "密钥库未解锁"})
+			continue
+		}
+		// 配置验证：失败则自动跳过
+		if errs := blockingConfigErrors(p.configIssues()); len(errs) > 0 {
+			fmt.Printf("[Gemini] [WARN] Provider %s 配置验证失败，已自动跳过: %v\n", p.Name, errs)
+			skipped = append(skipped, RouteSkip{Provider: p.Name, Reason: RouteSkipInvalidConfig, Detail: strings.Join(errs, "; "), counted: true})
+			continue
+		}
+		// 核心过滤：只保留支持请求模型的 provider
+		if requestedModel != "" && !p.IsModelSupported(requestedModel) {
+			fmt.Printf("[Gemini] Provider %s 不支持模型 %s，已跳过\n", p.Name, requestedModel)
+			skipped = append(skipped, RouteSkip{Provider: p.Name, Reason: RouteSkipModel, Detail: requestedModel, counted: true})
+			continue
+		}
+		// 非 Gemini 协议的 provider 只能承接 generateContent / streamGenerateContent
+		if p.UpstreamFormat() != GeminiAPIFormatGemini && !isGeminiGenerateEndpoint(endpoint) {
+			fmt.Printf("[Gemini] Provider %s（%s 协议）不支持 %s，已跳过\n", p.Name, p.UpstreamFormat(), fullPath)
+			skipped = append(skipped, RouteSkip{Provider: p.Name, Reason: RouteSkipEndpoint, Detail: p.UpstreamFormat(), counted: true})
+			continue
+		}
+		// 检查黑名单
+		if isBlacklisted, until := prs.blacklistService.IsBlacklisted("gemini", p.Name); isBlacklisted && !pinned {
+			fmt.Printf("[Gemini] ⛔ Provider %s 已拉黑，过期时间: %v\n", p.Name, until.Format("15:04:05"))
+			skipped = append(skipped, RouteSkip{Provider: p.Name, Reason: RouteSkipBlacklisted, Detail: "拉黑至 " + until.Format("15:04:05"), counted: true})
+			continue
+		}
+		// Level 默认值处理
+		if p.Level <= 0 {
+			p.Level = 1
+		}
+		active = append(active, p)
+	}
+	return active, skipped
+}
+
+// countedSkips 计入"已过滤"数量的 provider 数
+func countedSkips(skipped []RouteSkip) int {
+	count := 0
+	for _, s := range skipped {
+		if s.counted {
+			count++
+		}
+	}
+	return count
+}
+
+// previousResponseOwner 返回 Codex 请求的 previous_response_id 及创建它的 provider
+func (prs *ProviderRelayService) previousResponseOwner(body []byte) (string, string, bool) {
+	previousID := gjson.GetBytes(body, "previous_response_id").String()
+	if previousID == "" {
+		return "", "", false
+	}
+	owner, ok := prs.responseOwners.Get(previousID)
+	return previousID, owner, ok
+}
+
+// pinToProvider 只保留指定名称的 provider
+func pinToProvider(active []Provider, name string) []Provider {
+	for _, p := range active {
+		if p.Name == name {
+			return []Provider{p}
+		}
+	}
+	return nil
+}
+
+// orderProviders 按 Level 分组并排序：费用优先路由 -> 会话亲和 -> 额度感知
+// 返回分组、分组顺序、会话标识与命中的亲和 provider
+func (prs *ProviderRelayService) orderProviders(kind string, active []Provider, requestedModel string,
+	bodyBytes []byte) (map[int][]Provider, []int, string, string) {
+	// 按 Level 分组
+	levelGroups := make(map[int][]Provider)
+	for _, p := range active {
+		levelGroups[providerLevel(p.Level)] = append(levelGroups[providerLevel(p.Level)], p)
+	}
+
+	// 获取排序后的 Level 列表
+	var levels []int
+	for level := range levelGroups {
+		levels = append(levels, level)
+	}
+	sort.Ints(levels)
+
+	// 费用优先路由：按预估费用重排 Level 内（或全部）的 provider
+	if mode := prs.settingsService.GetRoutingMode(); mode != RoutingModePriority {
+		levels = prs.orderByCost(kind, mode, levelGroups, levels, requestedModel, bodyBytes)
+	}
+
+	// 会话亲和：同一会话优先使用上一次成功的 provider（仍可用时），保证上游 prompt cache 命中
+	affinityKey := conversationKey(kind, requestedModel, bodyBytes)
+	affinityProvider := ""
+	if name, ok := prs.affinity.Get(affinityKey); ok {
+		if preferAffinityProvider(levelGroups, levels, name) {
+			affinityProvider = name
+			fmt.Printf("[INFO] 🔗 会话亲和命中: %s\n", name)
+		}
+	}
+
+	// 额度感知：接近上限或已被上游限流的 provider 排到最后（优先于会话亲和）
+	levels = prs.deprioritizeByQuota(kind, levelGroups, levels)
+	return levelGroups, levels, affinityKey, affinityProvider
+}
+
+// groupGeminiProviders 按 Level 分组（Level 已在过滤时补全默认值）
+func groupGeminiProviders(active []GeminiProvider) (map[int][]GeminiProvider, []int) {
+	levelGroups := make(map[int][]GeminiProvider)
+	for _, p := range active {
+		levelGroups[p.Level] = append(levelGroups[p.Level], p)
+	}
+	var levels []int
+	for level := range levelGroups {
+		levels = append(levels, level)
+	}
+	sort.Ints(levels)
+	return levelGroups, levels
+}
@@ -0,0 +1,103 @@
+package services
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestExplainRoute(t *testing.T) {
+	prs := newTestRelay(t)
+	saveTestProviders(t, prs, "claude",
+		Provider{ID: 1, Name: "disabled", APIURL: "https://a.example.com", APIKey: "sk-a", Level: 1},
+		Provider{ID: 2, Name: "no-key", APIURL: "https://b.example.com", Enabled: true, Level: 1},
+		Provider{ID: 3, Name: "opus-only", APIURL: "https://c.example.com", APIKey: "sk-c", Enabled: true, Level: 1,
+			SupportedModels: map[string]bool{"claude-opus-*": true}},
+		Provider{ID: 4, Name: "no-vision", APIURL: "https://d.example.com", APIKey: "sk-d", Enabled: true, Level: 1,
+			Capabilities: map[string]bool{CapabilityVision: false}},
+		Provider{ID: 5, Name: "primary", APIURL: "https://e.example.com", APIKey: "sk-e", Enabled: true, Level: 1},
+		Provider{ID: 6, Name: "mapped", APIURL: "https://f.example.com", APIKey: "sk-f", Enabled: true, Level: 2,
+			SupportedModels: map[string]bool{"vendor/sonnet": true},
+			ModelMapping:    map[string]string{"claude-sonnet-*": "vendor/sonnet"}},
+	)
+
+	names := func(candidates []RouteCandidate) []string {
+		var out []string
+		for _, c := range candidates {
+			out = append(out, c.Provider)
+		}
+		return out
+	}
+	reasons := func(skipped []RouteSkip) map[string]string {
+		out := make(map[string]string)
+		for _, s := range skipped {
+			out[s.Provider] = s.Reason
+		}
+		return out
+	}
+
+	explanation, err := prs.ExplainRoute("claude", "claude-sonnet-4-5", "", nil)
+	if err != nil {
+		t.Fatalf("explain: %v", err)
+	}
+	if got := names(explanation.Candidates); strings.Join(got, ",") != "no-vision,primary,mapped" {
+		t.Fatalf("unexpected candidate order: %v", got)
+	}
+	if c := explanation.Candidates[2]; c.EffectiveModel != "vendor/sonnet" || c.Level != 2 || !c.WillTry {
+		t.Errorf("unexpected mapped candidate: %+v", c)
+	}
+	want := map[string]string{"disabled": RouteSkipDisabled, "no-key": RouteSkipNoCredentials, "opus-only": RouteSkipModel}
+	if got := reasons(explanation.Skipped); len(got) != len(want) {
+		t.Errorf("unexpected skips: %+v", explanation.Skipped)
+	} else {
+		for name, reason := range want {
+			if got[name] != reason {
+				t.Errorf("provider %s: expected skip reason %s, got %q", name, reason, got[name])
+			}
+		}
+	}
+
+	// 示例请求体带图片：缺少 vision 能力的 provider 被跳过；会话亲和只在所在 Level 内生效，不越过 Level 1
+	body := `{"model":"claude-sonnet-4-5","messages":[{"role":"user","content":[{"type":"image","source":{"type":"base64","media_type":"image/png","data":"AAAA"}},{"type":"text","text":"hi"}]}]}`
+	prs.affinity.Set(conversationKey("claude", "claude-sonnet-4-5", []byte(body)), "mapped")
+	explanation, err = prs.ExplainRoute("claude", "", body, nil)
+	if err != nil {
+		t.Fatalf("explain with body: %v", err)
+	}
+	if strings.Join(explanation.RequiredCapabilities, ",") != CapabilityVision {
+		t.Errorf("expected vision requirement, got %v", explanation.RequiredCapabilities)
+	}
+	if got := names(explanation.Candidates); strings.Join(got, ",") != "primary,mapped" {
+		t.Fatalf("unexpected candidate order with affinity: %v", got)
+	}
+	if explanation.Candidates[0].Affinity || !explanation.Candidates[1].Affinity {
+		t.Errorf("affinity flag should mark only the mapped candidate: %+v", explanation.Candidates)
+	}
+	if reasons(explanation.Skipped)["no-vision"] != RouteSkipCapability {
+		t.Errorf("expected no-vision skipped for capability, got %+v", explanation.Skipped)
+	}
+
+	// 客户端请求头：anthropic-beta 推导 context-1m 能力；未开启客户端指定 provider 时 pin 请求头被忽略
+	explanation, err = prs.ExplainRoute("claude", "claude-sonnet-4-5", "", map[string]string{
+		"anthropic-beta":  "context-1m-2025-08-07",
+		pinProviderHeader: "mapped",
+	})
+	if err != nil {
+		t.Fatalf("explain with headers: %v", err)
+	}
+	if strings.Join(explanation.RequiredCapabilities, ",") != CapabilityContext1M {
+		t.Errorf("expected context_1m requirement from anthropic-beta header, got %v", explanation.RequiredCapabilities)
+	}
+	if got := names(explanation.Candidates); strings.Join(got, ",") != "no-vision,primary,mapped" {
+		t.Errorf("pin header should be ignored while pinning is disabled: %v", got)
+	}
+	if !strings.Contains(strings.Join(explanation.Notes, "\n"), pinProviderHeader) {
+		t.Errorf("expected a note about the ignored pin header, got %v", explanation.Notes)
+	}
+
+	if _, err := prs.ExplainRoute("claude", "", "{not json", nil); err == nil {
+		t.Errorf("expected invalid sample body error")
+	}
+	if _, err := prs.ExplainRoute("unknown", "x", "", nil); err == nil {
+		t.Errorf("expected unsupported platform error")
+	}
+}
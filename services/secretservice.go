@@ -0,0 +1,168 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// SecretStoreStatus 密钥库状态
+type SecretStoreStatus struct {
+	Mode        string `json:"mode"`   // keyfile / passphrase
+	Locked      bool   `json:"locked"` // 口令模式下尚未解锁
+	SecretCount int    `json:"secretCount"`
+	VaultPath   string `json:"vaultPath"`
+	KeyPath     string `json:"keyPath,omitempty"`
+}
+
+// ConfigExport 导出的配置（默认不含密钥）
+type ConfigExport struct {
+	Version         int              `json:"version"`
+	ExportedAt      time.Time        `json:"exportedAt"`
+	SecretsIncluded bool             `json:"secretsIncluded"`
+	Claude          []Provider       `json:"claude"`
+	Codex           []Provider       `json:"codex"`
+	Gemini          []GeminiProvider `json:"gemini"`
+	MCP             []MCPServer      `json:"mcp"`
+}
+
+// SecretService 密钥库管理：解锁、设置口令、密钥轮换与配置导出
+type SecretService struct {
+	providerService *ProviderService
+	geminiService   *GeminiService
+	mcpService      *MCPService
+}
+
+func NewSecretService(providerService *ProviderService, geminiService *GeminiService, mcpService *MCPService) *SecretService {
+	return &SecretService{
+		providerService: providerService,
+		geminiService:   geminiService,
+		mcpService:      mcpService,
+	}
+}
+
+func (ss *SecretService) Start() error { return nil }
+func (ss *SecretService) Stop() error  { return nil }
+
+// GetSecretStoreStatus 获取密钥库状态
+func (ss *SecretService) GetSecretStoreStatus() (SecretStoreStatus, error) {
+	return defaultSecretStore.status()
+}
+
+// UnlockSecrets 使用口令解锁密钥库
+func (ss *SecretService) UnlockSecrets(passphrase string) error {
+	if err := defaultSecretStore.Unlock(passphrase); err != nil {
+		return err
+	}
+	ss.reloadGeminiProviders()
+	return nil
+}
+
+// SetSecretPassphrase 设置密钥库口令并重新加密全部密钥；口令为空时改回本地密钥文件
+func (ss *SecretService) SetSecretPassphrase(passphrase string) error {
+	mode := SecretModePassphrase
+	if passphrase == "" {
+		mode = SecretModeKeyFile
+	}
+	return defaultSecretStore.Rekey(mode, passphrase)
+}
+
+// RotateSecretKey 轮换加密密钥（保持当前的密钥派生方式）并重新加密全部密钥
+func (ss *SecretService) RotateSecretKey() error {
+	status, err := defaultSecretStore.status()
+	if err != nil {
+		return err
+	}
+	if status.Locked {
+		return ErrSecretsLocked
+	}
+	return defaultSecretStore.Rekey(status.Mode, "")
+}
+
+// ExportConfig 导出 provider 与 MCP 配置（JSON）
+// includeSecrets 为 false 时 API Key 与 env 的值全部清空，只有明确要求时才导出解密后的密钥
+func (ss *SecretService) ExportConfig(includeSecrets bool) (string, error) {
+	export := ConfigExport{
+		Version:         1,
+		ExportedAt:      time.Now(),
+		SecretsIncluded: includeSecrets,
+		Claude:          []Provider{},
+		Codex:           []Provider{},
+		Gemini:          []GeminiProvider{},
+		MCP:             []MCPServer{},
+	}
+
+	for _, kind := range []string{"claude", "codex"} {
+		providers, err := ss.providerService.LoadProviders(kind)
+		if err != nil {
+			return "", fmt.Errorf("加载 %s 供应商失败: %w", kind, err)
+		}
+		for _, p := range providers {
+			if includeSecrets && isSecretRef(p.APIKey) {
+				return "", fmt.Errorf("供应商 %s 的 API Key 无法解密: %w", p.Name, ErrSecretsLocked)
+			}
+			if !includeSecrets {
+				p.APIKey = ""
+			}
+			if kind == "claude" {
+				export.Claude = append(export.Claude, p)
+			} else {
+				export.Codex = append(export.Codex, p)
+			}
+		}
+	}
+
+	if ss.geminiService != nil {
+		for _, p := range ss.geminiService.GetProviders() {
+			p.EnvConfig = cloneStringMap(p.EnvConfig)
+			if includeSecrets && (isSecretRef(p.APIKey) || hasSecretRef(p.EnvConfig)) {
+				return "", fmt.Errorf("Gemini 供应商 %s 的密钥无法解密: %w", p.Name, ErrSecretsLocked)
+			}
+			if !includeSecrets {
+				p.APIKey = ""
+				redactEnv(p.EnvConfig)
+			}
+			export.Gemini = append(export.Gemini, p)
+		}
+	}
+
+	if ss.mcpService != nil {
+		servers, err := ss.mcpService.ListServers()
+		if err != nil {
+			return "", fmt.Errorf("加载 MCP 配置失败: %w", err)
+		}
+		for _, server := range servers {
+			server.Env = cloneStringMap(server.Env)
+			if includeSecrets && hasSecretRef(server.Env) {
+				return "", fmt.Errorf("MCP %s 的 env 无法解密: %w", server.Name, ErrSecretsLocked)
+			}
+			if !includeSecrets {
+				redactEnv(server.Env)
+			}
+			export.MCP = append(export.MCP, server)
+		}
+	}
+
+	data, err := json.MarshalIndent(export, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// reloadGeminiProviders 解锁后重新加载 Gemini 供应商（启动时加载的密钥仍是引用）
+func (ss *SecretService) reloadGeminiProviders() {
+	if ss.geminiService == nil {
+		return
+	}
+	ss.geminiService.mu.Lock()
+	defer ss.geminiService.mu.Unlock()
+	_ = ss.geminiService.loadProviders()
+}
+
+// redactEnv 清空 env 的值，只保留键名
+func redactEnv(env map[string]string) {
+	for name := range env {
+		env[name] = ""
+	}
+}
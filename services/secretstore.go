@@ -0,0 +1,679 @@
+package services
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// 密钥库：provider / MCP 配置中的密钥以 AES-GCM 加密保存在 ~/.code-switch/secrets.json，
+// 配置文件中只保留 secret://<引用> 形式的引用。
+// 加密密钥默认由本地密钥文件 secrets.key 派生（HKDF-SHA256），也可改为由口令派生（PBKDF2-SHA256）。
+
+const (
+	secretRefPrefix        = "secret://"
+	secretVaultFile        = "secrets.json"
+	secretKeyFile          = "secrets.key"
+	secretKeyFileNext      = "secrets.key.next" // 轮换密钥时的新密钥文件，密钥库写入成功后改名为 secrets.key
+	secretPassphraseEnv    = "CODE_SWITCH_SECRETS_PASSPHRASE"
+	secretPBKDF2Iterations = 600000
+	secretCheckRef         = "__check__" // 校验项：用于判断密钥 / 口令是否正确
+	secretCheckPlaintext   = "code-switch"
+)
+
+// 密钥派生方式
+const (
+	SecretModeKeyFile    = "keyfile"
+	SecretModePassphrase = "passphrase"
+)
+
+// ErrSecretsLocked 密钥库使用口令加密且尚未解锁
+var ErrSecretsLocked = errors.New("密钥库已设置口令，请先解锁")
+
+// secretVault secrets.json 的内容
+type secretVault struct {
+	Version    int               `json:"version"`
+	Mode       string            `json:"mode"`
+	Salt       string            `json:"salt,omitempty"`
+	Iterations int               `json:"iterations,omitempty"`
+	Check      string            `json:"check"`
+	Secrets    map[string]string `json:"secrets"` // 引用 -> base64(nonce || 密文)
+}
+
+// secretBinding 配置中需要加密的一个字段：ref 为该字段在密钥库中的引用，value 指向字段本身
+type secretBinding struct {
+	ref   string
+	value *string
+}
+
+// SecretStore 加密密钥库
+type SecretStore struct {
+	mu         sync.Mutex
+	passphrase string // 已解锁的口令（只保存在内存中）
+
+	// 口令派生的密钥缓存（PBKDF2 较慢，转发时每次加载配置都会用到）
+	cachedSalt       string
+	cachedPassphrase string
+	cachedKey        []byte
+
+	// 已解析的密钥库与校验过的密钥（密钥库只由本进程写入，转发热路径上不再重复读盘）
+	vaultDir      string
+	vault         *secretVault
+	key           []byte
+	keyPassphrase string
+}
+
+var defaultSecretStore = &SecretStore{}
+
+// isSecretRef 判断字段值是否为密钥库引用
+func isSecretRef(value string) bool {
+	return strings.HasPrefix(value, secretRefPrefix)
+}
+
+// hasSecretRef 判断 env 中是否仍有未解密的密钥库引用（口令模式未解锁时会出现）
+func hasSecretRef(env map[string]string) bool {
+	for _, value := range env {
+		if isSecretRef(value) {
+			return true
+		}
+	}
+	return false
+}
+
+// secretRef 拼接密钥库引用，例如 claude/3/apiKey
+func secretRef(parts ...string) string {
+	return strings.Join(parts, "/")
+}
+
+// secretDirPath 密钥库所在目录（不创建）
+func secretDirPath() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".code-switch"), nil
+}
+
+func secretDir() (string, error) {
+	dir, err := secretDirPath()
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
+// sealSecrets 把绑定字段中的明文存入密钥库并替换为引用（已是引用的字段保持不变），
+// 同时清理 scope 下已不再使用的密钥
+func (s *SecretStore) sealSecrets(scope string, bindings []secretBinding) error {
+	values := make(map[string]string)
+	keep := make(map[string]bool)
+	for _, b := range bindings {
+		switch {
+		case *b.value == "":
+		case isSecretRef(*b.value):
+			keep[strings.TrimPrefix(*b.value, secretRefPrefix)] = true
+		default:
+			values[b.ref] = *b.value
+			*b.value = secretRefPrefix + b.ref
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	dir, err := secretDir()
+	if err != nil {
+		return err
+	}
+	current, err := s.loadVault(dir)
+	if err != nil {
+		return err
+	}
+	if current == nil {
+		if len(values) == 0 {
+			return nil
+		}
+		if current, err = s.newVault(dir, SecretModeKeyFile, ""); err != nil {
+			return err
+		}
+	}
+
+	changed := false
+	var key []byte
+	if len(values) > 0 {
+		if key, err = s.vaultKey(dir, current); err != nil {
+			return err
+		}
+	}
+	// 在副本上修改，写盘失败时缓存保持与磁盘一致
+	updated := *current
+	updated.Secrets = make(map[string]string, len(current.Secrets)+len(values))
+	for ref, sealed := range current.Secrets {
+		updated.Secrets[ref] = sealed
+	}
+	vault := &updated
+	for ref, plaintext := range values {
+		// 明文未变化时保留原密文，避免每次保存都重写密钥库
+		if existing, ok := vault.Secrets[ref]; ok {
+			if opened, err := openSecret(key, ref, existing); err == nil && opened == plaintext {
+				continue
+			}
+		}
+		sealed, err := sealSecret(key, ref, plaintext)
+		if err != nil {
+			return err
+		}
+		vault.Secrets[ref] = sealed
+		changed = true
+	}
+	for ref := range vault.Secrets {
+		if strings.HasPrefix(ref, scope+"/") && !keep[ref] {
+			if _, ok := values[ref]; !ok {
+				delete(vault.Secrets, ref)
+				changed = true
+			}
+		}
+	}
+	if !changed {
+		return nil
+	}
+	if err := writeSecretVault(dir, vault); err != nil {
+		return err
+	}
+	s.cacheVault(dir, vault)
+	return nil
+}
+
+// openSecrets 把绑定字段中的引用替换为明文
+// 返回是否存在尚未加密的明文（需要迁移）；无法解密的引用保持原样
+func (s *SecretStore) openSecrets(bindings []secretBinding) (bool, error) {
+	plaintext := false
+	refs := 0
+	for _, b := range bindings {
+		if isSecretRef(*b.value) {
+			refs++
+		} else if *b.value != "" {
+			plaintext = true
+		}
+	}
+	if refs == 0 {
+		return plaintext, nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	dir, err := secretDirPath()
+	if err != nil {
+		return plaintext, err
+	}
+	vault, err := s.loadVault(dir)
+	if err != nil {
+		return plaintext, err
+	}
+	if vault == nil {
+		return plaintext, fmt.Errorf("密钥库 %s 不存在，%d 个密钥无法解密", secretVaultFile, refs)
+	}
+	key, err := s.vaultKey(dir, vault)
+	if err != nil {
+		return plaintext, err
+	}
+
+	var missing []string
+	for _, b := range bindings {
+		if !isSecretRef(*b.value) {
+			continue
+		}
+		ref := strings.TrimPrefix(*b.value, secretRefPrefix)
+		sealed, ok := vault.Secrets[ref]
+		if !ok {
+			missing = append(missing, ref)
+			continue
+		}
+		opened, err := openSecret(key, ref, sealed)
+		if err != nil {
+			missing = append(missing, ref)
+			continue
+		}
+		*b.value = opened
+	}
+	if len(missing) > 0 {
+		return plaintext, fmt.Errorf("以下密钥无法解密: %s", strings.Join(missing, ", "))
+	}
+	return plaintext, nil
+}
+
+// Unlock 使用口令解锁密钥库（口令错误时返回错误）
+func (s *SecretStore) Unlock(passphrase string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	dir, err := secretDir()
+	if err != nil {
+		return err
+	}
+	vault, err := s.loadVault(dir)
+	if err != nil {
+		return err
+	}
+	if vault == nil || vault.Mode != SecretModePassphrase {
+		return fmt.Errorf("密钥库未设置口令，无需解锁")
+	}
+	previous := s.passphrase
+	s.passphrase = passphrase
+	if _, err := s.vaultKey(dir, vault); err != nil {
+		s.passphrase = previous
+		return err
+	}
+	return nil
+}
+
+// Rekey 重新加密密钥库：mode 为 keyfile 时生成新的密钥文件，为 passphrase 时使用新的盐值和口令（为空则沿用当前口令）
+// 用于密钥轮换以及在密钥文件 / 口令两种方式之间切换
+func (s *SecretStore) Rekey(mode string, passphrase string) error {
+	if mode != SecretModeKeyFile && mode != SecretModePassphrase {
+		return fmt.Errorf("不支持的密钥派生方式: %s", mode)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// 口令模式下未指定口令时沿用当前口令（仅轮换盐值与密钥）
+	if mode == SecretModePassphrase && passphrase == "" {
+		if passphrase = s.passphrase; passphrase == "" {
+			passphrase = os.Getenv(secretPassphraseEnv)
+		}
+		if passphrase == "" {
+			return ErrSecretsLocked
+		}
+	}
+
+	dir, err := secretDir()
+	if err != nil {
+		return err
+	}
+	vault, err := s.loadVault(dir)
+	if err != nil {
+		return err
+	}
+
+	// 先用当前密钥解密全部密钥
+	plaintexts := make(map[string]string)
+	if vault != nil {
+		key, err := s.vaultKey(dir, vault)
+		if err != nil {
+			return err
+		}
+		for ref, sealed := range vault.Secrets {
+			opened, err := openSecret(key, ref, sealed)
+			if err != nil {
+				return fmt.Errorf("解密 %s 失败，已取消轮换: %w", ref, err)
+			}
+			plaintexts[ref] = opened
+		}
+	}
+
+	// 新密钥文件先写到 secrets.key.next，密钥库写入成功后再替换（中途失败可在加载时恢复）
+	keyPath := filepath.Join(dir, secretKeyFile)
+	nextPath := filepath.Join(dir, secretKeyFileNext)
+	var next *secretVault
+	if mode == SecretModeKeyFile {
+		if err := writeRandomKeyFile(nextPath); err != nil {
+			return err
+		}
+		next, err = s.newVaultWithKeyFile(nextPath)
+	} else {
+		next, err = s.newVault(dir, SecretModePassphrase, passphrase)
+	}
+	if err != nil {
+		return err
+	}
+	key, err := s.vaultKeyFrom(next, nextPath, passphrase)
+	if err != nil {
+		return err
+	}
+	for ref, plaintext := range plaintexts {
+		if next.Secrets[ref], err = sealSecret(key, ref, plaintext); err != nil {
+			return err
+		}
+	}
+	if err := writeSecretVault(dir, next); err != nil {
+		s.invalidateVault()
+		return err
+	}
+	s.cacheVault(dir, next)
+	s.key, s.keyPassphrase = key, passphrase
+	if mode == SecretModeKeyFile {
+		s.keyPassphrase = ""
+	}
+
+	if mode == SecretModeKeyFile {
+		if err := os.Rename(nextPath, keyPath); err != nil {
+			return err
+		}
+		s.passphrase = ""
+	} else {
+		// 口令模式不再需要密钥文件
+		if err := os.Remove(keyPath); err != nil && !os.IsNotExist(err) {
+			log.Printf("⚠️  删除密钥文件失败: %v", err)
+		}
+		s.passphrase = passphrase
+	}
+	log.Printf("✅ 密钥库已重新加密（%s，%d 个密钥）", mode, len(plaintexts))
+	return nil
+}
+
+// status 返回密钥库当前状态
+func (s *SecretStore) status() (SecretStoreStatus, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	dir, err := secretDir()
+	if err != nil {
+		return SecretStoreStatus{}, err
+	}
+	status := SecretStoreStatus{
+		Mode:      SecretModeKeyFile,
+		VaultPath: filepath.Join(dir, secretVaultFile),
+		KeyPath:   filepath.Join(dir, secretKeyFile),
+	}
+	vault, err := s.loadVault(dir)
+	if err != nil || vault == nil {
+		return status, err
+	}
+	status.Mode = vault.Mode
+	status.SecretCount = len(vault.Secrets)
+	if vault.Mode == SecretModePassphrase {
+		status.KeyPath = ""
+		if _, err := s.vaultKey(dir, vault); err != nil {
+			status.Locked = true
+		}
+	}
+	return status, nil
+}
+
+// newVault 创建空的密钥库（keyfile 模式下密钥文件不存在时自动生成）
+func (s *SecretStore) newVault(dir string, mode string, passphrase string) (*secretVault, error) {
+	if mode == SecretModeKeyFile {
+		keyPath := filepath.Join(dir, secretKeyFile)
+		if _, err := os.Stat(keyPath); os.IsNotExist(err) {
+			if err := writeRandomKeyFile(keyPath); err != nil {
+				return nil, err
+			}
+		}
+		return s.newVaultWithKeyFile(keyPath)
+	}
+
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	vault := &secretVault{
+		Version:    1,
+		Mode:       SecretModePassphrase,
+		Salt:       base64.StdEncoding.EncodeToString(salt),
+		Iterations: secretPBKDF2Iterations,
+		Secrets:    make(map[string]string),
+	}
+	key, err := s.vaultKeyFrom(vault, "", passphrase)
+	if err != nil {
+		return nil, err
+	}
+	if vault.Check, err = sealSecret(key, secretCheckRef, secretCheckPlaintext); err != nil {
+		return nil, err
+	}
+	return vault, nil
+}
+
+func (s *SecretStore) newVaultWithKeyFile(keyPath string) (*secretVault, error) {
+	vault := &secretVault{Version: 1, Mode: SecretModeKeyFile, Secrets: make(map[string]string)}
+	key, err := s.vaultKeyFrom(vault, keyPath, "")
+	if err != nil {
+		return nil, err
+	}
+	if vault.Check, err = sealSecret(key, secretCheckRef, secretCheckPlaintext); err != nil {
+		return nil, err
+	}
+	return vault, nil
+}
+
+// vaultKey 获取密钥库的加密密钥并校验（缓存的密钥库对应的密钥只派生一次）
+func (s *SecretStore) vaultKey(dir string, vault *secretVault) ([]byte, error) {
+	passphrase := ""
+	if vault.Mode == SecretModePassphrase {
+		if passphrase = s.passphrase; passphrase == "" {
+			passphrase = os.Getenv(secretPassphraseEnv)
+		}
+		if passphrase == "" {
+			return nil, ErrSecretsLocked
+		}
+	}
+	if s.key != nil && vault == s.vault && passphrase == s.keyPassphrase {
+		return s.key, nil
+	}
+	key, err := s.deriveVaultKey(dir, vault, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	if vault == s.vault {
+		s.key, s.keyPassphrase = key, passphrase
+	}
+	return key, nil
+}
+
+// deriveVaultKey 派生密钥库的加密密钥并用校验项验证
+func (s *SecretStore) deriveVaultKey(dir string, vault *secretVault, passphrase string) ([]byte, error) {
+	if vault.Mode == SecretModePassphrase {
+		key, err := s.vaultKeyFrom(vault, "", passphrase)
+		if err != nil {
+			return nil, err
+		}
+		if opened, err := openSecret(key, secretCheckRef, vault.Check); err != nil || opened != secretCheckPlaintext {
+			return nil, fmt.Errorf("口令错误")
+		}
+		return key, nil
+	}
+
+	keyPath := filepath.Join(dir, secretKeyFile)
+	key, err := s.vaultKeyFrom(vault, keyPath, "")
+	if err == nil {
+		if opened, openErr := openSecret(key, secretCheckRef, vault.Check); openErr == nil && opened == secretCheckPlaintext {
+			return key, nil
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	// 轮换中途失败：密钥库已用新密钥加密，但新密钥文件尚未改名
+	nextPath := filepath.Join(dir, secretKeyFileNext)
+	if nextKey, nextErr := s.vaultKeyFrom(vault, nextPath, ""); nextErr == nil {
+		if opened, openErr := openSecret(nextKey, secretCheckRef, vault.Check); openErr == nil && opened == secretCheckPlaintext {
+			if err := os.Rename(nextPath, keyPath); err != nil {
+				return nil, err
+			}
+			log.Printf("✅ 已恢复未完成的密钥轮换")
+			return nextKey, nil
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("读取密钥文件失败: %w", err)
+	}
+	return nil, fmt.Errorf("密钥文件 %s 与密钥库不匹配", keyPath)
+}
+
+// vaultKeyFrom 按密钥库的派生方式计算加密密钥（不校验）
+func (s *SecretStore) vaultKeyFrom(vault *secretVault, keyPath string, passphrase string) ([]byte, error) {
+	if vault.Mode == SecretModePassphrase {
+		if s.cachedKey != nil && s.cachedSalt == vault.Salt && s.cachedPassphrase == passphrase {
+			return s.cachedKey, nil
+		}
+		salt, err := base64.StdEncoding.DecodeString(vault.Salt)
+		if err != nil {
+			return nil, fmt.Errorf("密钥库盐值无效: %w", err)
+		}
+		key, err := pbkdf2.Key(sha256.New, passphrase, salt, vault.Iterations, 32)
+		if err != nil {
+			return nil, err
+		}
+		s.cachedSalt, s.cachedPassphrase, s.cachedKey = vault.Salt, passphrase, key
+		return key, nil
+	}
+
+	material, err := os.ReadFile(keyPath)
+	if err != nil {
+		return nil, err
+	}
+	material = bytes.TrimSpace(material)
+	if len(material) < 32 {
+		return nil, fmt.Errorf("密钥文件 %s 长度不足", keyPath)
+	}
+	return hkdf.Key(sha256.New, material, nil, "code-switch secrets v1", 32)
+}
+
+// writeRandomKeyFile 生成随机密钥文件（仅当前用户可读）
+func writeRandomKeyFile(path string) error {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return err
+	}
+	encoded := base64.StdEncoding.EncodeToString(raw) + "\n"
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(encoded), 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// loadVault 读取密钥库，优先使用内存缓存
+func (s *SecretStore) loadVault(dir string) (*secretVault, error) {
+	if s.vault != nil && s.vaultDir == dir {
+		return s.vault, nil
+	}
+	vault, err := loadSecretVault(dir)
+	if err != nil || vault == nil {
+		return vault, err
+	}
+	s.cacheVault(dir, vault)
+	return vault, nil
+}
+
+// cacheVault 更新密钥库缓存；派生参数变化时丢弃已缓存的密钥
+func (s *SecretStore) cacheVault(dir string, vault *secretVault) {
+	if s.vault == nil || s.vaultDir != dir || s.vault.Mode != vault.Mode || s.vault.Salt != vault.Salt || s.vault.Check != vault.Check {
+		s.key, s.keyPassphrase = nil, ""
+	}
+	s.vaultDir, s.vault = dir, vault
+}
+
+func (s *SecretStore) invalidateVault() {
+	s.vaultDir, s.vault, s.key, s.keyPassphrase = "", nil, nil, ""
+}
+
+func loadSecretVault(dir string) (*secretVault, error) {
+	data, err := os.ReadFile(filepath.Join(dir, secretVaultFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var vault secretVault
+	if err := json.Unmarshal(data, &vault); err != nil {
+		return nil, fmt.Errorf("解析密钥库失败: %w", err)
+	}
+	if vault.Secrets == nil {
+		vault.Secrets = make(map[string]string)
+	}
+	return &vault, nil
+}
+
+func writeSecretVault(dir string, vault *secretVault) error {
+	data, err := json.MarshalIndent(vault, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(dir, secretVaultFile)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// sealSecret AES-256-GCM 加密，引用作为附加数据，防止密文被挪用到其他字段
+func sealSecret(key []byte, ref string, plaintext string) (string, error) {
+	gcm, err := newSecretAEAD(key)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := gcm.Seal(nonce, nonce, []byte(plaintext), []byte(ref))
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+func openSecret(key []byte, ref string, sealed string) (string, error) {
+	gcm, err := newSecretAEAD(key)
+	if err != nil {
+		return "", err
+	}
+	raw, err := base64.StdEncoding.DecodeString(sealed)
+	if err != nil {
+		return "", err
+	}
+	if len(raw) < gcm.NonceSize() {
+		return "", fmt.Errorf("密文长度不足")
+	}
+	plaintext, err := gcm.Open(nil, raw[:gcm.NonceSize()], raw[gcm.NonceSize():], []byte(ref))
+	if err != nil {
+		return "", err
+	}
+	return string(plaintext), nil
+}
+
+func newSecretAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// envSecretBindings 为 env 配置生成绑定（MCP / Gemini 的 env 键名不固定，无法可靠区分，整体视为密钥）
+// map 的值不可取地址，seal / open 之后需调用返回的 commit 写回 map
+func envSecretBindings(env map[string]string, refParts ...string) ([]secretBinding, func()) {
+	names := make([]string, 0, len(env))
+	for name := range env {
+		names = append(names, name)
+	}
+	values := make([]string, len(names))
+	bindings := make([]secretBinding, len(names))
+	for i, name := range names {
+		values[i] = env[name]
+		parts := append(append([]string{}, refParts...), "env", name)
+		bindings[i] = secretBinding{ref: secretRef(parts...), value: &values[i]}
+	}
+	return bindings, func() {
+		for i, name := range names {
+			env[name] = values[i]
+		}
+	}
+}
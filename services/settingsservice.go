@@ -1,6 +1,7 @@
 package services
 
 import (
+	"encoding/json"
 	"fmt"
 	"log"
 	"strconv"
@@ -257,3 +258,282 @@ func (ss *SettingsService) SetLevelBlacklistEnabled(enabled bool) error {
 
 	return nil
 }
+
+// 跨 provider 思考块的处理方式
+const (
+	ThinkingSignatureDrop = "drop" // 删除其他 provider 生成的 thinking / redacted_thinking 块（默认）
+	ThinkingSignatureText = "text" // thinking 转为普通文本，redacted_thinking 删除
+	ThinkingSignatureOff  = "off"  // 不处理，原样转发
+)
+
+// GetThinkingSignatureMode 获取跨 provider 思考块的处理方式
+func (ss *SettingsService) GetThinkingSignatureMode() string {
+	db, err := xdb.DB("default")
+	if err != nil {
+		return ThinkingSignatureDrop
+	}
+
+	var mode string
+	err = db.QueryRow(`
+		SELECT value FROM app_settings WHERE key = 'thinking_signature_mode'
+	`).Scan(&mode)
+
+	if err != nil {
+		// 找不到记录时使用默认值
+		return ThinkingSignatureDrop
+	}
+
+	switch mode {
+	case ThinkingSignatureText, ThinkingSignatureOff:
+		return mode
+	default:
+		return ThinkingSignatureDrop
+	}
+}
+
+// SetThinkingSignatureMode 设置跨 provider 思考块的处理方式（drop / text / off）
+func (ss *SettingsService) SetThinkingSignatureMode(mode string) error {
+	switch mode {
+	case ThinkingSignatureDrop, ThinkingSignatureText, ThinkingSignatureOff:
+	default:
+		return fmt.Errorf("无效的思考块处理方式: %s", mode)
+	}
+
+	err := GlobalDBQueue.Exec(`
+		INSERT INTO app_settings (key, value) VALUES ('thinking_signature_mode', ?)
+		ON CONFLICT(key) DO UPDATE SET value = excluded.value
+	`, mode)
+
+	if err != nil {
+		return fmt.Errorf("设置思考块处理方式失败: %w", err)
+	}
+
+	log.Printf("✅ 跨 provider 思考块处理方式已更新: %s", mode)
+	return nil
+}
+
+// GetStreamResumeEnabled 获取流式中断续传开关状态
+func (ss *SettingsService) GetStreamResumeEnabled() (bool, error) {
+	db, err := xdb.DB("default")
+	if err != nil {
+		return false, fmt.Errorf("获取数据库连接失败: %w", err)
+	}
+
+	var enabledStr string
+	err = db.QueryRow(`
+		SELECT value FROM app_settings WHERE key = 'stream_resume_enabled'
+	`).Scan(&enabledStr)
+
+	if err != nil {
+		// 找不到记录时默认关闭
+		return false, nil
+	}
+
+	return enabledStr == "true", nil
+}
+
+// SetStreamResumeEnabled 设置流式中断续传开关状态
+func (ss *SettingsService) SetStreamResumeEnabled(enabled bool) error {
+	enabledStr := "false"
+	if enabled {
+		enabledStr = "true"
+	}
+
+	err := GlobalDBQueue.Exec(`
+		INSERT INTO app_settings (key, value) VALUES ('stream_resume_enabled', ?)
+		ON CONFLICT(key) DO UPDATE SET value = excluded.value
+	`, enabledStr)
+
+	if err != nil {
+		return fmt.Errorf("设置流式续传开关失败: %w", err)
+	}
+
+	log.Printf("✅ 流式中断续传开关已更新: %v", enabled)
+	return nil
+}
+
+// GetProviderPinningEnabled 获取是否允许客户端通过请求头指定 provider
+func (ss *SettingsService) GetProviderPinningEnabled() (bool, error) {
+	db, err := xdb.DB("default")
+	if err != nil {
+		return false, fmt.Errorf("获取数据库连接失败: %w", err)
+	}
+
+	var enabledStr string
+	err = db.QueryRow(`
+		SELECT value FROM app_settings WHERE key = 'provider_pinning_enabled'
+	`).Scan(&enabledStr)
+
+	if err != nil {
+		// 找不到记录时默认关闭
+		return false, nil
+	}
+
+	return enabledStr == "true", nil
+}
+
+// SetProviderPinningEnabled 设置是否允许客户端通过请求头指定 provider
+func (ss *SettingsService) SetProviderPinningEnabled(enabled bool) error {
+	enabledStr := "false"
+	if enabled {
+		enabledStr = "true"
+	}
+
+	err := GlobalDBQueue.Exec(`
+		INSERT INTO app_settings (key, value) VALUES ('provider_pinning_enabled', ?)
+		ON CONFLICT(key) DO UPDATE SET value = excluded.value
+	`, enabledStr)
+
+	if err != nil {
+		return fmt.Errorf("设置客户端指定 provider 开关失败: %w", err)
+	}
+
+	log.Printf("✅ 客户端指定 provider 开关已更新: %v", enabled)
+	return nil
+}
+
+// 路由模式：同一 Level 内（或跨 Level）provider 的尝试顺序
+const (
+	RoutingModePriority  = "priority"   // 按配置顺序和 Level（默认）
+	RoutingModeCostLevel = "cost_level" // Level 内按预估费用从低到高
+	RoutingModeCost      = "cost"       // 忽略 Level，全部按预估费用从低到高
+)
+
+// GetRoutingMode 获取路由模式
+func (ss *SettingsService) GetRoutingMode() string {
+	db, err := xdb.DB("default")
+	if err != nil {
+		return RoutingModePriority
+	}
+
+	var mode string
+	err = db.QueryRow(`
+		SELECT value FROM app_settings WHERE key = 'routing_mode'
+	`).Scan(&mode)
+
+	if err != nil {
+		// 找不到记录时使用默认值
+		return RoutingModePriority
+	}
+
+	switch mode {
+	case RoutingModeCostLevel, RoutingModeCost:
+		return mode
+	default:
+		return RoutingModePriority
+	}
+}
+
+// SetRoutingMode 设置路由模式（priority / cost_level / cost）
+func (ss *SettingsService) SetRoutingMode(mode string) error {
+	switch mode {
+	case RoutingModePriority, RoutingModeCostLevel, RoutingModeCost:
+	default:
+		return fmt.Errorf("无效的路由模式: %s", mode)
+	}
+
+	err := GlobalDBQueue.Exec(`
+		INSERT INTO app_settings (key, value) VALUES ('routing_mode', ?)
+		ON CONFLICT(key) DO UPDATE SET value = excluded.value
+	`, mode)
+
+	if err != nil {
+		return fmt.Errorf("设置路由模式失败: %w", err)
+	}
+
+	log.Printf("✅ 路由模式已更新: %s", mode)
+	return nil
+}
+
+// GetModelFallbackChains 获取模型降级链
+func (ss *SettingsService) GetModelFallbackChains() ([]ModelFallbackChain, error) {
+	db, err := xdb.DB("default")
+	if err != nil {
+		return nil, fmt.Errorf("获取数据库连接失败: %w", err)
+	}
+
+	var raw string
+	err = db.QueryRow(`
+		SELECT value FROM app_settings WHERE key = 'model_fallback_chains'
+	`).Scan(&raw)
+
+	if err != nil {
+		// 找不到记录时不降级
+		return []ModelFallbackChain{}, nil
+	}
+
+	var chains []ModelFallbackChain
+	if err := json.Unmarshal([]byte(raw), &chains); err != nil {
+		return nil, fmt.Errorf("解析模型降级链失败: %w", err)
+	}
+	return chains, nil
+}
+
+// SetModelFallbackChains 设置模型降级链（按顺序匹配，精确匹配优先）
+func (ss *SettingsService) SetModelFallbackChains(chains []ModelFallbackChain) error {
+	if err := validateModelFallbackChains(chains); err != nil {
+		return err
+	}
+	if chains == nil {
+		chains = []ModelFallbackChain{}
+	}
+	data, err := json.Marshal(chains)
+	if err != nil {
+		return fmt.Errorf("序列化模型降级链失败: %w", err)
+	}
+
+	err = GlobalDBQueue.Exec(`
+		INSERT INTO app_settings (key, value) VALUES ('model_fallback_chains', ?)
+		ON CONFLICT(key) DO UPDATE SET value = excluded.value
+	`, string(data))
+
+	if err != nil {
+		return fmt.Errorf("设置模型降级链失败: %w", err)
+	}
+
+	log.Printf("✅ 模型降级链已更新: %d 条", len(chains))
+	return nil
+}
+
+// GetModelDiscoveryIntervalHours 获取模型列表定时刷新间隔（小时，0 表示关闭）
+func (ss *SettingsService) GetModelDiscoveryIntervalHours() int {
+	db, err := xdb.DB("default")
+	if err != nil {
+		return 0
+	}
+
+	var hoursStr string
+	err = db.QueryRow(`
+		SELECT value FROM app_settings WHERE key = 'model_discovery_interval_hours'
+	`).Scan(&hoursStr)
+
+	if err != nil {
+		// 找不到记录时默认关闭
+		return 0
+	}
+
+	hours, err := strconv.Atoi(hoursStr)
+	if err != nil || hours < 0 {
+		return 0
+	}
+	return hours
+}
+
+// SetModelDiscoveryIntervalHours 设置模型列表定时刷新间隔（0 关闭，1-168 小时）
+func (ss *SettingsService) SetModelDiscoveryIntervalHours(hours int) error {
+	if hours < 0 || hours > 168 {
+		return fmt.Errorf("刷新间隔必须在 0-168 小时之间")
+	}
+
+	err := GlobalDBQueue.Exec(`
+		INSERT INTO app_settings (key, value) VALUES ('model_discovery_interval_hours', ?)
+		ON CONFLICT(key) DO UPDATE SET value = excluded.value
+	`, strconv.Itoa(hours))
+
+	if err != nil {
+		return fmt.Errorf("设置模型列表刷新间隔失败: %w", err)
+	}
+
+	log.Printf("✅ 模型列表刷新间隔已更新: %d 小时", hours)
+	return nil
+}
@@ -0,0 +1,403 @@
+package services
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/daodao97/xgo/xdb"
+	"github.com/tidwall/gjson"
+)
+
+// shadowTimeout 影子请求的超时时间（在后台执行，不影响客户端）
+const shadowTimeout = 5 * time.Minute
+
+// maxConcurrentShadows 同时进行的影子请求上限，超出时直接丢弃（影子请求只用于评估，不排队）
+const maxConcurrentShadows = 8
+
+// maxShadowBodyBytes 影子响应最多读取的字节数
+const maxShadowBodyBytes = 8 << 20
+
+// shadowDiffChars 差异摘要中每侧保留的字符数
+const shadowDiffChars = 80
+
+// ShadowLog 一次影子请求的记录（shadow_log 表，不计入 request_log 的用量与费用统计）
+type ShadowLog struct {
+	ID                      int64   `json:"id"`
+	RequestID               string  `json:"request_id"`
+	Platform                string  `json:"platform"`
+	Model                   string  `json:"model"` // 客户端请求的模型
+	PrimaryProvider         string  `json:"primary_provider"`
+	ShadowProvider          string  `json:"shadow_provider"`
+	ShadowModel             string  `json:"shadow_model"` // 影子 provider 映射后的模型
+	PrimaryHttpCode         int     `json:"primary_http_code"`
+	ShadowHttpCode          int     `json:"shadow_http_code"`
+	PrimaryDurationSec      float64 `json:"primary_duration_sec"`
+	ShadowDurationSec       float64 `json:"shadow_duration_sec"`
+	PrimaryTTFTSec          float64 `json:"primary_ttft_sec"`
+	ShadowTTFTSec           float64 `json:"shadow_ttft_sec"`
+	PrimaryOutputTokens     int     `json:"primary_output_tokens"`
+	ShadowInputTokens       int     `json:"shadow_input_tokens"`
+	ShadowOutputTokens      int     `json:"shadow_output_tokens"`
+	ShadowCacheCreateTokens int     `json:"shadow_cache_create_tokens"`
+	ShadowCacheReadTokens   int     `json:"shadow_cache_read_tokens"`
+	ErrorClass              string  `json:"error_class"` // 影子请求失败原因（成功为空）
+	ErrorMessage            string  `json:"error_message"`
+	Similarity              float64 `json:"similarity"` // 与主响应文本的相似度（0~1）
+	Diff                    string  `json:"diff"`       // 差异摘要
+	CreatedAt               string  `json:"created_at"`
+}
+
+// shadowCandidates 按各 provider 的采样比例抽取本次要镜像的候选 provider
+// 候选 provider 不要求启用，便于在接入真实流量之前评估
+func shadowCandidates(providers []Provider, primary string, requestedModel string) []Provider {
+	var picked []Provider
+	for _, p := range providers {
+		if p.ShadowPercent <= 0 || p.Name == primary || p.APIURL == "" || p.APIKey == "" {
+			continue
+		}
+		if requestedModel != "" && !p.IsModelSupported(requestedModel) {
+			continue
+		}
+		if len(blockingConfigErrors(p.configIssues())) > 0 {
+			continue
+		}
+		if rand.Intn(100) < p.ShadowPercent {
+			picked = append(picked, p)
+		}
+	}
+	return picked
+}
+
+// newShadowCapture 配置了影子 provider 时收集主响应的文本，用于与影子响应对比
+func newShadowCapture(providers []Provider) *strings.Builder {
+	for _, p := range providers {
+		if p.ShadowPercent > 0 {
+			return &strings.Builder{}
+		}
+	}
+	return nil
+}
+
+// mirrorShadow 主请求成功后，在后台把同一请求发给抽中的候选 provider
+// 客户端只收到主响应；影子请求不计入黑名单、会话亲和和 request_log
+func (prs *ProviderRelayService) mirrorShadow(kind string, endpoint string, query map[string]string, clientHeaders map[string]string,
+	bodyBytes []byte, requestedModel string, isStream bool, providers []Provider, primary *ReqeustLog) {
+	if primary.shadowText == nil {
+		return
+	}
+	candidates := shadowCandidates(providers, primary.Provider, requestedModel)
+	if len(candidates) == 0 {
+		return
+	}
+	base := ShadowLog{
+		RequestID:           primary.RequestID,
+		Platform:            kind,
+		Model:               requestedModel,
+		PrimaryProvider:     primary.Provider,
+		PrimaryHttpCode:     primary.HttpCode,
+		PrimaryDurationSec:  primary.DurationSec,
+		PrimaryTTFTSec:      primary.TTFTSec,
+		PrimaryOutputTokens: primary.OutputTokens,
+	}
+	primaryText := primary.shadowText.String()
+	for _, candidate := range candidates {
+		select {
+		case prs.shadowSlots <- struct{}{}:
+		default:
+			fmt.Printf("[WARN] 影子请求并发已达上限 %d，丢弃: %s -> %s\n", maxConcurrentShadows, primary.Provider, candidate.Name)
+			continue
+		}
+		fmt.Printf("[INFO] 👥 影子请求: %s -> %s\n", primary.Provider, candidate.Name)
+		go func(candidate Provider) {
+			defer func() { <-prs.shadowSlots }()
+			prs.runShadow(kind, candidate, endpoint, query, clientHeaders, bodyBytes, requestedModel, isStream, base, primaryText)
+		}(candidate)
+	}
+}
+
+// runShadow 发送一次影子请求并记录结果
+func (prs *ProviderRelayService) runShadow(kind string, provider Provider, endpoint string, query map[string]string, clientHeaders map[string]string,
+	bodyBytes []byte, requestedModel string, isStream bool, entry ShadowLog, primaryText string) {
+	ctx, cancel := context.WithTimeout(context.Background(), shadowTimeout)
+	defer cancel()
+	shadowLog := prs.sendDetached(ctx, kind, provider, endpoint, query, clientHeaders, bodyBytes, requestedModel, isStream)
+
+	entry.ShadowProvider = provider.Name
+	entry.ShadowModel = shadowLog.Model
+	entry.ShadowHttpCode = shadowLog.HttpCode
+	entry.ShadowDurationSec = shadowLog.DurationSec
+	entry.ShadowTTFTSec = shadowLog.TTFTSec
+	entry.ShadowInputTokens = shadowLog.InputTokens
+	entry.ShadowOutputTokens = shadowLog.OutputTokens
+	entry.ShadowCacheCreateTokens = shadowLog.CacheCreateTokens
+	entry.ShadowCacheReadTokens = shadowLog.CacheReadTokens
+	entry.ErrorClass = shadowLog.ErrorClass
+	entry.ErrorMessage = shadowLog.ErrorMessage
+	if entry.ErrorClass == "" {
+		entry.Similarity, entry.Diff = contentDiff(primaryText, shadowLog.shadowText.String())
+	}
+	saveShadowLog(entry)
+}
+
+// sendDetached 在客户端请求之外把请求发给指定 provider 并完整读取响应（影子流量、对比测试共用）
+// 与 forwardRequest 相同地应用模型映射、兼容性配置和思考块处理，但不写客户端、不参与黑名单和会话亲和
+// 返回的日志包含状态码、耗时、用量和错误分类，shadowText 为响应文本，Model 为映射后的模型
+func (prs *ProviderRelayService) sendDetached(ctx context.Context, kind string, provider Provider, endpoint string, query map[string]string,
+	clientHeaders map[string]string, bodyBytes []byte, requestedModel string, isStream bool) *ReqeustLog {
+	effectiveModel := provider.GetEffectiveModel(requestedModel)
+	requestLog := &ReqeustLog{Platform: kind, Model: effectiveModel, Provider: provider.Name, IsStream: isStream, shadowText: &strings.Builder{}}
+
+	if effectiveModel != requestedModel && requestedModel != "" {
+		modified, err := ReplaceModelInRequestBody(bodyBytes, effectiveModel)
+		if err != nil {
+			requestLog.fail(relayErrorRequest, err.Error())
+			return requestLog
+		}
+		bodyBytes = modified
+	}
+	headers := cloneMap(clientHeaders)
+	headers["Authorization"] = fmt.Sprintf("Bearer %s", provider.APIKey)
+	if _, ok := headers["Accept"]; !ok {
+		headers["Accept"] = "application/json"
+	}
+	bodyBytes, headers, _ = applyCompatProfile(kind, provider.Compat, bodyBytes, headers)
+	if kind == "claude" {
+		bodyBytes = prs.stripForeignThinking(provider.Name, bodyBytes)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, joinURL(provider.APIURL, endpoint), bytes.NewReader(bodyBytes))
+	if err != nil {
+		requestLog.fail(relayErrorRequest, err.Error())
+		return requestLog
+	}
+	for key, value := range headers {
+		req.Header[key] = []string{value}
+	}
+	if req.Header.Get("Content-Type") == "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if len(query) > 0 {
+		values := req.URL.Query()
+		for key, value := range query {
+			values.Add(key, value)
+		}
+		req.URL.RawQuery = values.Encode()
+	}
+
+	start := time.Now()
+	requestLog.beginAttempt()
+	defer func() {
+		requestLog.DurationSec = time.Since(start).Seconds()
+		requestLog.finishTiming()
+	}()
+
+	resp, err := prs.transports.Do(kind, provider.Name, req, isStream)
+	if err != nil {
+		requestLog.fail(classifyRelayError(err), err.Error())
+		return requestLog
+	}
+	defer resp.Body.Close()
+	requestLog.markFirstByte()
+	requestLog.HttpCode = resp.StatusCode
+	if resp.StatusCode < http.StatusOK || resp.StatusCode >= http.StatusMultipleChoices {
+		errorBody, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorBodyBytes+1))
+		requestLog.fail(relayErrorUpstreamStatus, string(errorBody))
+		return requestLog
+	}
+
+	// 与主请求相同的解析与校验（用量、耗时、完整性）
+	hook := ReqeustLogHook(nil, kind, requestLog)
+	validator := newResponseValidator(isStream)
+	body := io.LimitReader(resp.Body, maxShadowBodyBytes)
+	if !isStream {
+		data, err := io.ReadAll(body)
+		if err != nil {
+			requestLog.fail(classifyRelayError(err), err.Error())
+			return requestLog
+		}
+		hook(data)
+		validator.hook(data)
+	} else {
+		reader := bufio.NewReader(body)
+		for {
+			line, readErr := reader.ReadBytes('\n')
+			if line = bytes.TrimRight(line, "\r\n"); len(line) > 0 {
+				hook(line)
+				validator.hook(line)
+			}
+			if readErr != nil {
+				if readErr != io.EOF {
+					validator.invalid(relayErrorTruncated, "读取上游响应失败: %v", readErr)
+				}
+				break
+			}
+		}
+	}
+	if class, problem := validator.result(); class != "" {
+		requestLog.fail(class, problem)
+	}
+	return requestLog
+}
+
+// responseText 提取响应中的文本内容（SSE 增量或完整 JSON），用于主/影子响应对比
+func responseText(kind string, payload string) string {
+	if strings.HasPrefix(payload, "{") {
+		var b strings.Builder
+		if kind == "codex" {
+			gjson.Get(payload, "output.#.content.#.text").ForEach(func(_, texts gjson.Result) bool {
+				texts.ForEach(func(_, text gjson.Result) bool {
+					b.WriteString(text.String())
+					return true
+				})
+				return true
+			})
+		} else {
+			gjson.Get(payload, `content.#(type=="text")#.text`).ForEach(func(_, text gjson.Result) bool {
+				b.WriteString(text.String())
+				return true
+			})
+		}
+		return b.String()
+	}
+
+	var b strings.Builder
+	for _, line := range strings.Split(payload, "\n") {
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, "data:") {
+			continue
+		}
+		event := gjson.Parse(strings.TrimSpace(strings.TrimPrefix(line, "data:")))
+		switch event.Get("type").String() {
+		case "content_block_delta":
+			b.WriteString(event.Get("delta.text").String())
+		case "response.output_text.delta":
+			b.WriteString(event.Get("delta").String())
+		}
+	}
+	return b.String()
+}
+
+// contentDiff 比较主响应与影子响应的文本，返回按词计算的相似度（Jaccard）和首个差异处的摘要
+func contentDiff(primary string, shadow string) (float64, string) {
+	if primary == shadow {
+		return 1, "内容相同"
+	}
+
+	primaryWords := make(map[string]bool)
+	for _, word := range strings.Fields(primary) {
+		primaryWords[word] = true
+	}
+	shadowWords := make(map[string]bool)
+	for _, word := range strings.Fields(shadow) {
+		shadowWords[word] = true
+	}
+	common := 0
+	for word := range shadowWords {
+		if primaryWords[word] {
+			common++
+		}
+	}
+	similarity := 0.0
+	if union := len(primaryWords) + len(shadowWords) - common; union > 0 {
+		similarity = float64(common) / float64(union)
+	}
+
+	// 首个不同字符的位置（按 rune 对齐，避免截断多字节字符）
+	prefix := 0
+	for prefix < len(primary) && prefix < len(shadow) {
+		r1, size := utf8.DecodeRuneInString(primary[prefix:])
+		r2, _ := utf8.DecodeRuneInString(shadow[prefix:])
+		if r1 != r2 {
+			break
+		}
+		prefix += size
+	}
+	diff := fmt.Sprintf("长度 %d / %d 字符，第 %d 字符起不同：主「%s」影子「%s」",
+		utf8.RuneCountInString(primary), utf8.RuneCountInString(shadow), utf8.RuneCountInString(primary[:prefix]),
+		diffSnippet(primary[prefix:]), diffSnippet(shadow[prefix:]))
+	return similarity, diff
+}
+
+// diffSnippet 截取差异处开头的一小段文本
+func diffSnippet(text string) string {
+	if utf8.RuneCountInString(text) <= shadowDiffChars {
+		return text
+	}
+	return string([]rune(text)[:shadowDiffChars]) + "…"
+}
+
+// saveShadowLog 写入 shadow_log（独立于 request_log，不参与费用统计）
+func saveShadowLog(entry ShadowLog) {
+	if GlobalDBQueueLogs == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err := GlobalDBQueueLogs.ExecBatchCtx(ctx, `
+		INSERT INTO shadow_log (
+			request_id, platform, model, primary_provider, shadow_provider, shadow_model,
+			primary_http_code, shadow_http_code, primary_duration_sec, shadow_duration_sec,
+			primary_ttft_sec, shadow_ttft_sec, primary_output_tokens,
+			shadow_input_tokens, shadow_output_tokens, shadow_cache_create_tokens, shadow_cache_read_tokens,
+			error_class, error_message, similarity, diff
+		) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`,
+		entry.RequestID, entry.Platform, entry.Model, entry.PrimaryProvider, entry.ShadowProvider, entry.ShadowModel,
+		entry.PrimaryHttpCode, entry.ShadowHttpCode, entry.PrimaryDurationSec, entry.ShadowDurationSec,
+		entry.PrimaryTTFTSec, entry.ShadowTTFTSec, entry.PrimaryOutputTokens,
+		entry.ShadowInputTokens, entry.ShadowOutputTokens, entry.ShadowCacheCreateTokens, entry.ShadowCacheReadTokens,
+		entry.ErrorClass, entry.ErrorMessage, entry.Similarity, entry.Diff,
+	)
+	if err != nil {
+		fmt.Printf("⚠️  写入 shadow_log 失败: %v\n", err)
+	}
+}
+
+// ensureShadowLogTable 确保 shadow_log 表存在
+func ensureShadowLogTable() error {
+	db, err := xdb.DB("default")
+	if err != nil {
+		return fmt.Errorf("获取数据库连接失败: %w", err)
+	}
+
+	const createSQL = `CREATE TABLE IF NOT EXISTS shadow_log (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		request_id TEXT DEFAULT '',
+		platform TEXT,
+		model TEXT,
+		primary_provider TEXT,
+		shadow_provider TEXT,
+		shadow_model TEXT,
+		primary_http_code INTEGER DEFAULT 0,
+		shadow_http_code INTEGER DEFAULT 0,
+		primary_duration_sec REAL DEFAULT 0,
+		shadow_duration_sec REAL DEFAULT 0,
+		primary_ttft_sec REAL DEFAULT 0,
+		shadow_ttft_sec REAL DEFAULT 0,
+		primary_output_tokens INTEGER DEFAULT 0,
+		shadow_input_tokens INTEGER DEFAULT 0,
+		shadow_output_tokens INTEGER DEFAULT 0,
+		shadow_cache_create_tokens INTEGER DEFAULT 0,
+		shadow_cache_read_tokens INTEGER DEFAULT 0,
+		error_class TEXT DEFAULT '',
+		error_message TEXT DEFAULT '',
+		similarity REAL DEFAULT 0,
+		diff TEXT DEFAULT '',
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	)`
+	if _, err := db.Exec(createSQL); err != nil {
+		return fmt.Errorf("创建 shadow_log 表失败: %w", err)
+	}
+	if _, err := db.Exec(`CREATE INDEX IF NOT EXISTS idx_shadow_log_provider ON shadow_log(platform, shadow_provider, id)`); err != nil {
+		return fmt.Errorf("创建 shadow_log 索引失败: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+package services
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMirrorShadowDropsWhenSaturated(t *testing.T) {
+	prs := newTestRelay(t)
+
+	release := make(chan struct{})
+	var hits atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		<-release
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"type":"message","content":[{"type":"text","text":"hi"}],"usage":{"input_tokens":1,"output_tokens":1}}`))
+	}))
+	t.Cleanup(upstream.Close)
+	t.Cleanup(func() {
+		select {
+		case <-release:
+		default:
+			close(release)
+		}
+	})
+
+	candidate := Provider{Name: "shadow", APIURL: upstream.URL, APIKey: "sk-shadow", ShadowPercent: 100}
+	body := []byte(`{"model":"claude-sonnet-4-5","messages":[{"role":"user","content":"hi"}]}`)
+	mirror := func() {
+		primary := &ReqeustLog{Provider: "primary", HttpCode: 200, shadowText: &strings.Builder{}}
+		prs.mirrorShadow("claude", "/v1/messages", nil, map[string]string{}, body, "claude-sonnet-4-5", false, []Provider{candidate}, primary)
+	}
+
+	for i := 0; i < maxConcurrentShadows+3; i++ {
+		mirror()
+	}
+	waitFor := func(cond func() bool) bool {
+		deadline := time.Now().Add(2 * time.Second)
+		for time.Now().Before(deadline) {
+			if cond() {
+				return true
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		return cond()
+	}
+	if !waitFor(func() bool { return hits.Load() == maxConcurrentShadows }) {
+		t.Fatalf("expected %d in-flight shadows, got %d", maxConcurrentShadows, hits.Load())
+	}
+	time.Sleep(50 * time.Millisecond)
+	if got := hits.Load(); got != maxConcurrentShadows {
+		t.Errorf("shadows beyond the limit should be dropped, got %d upstream hits", got)
+	}
+
+	// 影子请求结束后释放并发名额
+	close(release)
+	if !waitFor(func() bool { return len(prs.shadowSlots) == 0 }) {
+		t.Fatalf("shadow slots should be released, %d still held", len(prs.shadowSlots))
+	}
+	mirror()
+	if !waitFor(func() bool { return hits.Load() == maxConcurrentShadows+1 }) {
+		t.Errorf("shadow should run again once slots are free, got %d hits", hits.Load())
+	}
+}
+
+func TestShadowComparisonHelpers(t *testing.T) {
+	stream := "event: content_block_delta\ndata: {\"type\":\"content_block_delta\",\"index\":0,\"delta\":{\"type\":\"text_delta\",\"text\":\"hello \"}}\n\n" +
+		"data: {\"type\":\"content_block_delta\",\"index\":0,\"delta\":{\"type\":\"text_delta\",\"text\":\"world\"}}\n"
+	if got := responseText("claude", stream); got != "hello world" {
+		t.Errorf("SSE 文本提取错误: %q", got)
+	}
+	body := `{"content":[{"type":"thinking","thinking":"x"},{"type":"text","text":"hi"}]}`
+	if got := responseText("claude", body); got != "hi" {
+		t.Errorf("JSON 文本提取应跳过思考块: %q", got)
+	}
+	codex := `{"output":[{"type":"message","content":[{"type":"output_text","text":"ok"}]}],"error":null}`
+	if got := responseText("codex", codex); got != "ok" {
+		t.Errorf("Responses API 文本提取错误: %q", got)
+	}
+
+	if similarity, _ := contentDiff("same text", "same text"); similarity != 1 {
+		t.Errorf("相同内容相似度应为 1，得到 %v", similarity)
+	}
+	similarity, diff := contentDiff("你好 a b c", "你好 a b d")
+	if similarity != 0.6 {
+		t.Errorf("相似度应为 3/5，得到 %v", similarity)
+	}
+	if !strings.Contains(diff, "第 7 字符起不同") || !strings.Contains(diff, "主「c」影子「d」") {
+		t.Errorf("差异摘要错误: %s", diff)
+	}
+
+	providers := []Provider{
+		{Name: "primary", APIURL: "https://a", APIKey: "k", ShadowPercent: 100},
+		{Name: "always", APIURL: "https://b", APIKey: "k", ShadowPercent: 100},
+		{Name: "never", APIURL: "https://c", APIKey: "k"},
+		{Name: "other-model", APIURL: "https://d", APIKey: "k", ShadowPercent: 100,
+			SupportedModels: map[string]bool{"gpt-5": true}},
+	}
+	picked := shadowCandidates(providers, "primary", "claude-sonnet-4")
+	if len(picked) != 1 || picked[0].Name != "always" {
+		t.Errorf("应只抽中 always，得到 %+v", picked)
+	}
+	if newShadowCapture(providers[2:3]) != nil {
+		t.Error("未配置影子流量时不应收集主响应文本")
+	}
+}
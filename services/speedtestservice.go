@@ -23,11 +23,20 @@ type EndpointLatency struct {
 }
 
 // SpeedTestService 测速服务
-type SpeedTestService struct{}
+// TestEndpoints 只测量 GET 延迟；CheckProvider 发送真实的补全请求检查密钥、模型与流式
+type SpeedTestService struct {
+	providerService *ProviderService
+	geminiService   *GeminiService
+	client          *http.Client // 补全检查使用的客户端（带整体超时）
+}
 
 // NewSpeedTestService 创建测速服务
-func NewSpeedTestService() *SpeedTestService {
-	return &SpeedTestService{}
+func NewSpeedTestService(providerService *ProviderService, geminiService *GeminiService) *SpeedTestService {
+	return &SpeedTestService{
+		providerService: providerService,
+		geminiService:   geminiService,
+		client:          &http.Client{Timeout: providerCheckTimeout},
+	}
 }
 
 // Start Wails生命周期方法
@@ -0,0 +1,326 @@
+package services
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"unicode"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+// streamResumeMaxAttempts 一次客户端请求最多续传的次数
+const streamResumeMaxAttempts = 3
+
+// errStreamInterrupted 上游在 message_stop 之前断开
+var errStreamInterrupted = errors.New("upstream stream interrupted before message_stop")
+
+// resumeBlock 已转发给客户端的一个内容块
+type resumeBlock struct {
+	blockType string
+	text      strings.Builder // text / thinking 块的内容
+	closed    bool
+}
+
+// streamResume 一次客户端流式请求的续传状态，在同一请求的各次上游尝试之间共享
+// 转发 Anthropic SSE 时记录已发给客户端的内容；上游中途断开后，用已生成的文本作为 assistant 预填充重新请求，
+// 并把续写结果拼接到客户端仍在等待的同一条消息里（修正内容块 index 和最终 usage）
+type streamResume struct {
+	started      bool           // 已向客户端发送 message_start
+	stopped      bool           // 已向客户端发送 message_stop
+	blocks       []*resumeBlock // 客户端看到的内容块，下标即客户端 index
+	inputTokens  int            // 原始请求的输入 token（续写请求的输入包含预填充，不能用）
+	outputTokens int            // 已中断分段的输出 token（按字符数估算）
+	resumes      int            // 已续传次数
+	retried      string         // 已在同一 provider 上重试过续传的 provider
+
+	// 当前分段
+	offset       int  // 上游 index + offset = 客户端 index
+	merge        bool // 续写的第一个文本块接续客户端尚未关闭的文本块
+	trimLeading  bool // 预填充去掉了结尾空白，续写开头的空白也要去掉
+	segmentChars int  // 当前分段输出的字符数，中断时用于估算输出 token
+}
+
+// newStreamResume 开启续传时为 Claude 流式请求创建续传状态，否则返回 nil
+func (prs *ProviderRelayService) newStreamResume(kind string, isStream bool) *streamResume {
+	if kind != "claude" || !isStream {
+		return nil
+	}
+	enabled, err := prs.settingsService.GetStreamResumeEnabled()
+	if err != nil || !enabled {
+		return nil
+	}
+	return &streamResume{}
+}
+
+// exhausted 客户端已收到部分内容且无法再续传（次数用尽或已输出工具调用）
+func (s *streamResume) exhausted() bool {
+	if s == nil || !s.started || s.stopped {
+		return false
+	}
+	if s.resumes >= streamResumeMaxAttempts {
+		return true
+	}
+	for _, block := range s.blocks {
+		if !resumableBlock(block.blockType) {
+			return true
+		}
+	}
+	return false
+}
+
+// resumableBlock 只有文本和思考块可以续传：预填充不能以 tool_use 结尾
+func resumableBlock(blockType string) bool {
+	switch blockType {
+	case "text", "thinking", "redacted_thinking":
+		return true
+	}
+	return false
+}
+
+// continuationBody 把已输出的文本作为 assistant 预填充追加到请求中，并准备下一分段的 index 映射
+func (s *streamResume) continuationBody(body []byte) ([]byte, error) {
+	if s.resumes >= streamResumeMaxAttempts {
+		return nil, fmt.Errorf("续传次数已达上限（%d 次）", streamResumeMaxAttempts)
+	}
+
+	var prefill []map[string]string
+	lastText := -1 // 最后一个预填充文本对应的客户端 index
+	for i, block := range s.blocks {
+		if !resumableBlock(block.blockType) {
+			return nil, fmt.Errorf("已输出 %s 内容块，无法续传", block.blockType)
+		}
+		// 预填充与思考不兼容，思考块不带入续写请求
+		if block.blockType != "text" || block.text.Len() == 0 {
+			continue
+		}
+		prefill = append(prefill, map[string]string{"type": "text", "text": block.text.String()})
+		lastText = i
+	}
+
+	s.resumes++
+	s.offset = len(s.blocks)
+	s.merge = false
+	s.trimLeading = false
+	s.segmentChars = 0
+	if len(prefill) == 0 {
+		return body, nil
+	}
+
+	// 上游不接受以空白结尾的预填充
+	last := prefill[len(prefill)-1]
+	trimmed := strings.TrimRightFunc(last["text"], unicode.IsSpace)
+	if trimmed == "" {
+		prefill = prefill[:len(prefill)-1]
+	} else {
+		last["text"] = trimmed
+	}
+	if lastText == len(s.blocks)-1 && !s.blocks[lastText].closed && trimmed != "" {
+		s.merge = true
+		s.offset = len(s.blocks) - 1
+		s.trimLeading = trimmed != s.blocks[lastText].text.String()
+	}
+	if len(prefill) == 0 {
+		return body, nil
+	}
+
+	body, err := sjson.DeleteBytes(body, "thinking")
+	if err != nil {
+		return nil, err
+	}
+	messages := gjson.GetBytes(body, "messages").Array()
+	if n := len(messages); n > 0 && messages[n-1].Get("role").String() == "assistant" {
+		// 客户端自带预填充：续写内容追加到同一条 assistant 消息
+		var content []any
+		existing := messages[n-1].Get("content")
+		if existing.Type == gjson.String {
+			if existing.String() != "" {
+				content = append(content, map[string]string{"type": "text", "text": existing.String()})
+			}
+		} else {
+			existing.ForEach(func(_, block gjson.Result) bool {
+				content = append(content, json.RawMessage(block.Raw))
+				return true
+			})
+		}
+		for _, block := range prefill {
+			content = append(content, block)
+		}
+		return sjson.SetBytes(body, fmt.Sprintf("messages.%d.content", n-1), content)
+	}
+	return sjson.SetBytes(body, "messages.-1", map[string]any{"role": "assistant", "content": prefill})
+}
+
+// relay 转发一个分段的 SSE，返回 nil 表示已转发 message_stop
+// 上游中途断开返回 errStreamInterrupted，写客户端失败返回 errClientAbort
+func (s *streamResume) relay(c *gin.Context, resp *http.Response, hook func([]byte) (bool, []byte)) error {
+	w := c.Writer
+	if !w.Written() {
+		for key, values := range resp.Header {
+			w.Header()[key] = append([]string(nil), values...)
+		}
+		w.Header().Del("Content-Length")
+		w.WriteHeader(resp.StatusCode)
+		w.WriteHeaderNow()
+	}
+
+	reader := bufio.NewReader(resp.Body)
+	for {
+		line, readErr := reader.ReadBytes('\n')
+		line = bytes.TrimRight(line, "\r\n")
+		if len(line) > 0 {
+			hook(line)
+			if payload, ok := bytes.CutPrefix(line, []byte("data:")); ok {
+				if err := s.handleEvent(w, bytes.TrimSpace(payload)); err != nil {
+					return s.interrupted(err)
+				}
+				if s.stopped {
+					return nil
+				}
+			}
+		}
+		if readErr != nil {
+			if c.Request.Context().Err() != nil {
+				return fmt.Errorf("%w: %v", errClientAbort, readErr)
+			}
+			if readErr == io.EOF {
+				return s.interrupted(errStreamInterrupted)
+			}
+			return s.interrupted(fmt.Errorf("%w: %v", errStreamInterrupted, readErr))
+		}
+	}
+}
+
+// interrupted 分段中断时按已输出字符估算该分段的输出 token（约 4 字符 / token）
+func (s *streamResume) interrupted(err error) error {
+	if errors.Is(err, errStreamInterrupted) {
+		s.outputTokens += (s.segmentChars + 3) / 4
+		s.segmentChars = 0
+	}
+	return err
+}
+
+// handleEvent 改写一个上游事件并转发给客户端
+func (s *streamResume) handleEvent(w gin.ResponseWriter, data []byte) error {
+	event := gjson.ParseBytes(data)
+	eventType := event.Get("type").String()
+	out := data
+
+	switch eventType {
+	case "message_start":
+		// 续写分段的 message_start 不再转发，客户端只看到一条消息
+		if s.started {
+			return nil
+		}
+		s.started = true
+		s.inputTokens = int(event.Get("message.usage.input_tokens").Int())
+
+	case "content_block_start":
+		index := int(event.Get("index").Int())
+		blockType := event.Get("content_block.type").String()
+		if s.merge && index == 0 {
+			if blockType == "text" {
+				return nil // 客户端的文本块仍未关闭，直接续写到该块
+			}
+			// 续写没有从文本开始：先关闭客户端未关闭的文本块
+			if err := s.closeBlock(w, s.offset); err != nil {
+				return err
+			}
+			s.merge = false
+			s.offset++
+		}
+		clientIndex := index + s.offset
+		for len(s.blocks) <= clientIndex {
+			s.blocks = append(s.blocks, &resumeBlock{})
+		}
+		s.blocks[clientIndex].blockType = blockType
+		s.blocks[clientIndex].text.WriteString(event.Get("content_block.text").String())
+		out, _ = sjson.SetBytes(data, "index", clientIndex)
+
+	case "content_block_delta":
+		index := int(event.Get("index").Int())
+		clientIndex := index + s.offset
+		block := s.block(clientIndex)
+		switch event.Get("delta.type").String() {
+		case "text_delta":
+			text := event.Get("delta.text").String()
+			if s.trimLeading && s.merge && index == 0 {
+				text = strings.TrimLeftFunc(text, unicode.IsSpace)
+				s.trimLeading = false
+				data, _ = sjson.SetBytes(data, "delta.text", text)
+			}
+			block.text.WriteString(text)
+			s.segmentChars += len([]rune(text))
+		case "thinking_delta":
+			thinking := event.Get("delta.thinking").String()
+			block.text.WriteString(thinking)
+			s.segmentChars += len([]rune(thinking))
+		case "input_json_delta":
+			s.segmentChars += len(event.Get("delta.partial_json").String())
+		}
+		out, _ = sjson.SetBytes(data, "index", clientIndex)
+
+	case "content_block_stop":
+		clientIndex := int(event.Get("index").Int()) + s.offset
+		s.block(clientIndex).closed = true
+		out, _ = sjson.SetBytes(data, "index", clientIndex)
+
+	case "message_delta":
+		// 最终 usage：输出加上已中断分段的估算值，输入恢复为原始请求的值
+		if s.outputTokens > 0 {
+			out, _ = sjson.SetBytes(out, "usage.output_tokens", event.Get("usage.output_tokens").Int()+int64(s.outputTokens))
+		}
+		if s.resumes > 0 && event.Get("usage.input_tokens").Exists() {
+			out, _ = sjson.SetBytes(out, "usage.input_tokens", s.inputTokens)
+		}
+
+	case "message_stop":
+		s.stopped = true
+
+	case "error":
+		// 上游在流中返回错误（如 overloaded），与断开同样处理
+		return fmt.Errorf("%w: %s", errStreamInterrupted, event.Get("error.message").String())
+	}
+
+	return writeSSEEvent(w, eventType, out)
+}
+
+// block 返回客户端 index 对应的内容块（上游 index 异常时补齐）
+func (s *streamResume) block(clientIndex int) *resumeBlock {
+	for len(s.blocks) <= clientIndex {
+		s.blocks = append(s.blocks, &resumeBlock{})
+	}
+	return s.blocks[clientIndex]
+}
+
+// closeBlock 向客户端发送 content_block_stop
+func (s *streamResume) closeBlock(w gin.ResponseWriter, clientIndex int) error {
+	s.block(clientIndex).closed = true
+	data, _ := json.Marshal(map[string]any{"type": "content_block_stop", "index": clientIndex})
+	return writeSSEEvent(w, "content_block_stop", data)
+}
+
+// writeSSEEvent 写出一个 SSE 事件并立即 flush
+func writeSSEEvent(w gin.ResponseWriter, eventType string, data []byte) error {
+	if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", eventType, data); err != nil {
+		return fmt.Errorf("%w: %v", errClientAbort, err)
+	}
+	w.Flush()
+	return nil
+}
+
+// writeSSEData 写出一个没有事件名的 SSE 事件并立即 flush（Gemini 流式格式）
+func writeSSEData(w gin.ResponseWriter, data []byte) error {
+	if _, err := fmt.Fprintf(w, "data: %s\n\n", data); err != nil {
+		return fmt.Errorf("%w: %v", errClientAbort, err)
+	}
+	w.Flush()
+	return nil
+}
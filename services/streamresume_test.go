@@ -0,0 +1,158 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/tidwall/gjson"
+)
+
+func TestStreamResume(t *testing.T) {
+	sse := func(events ...string) *http.Response {
+		var b strings.Builder
+		for _, event := range events {
+			fmt.Fprintf(&b, "event: %s\ndata: %s\n\n", gjson.Get(event, "type").String(), event)
+		}
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{"Content-Type": []string{"text/event-stream"}},
+			Body:       io.NopCloser(strings.NewReader(b.String())),
+		}
+	}
+	c, recorder := newTestContext("/v1/messages", "")
+	hook := func(data []byte) (bool, []byte) { return true, data }
+
+	// 第一段：思考块完成后，文本块输出到一半断开
+	resume := &streamResume{}
+	err := resume.relay(c, sse(
+		`{"type":"message_start","message":{"id":"msg_1","usage":{"input_tokens":100,"output_tokens":1}}}`,
+		`{"type":"content_block_start","index":0,"content_block":{"type":"thinking","thinking":""}}`,
+		`{"type":"content_block_delta","index":0,"delta":{"type":"thinking_delta","thinking":"plan"}}`,
+		`{"type":"content_block_stop","index":0}`,
+		`{"type":"content_block_start","index":1,"content_block":{"type":"text","text":""}}`,
+		`{"type":"content_block_delta","index":1,"delta":{"type":"text_delta","text":"Hello wor "}}`,
+	), hook)
+	if !errors.Is(err, errStreamInterrupted) {
+		t.Fatalf("缺少 message_stop 应判定为中断，实际 %v", err)
+	}
+
+	body, err := resume.continuationBody([]byte(`{"model":"claude-sonnet-4","stream":true,"thinking":{"type":"enabled","budget_tokens":1024},"messages":[{"role":"user","content":"hi"}]}`))
+	if err != nil {
+		t.Fatalf("continuationBody 失败: %v", err)
+	}
+	if gjson.GetBytes(body, "thinking").Exists() {
+		t.Error("预填充请求应关闭 thinking")
+	}
+	prefill := gjson.GetBytes(body, "messages.1")
+	if prefill.Get("role").String() != "assistant" || prefill.Get("content.#").Int() != 1 || prefill.Get("content.0.text").String() != "Hello wor" {
+		t.Errorf("预填充应只包含已输出文本且去掉结尾空白，实际 %s", prefill.Raw)
+	}
+
+	// 第二段：续写接到客户端未关闭的文本块，并新开一个文本块
+	err = resume.relay(c, sse(
+		`{"type":"message_start","message":{"id":"msg_2","usage":{"input_tokens":110,"output_tokens":1}}}`,
+		`{"type":"content_block_start","index":0,"content_block":{"type":"text","text":""}}`,
+		`{"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":" ld"}}`,
+		`{"type":"content_block_stop","index":0}`,
+		`{"type":"content_block_start","index":1,"content_block":{"type":"text","text":""}}`,
+		`{"type":"content_block_stop","index":1}`,
+		`{"type":"message_delta","delta":{"stop_reason":"end_turn"},"usage":{"input_tokens":110,"output_tokens":5}}`,
+		`{"type":"message_stop"}`,
+	), hook)
+	if err != nil {
+		t.Fatalf("续写分段应完整结束，实际 %v", err)
+	}
+
+	output := recorder.Body.String()
+	if n := strings.Count(output, "event: message_start"); n != 1 {
+		t.Errorf("客户端应只收到一个 message_start，实际 %d", n)
+	}
+	if !strings.Contains(output, `"index":1,"delta":{"type":"text_delta","text":"ld"}`) {
+		t.Errorf("续写应接到客户端 index 1 并去掉开头空白: %s", output)
+	}
+	if !strings.Contains(output, `{"type":"content_block_start","index":2`) {
+		t.Errorf("续写的第二个内容块应映射到 index 2: %s", output)
+	}
+	var finalDelta gjson.Result
+	for _, line := range strings.Split(output, "\n") {
+		if strings.Contains(line, `"message_delta"`) {
+			finalDelta = gjson.Parse(strings.TrimPrefix(line, "data: "))
+		}
+	}
+	// 中断分段输出 14 个字符，估算 4 个 token
+	if got := finalDelta.Get("usage.output_tokens").Int(); got != 9 {
+		t.Errorf("最终 output_tokens 应包含中断分段的估算值，实际 %d", got)
+	}
+	if got := finalDelta.Get("usage.input_tokens").Int(); got != 100 {
+		t.Errorf("最终 input_tokens 应为原始请求的值，实际 %d", got)
+	}
+	if resume.exhausted() {
+		t.Error("已完成的流不应判定为无法续传")
+	}
+
+	toolUse := &streamResume{started: true, blocks: []*resumeBlock{{blockType: "tool_use"}}}
+	if !toolUse.exhausted() {
+		t.Error("已输出 tool_use 的流不能续传")
+	}
+}
+
+func TestStreamResumeSignatureRetryContinuesOnce(t *testing.T) {
+	var bodies []string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := io.ReadAll(r.Body)
+		bodies = append(bodies, string(data))
+		if len(bodies) == 1 {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"type":"error","error":{"type":"invalid_request_error","message":"messages.1.content.0: Invalid `+"`signature`"+` in `+"`thinking`"+` block"}}`)
+			return
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		for _, event := range []string{
+			`{"type":"message_start","message":{"id":"msg_2","usage":{"input_tokens":10,"output_tokens":1}}}`,
+			`{"type":"content_block_start","index":0,"content_block":{"type":"text","text":""}}`,
+			`{"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":" world"}}`,
+			`{"type":"content_block_stop","index":0}`,
+			`{"type":"message_delta","delta":{"stop_reason":"end_turn"},"usage":{"output_tokens":2}}`,
+			`{"type":"message_stop"}`,
+		} {
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", gjson.Get(event, "type").String(), event)
+		}
+	}))
+	defer upstream.Close()
+
+	prs := newTestRelay(t)
+	body := `{"model":"claude-sonnet-4-5","stream":true,"messages":[{"role":"user","content":"hi"},` +
+		`{"role":"assistant","content":[{"type":"thinking","thinking":"x","signature":"sig-a"},{"type":"text","text":"one"}]},` +
+		`{"role":"user","content":"again"}]}`
+	c, _ := newTestContext("/v1/messages", body)
+
+	// 上一次尝试已向客户端输出 "Hello" 后中断
+	block := &resumeBlock{blockType: "text"}
+	block.text.WriteString("Hello")
+	resume := &streamResume{started: true, blocks: []*resumeBlock{block}}
+	requestLog := &ReqeustLog{Platform: "claude", Provider: "relay-a", IsStream: true, resume: resume}
+
+	provider := Provider{Name: "relay-a", APIURL: upstream.URL, APIKey: "sk"}
+	ok, err := prs.forwardRequest(c, "claude", provider, "/v1/messages", nil, map[string]string{}, []byte(body), true, requestLog)
+	if !ok || err != nil {
+		t.Fatalf("签名重试后应成功: %v", err)
+	}
+	if len(bodies) != 2 {
+		t.Fatalf("应发送一次请求和一次签名重试，实际 %d 次", len(bodies))
+	}
+	if resume.resumes != 1 || requestLog.ResumeCount != 1 {
+		t.Errorf("签名重试不应再次生成续传: resumes=%d ResumeCount=%d", resume.resumes, requestLog.ResumeCount)
+	}
+	retried := bodies[1]
+	if gjson.Get(retried, "messages.1.content.0.type").String() == "thinking" {
+		t.Errorf("重试请求应移除思考块: %s", retried)
+	}
+	if last := gjson.Get(retried, "messages.@reverse.0"); last.Get("role").String() != "assistant" || last.Get("content.0.text").String() != "Hello" {
+		t.Errorf("重试请求应保留同一份续传预填充: %s", retried)
+	}
+}
@@ -0,0 +1,150 @@
+package services
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+// thinkingSignatureTTL 思考块签名与 provider 绑定记录的有效期
+const thinkingSignatureTTL = 24 * time.Hour
+
+// signatureKey 签名较长，只保存其哈希
+func signatureKey(signature string) string {
+	sum := sha256.Sum256([]byte(signature))
+	return hex.EncodeToString(sum[:16])
+}
+
+// thinkingSignaturesFrom 从 Messages API 的 SSE 事件或 JSON 响应中提取思考块签名
+// thinking 块取 signature（流式为 signature_delta），redacted_thinking 块取 data
+func thinkingSignaturesFrom(payload string) []string {
+	if !strings.Contains(payload, "signature") && !strings.Contains(payload, "redacted_thinking") {
+		return nil
+	}
+	var signatures []string
+	collect := func(block gjson.Result) {
+		switch block.Get("type").String() {
+		case "thinking":
+			if sig := block.Get("signature").String(); sig != "" {
+				signatures = append(signatures, sig)
+			}
+		case "redacted_thinking":
+			if data := block.Get("data").String(); data != "" {
+				signatures = append(signatures, data)
+			}
+		}
+	}
+
+	if strings.HasPrefix(payload, "{") {
+		gjson.Get(payload, "content").ForEach(func(_, block gjson.Result) bool {
+			collect(block)
+			return true
+		})
+		return signatures
+	}
+	for _, line := range strings.Split(payload, "\n") {
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, "data:") {
+			continue
+		}
+		event := gjson.Parse(strings.TrimSpace(strings.TrimPrefix(line, "data:")))
+		switch event.Get("type").String() {
+		case "content_block_start":
+			collect(event.Get("content_block"))
+		case "content_block_delta":
+			if event.Get("delta.type").String() == "signature_delta" {
+				if sig := event.Get("delta.signature").String(); sig != "" {
+					signatures = append(signatures, sig)
+				}
+			}
+		}
+	}
+	return signatures
+}
+
+// blockSignature 返回请求历史中思考块的签名
+func blockSignature(block gjson.Result) string {
+	if block.Get("type").String() == "redacted_thinking" {
+		return block.Get("data").String()
+	}
+	return block.Get("signature").String()
+}
+
+// isThinkingSignatureError 判断上游 400 是否因为无法校验思考块签名
+func isThinkingSignatureError(errorBody string) bool {
+	lower := strings.ToLower(errorBody)
+	return strings.Contains(lower, "signature") && strings.Contains(lower, "thinking")
+}
+
+// stripThinkingBlocks 处理历史 assistant 消息中的思考块
+// foreign 判断某个签名是否属于其他 provider；mode 为 text 时 thinking 转为文本，redacted_thinking 始终删除。
+// 如果最后一条 assistant 消息的思考块被移除，同时关闭本次请求的 thinking，否则上游会要求该消息以思考块开头。
+func stripThinkingBlocks(body []byte, mode string, foreign func(signature string) bool) ([]byte, int) {
+	if mode == ThinkingSignatureOff {
+		return body, 0
+	}
+	messages := gjson.GetBytes(body, "messages").Array()
+	lastAssistant := -1
+	for i, message := range messages {
+		if message.Get("role").String() == "assistant" {
+			lastAssistant = i
+		}
+	}
+
+	removed := 0
+	disableThinking := false
+	for i := len(messages) - 1; i >= 0; i-- {
+		if messages[i].Get("role").String() != "assistant" {
+			continue
+		}
+		blocks := messages[i].Get("content").Array()
+		for j := len(blocks) - 1; j >= 0; j-- {
+			block := blocks[j]
+			blockType := block.Get("type").String()
+			if blockType != "thinking" && blockType != "redacted_thinking" {
+				continue
+			}
+			if !foreign(blockSignature(block)) {
+				continue
+			}
+			path := fmt.Sprintf("messages.%d.content.%d", i, j)
+			if mode == ThinkingSignatureText && blockType == "thinking" && block.Get("thinking").String() != "" {
+				body, _ = sjson.SetBytes(body, path, map[string]string{
+					"type": "text",
+					"text": block.Get("thinking").String(),
+				})
+			} else {
+				body, _ = sjson.DeleteBytes(body, path)
+			}
+			removed++
+			if i == lastAssistant {
+				disableThinking = true
+			}
+		}
+	}
+	if disableThinking && gjson.GetBytes(body, "thinking").Exists() {
+		body, _ = sjson.DeleteBytes(body, "thinking")
+	}
+	return body, removed
+}
+
+// stripForeignThinking 移除其他 provider 生成的思考块（只处理能确认来源的签名）
+func (prs *ProviderRelayService) stripForeignThinking(providerName string, body []byte) []byte {
+	if !strings.Contains(string(body), `"signature"`) && !strings.Contains(string(body), "redacted_thinking") {
+		return body
+	}
+	mode := prs.settingsService.GetThinkingSignatureMode()
+	stripped, removed := stripThinkingBlocks(body, mode, func(signature string) bool {
+		owner, ok := prs.thinkingOwners.Get(signatureKey(signature))
+		return ok && owner != providerName
+	})
+	if removed > 0 {
+		fmt.Printf("[INFO] Provider %s: 已处理 %d 个其他 provider 生成的思考块（%s）\n", providerName, removed, mode)
+	}
+	return stripped
+}
@@ -0,0 +1,65 @@
+package services
+
+import (
+	"testing"
+
+	"github.com/tidwall/gjson"
+)
+
+func TestStripThinkingBlocks(t *testing.T) {
+	stream := "event: content_block_start\ndata: {\"type\":\"content_block_start\",\"index\":0,\"content_block\":{\"type\":\"thinking\",\"thinking\":\"\"}}\n\n" +
+		"event: content_block_delta\ndata: {\"type\":\"content_block_delta\",\"index\":0,\"delta\":{\"type\":\"signature_delta\",\"signature\":\"sig-a\"}}\n\n"
+	if got := thinkingSignaturesFrom(stream); len(got) != 1 || got[0] != "sig-a" {
+		t.Fatalf("应从 SSE 提取签名，实际 %v", got)
+	}
+	if got := thinkingSignaturesFrom(`{"content":[{"type":"redacted_thinking","data":"enc-b"},{"type":"text","text":"hi"}]}`); len(got) != 1 || got[0] != "enc-b" {
+		t.Fatalf("应从 JSON 响应提取 redacted_thinking，实际 %v", got)
+	}
+
+	body := []byte(`{
+		"thinking": {"type": "enabled", "budget_tokens": 2048},
+		"messages": [
+			{"role": "user", "content": "hi"},
+			{"role": "assistant", "content": [
+				{"type": "thinking", "thinking": "old", "signature": "sig-a"},
+				{"type": "text", "text": "one"}
+			]},
+			{"role": "user", "content": "again"},
+			{"role": "assistant", "content": [
+				{"type": "thinking", "thinking": "new", "signature": "sig-c"},
+				{"type": "redacted_thinking", "data": "enc-b"},
+				{"type": "text", "text": "two"}
+			]}
+		]
+	}`)
+	foreign := func(signature string) bool { return signature == "sig-a" }
+
+	out, removed := stripThinkingBlocks(body, ThinkingSignatureDrop, foreign)
+	if removed != 1 || gjson.GetBytes(out, "messages.1.content.0.type").String() != "text" {
+		t.Errorf("只应删除外来签名的思考块: %s", out)
+	}
+	if !gjson.GetBytes(out, "thinking").Exists() || gjson.GetBytes(out, "messages.3.content.#").Int() != 3 {
+		t.Errorf("最后一条 assistant 消息未改动，thinking 应保留: %s", out)
+	}
+
+	out, removed = stripThinkingBlocks(body, ThinkingSignatureText, func(string) bool { return true })
+	if removed != 3 {
+		t.Fatalf("应处理全部 3 个思考块，实际 %d", removed)
+	}
+	if got := gjson.GetBytes(out, "messages.3.content.0.text").String(); got != "new" {
+		t.Errorf("text 模式下 thinking 应转为文本，实际 %q", got)
+	}
+	if gjson.GetBytes(out, "messages.3.content.#").Int() != 2 {
+		t.Errorf("redacted_thinking 无法转文本，应删除: %s", out)
+	}
+	if gjson.GetBytes(out, "thinking").Exists() {
+		t.Error("最后一条 assistant 消息的思考块被移除后应关闭 thinking")
+	}
+
+	if out, removed := stripThinkingBlocks(body, ThinkingSignatureOff, foreign); removed != 0 || string(out) != string(body) {
+		t.Error("off 模式不应改动请求")
+	}
+	if !isThinkingSignatureError(`{"type":"error","error":{"type":"invalid_request_error","message":"messages.1.content.0: Invalid ` + "`signature`" + ` in ` + "`thinking`" + ` block"}}`) {
+		t.Error("应识别签名校验失败")
+	}
+}